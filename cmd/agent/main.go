@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/itaraxa/effectivepancake/internal/config"
+	"github.com/itaraxa/effectivepancake/internal/encryption"
 	"github.com/itaraxa/effectivepancake/internal/logger"
 	"github.com/itaraxa/effectivepancake/internal/services"
 	"github.com/itaraxa/effectivepancake/internal/version"
@@ -20,14 +26,18 @@ type AgentApp struct {
 	httpClient *http.Client
 	config     *config.AgentConfig
 	wg         *sync.WaitGroup
+	publicKey  *rsa.PublicKey
+	spool      *services.Spool
 }
 
-func NewAgentApp(logger logger.Logger, httpClient *http.Client, config *config.AgentConfig) *AgentApp {
+func NewAgentApp(logger logger.Logger, httpClient *http.Client, config *config.AgentConfig, publicKey *rsa.PublicKey, spool *services.Spool) *AgentApp {
 	return &AgentApp{
 		logger:     logger,
 		httpClient: httpClient,
 		config:     config,
 		wg:         new(sync.WaitGroup),
+		publicKey:  publicKey,
+		spool:      spool,
 	}
 }
 
@@ -35,71 +45,108 @@ func (aa *AgentApp) Run() {
 	aa.logger.Info("Agent version", "Version", version.AgentVersion)
 	aa.logger.Info("Agent started", "server", aa.config.AddressServer,
 		"poll interval", aa.config.PollInterval,
+		"system poll interval", aa.config.SystemPollInterval,
 		"report interval", aa.config.ReportInterval,
 		"log level", aa.config.LogLevel,
 		"report mode", aa.config.ReportMode,
+		"transport", aa.config.Transport,
 		"compress methode", aa.config.Compress,
 		"batch mode", aa.config.Batch,
+		"rate limit", aa.config.RateLimit,
+		"shutdown timeout", aa.config.ShutdownTimeout,
+		"spool", aa.config.SpoolDir,
+		"signing", aa.config.Key != "",
+		"crypto key", aa.config.CryptoKey,
+		"instance id", aa.config.InstanceID,
+		"tags", aa.config.Tags,
+		"config file", aa.config.ConfigFile,
 	)
+	if aa.publicKey != nil && (!aa.config.Batch || aa.config.Transport == `grpc`) {
+		aa.logger.Info("encryption is supported only in batch mode over http, data will be sent unencrypted")
+	}
+	if aa.spool != nil && aa.spool.Len() > 0 {
+		aa.logger.Info("spooled metrics from the previous run will be replayed", "spooled", aa.spool.Len())
+	}
 	defer aa.logger.Info("Agent stopped")
 
-	var wg sync.WaitGroup
-	msCh := make(chan services.MetricsAddGetter, aa.config.ReportInterval/aa.config.PollInterval+1) // создаем канал для обмена данными между сборщиком и отправщиком
+	// создаем канал для обмена данными между сборщиками и отправщиком
+	msCh := make(chan services.MetricsAddGetter, aa.config.ReportInterval/aa.config.PollInterval+aa.config.ReportInterval/aa.config.SystemPollInterval+2)
 	defer close(msCh)
 
-	// Ctrl+C handling
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	pollingStopChan := make(chan bool, 1)
-	reportStopChan := make(chan bool, 1)
-	go func() {
-		<-signalChan
-		aa.logger.Info("Agent stopping", "reason", "Ctrl+C press")
-		// sending true to the control channel if polling/reporting should stop
-		// reading from channel for unblocking
-		<-pollingStopChan
-		pollingStopChan <- true
-		<-reportStopChan
-		reportStopChan <- true
-	}()
+	// Ctrl+C, SIGTERM and SIGQUIT handling
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	// the reporter is stopped after the pollers to flush all collected metrics
+	reportCtx, stopReport := context.WithCancel(context.Background())
+	defer stopReport()
 
+	var pollWG, reportWG sync.WaitGroup
 	// goroutine для сбора метрик
-	wg.Add(1)
-	go services.PollMetrics(&wg, pollingStopChan, msCh, aa.logger, aa.config)
+	pollWG.Add(1)
+	go services.PollMetrics(ctx, &pollWG, msCh, aa.spool, aa.logger, aa.config)
+
+	// goroutine для сбора системных метрик
+	pollWG.Add(1)
+	go services.PollSystemMetrics(ctx, &pollWG, msCh, aa.spool, aa.logger, aa.config)
 
 	// goroutine для отправки метрик
-	wg.Add(1)
-	go services.ReportMetrics(&wg, reportStopChan, msCh, aa.logger, aa.config, aa.httpClient)
+	reportWG.Add(1)
+	go services.ReportMetrics(reportCtx, &reportWG, msCh, aa.spool, aa.logger, aa.config, aa.httpClient, aa.publicKey)
 
-	wg.Wait()
+	<-ctx.Done()
+	aa.logger.Info("Agent stopping", "reason", "signal received")
+	pollWG.Wait()
+	stopReport()
+	reportWG.Wait()
 }
 
 func main() {
 	// Preparing the configuration for Agent app startup
 	agentConf := config.NewAgentConfig()
-	err := agentConf.ParseFlags()
+	err := agentConf.Load(os.Args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("error parsing comandline flags: %v", err.Error())
+		log.Fatalf("error loading config: %v", err.Error())
 	}
 	if agentConf.ShowVersion {
 		fmt.Println(version.AgentVersion)
 		return
 	}
 
-	err = agentConf.ParseEnv()
-	if err != nil {
-		log.Fatalf("error parsing environment variables: %v", err.Error())
-	}
-
 	logger, err := logger.NewZapLogger(agentConf.LogLevel)
 	if err != nil {
 		log.Fatalf("дogger initialization error: %v", err.Error())
 	}
 	defer logger.Sync()
+	realIP, err := services.OutboundIP(agentConf.AddressServer)
+	if err != nil {
+		logger.Error("cannot detect outbound address, X-Real-IP isn't set", "error", err.Error())
+	}
 	myClient := &http.Client{
-		Timeout: 1 * time.Second,
+		Timeout:   1 * time.Second,
+		Transport: services.NewRealIPTransport(realIP, services.NewAgentIDTransport(services.AgentID(agentConf), nil)),
+	}
+
+	var publicKey *rsa.PublicKey
+	if agentConf.CryptoKey != "" {
+		publicKey, err = encryption.LoadPublicKey(agentConf.CryptoKey)
+		if err != nil {
+			log.Fatalf("error loading public key: %v", err.Error())
+		}
+	}
+
+	var spool *services.Spool
+	if agentConf.SpoolDir != "" && !services.ReplaysSafely(agentConf) {
+		logger.Error("spool is disabled: replayed single metrics would be applied twice, use batches or the grpc transport", "spool", agentConf.SpoolDir)
+	} else if agentConf.SpoolDir != "" {
+		spool, err = services.NewSpool(agentConf.SpoolDir, agentConf.SpoolMaxSize, agentConf.SpoolMaxAge)
+		if err != nil {
+			log.Fatalf("error opening spool: %v", err.Error())
+		}
 	}
 
-	app := NewAgentApp(logger, myClient, agentConf)
+	app := NewAgentApp(logger, myClient, agentConf, publicKey, spool)
 	app.Run()
 }
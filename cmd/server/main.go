@@ -2,15 +2,23 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"google.golang.org/grpc"
 
 	"github.com/itaraxa/effectivepancake/internal/config"
+	"github.com/itaraxa/effectivepancake/internal/encryption"
+	"github.com/itaraxa/effectivepancake/internal/grpcserver"
 	"github.com/itaraxa/effectivepancake/internal/handlers"
 	"github.com/itaraxa/effectivepancake/internal/logger"
 	"github.com/itaraxa/effectivepancake/internal/middlewares"
@@ -64,14 +72,24 @@ func (sa *ServerApp) Run() {
 	)
 	sa.logger.Info("server started",
 		"Listen", sa.config.Endpoint,
+		"Listen gRPC", sa.config.GRPCEndpoint,
 		"Log level", sa.config.LogLevel,
 		"Restore", sa.config.Restore,
 		"Storing metrica file", sa.config.FileStoragePath,
+		"File generations", sa.config.FileGenerations,
 		"Store interval", time.Duration(sa.config.StoreInterval)*time.Second,
 		"Database DSN", sa.config.DatabaseDSN,
+		"Store history", sa.config.StoreHistory,
+		"Signing", sa.config.Key != "",
+		"Crypto key", sa.config.CryptoKey,
+		"Config file", sa.config.ConfigFile,
+		"Trusted subnet", sa.config.TrustedSubnet,
 	)
 	defer sa.logger.Info("server stopped")
 
+	// Snapshots of metrics are replaced atomically, previous snapshots are kept for restoring
+	snapshots := services.NewSnapshotFile(sa.config.FileStoragePath, sa.config.FileGenerations)
+
 	// Ctrl+C handling
 	signalChan := make(chan os.Signal, 1)
 	stopServerChan := make(chan bool, 1)
@@ -91,7 +109,7 @@ func (sa *ServerApp) Run() {
 		<-signalChan
 		sa.logger.Info("stopping server", "cause", "Exit programm because Ctrl+C press")
 		// Saving metric to a file before Exit
-		err := services.SaveMetricsToFile(ctx, sa.logger, sa.storage, sa.config.FileStoragePath)
+		err := snapshots.Save(ctx, sa.storage)
 		if err != nil {
 			sa.logger.Error("metric data hasn't been saved to the file", "error", err.Error(), "filename", sa.config.FileStoragePath)
 			return
@@ -111,42 +129,105 @@ func (sa *ServerApp) Run() {
 			sa.logger.Error("cleaning storage before metrics loading from file", "error", err.Error())
 		}
 		sa.logger.Info("try to load metrics from file", "filename", sa.config.FileStoragePath)
-		err = services.LoadMetricsFromFile(sa.logger, sa.storage, sa.config.FileStoragePath)
+		// the newest valid generation is loaded, if the last snapshot is broken
+		loaded, err := snapshots.Load(sa.logger, sa.storage)
 		if err != nil {
 			sa.logger.Error("metrics wasn't loaded from file", "error", err.Error(), "filename", sa.config.FileStoragePath)
 		} else {
-			sa.logger.Info("metrics have been loaded from file")
+			sa.logger.Info("metrics have been loaded from file", "filename", loaded)
 		}
 	}
 
+	// Background jobs are stopped, when the server is stopped
+	var jobsWG sync.WaitGroup
+	defer jobsWG.Wait()
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+
+	// Settings, which are changed on SIGHUP without restart
+	alerts := services.NewAlertEngine(nil)
+	live, err := services.NewLiveConfig(sa.config, alerts, sa.logger)
+	if err != nil {
+		sa.logger.Error("cannot parse trusted subnet", "error", err.Error())
+		return
+	}
+
 	// Writing metric data to the file periodically if don't use postgres storage
 	if sa.config.StoreInterval > 0 && sa.config.DatabaseDSN == "" {
+		jobsWG.Add(1)
 		go func() {
-			ticker := time.NewTicker(time.Second * time.Duration(sa.config.StoreInterval))
-			defer ticker.Stop()
-			for {
-				<-ticker.C
-				if err := services.SaveMetricsToFile(ctx, sa.logger, sa.storage, sa.config.FileStoragePath); err != nil {
-					sa.logger.Error("cannot save data to file", "error", err.Error())
-				}
-			}
+			defer jobsWG.Done()
+			services.RunPeriodicSaving(jobsCtx, sa.logger, sa.storage, snapshots,
+				time.Second*time.Duration(sa.config.StoreInterval), live.StoreIntervals())
 		}()
 	}
 
+	// Compacting and deleting old history in postgres
+	if compactor, ok := sa.storage.(services.HistoryCompactor); ok && sa.config.StoreHistory {
+		sa.logger.Info("retention job started",
+			"raw", sa.config.Retention.Raw,
+			"1m rollups", sa.config.Retention.Minute,
+			"1h rollups", sa.config.Retention.Hour,
+			"interval", sa.config.Retention.Interval,
+		)
+		jobsWG.Add(1)
+		go services.RunRetention(jobsCtx, &jobsWG, sa.logger, compactor, sa.storage, sa.config.Retention)
+	}
+
+	// Evaluating alerting rules. The engine runs without rules too, because they can be added on SIGHUP
+	silences := services.NewSilenceStore()
+	if sa.config.RulesFile != "" {
+		rules, err := services.LoadAlertRules(sa.config.RulesFile)
+		if err != nil {
+			sa.logger.Error("cannot load alerting rules", "error", err.Error(), "filename", sa.config.RulesFile)
+			return
+		}
+		alerts.SetRules(rules, time.Now())
+		sa.logger.Info("alerting rules loaded", "rules", len(rules), "filename", sa.config.RulesFile)
+	}
+	notifiers := services.NewAlertNotifiers(sa.config)
+	dispatcher := services.NewAlertDispatcher(notifiers, silences, sa.config.NotifyGroupBy, sa.config.NotifyRepeat)
+	sa.logger.Info("alerting started", "interval", sa.config.RulesInterval, "notifiers", len(notifiers))
+	jobsWG.Add(2)
+	go dispatcher.Run(jobsCtx, &jobsWG, sa.logger)
+	go services.RunAlerting(jobsCtx, &jobsWG, sa.logger, alerts, sa.storage, dispatcher, sa.config.RulesInterval)
+
+	// Reloading settings on SIGHUP
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+	go func() {
+		for {
+			select {
+			case <-jobsCtx.Done():
+				return
+			case <-reloadChan:
+				sa.reloadConfig(live)
+			}
+		}
+	}()
+
+	// Tracking of agents and updates of metrics
+	heartbeats := services.NewHeartbeats(sa.config.StaleTimeout, sa.config.MarkStale)
+	tracked := services.NewTrackedStorage(sa.storage, heartbeats)
+
 	// Add middlewares
 	sa.router.Use(middlewares.LoggerMiddleware(sa.logger))
 	sa.router.Use(middlewares.CompressResponceMiddleware(sa.logger))
+	if sa.config.CryptoKey != "" {
+		privateKey, err := encryption.LoadPrivateKey(sa.config.CryptoKey)
+		if err != nil {
+			sa.logger.Error("cannot load private key", "error", err.Error(), "filename", sa.config.CryptoKey)
+			return
+		}
+		sa.router.Use(middlewares.DecryptRequestMiddleware(sa.logger, privateKey))
+	}
 	sa.router.Use(middlewares.DecompressRequestMiddleware(sa.logger))
+	sa.router.Use(middlewares.SignMiddleware(sa.logger, live))
 	sa.router.Use(middlewares.StatMiddleware(sa.logger, 10))
 	if sa.config.StoreInterval == 0 && sa.config.DatabaseDSN == "" {
 		sa.logger.Info("synchronous file writing is used")
-		file, err := os.OpenFile(sa.config.FileStoragePath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
-		if err != nil {
-			sa.logger.Error("cannot open file for writing", "error", err.Error())
-			return
-		}
-		defer file.Close()
-		sa.router.Use(middlewares.SaveStorageToFile(ctx, sa.logger, sa.storage, file))
+		sa.router.Use(middlewares.SaveStorageToFile(ctx, sa.logger, sa.storage, snapshots))
 	}
 
 	// Add routes
@@ -154,15 +235,30 @@ func (sa *ServerApp) Run() {
 	sa.router.Get(`/ping`, handlers.PingDB(ctx, sa.logger, sa.storage))
 	sa.router.Get(`/ping/`, handlers.PingDB(ctx, sa.logger, sa.storage))
 	// query-row routs
-	sa.router.Get(`/value/{type}/{name}`, handlers.GetMetrica(ctx, sa.storage, sa.logger))
-	sa.router.Post(`/update/*`, handlers.PostUpdateHandler(ctx, sa.logger, sa.storage))
+	sa.router.Get(`/value/{type}/{name}`, handlers.GetMetrica(ctx, sa.storage, heartbeats, sa.logger))
 	// json routs
-	sa.router.Post(`/value`, handlers.JSONGetMetrica(ctx, sa.storage, sa.logger))
-	sa.router.Post(`/value/`, handlers.JSONGetMetrica(ctx, sa.storage, sa.logger))
-	sa.router.Post(`/update/`, handlers.PostJSONUpdateHandler(ctx, sa.logger, sa.storage))
-	sa.router.Post(`/updates/`, handlers.PostJSONUpdateBatchHandler(ctx, sa.logger, sa.storage))
+	sa.router.Post(`/value`, handlers.JSONGetMetrica(ctx, sa.storage, heartbeats, sa.logger))
+	sa.router.Post(`/value/`, handlers.JSONGetMetrica(ctx, sa.storage, heartbeats, sa.logger))
+	// updating routes are open only for agents from the trusted subnet, accepted updates are heartbeats of agents
+	sa.router.Group(func(r chi.Router) {
+		r.Use(middlewares.TrustedSubnetMiddleware(sa.logger, live))
+		r.Use(middlewares.HeartbeatMiddleware(sa.logger, heartbeats))
+		r.Post(`/update/*`, handlers.PostUpdateHandler(ctx, sa.logger, tracked, sa.config.HistogramBounds))
+		r.Post(`/update/`, handlers.PostJSONUpdateHandler(ctx, sa.logger, tracked))
+		r.Post(`/updates/`, handlers.PostJSONUpdateBatchHandler(ctx, sa.logger, tracked))
+	})
+	// metric history
+	sa.router.Get(`/history/{type}/{name}`, handlers.GetMetricHistory(ctx, sa.storage, sa.logger))
 	// get all metrics
-	sa.router.Get(`/`, handlers.GetAllCurrentMetrics(ctx, sa.storage, sa.logger))
+	sa.router.Get(`/`, handlers.GetAllCurrentMetrics(ctx, tracked, sa.logger))
+	// reporting agents
+	sa.router.Get(`/agents`, handlers.GetAgents(heartbeats, sa.logger))
+	// alerts, silences can be added only from the trusted subnet
+	sa.router.Get(`/alerts`, handlers.GetAlerts(alerts, sa.logger))
+	sa.router.Get(`/silences`, handlers.GetSilences(silences, sa.logger))
+	sa.router.With(middlewares.TrustedSubnetMiddleware(sa.logger, live)).Post(`/silences`, handlers.PostSilence(silences, sa.logger))
+	// prometheus exposition
+	sa.router.Get(`/metrics`, handlers.GetPrometheusMetrics(ctx, sa.storage, sa.logger))
 
 	// Start router
 	server := &http.Server{
@@ -178,31 +274,90 @@ func (sa *ServerApp) Run() {
 		}
 	}()
 
+	// Start gRPC server next to the router
+	if sa.config.GRPCEndpoint != "" {
+		listener, err := net.Listen(`tcp`, sa.config.GRPCEndpoint)
+		if err != nil {
+			sa.logger.Error("cannot listen gRPC endpoint", "error", err.Error(), "endpoint", sa.config.GRPCEndpoint)
+			return
+		}
+		opts := []grpc.ServerOption{}
+		if sa.config.StoreInterval == 0 && sa.config.DatabaseDSN == "" {
+			opts = append(opts,
+				grpc.ChainUnaryInterceptor(grpcserver.SaveUnaryInterceptor(sa.logger, sa.storage, snapshots)),
+				grpc.ChainStreamInterceptor(grpcserver.SaveStreamInterceptor(sa.logger, sa.storage, snapshots)),
+			)
+		}
+		grpcServer := grpcserver.NewServer(sa.logger, live, grpcserver.NewMetricsServer(sa.logger, tracked, heartbeats), opts...)
+		defer grpcserver.Stop(sa.logger, grpcServer, 3*time.Second)
+		go func() {
+			sa.logger.Info("start gRPC server")
+			if err := grpcServer.Serve(listener); err != nil {
+				sa.logger.Fatal("gRPC server error", "err", err.Error())
+			}
+		}()
+	}
+
 	// stopping http server
 	<-stopServerChan
 	ctxWithTimeout, cancelWithTimeout := context.WithTimeout(ctx, 3*time.Second)
 	defer cancelWithTimeout()
-	err := server.Shutdown(ctxWithTimeout)
+	err = server.Shutdown(ctxWithTimeout)
 	if err != nil {
 		sa.logger.Fatal("stopping server", "error", err.Error())
 	}
 	sa.logger.Info("server stopped gracefully")
 }
 
+/*
+reloadConfig re-reads flags, environment variables and the config file and applies the safe changes.
+Other changed settings are only logged, they need a restart of the server
+
+Args:
+
+	live *services.LiveConfig: settings of the running server
+*/
+func (sa *ServerApp) reloadConfig(live *services.LiveConfig) {
+	sa.logger.Info("reloading config", "cause", "SIGHUP")
+	next := config.NewServerConfig()
+	if err := next.Load(os.Args); err != nil {
+		sa.logger.Error("config isn't reloaded", "error", err.Error())
+		return
+	}
+	applied, restart, err := live.Apply(next)
+	if err != nil {
+		sa.logger.Error("config isn't reloaded", "error", err.Error())
+		return
+	}
+	sa.logger.Info("config reloaded", "applied", applied)
+	if len(restart) > 0 {
+		sa.logger.Info("changed settings need restart", "settings", restart)
+	}
+}
+
 func main() {
 	serverConf := config.NewServerConfig()
-	err := serverConf.ParseFlags()
+	err := serverConf.Load(os.Args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("error parsing flags: %v", err)
+		log.Fatalf("error loading config: %v", err)
 	}
 	if serverConf.ShowVersion {
 		log.Print(version.ServerVersion)
 		return
 	}
 
-	err = serverConf.ParseEnv()
-	if err != nil {
-		log.Fatalf("error parsing environment variable: %v", err)
+	// Subcommands are executed instead of starting the server
+	if len(serverConf.Command) > 0 {
+		if serverConf.Command[0] != `migrate` {
+			log.Fatalf("unknown command: %s", serverConf.Command[0])
+		}
+		if err = runMigrate(context.Background(), serverConf.DatabaseDSN, serverConf.Command[1:], os.Stdout); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
 	}
 
 	logger, err := logger.NewZapLogger(serverConf.LogLevel)
@@ -215,7 +370,12 @@ func main() {
 
 	var s services.MetricStorager
 	if serverConf.DatabaseDSN != "" {
-		s, err = postgres.NewPostgresRepository(context.Background(), serverConf.DatabaseDSN)
+		if serverConf.StoreHistory {
+			if err = serverConf.Retention.Validate(); err != nil {
+				log.Fatalf("error in retention policy: %v", err)
+			}
+		}
+		s, err = postgres.NewPostgresRepository(context.Background(), serverConf.DatabaseDSN, serverConf.StoreHistory)
 		if err != nil {
 			log.Fatalf("error connecting to database: %v", err)
 		}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/itaraxa/effectivepancake/internal/repositories/postgres"
+)
+
+// migrateCommand is a parsed "migrate" subcommand
+type migrateCommand struct {
+	action string // up, down, status or force
+	arg    int    // number of migrations for down, version for force
+}
+
+/*
+parseMigrateArgs parses arguments of the "migrate" subcommand
+
+Args:
+
+	args []string: arguments after "migrate", example: ["down", "2"]
+
+Returns:
+
+	migrateCommand
+	error: nil or error, if the action is unknown or the argument is missing or bad
+*/
+func parseMigrateArgs(args []string) (migrateCommand, error) {
+	if len(args) == 0 {
+		return migrateCommand{}, errors.New("migrate: action is required: up, down N, status or force V")
+	}
+	cmd := migrateCommand{action: args[0]}
+	switch cmd.action {
+	case `up`, `status`:
+		if len(args) != 1 {
+			return cmd, fmt.Errorf("migrate %s: unexpected arguments %v", cmd.action, args[1:])
+		}
+	case `down`, `force`:
+		if len(args) != 2 {
+			return cmd, fmt.Errorf("migrate %s: exactly one numeric argument is required", cmd.action)
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || (cmd.action == `down` && n == 0) {
+			return cmd, fmt.Errorf("migrate %s: bad argument %q", cmd.action, args[1])
+		}
+		cmd.arg = n
+	default:
+		return cmd, fmt.Errorf("migrate: unknown action %q", cmd.action)
+	}
+	return cmd, nil
+}
+
+/*
+runMigrate executes the "migrate" subcommand against the database and prints applied and pending versions
+
+Args:
+
+	ctx context.Context
+	databaseDSN string: string for connection to databse
+	args []string: arguments after "migrate"
+	out io.Writer: destination for the report
+
+Returns:
+
+	error: nil or error of parsing arguments, connecting to the database or migrating
+*/
+func runMigrate(ctx context.Context, databaseDSN string, args []string, out io.Writer) error {
+	cmd, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+	if databaseDSN == "" {
+		return errors.New("migrate: database DSN is not set, use -d flag or DATABASE_DSN environment variable")
+	}
+
+	db, err := sql.Open("pgx", databaseDSN)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	defer db.Close()
+	migrator, err := postgres.NewMigrator(db)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	var versions []int
+	switch cmd.action {
+	case `up`:
+		versions, err = migrator.Up(ctx)
+		fmt.Fprintf(out, "applied: %v\n", versions)
+	case `down`:
+		versions, err = migrator.Down(ctx, cmd.arg)
+		fmt.Fprintf(out, "rolled back: %v\n", versions)
+	case `force`:
+		err = migrator.Force(ctx, cmd.arg)
+		if err == nil {
+			fmt.Fprintf(out, "forced version: %d\n", cmd.arg)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migrate %s: %w", cmd.action, err)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate status: %w", err)
+	}
+	printMigrationStatus(out, statuses)
+	return nil
+}
+
+/*
+printMigrationStatus prints the state of every migration, one per line
+
+Args:
+
+	out io.Writer: destination for the report
+	statuses []postgres.MigrationStatus: states of migrations
+
+Returns:
+
+	None
+*/
+func printMigrationStatus(out io.Writer, statuses []postgres.MigrationStatus) {
+	for _, s := range statuses {
+		state := `pending`
+		if s.Applied {
+			state = `applied`
+		}
+		fmt.Fprintf(out, "%03d %-8s %s\n", s.Version, state, s.Name)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/itaraxa/effectivepancake/internal/repositories/postgres"
+)
+
+func Test_parseMigrateArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    migrateCommand
+		wantErr bool
+	}{
+		{name: `Up`, args: []string{`up`}, want: migrateCommand{action: `up`}},
+		{name: `Status`, args: []string{`status`}, want: migrateCommand{action: `status`}},
+		{name: `Down N`, args: []string{`down`, `2`}, want: migrateCommand{action: `down`, arg: 2}},
+		{name: `Force V`, args: []string{`force`, `3`}, want: migrateCommand{action: `force`, arg: 3}},
+		{name: `Force zero`, args: []string{`force`, `0`}, want: migrateCommand{action: `force`, arg: 0}},
+		{name: `No action`, args: nil, wantErr: true},
+		{name: `Unknown action`, args: []string{`redo`}, wantErr: true},
+		{name: `Down without N`, args: []string{`down`}, wantErr: true},
+		{name: `Down zero`, args: []string{`down`, `0`}, wantErr: true},
+		{name: `Force bad version`, args: []string{`force`, `x`}, wantErr: true},
+		{name: `Up with argument`, args: []string{`up`, `1`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMigrateArgs(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMigrateArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseMigrateArgs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_runMigrateWithoutDSN(t *testing.T) {
+	if err := runMigrate(context.Background(), ``, []string{`status`}, &bytes.Buffer{}); err == nil {
+		t.Errorf("runMigrate() without DSN error = nil, wantErr true")
+	}
+}
+
+func Test_printMigrationStatus(t *testing.T) {
+	var out bytes.Buffer
+	printMigrationStatus(&out, []postgres.MigrationStatus{
+		{Version: 1, Name: `create_gauges_table`, Applied: true},
+		{Version: 2, Name: `create_histograms_table`},
+	})
+	want := "001 applied  create_gauges_table\n002 pending  create_histograms_table\n"
+	if out.String() != want {
+		t.Errorf("printMigrationStatus() = %q, want %q", out.String(), want)
+	}
+}
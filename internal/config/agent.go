@@ -5,60 +5,242 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/itaraxa/effectivepancake/internal/models"
 	"github.com/itaraxa/effectivepancake/internal/version"
 )
 
 type AgentConfig struct {
-	PollInterval   time.Duration
-	ReportInterval time.Duration
-	AddressServer  string
-	LogLevel       string
-	ShowVersion    bool
-	ReportMode     string // json or raw
-	Compress       string // gzip or none
-	Batch          bool
+	PollInterval       time.Duration     `json:"poll_interval"`
+	SystemPollInterval time.Duration     `json:"system_poll_interval"` // interval of collecting system metrics of the host
+	ReportInterval     time.Duration     `json:"report_interval"`
+	AddressServer      string            `json:"address"`
+	LogLevel           string            `json:"log_level"`
+	ShowVersion        bool              `json:"-"`
+	ConfigFile         string            `json:"-"`           // path to the JSON config file, empty - file isn't used
+	ReportMode         string            `json:"report_mode"` // json or raw
+	Transport          string            `json:"transport"`   // http or grpc
+	Compress           string            `json:"compress"`    // gzip or none
+	Batch              bool              `json:"batch"`
+	Key                string            `json:"key"`              // key for signing requests, empty - signing disabled
+	CryptoKey          string            `json:"crypto_key"`       // path to the server public key in PEM, empty - encryption disabled
+	InstanceID         string            `json:"agent_id"`         // agent identifier, sent as the "instance" label
+	Tags               map[string]string `json:"tags"`             // extra labels attached to every metric
+	RateLimit          int               `json:"rate_limit"`       // maximum number of concurrent requests to the server
+	ShutdownTimeout    time.Duration     `json:"shutdown_timeout"` // deadline for sending buffered metrics on exit
+	SpoolDir           string            `json:"spool_dir"`        // directory for snapshots, that failed to send, empty - spool disabled
+	SpoolMaxSize       int64             `json:"spool_max_size"`   // maximum size of the spool, bytes, megabytes in the config file
+	SpoolMaxAge        time.Duration     `json:"spool_max_age"`    // maximum age of a spooled snapshot
 }
 
 func NewAgentConfig() *AgentConfig {
 	return &AgentConfig{
-		PollInterval:   2 * time.Second,
-		ReportInterval: 10 * time.Second,
-		AddressServer:  `localhost:8080`,
-		LogLevel:       `INFO`,
-		ReportMode:     `json`,
-		Compress:       `gzip`,
-		Batch:          true,
+		PollInterval:       2 * time.Second,
+		SystemPollInterval: 2 * time.Second,
+		ReportInterval:     10 * time.Second,
+		AddressServer:      `localhost:8080`,
+		LogLevel:           `INFO`,
+		ReportMode:         `json`,
+		Transport:          `http`,
+		Compress:           `gzip`,
+		Batch:              true,
+		Tags:               map[string]string{},
+		RateLimit:          1,
+		ShutdownTimeout:    5 * time.Second,
+		SpoolMaxSize:       64 << 20,
+		SpoolMaxAge:        models.IdempotencyKeyTTL, // the server remembers replayed snapshots so long
 	}
 }
 
-func (ac *AgentConfig) ParseFlags() error {
-	flag.BoolVar(&ac.ShowVersion, `v`, false, `Show version and exit`)
-	flag.BoolVar(&ac.Batch, `b`, true, `Use batch mode`)
-	flag.StringVar(&ac.AddressServer, `a`, `localhost:8080`, `HTTP-server endpoint address. Environment variable ADDRESS`)
-	flag.StringVar(&ac.LogLevel, `log`, `INFO`, `Set log level: INFO, DEBUG, etc. `)
-	flag.StringVar(&ac.ReportMode, `m`, `json`, `Set method to report metrics: json, raw. Environment variable REPORT_METHOD`)
-	flag.StringVar(&ac.Compress, `c`, `gzip`, `Set a data compression method: gzip or none. Environment variable COMPRESS`)
-	var p, r int64
-	flag.Int64Var(&p, `p`, 2, `metrics poll interval, seconds. Environment variable POLL_INTERVAL`)
-	flag.Int64Var(&r, `r`, 10, `metrics report interval, seconds. Environment variable REPORT_INTERVAL`)
-
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Version: %s\nUsage of %s\n", version.AgentVersion, os.Args[0])
-		flag.PrintDefaults()
-	}
-
-	err := flag.CommandLine.Parse(os.Args[1:])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing flags: %v", err)
+/*
+parseTags parses comma separated key=value pairs into the map of tags
+
+Args:
+
+	raw string: tags, example: "dc=eu,rack=12"
+
+Returns:
+
+	map[string]string: parsed tags
+	error: nil or error if a pair has no '=' or a tag name is not a valid label name
+*/
+func parseTags(raw string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(raw, `,`) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, `=`)
+		if !ok {
+			return nil, fmt.Errorf("tag %q is not in key=value format", pair)
+		}
+		tags[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	if err := models.ValidateLabels(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+/*
+UnmarshalJSON reads the config file. Durations are written as strings, example: "1s", the spool size - in megabytes
+
+Args:
+
+	data []byte: content of the config file
+
+Returns:
+
+	error: nil or error of decoding
+*/
+func (ac *AgentConfig) UnmarshalJSON(data []byte) error {
+	type plain AgentConfig
+	aux := struct {
+		*plain
+		PollInterval       durationJSON  `json:"poll_interval"`
+		SystemPollInterval durationJSON  `json:"system_poll_interval"`
+		ReportInterval     durationJSON  `json:"report_interval"`
+		ShutdownTimeout    durationJSON  `json:"shutdown_timeout"`
+		SpoolMaxSize       megabytesJSON `json:"spool_max_size"`
+		SpoolMaxAge        durationJSON  `json:"spool_max_age"`
+	}{
+		plain:              (*plain)(ac),
+		PollInterval:       durationJSON{&ac.PollInterval},
+		SystemPollInterval: durationJSON{&ac.SystemPollInterval},
+		ReportInterval:     durationJSON{&ac.ReportInterval},
+		ShutdownTimeout:    durationJSON{&ac.ShutdownTimeout},
+		SpoolMaxSize:       megabytesJSON{&ac.SpoolMaxSize},
+		SpoolMaxAge:        durationJSON{&ac.SpoolMaxAge},
+	}
+	return decodeStrict(data, &aux)
+}
+
+/*
+Load fills the config from the sources in the order of increasing priority: defaults, the config file,
+environment variables and flags. Only flags, that are set explicitly, override other sources
+
+Args:
+
+	args []string: command line with the program name, example: os.Args
+
+Returns:
+
+	error: nil or error of parsing flags, reading the config file, parsing environment variables or checking values
+*/
+func (ac *AgentConfig) Load(args []string) error {
+	// the first pass finds the config file and the version flag
+	probe := NewAgentConfig()
+	if err := probe.parseFlags(args); err != nil {
 		return err
 	}
+	if probe.ShowVersion {
+		ac.ShowVersion = true
+		return nil
+	}
+	if path := configPath(probe.ConfigFile); path != "" {
+		if err := readConfigFile(path, ac); err != nil {
+			return err
+		}
+		ac.ConfigFile = path
+	}
+	if err := ac.ParseEnv(); err != nil {
+		return err
+	}
+	if err := ac.parseFlags(args); err != nil {
+		return err
+	}
+	return ac.validate()
+}
 
-	ac.PollInterval = time.Duration(p) * time.Second
-	ac.ReportInterval = time.Duration(r) * time.Second
+/*
+validate checks the loaded values, which can't be checked while parsing a single source
 
-	return nil
+Args:
+
+	None
+
+Returns:
+
+	error: nil or error describing the bad setting
+*/
+func (ac *AgentConfig) validate() error {
+	// tickers of polling and reporting panic on non-positive intervals
+	if ac.PollInterval <= 0 {
+		return fmt.Errorf("poll interval must be positive: %s", ac.PollInterval)
+	}
+	if ac.ReportInterval <= 0 {
+		return fmt.Errorf("report interval must be positive: %s", ac.ReportInterval)
+	}
+	if ac.SystemPollInterval <= 0 {
+		return fmt.Errorf("system poll interval must be positive: %s", ac.SystemPollInterval)
+	}
+	if ac.Transport != `http` && ac.Transport != `grpc` {
+		return fmt.Errorf("transport must be http or grpc: %q", ac.Transport)
+	}
+	if ac.Compress != `gzip` && ac.Compress != `none` {
+		return fmt.Errorf("compression must be gzip or none: %q", ac.Compress)
+	}
+	// tags of flags and environment variables are checked while parsing, tags of the config file - here
+	return models.ValidateLabels(ac.Tags)
+}
+
+/*
+parseFlags parses the command line into the config. Current values of the config are used as defaults of flags,
+so flags, that aren't set, keep them
+
+Args:
+
+	args []string: command line with the program name
+
+Returns:
+
+	error: nil or error of parsing flags
+*/
+func (ac *AgentConfig) parseFlags(args []string) error {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.BoolVar(&ac.ShowVersion, `v`, false, `Show version and exit`)
+	fs.StringVar(&ac.ConfigFile, `c`, ac.ConfigFile, `Path to the JSON config file, the same as -config. Previously -c set the compression, use -compress for it. Environment variable CONFIG`)
+	fs.StringVar(&ac.ConfigFile, `config`, ac.ConfigFile, `Path to the JSON config file. Environment variable CONFIG`)
+	fs.BoolVar(&ac.Batch, `b`, ac.Batch, `Use batch mode`)
+	fs.StringVar(&ac.AddressServer, `a`, ac.AddressServer, `HTTP-server endpoint address. Environment variable ADDRESS`)
+	fs.StringVar(&ac.LogLevel, `log`, ac.LogLevel, `Set log level: INFO, DEBUG, etc. `)
+	fs.StringVar(&ac.ReportMode, `m`, ac.ReportMode, `Set method to report metrics: json, raw. Environment variable REPORT_METHOD`)
+	fs.StringVar(&ac.Transport, `transport`, ac.Transport, `Set transport for reporting metrics: http or grpc, with grpc the -a address is the gRPC endpoint. Environment variable TRANSPORT`)
+	fs.StringVar(&ac.Compress, `compress`, ac.Compress, `Set a data compression method: gzip or none. Environment variable COMPRESS`)
+	fs.StringVar(&ac.Key, `k`, ac.Key, `Key for signing requests with HMAC-SHA256. Environment variable KEY`)
+	fs.StringVar(&ac.CryptoKey, `crypto-key`, ac.CryptoKey, `Path to the server public key in PEM for encrypting reported data. Environment variable CRYPTO_KEY`)
+	fs.StringVar(&ac.InstanceID, `id`, ac.InstanceID, `Agent identifier, attached to every metric as the "instance" label. Environment variable AGENT_ID`)
+	fs.Func(`tag`, `Extra key=value tags attached to every metric, can be repeated or comma separated. Environment variable TAGS`, func(raw string) error {
+		tags, err := parseTags(raw)
+		if err != nil {
+			return err
+		}
+		if ac.Tags == nil {
+			ac.Tags = map[string]string{}
+		}
+		for k, v := range tags {
+			ac.Tags[k] = v
+		}
+		return nil
+	})
+	fs.IntVar(&ac.RateLimit, `l`, ac.RateLimit, `Maximum number of concurrent requests to the server. Environment variable RATE_LIMIT`)
+	fs.StringVar(&ac.SpoolDir, `spool`, ac.SpoolDir, `Directory for metrics, that failed to send, empty - spool disabled. Used only with batches or the grpc transport. Environment variable SPOOL_DIR`)
+	fs.Var(secondsFlag{&ac.PollInterval}, `p`, `metrics poll interval, seconds. Environment variable POLL_INTERVAL`)
+	fs.Var(secondsFlag{&ac.SystemPollInterval}, `sp`, `system metrics poll interval, seconds. Environment variable SYSTEM_POLL_INTERVAL`)
+	fs.Var(secondsFlag{&ac.ReportInterval}, `r`, `metrics report interval, seconds. Environment variable REPORT_INTERVAL`)
+	fs.Var(secondsFlag{&ac.ShutdownTimeout}, `st`, `deadline for sending buffered metrics on shutdown, seconds. Environment variable SHUTDOWN_TIMEOUT`)
+	fs.Var(megabytesFlag{&ac.SpoolMaxSize}, `spool-size`, `maximum size of the spool, megabytes. Environment variable SPOOL_MAX_SIZE`)
+	fs.Var(secondsFlag{&ac.SpoolMaxAge}, `spool-age`, `maximum age of spooled metrics, seconds. Environment variable SPOOL_MAX_AGE`)
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Version: %s\nUsage of %s\n", version.AgentVersion, args[0])
+		fs.PrintDefaults()
+	}
+
+	return fs.Parse(args[1:])
 }
 
 func (ac *AgentConfig) ParseEnv() error {
@@ -71,6 +253,15 @@ func (ac *AgentConfig) ParseEnv() error {
 		ac.PollInterval = time.Duration(pi) * time.Second
 	}
 
+	sp, ok := os.LookupEnv(`SYSTEM_POLL_INTERVAL`)
+	if ok {
+		spi, err := strconv.Atoi(sp)
+		if err != nil {
+			return err
+		}
+		ac.SystemPollInterval = time.Duration(spi) * time.Second
+	}
+
 	r, ok := os.LookupEnv(`REPORT_INTERVAL`)
 	if ok {
 		ri, err := strconv.Atoi(r)
@@ -80,6 +271,34 @@ func (ac *AgentConfig) ParseEnv() error {
 		ac.ReportInterval = time.Duration(ri) * time.Second
 	}
 
+	if st, ok := os.LookupEnv(`SHUTDOWN_TIMEOUT`); ok {
+		sti, err := strconv.Atoi(st)
+		if err != nil {
+			return err
+		}
+		ac.ShutdownTimeout = time.Duration(sti) * time.Second
+	}
+
+	if sd, ok := os.LookupEnv(`SPOOL_DIR`); ok {
+		ac.SpoolDir = sd
+	}
+
+	if ss, ok := os.LookupEnv(`SPOOL_MAX_SIZE`); ok {
+		ssi, err := strconv.ParseInt(ss, 10, 64)
+		if err != nil {
+			return err
+		}
+		ac.SpoolMaxSize = ssi << 20
+	}
+
+	if sa, ok := os.LookupEnv(`SPOOL_MAX_AGE`); ok {
+		sai, err := strconv.Atoi(sa)
+		if err != nil {
+			return err
+		}
+		ac.SpoolMaxAge = time.Duration(sai) * time.Second
+	}
+
 	addressServer, ok := os.LookupEnv(`ADDRESS`)
 	if ok {
 		ac.AddressServer = addressServer
@@ -105,6 +324,10 @@ func (ac *AgentConfig) ParseEnv() error {
 		ac.ReportMode = m
 	}
 
+	if t, ok := os.LookupEnv(`TRANSPORT`); ok {
+		ac.Transport = t
+	}
+
 	c, ok := os.LookupEnv(`COMPRESS`)
 	if ok {
 		switch c {
@@ -117,5 +340,33 @@ func (ac *AgentConfig) ParseEnv() error {
 			ac.Compress = `gzip`
 		}
 	}
+
+	if k, ok := os.LookupEnv(`KEY`); ok {
+		ac.Key = k
+	}
+
+	if ck, ok := os.LookupEnv(`CRYPTO_KEY`); ok {
+		ac.CryptoKey = ck
+	}
+
+	if rl, ok := os.LookupEnv(`RATE_LIMIT`); ok {
+		rateLimit, err := strconv.Atoi(rl)
+		if err != nil {
+			return err
+		}
+		ac.RateLimit = rateLimit
+	}
+
+	if id, ok := os.LookupEnv(`AGENT_ID`); ok {
+		ac.InstanceID = id
+	}
+
+	if t, ok := os.LookupEnv(`TAGS`); ok {
+		tags, err := parseTags(t)
+		if err != nil {
+			return err
+		}
+		ac.Tags = tags
+	}
 	return nil
 }
@@ -0,0 +1,325 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the config file into the temporary directory
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), `config.json`)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("cannot write config file: %v", err)
+	}
+	return path
+}
+
+// setEnv sets environment variables for the test, empty value unsets the variable
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+		if v == "" {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestAgentConfig_Load(t *testing.T) {
+	file := writeConfig(t, `{
+		"address": "file:8080",
+		"report_interval": "20s",
+		"poll_interval": "500ms",
+		"compress": "none",
+		"spool_max_size": 8,
+		"tags": {"dc": "eu"}
+	}`)
+	other := writeConfig(t, `{"address": "other:8080"}`)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    func(ac *AgentConfig)
+		wantErr bool
+	}{
+		{
+			name: `defaults`,
+			args: []string{`agent`},
+			want: func(ac *AgentConfig) {},
+		},
+		{
+			name: `file over defaults`,
+			args: []string{`agent`, `-config`, file},
+			want: func(ac *AgentConfig) {
+				ac.ConfigFile = file
+				ac.AddressServer = `file:8080`
+				ac.ReportInterval = 20 * time.Second
+				ac.PollInterval = 500 * time.Millisecond
+				ac.Compress = `none`
+				ac.SpoolMaxSize = 8 << 20
+				ac.Tags = map[string]string{`dc`: `eu`}
+			},
+		},
+		{
+			name: `env over file`,
+			args: []string{`agent`},
+			env:  map[string]string{`CONFIG`: file, `ADDRESS`: `env:8080`, `REPORT_INTERVAL`: `30`},
+			want: func(ac *AgentConfig) {
+				ac.ConfigFile = file
+				ac.AddressServer = `env:8080`
+				ac.ReportInterval = 30 * time.Second
+				ac.PollInterval = 500 * time.Millisecond
+				ac.Compress = `none`
+				ac.SpoolMaxSize = 8 << 20
+				ac.Tags = map[string]string{`dc`: `eu`}
+			},
+		},
+		{
+			name: `flags over env and file`,
+			args: []string{`agent`, `-c`, file, `-a`, `flag:8080`, `-compress`, `gzip`, `-tag`, `rack=12`},
+			env:  map[string]string{`ADDRESS`: `env:8080`},
+			want: func(ac *AgentConfig) {
+				ac.ConfigFile = file
+				ac.AddressServer = `flag:8080`
+				ac.ReportInterval = 20 * time.Second
+				ac.PollInterval = 500 * time.Millisecond
+				ac.SpoolMaxSize = 8 << 20
+				ac.Tags = map[string]string{`dc`: `eu`, `rack`: `12`}
+			},
+		},
+		{
+			name: `config flag over CONFIG env`,
+			args: []string{`agent`, `-config`, other},
+			env:  map[string]string{`CONFIG`: file},
+			want: func(ac *AgentConfig) {
+				ac.ConfigFile = other
+				ac.AddressServer = `other:8080`
+			},
+		},
+		{
+			name:    `c is the config file only`,
+			args:    []string{`agent`, `-c`, `none`},
+			wantErr: true,
+		},
+		{
+			name:    `bad tag in file`,
+			args:    []string{`agent`, `-c`, writeConfig(t, `{"tags": {"data center": "eu"}}`)},
+			wantErr: true,
+		},
+		{
+			name:    `unknown compression in file`,
+			args:    []string{`agent`, `-c`, writeConfig(t, `{"compress": "zstd"}`)},
+			wantErr: true,
+		},
+		{
+			name:    `duration as number`,
+			args:    []string{`agent`, `-c`, writeConfig(t, `{"report_interval": 10}`)},
+			wantErr: true,
+		},
+		{
+			name:    `unknown setting`,
+			args:    []string{`agent`, `-c`, writeConfig(t, `{"report_intreval": "10s"}`)},
+			wantErr: true,
+		},
+		{
+			name:    `missing file`,
+			args:    []string{`agent`, `-c`, filepath.Join(t.TempDir(), `missing.json`)},
+			wantErr: true,
+		},
+		{
+			name:    `zero poll interval in file`,
+			args:    []string{`agent`, `-c`, writeConfig(t, `{"poll_interval": "0s"}`)},
+			wantErr: true,
+		},
+		{
+			name:    `negative report interval in env`,
+			args:    []string{`agent`},
+			env:     map[string]string{`REPORT_INTERVAL`: `-5`},
+			wantErr: true,
+		},
+		{
+			name:    `zero report interval in flag`,
+			args:    []string{`agent`, `-r`, `0`},
+			wantErr: true,
+		},
+		{
+			name:    `zero system poll interval in flag`,
+			args:    []string{`agent`, `-sp`, `0`},
+			wantErr: true,
+		},
+		{
+			name:    `unknown transport`,
+			args:    []string{`agent`, `-transport`, `grcp`},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{`CONFIG`: ``, `ADDRESS`: ``, `REPORT_INTERVAL`: ``, `COMPRESS`: ``, `TAGS`: ``, `TRANSPORT`: ``})
+			setEnv(t, tt.env)
+			ac := NewAgentConfig()
+			err := ac.Load(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := NewAgentConfig()
+			tt.want(want)
+			if !reflect.DeepEqual(ac, want) {
+				t.Errorf("Load() = %+v, want %+v", ac, want)
+			}
+		})
+	}
+}
+
+func TestServerConfig_Load(t *testing.T) {
+	file := writeConfig(t, `{
+		"address": "file:8080",
+		"store_interval": "30s",
+		"restore": true,
+		"file_generations": 5,
+		"trusted_subnet": "10.0.0.0/8",
+		"histogram_buckets": [1, 10],
+		"retention_raw": "1h",
+		"retention_batch": 500,
+		"notify_group_by": ["alertname", "host"],
+		"stale_timeout": "2m"
+	}`)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    func(sc *ServerConfig)
+		wantErr bool
+	}{
+		{
+			name: `defaults`,
+			args: []string{`server`},
+			want: func(sc *ServerConfig) {},
+		},
+		{
+			name: `file over defaults`,
+			args: []string{`server`, `-c`, file},
+			want: func(sc *ServerConfig) {
+				sc.ConfigFile = file
+				sc.Endpoint = `file:8080`
+				sc.StoreInterval = 30
+				sc.FileGenerations = 5
+				sc.TrustedSubnet = `10.0.0.0/8`
+				sc.HistogramBounds = []float64{1, 10}
+				sc.Retention.Raw = time.Hour
+				sc.Retention.BatchSize = 500
+				sc.NotifyGroupBy = []string{`alertname`, `host`}
+				sc.StaleTimeout = 2 * time.Minute
+			},
+		},
+		{
+			name: `flags over env over file`,
+			args: []string{`server`, `-config`, file, `-i`, `5`, `-retention-raw`, `2h`, `migrate`, `up`},
+			env:  map[string]string{`STORE_INTERVAL`: `10`, `RESTORE`: `false`, `RETENTION_RAW`: `3h`},
+			want: func(sc *ServerConfig) {
+				sc.ConfigFile = file
+				sc.Endpoint = `file:8080`
+				sc.StoreInterval = 5
+				sc.FileGenerations = 5
+				sc.Restore = false
+				sc.TrustedSubnet = `10.0.0.0/8`
+				sc.HistogramBounds = []float64{1, 10}
+				sc.Retention.Raw = 2 * time.Hour
+				sc.Retention.BatchSize = 500
+				sc.NotifyGroupBy = []string{`alertname`, `host`}
+				sc.StaleTimeout = 2 * time.Minute
+				sc.Command = []string{`migrate`, `up`}
+			},
+		},
+		{
+			name:    `unsorted buckets`,
+			args:    []string{`server`, `-c`, writeConfig(t, `{"histogram_buckets": [10, 1]}`)},
+			wantErr: true,
+		},
+		{
+			name:    `bad duration`,
+			args:    []string{`server`, `-c`, writeConfig(t, `{"stale_timeout": "soon"}`)},
+			wantErr: true,
+		},
+		{
+			name:    `zero rules interval`,
+			args:    []string{`server`, `-rules-interval`, `0s`},
+			wantErr: true,
+		},
+		{
+			name:    `zero stale timeout`,
+			args:    []string{`server`, `-stale-timeout`, `0s`},
+			wantErr: true,
+		},
+		{
+			name:    `negative stale timeout in file`,
+			args:    []string{`server`, `-c`, writeConfig(t, `{"stale_timeout": "-1m"}`)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{`CONFIG`: ``, `ADDRESS`: ``, `STORE_INTERVAL`: ``, `RESTORE`: ``, `RETENTION_RAW`: ``})
+			setEnv(t, tt.env)
+			sc := NewServerConfig()
+			err := sc.Load(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := NewServerConfig()
+			want.Command = []string{}
+			tt.want(want)
+			if !reflect.DeepEqual(sc, want) {
+				t.Errorf("Load() = %+v, want %+v", sc, want)
+			}
+		})
+	}
+}
+
+func TestServerConfig_ChangedSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(sc *ServerConfig)
+		want   []string
+	}{
+		{name: `nothing`, change: func(sc *ServerConfig) {}, want: []string{}},
+		{
+			name:   `settings`,
+			change: func(sc *ServerConfig) { sc.LogLevel, sc.Key, sc.HistogramBounds = `DEBUG`, `secret`, []float64{1} },
+			want:   []string{`log_level`, `key`, `histogram_buckets`},
+		},
+		{
+			name:   `retention`,
+			change: func(sc *ServerConfig) { sc.Retention.Raw = time.Minute },
+			want:   []string{`retention`},
+		},
+		{
+			name: `ignored fields`,
+			change: func(sc *ServerConfig) {
+				sc.ConfigFile, sc.ShowVersion, sc.Command = `config.json`, true, []string{`migrate`}
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := NewServerConfig()
+			tt.change(next)
+			if got := NewServerConfig().ChangedSettings(next); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ChangedSettings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+configPath chooses the path to the config file: the -c/-config flag takes precedence over the CONFIG environment variable
+
+Args:
+
+	flagValue string: value of the flag, empty if the flag isn't set
+
+Returns:
+
+	string: path to the config file, empty - the file isn't used
+*/
+func configPath(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return os.Getenv(`CONFIG`)
+}
+
+/*
+readConfigFile reads the JSON config file into the config. Settings missing in the file keep their values,
+unknown settings are rejected to catch typos
+
+Args:
+
+	path string: path to the config file
+	conf any: pointer to the config
+
+Returns:
+
+	error: nil or error of reading or decoding the file
+*/
+func readConfigFile(path string, conf any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file error: %w", err)
+	}
+	if err = decodeStrict(data, conf); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// decodeStrict decodes JSON into v and rejects unknown fields
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// durationJSON decodes the duration written as a string, example: "1s", into the field of the config
+type durationJSON struct{ d *time.Duration }
+
+func (dj durationJSON) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %s", data)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*dj.d = d
+	return nil
+}
+
+// secondsJSON decodes the duration written as a string, example: "300s", into the field with whole seconds
+type secondsJSON struct{ s *int }
+
+func (sj secondsJSON) UnmarshalJSON(data []byte) error {
+	var d time.Duration
+	if err := (durationJSON{d: &d}).UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*sj.s = int(d / time.Second)
+	return nil
+}
+
+// megabytesJSON decodes the size in megabytes into the field with bytes
+type megabytesJSON struct{ b *int64 }
+
+func (mj megabytesJSON) UnmarshalJSON(data []byte) error {
+	var mb int64
+	if err := json.Unmarshal(data, &mb); err != nil {
+		return err
+	}
+	*mj.b = mb << 20
+	return nil
+}
+
+// secondsFlag is the flag with the duration in whole seconds
+type secondsFlag struct{ d *time.Duration }
+
+func (sf secondsFlag) String() string {
+	if sf.d == nil {
+		return `0`
+	}
+	return strconv.FormatInt(int64(*sf.d/time.Second), 10)
+}
+
+func (sf secondsFlag) Set(v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return err
+	}
+	*sf.d = time.Duration(n) * time.Second
+	return nil
+}
+
+// megabytesFlag is the flag with the size in megabytes
+type megabytesFlag struct{ b *int64 }
+
+func (mf megabytesFlag) String() string {
+	if mf.b == nil {
+		return `0`
+	}
+	return strconv.FormatInt(*mf.b>>20, 10)
+}
+
+func (mf megabytesFlag) Set(v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return err
+	}
+	*mf.b = n << 20
+	return nil
+}
@@ -4,19 +4,47 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/itaraxa/effectivepancake/internal/models"
 	"github.com/itaraxa/effectivepancake/internal/version"
 )
 
 type ServerConfig struct {
-	Endpoint        string
-	LogLevel        string
-	ShowVersion     bool
-	StoreInterval   int
-	FileStoragePath string
-	Restore         bool
-	DatabaseDSN     string
+	Endpoint        string                 `json:"address"`
+	GRPCEndpoint    string                 `json:"grpc_address"` // address of the gRPC server of metrics, empty - gRPC disabled
+	LogLevel        string                 `json:"log_level"`
+	ShowVersion     bool                   `json:"-"`
+	ConfigFile      string                 `json:"-"` // path to the JSON config file, empty - file isn't used
+	StoreInterval   int                    `json:"store_interval"`
+	FileStoragePath string                 `json:"file_storage_path"`
+	FileGenerations int                    `json:"file_generations"` // number of previous snapshots kept as metrics.dat.1, metrics.dat.2, ...
+	Restore         bool                   `json:"restore"`
+	DatabaseDSN     string                 `json:"database_dsn"`
+	Key             string                 `json:"key"`
+	CryptoKey       string                 `json:"crypto_key"`
+	TrustedSubnet   string                 `json:"trusted_subnet"` // CIDR of agents allowed to update metrics, empty - any address is allowed
+	HistogramBounds []float64              `json:"histogram_buckets"`
+	StoreHistory    bool                   `json:"store_history"`   // keep every update in the postgres history tables
+	Retention       models.RetentionPolicy `json:"-"`               // lifecycle of the postgres history, retention_* settings in the config file
+	RulesFile       string                 `json:"rules_file"`      // path to the alerting rules in JSON or YAML
+	RulesInterval   time.Duration          `json:"rules_interval"`  // interval between evaluations of alerting rules
+	NotifyWebhook   string                 `json:"notify_webhook"`  // URL for posting alert notifications in JSON
+	NotifyFile      string                 `json:"notify_file"`     // path to the JSONL file for alert notifications
+	NotifyGroupBy   []string               `json:"notify_group_by"` // labels for grouping alerts into notifications
+	NotifyRepeat    time.Duration          `json:"notify_repeat"`   // interval of repeated notifications about firing alerts
+	SMTPAddr        string                 `json:"smtp_addr"`       // address of the SMTP server for alert notifications
+	SMTPFrom        string                 `json:"smtp_from"`       // sender of alert notifications
+	SMTPTo          []string               `json:"smtp_to"`         // recipients of alert notifications
+	SMTPUser        string                 `json:"smtp_user"`       // user for SMTP authentication
+	SMTPPassword    string                 `json:"smtp_password"`   // password for SMTP authentication
+	StaleTimeout    time.Duration          `json:"stale_timeout"`   // agents and metrics without updates for this time are stale
+	MarkStale       bool                   `json:"mark_stale"`      // mark stale metrics in the HTML view and /value/ responses
+	Command         []string               `json:"-"`               // subcommand with arguments after flags, example: migrate up
 }
 
 /*
@@ -32,40 +60,192 @@ Returns:
 */
 func NewServerConfig() *ServerConfig {
 	return &ServerConfig{
-		Endpoint:    `localhost:8080`,
-		LogLevel:    `INFO`,
-		ShowVersion: false,
+		Endpoint:        `localhost:8080`,
+		LogLevel:        `INFO`,
+		ShowVersion:     false,
+		StoreInterval:   300,
+		FileStoragePath: `metrics.dat`,
+		FileGenerations: 3,
+		Restore:         true,
+		HistogramBounds: slices.Clone(models.DefaultHistogramBounds),
+		Retention:       models.DefaultRetentionPolicy,
+		RulesInterval:   15 * time.Second,
+		NotifyGroupBy:   []string{models.AlertNameLabel},
+		NotifyRepeat:    4 * time.Hour,
+		StaleTimeout:    time.Minute,
 	}
 }
 
 /*
-A method for reading parameters passed as flags. The read parameters override those already specified in the ServerConf structure
+UnmarshalJSON reads the config file. Durations are written as strings, example: "1s", the retention policy -
+as retention_* settings
+
+Args:
+
+	data []byte: content of the config file
+
+Returns:
+
+	error: nil or error of decoding
+*/
+func (sc *ServerConfig) UnmarshalJSON(data []byte) error {
+	type plain ServerConfig
+	aux := struct {
+		*plain
+		StoreInterval     secondsJSON  `json:"store_interval"`
+		RulesInterval     durationJSON `json:"rules_interval"`
+		NotifyRepeat      durationJSON `json:"notify_repeat"`
+		StaleTimeout      durationJSON `json:"stale_timeout"`
+		RetentionRaw      durationJSON `json:"retention_raw"`
+		RetentionMinute   durationJSON `json:"retention_1m"`
+		RetentionHour     durationJSON `json:"retention_1h"`
+		RetentionInterval durationJSON `json:"retention_interval"`
+		RetentionBatch    *int         `json:"retention_batch"`
+	}{
+		plain:             (*plain)(sc),
+		StoreInterval:     secondsJSON{&sc.StoreInterval},
+		RulesInterval:     durationJSON{&sc.RulesInterval},
+		NotifyRepeat:      durationJSON{&sc.NotifyRepeat},
+		StaleTimeout:      durationJSON{&sc.StaleTimeout},
+		RetentionRaw:      durationJSON{&sc.Retention.Raw},
+		RetentionMinute:   durationJSON{&sc.Retention.Minute},
+		RetentionHour:     durationJSON{&sc.Retention.Hour},
+		RetentionInterval: durationJSON{&sc.Retention.Interval},
+		RetentionBatch:    &sc.Retention.BatchSize,
+	}
+	if err := decodeStrict(data, &aux); err != nil {
+		return err
+	}
+	return checkHistogramBounds(sc.HistogramBounds)
+}
+
+/*
+Load fills the config from the sources in the order of increasing priority: defaults, the config file,
+environment variables and flags. Only flags, that are set explicitly, override other sources
+
+Args:
+
+	args []string: command line with the program name, example: os.Args
+
+Returns:
+
+	error: nil or error of parsing flags, reading the config file, parsing environment variables or checking values
+*/
+func (sc *ServerConfig) Load(args []string) error {
+	// the first pass finds the config file and the version flag
+	probe := NewServerConfig()
+	if err := probe.parseFlags(args); err != nil {
+		return err
+	}
+	if probe.ShowVersion {
+		sc.ShowVersion = true
+		return nil
+	}
+	if path := configPath(probe.ConfigFile); path != "" {
+		if err := readConfigFile(path, sc); err != nil {
+			return err
+		}
+		sc.ConfigFile = path
+	}
+	if err := sc.ParseEnv(); err != nil {
+		return err
+	}
+	if err := sc.parseFlags(args); err != nil {
+		return err
+	}
+	return sc.validate()
+}
+
+/*
+validate checks the loaded values, which can't be checked while parsing a single source
 
 Args:
 
 	None
 
+Returns:
+
+	error: nil or error describing the bad setting
+*/
+func (sc *ServerConfig) validate() error {
+	if sc.RulesInterval <= 0 {
+		return fmt.Errorf("rules interval must be positive: %s", sc.RulesInterval)
+	}
+	if sc.StaleTimeout <= 0 {
+		return fmt.Errorf("stale timeout must be positive: %s", sc.StaleTimeout)
+	}
+	return nil
+}
+
+/*
+parseFlags parses the command line into the config. Current values of the config are used as defaults of flags,
+so flags, that aren't set, keep them. Arguments after flags are the subcommand
+
+Args:
+
+	args []string: command line with the program name
+
 Returns:
 
 	error: nil or error of parsing flags
 */
-func (sc *ServerConfig) ParseFlags() error {
-	flag.BoolVar(&sc.ShowVersion, `v`, false, `Show version and exit`)
-	flag.StringVar(&sc.Endpoint, `a`, `localhost:8080`, `HTTP-server endpoint address. Environment variable ADDRESS`)
-	flag.StringVar(&sc.LogLevel, `log`, `INFO`, `Set log level: INFO, DEBUG, etc.`)
-	flag.BoolVar(&sc.Restore, `r`, true, `Restore saved data from the file. Environment variable RESTORE`)
-	flag.StringVar(&sc.FileStoragePath, `f`, `metrics.dat`, `File path for saving metrics. Environment variable FILE_STORAGE_PATH`)
-	flag.StringVar(&sc.DatabaseDSN, `d`, ``, `database connection string. Environment variable DATABASE_DSN`)
-	flag.IntVar(&sc.StoreInterval, `i`, 300, `Time interval after which the current metrics are saved to a file. If set to 0, data is saved synchronously. Environment variable STORE_INTERVAL`)
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Version: %s\nUsage of %s\n", version.ServerVersion, os.Args[0])
-		flag.PrintDefaults()
-	}
-	err := flag.CommandLine.Parse(os.Args[1:])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing flags: %v", err)
+func (sc *ServerConfig) parseFlags(args []string) error {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.BoolVar(&sc.ShowVersion, `v`, false, `Show version and exit`)
+	fs.StringVar(&sc.ConfigFile, `c`, sc.ConfigFile, `Path to the JSON config file, the same as -config. Environment variable CONFIG`)
+	fs.StringVar(&sc.ConfigFile, `config`, sc.ConfigFile, `Path to the JSON config file. Environment variable CONFIG`)
+	fs.StringVar(&sc.Endpoint, `a`, sc.Endpoint, `HTTP-server endpoint address. Environment variable ADDRESS`)
+	fs.StringVar(&sc.GRPCEndpoint, `grpc-address`, sc.GRPCEndpoint, `gRPC-server endpoint address, empty - gRPC disabled. Environment variable GRPC_ADDRESS`)
+	fs.StringVar(&sc.LogLevel, `log`, sc.LogLevel, `Set log level: INFO, DEBUG, etc.`)
+	fs.BoolVar(&sc.Restore, `r`, sc.Restore, `Restore saved data from the file. Environment variable RESTORE`)
+	fs.StringVar(&sc.FileStoragePath, `f`, sc.FileStoragePath, `File path for saving metrics. Environment variable FILE_STORAGE_PATH`)
+	fs.IntVar(&sc.FileGenerations, `file-generations`, sc.FileGenerations, `Number of previous snapshots kept next to the metrics file. Environment variable FILE_GENERATIONS`)
+	fs.StringVar(&sc.DatabaseDSN, `d`, sc.DatabaseDSN, `database connection string. Environment variable DATABASE_DSN`)
+	fs.BoolVar(&sc.StoreHistory, `history`, sc.StoreHistory, `Keep every metric update in the database history tables. Environment variable STORE_HISTORY`)
+	fs.DurationVar(&sc.Retention.Raw, `retention-raw`, sc.Retention.Raw, `Keep raw history values, older values are compacted into 1-minute rollups. Environment variable RETENTION_RAW`)
+	fs.DurationVar(&sc.Retention.Minute, `retention-1m`, sc.Retention.Minute, `Keep 1-minute rollups, older rollups are compacted into 1-hour rollups. Environment variable RETENTION_1M`)
+	fs.DurationVar(&sc.Retention.Hour, `retention-1h`, sc.Retention.Hour, `Keep 1-hour rollups, older rollups are deleted. Environment variable RETENTION_1H`)
+	fs.DurationVar(&sc.Retention.Interval, `retention-interval`, sc.Retention.Interval, `Interval between runs of the retention job. Environment variable RETENTION_INTERVAL`)
+	fs.IntVar(&sc.Retention.BatchSize, `retention-batch`, sc.Retention.BatchSize, `Maximum number of history rows processed by one query. Environment variable RETENTION_BATCH`)
+	fs.StringVar(&sc.RulesFile, `rules`, sc.RulesFile, `Path to the alerting rules file in JSON or YAML (.yaml, .yml). Environment variable RULES_FILE`)
+	fs.DurationVar(&sc.RulesInterval, `rules-interval`, sc.RulesInterval, `Interval between evaluations of alerting rules. Environment variable RULES_INTERVAL`)
+	fs.StringVar(&sc.NotifyWebhook, `notify-webhook`, sc.NotifyWebhook, `URL of the webhook for alert notifications. Environment variable NOTIFY_WEBHOOK`)
+	fs.StringVar(&sc.NotifyFile, `notify-file`, sc.NotifyFile, `Path to the JSONL file for alert notifications. Environment variable NOTIFY_FILE`)
+	fs.Func(`notify-group-by`, `Comma separated labels for grouping alerts, alertname is the rule name. Environment variable NOTIFY_GROUP_BY`, func(v string) error {
+		sc.NotifyGroupBy = parseList(v)
+		return nil
+	})
+	fs.DurationVar(&sc.NotifyRepeat, `notify-repeat`, sc.NotifyRepeat, `Interval of repeated notifications about firing alerts. Environment variable NOTIFY_REPEAT`)
+	fs.StringVar(&sc.SMTPAddr, `smtp-addr`, sc.SMTPAddr, `Address of the SMTP server for alert notifications. Environment variable SMTP_ADDR`)
+	fs.StringVar(&sc.SMTPFrom, `smtp-from`, sc.SMTPFrom, `Sender of alert notifications. Environment variable SMTP_FROM`)
+	fs.Func(`smtp-to`, `Comma separated recipients of alert notifications. Environment variable SMTP_TO`, func(v string) error {
+		sc.SMTPTo = parseList(v)
+		return nil
+	})
+	fs.StringVar(&sc.SMTPUser, `smtp-user`, sc.SMTPUser, `User for SMTP authentication. Environment variable SMTP_USER`)
+	fs.StringVar(&sc.SMTPPassword, `smtp-password`, sc.SMTPPassword, `Password for SMTP authentication. Environment variable SMTP_PASSWORD`)
+	fs.DurationVar(&sc.StaleTimeout, `stale-timeout`, sc.StaleTimeout, `Agents and metrics without updates for this time are stale. Environment variable STALE_TIMEOUT`)
+	fs.BoolVar(&sc.MarkStale, `mark-stale`, sc.MarkStale, `Mark stale metrics in the HTML view and /value/ responses. Environment variable MARK_STALE`)
+	fs.StringVar(&sc.Key, `k`, sc.Key, `Key for checking and signing data with HMAC-SHA256. Environment variable KEY`)
+	fs.StringVar(&sc.TrustedSubnet, `t`, sc.TrustedSubnet, `Trusted subnet of agents in CIDR, updates from other addresses are rejected. Environment variable TRUSTED_SUBNET`)
+	fs.StringVar(&sc.CryptoKey, `crypto-key`, sc.CryptoKey, `Path to the private key in PEM for decrypting agent data, unencrypted batches of metrics are rejected. Environment variable CRYPTO_KEY`)
+	fs.Func(`hb`, `Comma separated bucket bounds for histograms created by single observations. Environment variable HISTOGRAM_BUCKETS`, func(v string) error {
+		bounds, err := parseHistogramBounds(v)
+		if err != nil {
+			return err
+		}
+		sc.HistogramBounds = bounds
+		return nil
+	})
+	fs.IntVar(&sc.StoreInterval, `i`, sc.StoreInterval, `Time interval after which the current metrics are saved to a file. If set to 0, data is saved synchronously. Environment variable STORE_INTERVAL`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Version: %s\nUsage of %s [flags] [migrate up|down N|status|force V]\n", version.ServerVersion, args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
 		return err
 	}
+	sc.Command = fs.Args()
 
 	return nil
 }
@@ -96,6 +276,13 @@ func (sc *ServerConfig) ParseEnv() error {
 	if fileStoragePath, ok := os.LookupEnv(`FILE_STORAGE_PATH`); ok {
 		sc.FileStoragePath = fileStoragePath
 	}
+	if fileGenerations, ok := os.LookupEnv(`FILE_GENERATIONS`); ok {
+		g, err := strconv.Atoi(fileGenerations)
+		if err != nil {
+			return fmt.Errorf(`uncorrect value in environment variable: %v`, err)
+		}
+		sc.FileGenerations = g
+	}
 	if restore, ok := os.LookupEnv(`RESTORE`); ok {
 		r, err := strconv.ParseBool(restore)
 		if err != nil {
@@ -106,5 +293,168 @@ func (sc *ServerConfig) ParseEnv() error {
 	if database, ok := os.LookupEnv(`DATABASE_DSN`); ok {
 		sc.DatabaseDSN = database
 	}
+	if storeHistory, ok := os.LookupEnv(`STORE_HISTORY`); ok {
+		h, err := strconv.ParseBool(storeHistory)
+		if err != nil {
+			return fmt.Errorf(`uncorrect value in environment variable: %v`, err)
+		}
+		sc.StoreHistory = h
+	}
+	for env, d := range map[string]*time.Duration{
+		`RETENTION_RAW`:      &sc.Retention.Raw,
+		`RETENTION_1M`:       &sc.Retention.Minute,
+		`RETENTION_1H`:       &sc.Retention.Hour,
+		`RETENTION_INTERVAL`: &sc.Retention.Interval,
+		`RULES_INTERVAL`:     &sc.RulesInterval,
+		`NOTIFY_REPEAT`:      &sc.NotifyRepeat,
+		`STALE_TIMEOUT`:      &sc.StaleTimeout,
+	} {
+		if v, ok := os.LookupEnv(env); ok {
+			p, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf(`uncorrect value in environment variable: %v`, err)
+			}
+			*d = p
+		}
+	}
+	if retentionBatch, ok := os.LookupEnv(`RETENTION_BATCH`); ok {
+		b, err := strconv.Atoi(retentionBatch)
+		if err != nil {
+			return fmt.Errorf(`uncorrect value in environment variable: %v`, err)
+		}
+		sc.Retention.BatchSize = b
+	}
+	if rulesFile, ok := os.LookupEnv(`RULES_FILE`); ok {
+		sc.RulesFile = rulesFile
+	}
+	for env, v := range map[string]*string{
+		`GRPC_ADDRESS`:   &sc.GRPCEndpoint,
+		`NOTIFY_WEBHOOK`: &sc.NotifyWebhook,
+		`NOTIFY_FILE`:    &sc.NotifyFile,
+		`SMTP_ADDR`:      &sc.SMTPAddr,
+		`SMTP_FROM`:      &sc.SMTPFrom,
+		`SMTP_USER`:      &sc.SMTPUser,
+		`SMTP_PASSWORD`:  &sc.SMTPPassword,
+		`TRUSTED_SUBNET`: &sc.TrustedSubnet,
+	} {
+		if value, ok := os.LookupEnv(env); ok {
+			*v = value
+		}
+	}
+	if groupBy, ok := os.LookupEnv(`NOTIFY_GROUP_BY`); ok {
+		sc.NotifyGroupBy = parseList(groupBy)
+	}
+	if smtpTo, ok := os.LookupEnv(`SMTP_TO`); ok {
+		sc.SMTPTo = parseList(smtpTo)
+	}
+	if markStale, ok := os.LookupEnv(`MARK_STALE`); ok {
+		m, err := strconv.ParseBool(markStale)
+		if err != nil {
+			return fmt.Errorf(`uncorrect value in environment variable: %v`, err)
+		}
+		sc.MarkStale = m
+	}
+	if key, ok := os.LookupEnv(`KEY`); ok {
+		sc.Key = key
+	}
+	if cryptoKey, ok := os.LookupEnv(`CRYPTO_KEY`); ok {
+		sc.CryptoKey = cryptoKey
+	}
+	if histogramBuckets, ok := os.LookupEnv(`HISTOGRAM_BUCKETS`); ok {
+		bounds, err := parseHistogramBounds(histogramBuckets)
+		if err != nil {
+			return fmt.Errorf(`uncorrect value in environment variable: %v`, err)
+		}
+		sc.HistogramBounds = bounds
+	}
+	return nil
+}
+
+/*
+parseHistogramBounds parses comma separated list of histogram bucket bounds
+
+Args:
+
+	raw string: list of bounds, example: "0.1,0.5,1,5"
+
+Returns:
+
+	[]float64: bounds in strictly ascending order
+	error: nil or error of parsing
+*/
+func parseHistogramBounds(raw string) ([]float64, error) {
+	bounds := []float64{}
+	for _, item := range strings.Split(raw, `,`) {
+		item = strings.TrimSpace(item)
+		if item == `` {
+			continue
+		}
+		b, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse histogram bound %s: %w", item, err)
+		}
+		bounds = append(bounds, b)
+	}
+	if err := checkHistogramBounds(bounds); err != nil {
+		return nil, err
+	}
+	return bounds, nil
+}
+
+// checkHistogramBounds checks, that bounds are in strictly ascending order
+func checkHistogramBounds(bounds []float64) error {
+	if !slices.IsSorted(bounds) || len(slices.Compact(slices.Clone(bounds))) != len(bounds) {
+		return fmt.Errorf("histogram bounds must be strictly ascending: %v", bounds)
+	}
 	return nil
 }
+
+/*
+parseList parses comma separated list, empty items are skipped
+
+Args:
+
+	raw string: list, example: "alertname, host"
+
+Returns:
+
+	[]string: items without spaces
+*/
+func parseList(raw string) []string {
+	items := []string{}
+	for _, item := range strings.Split(raw, `,`) {
+		if item = strings.TrimSpace(item); item != `` {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+/*
+ChangedSettings compares two configs and returns names of the changed settings as in the config file.
+The retention policy is reported as "retention", the version flag, the path to the config file and the subcommand are ignored
+
+Args:
+
+	next *ServerConfig: new config
+
+Returns:
+
+	[]string: names of changed settings in the order of fields
+*/
+func (sc *ServerConfig) ChangedSettings(next *ServerConfig) []string {
+	changed := []string{}
+	prev, cur := reflect.ValueOf(sc).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < prev.NumField(); i++ {
+		field := prev.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get(`json`), `,`)
+		if field.Name == `Retention` {
+			name = `retention`
+		}
+		if name == `-` || reflect.DeepEqual(prev.Field(i).Interface(), cur.Field(i).Interface()) {
+			continue
+		}
+		changed = append(changed, name)
+	}
+	return changed
+}
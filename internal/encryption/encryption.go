@@ -0,0 +1,330 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+const (
+	// EncryptionHeader is the name of the HTTP header marking the encrypted request body
+	EncryptionHeader = `X-Encryption`
+	// EncryptionScheme is the value of EncryptionHeader for the hybrid RSA-OAEP + AES-256-GCM scheme
+	EncryptionScheme = `rsa-oaep-aes256-gcm`
+
+	aesKeySize = 32
+)
+
+/*
+GenerateKeyPair generates a new RSA key pair
+
+Args:
+
+	bits int: size of the key in bits, 2048 or more is recommended
+
+Returns:
+
+	*rsa.PrivateKey: generated private key, public key is available as PublicKey field
+	error: nil or error, if occured
+*/
+func GenerateKeyPair(bits int) (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+/*
+EncodePrivateKeyPEM encodes private key into PEM block of "RSA PRIVATE KEY" type (PKCS #1)
+
+Args:
+
+	key *rsa.PrivateKey: encoded private key
+
+Returns:
+
+	[]byte: PEM encoded key
+*/
+func EncodePrivateKeyPEM(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  `RSA PRIVATE KEY`,
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+/*
+EncodePublicKeyPEM encodes public key into PEM block of "PUBLIC KEY" type (PKIX)
+
+Args:
+
+	key *rsa.PublicKey: encoded public key
+
+Returns:
+
+	[]byte: PEM encoded key
+	error: nil or error, if occured
+*/
+func EncodePublicKeyPEM(key *rsa.PublicKey) ([]byte, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal public key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  `PUBLIC KEY`,
+		Bytes: b,
+	}), nil
+}
+
+/*
+GenerateKeyFiles generates a new RSA key pair and saves it into PEM files.
+The private key file is created with 0600 permissions
+
+Args:
+
+	privateKeyPath string: path to the private key file
+	publicKeyPath string: path to the public key file
+	bits int: size of the key in bits
+
+Returns:
+
+	error: nil or error, if occured
+*/
+func GenerateKeyFiles(privateKeyPath string, publicKeyPath string, bits int) error {
+	key, err := GenerateKeyPair(bits)
+	if err != nil {
+		return fmt.Errorf("cannot generate key pair: %w", err)
+	}
+	publicPEM, err := EncodePublicKeyPEM(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(privateKeyPath, EncodePrivateKeyPEM(key), 0600); err != nil {
+		return fmt.Errorf("cannot write private key to %s: %w", privateKeyPath, err)
+	}
+	if err = os.WriteFile(publicKeyPath, publicPEM, 0644); err != nil {
+		return fmt.Errorf("cannot write public key to %s: %w", publicKeyPath, err)
+	}
+	return nil
+}
+
+/*
+ParsePublicKeyPEM parses RSA public key from PEM block of "PUBLIC KEY" (PKIX) or "RSA PUBLIC KEY" (PKCS #1) type
+
+Args:
+
+	data []byte: PEM encoded key
+
+Returns:
+
+	*rsa.PublicKey
+	error: nil or error, if occured
+*/
+func ParsePublicKeyPEM(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, myErrors.ErrBadPEM
+	}
+	switch block.Type {
+	case `PUBLIC KEY`:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, myErrors.ErrNotRSAKey
+		}
+		return rsaKey, nil
+	case `RSA PUBLIC KEY`:
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, myErrors.ErrUnknownKeyType
+	}
+}
+
+/*
+ParsePrivateKeyPEM parses RSA private key from PEM block of "RSA PRIVATE KEY" (PKCS #1) or "PRIVATE KEY" (PKCS #8) type
+
+Args:
+
+	data []byte: PEM encoded key
+
+Returns:
+
+	*rsa.PrivateKey
+	error: nil or error, if occured
+*/
+func ParsePrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, myErrors.ErrBadPEM
+	}
+	switch block.Type {
+	case `RSA PRIVATE KEY`:
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse private key: %w", err)
+		}
+		return key, nil
+	case `PRIVATE KEY`:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse private key: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, myErrors.ErrNotRSAKey
+		}
+		return rsaKey, nil
+	default:
+		return nil, myErrors.ErrUnknownKeyType
+	}
+}
+
+/*
+LoadPublicKey reads RSA public key from PEM file
+
+Args:
+
+	fileName string: path to the public key file
+
+Returns:
+
+	*rsa.PublicKey
+	error: nil or error, if occured
+*/
+func LoadPublicKey(fileName string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read public key file %s: %w", fileName, err)
+	}
+	return ParsePublicKeyPEM(data)
+}
+
+/*
+LoadPrivateKey reads RSA private key from PEM file
+
+Args:
+
+	fileName string: path to the private key file
+
+Returns:
+
+	*rsa.PrivateKey
+	error: nil or error, if occured
+*/
+func LoadPrivateKey(fileName string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read private key file %s: %w", fileName, err)
+	}
+	return ParsePrivateKeyPEM(data)
+}
+
+/*
+Encrypt encrypts data with the hybrid scheme: the data is encrypted by AES-256-GCM with a random session key,
+the session key is encrypted by RSA-OAEP (SHA-256) with the public key.
+
+Output format:
+
+	| 2 bytes: length of encrypted session key | encrypted session key | GCM nonce | AES-GCM ciphertext |
+
+Args:
+
+	key *rsa.PublicKey: public key of the recipient
+	data []byte: plain data
+
+Returns:
+
+	[]byte: encrypted data
+	error: nil or error, if occured
+*/
+func Encrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+	sessionKey := make([]byte, aesKeySize)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, fmt.Errorf("cannot generate session key: %w", err)
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, sessionKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encrypt session key: %w", err)
+	}
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("cannot generate nonce: %w", err)
+	}
+
+	out := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, nil), nil
+}
+
+/*
+Decrypt decrypts data, encrypted by Encrypt function
+
+Args:
+
+	key *rsa.PrivateKey: private key of the recipient
+	data []byte: encrypted data
+
+Returns:
+
+	[]byte: plain data
+	error: nil or error, if occured
+*/
+func Decrypt(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, myErrors.ErrBadCiphertext
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < keyLen {
+		return nil, myErrors.ErrBadCiphertext
+	}
+	sessionKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, data[:keyLen], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt session key: %w", err)
+	}
+	data = data[keyLen:]
+
+	gcm, err := newGCM(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, myErrors.ErrBadCiphertext
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt data: %w", err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create GCM: %w", err)
+	}
+	return gcm, nil
+}
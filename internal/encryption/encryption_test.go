@@ -0,0 +1,170 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: `Empty data`,
+			data: []byte{},
+		},
+		{
+			name: `JSON batch`,
+			data: []byte(`[{"id":"Alloc","type":"gauge","value":3.14},{"id":"PollCount","type":"counter","delta":1}]`),
+		},
+		{
+			name: `Data larger than RSA block`,
+			data: bytes.Repeat([]byte(`metrics`), 1000),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encrypted, err := Encrypt(&key.PublicKey, tt.data)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			if len(tt.data) > 0 && bytes.Contains(encrypted, tt.data) {
+				t.Errorf("Encrypt() output contains plain data")
+			}
+			got, err := Decrypt(key, encrypted)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("Decrypt() = %v, want %v", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	key, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	otherKey, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	encrypted, err := Encrypt(&key.PublicKey, []byte(`secret data`))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	damaged := bytes.Clone(encrypted)
+	damaged[len(damaged)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: `Too short data`, data: []byte{0x01}},
+		{name: `Truncated session key`, data: encrypted[:100]},
+		{name: `Damaged ciphertext`, data: damaged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decrypt(key, tt.data); err == nil {
+				t.Errorf("Decrypt() error = nil, wantErr true")
+			}
+		})
+	}
+	t.Run(`Wrong private key`, func(t *testing.T) {
+		if _, err := Decrypt(otherKey, encrypted); err == nil {
+			t.Errorf("Decrypt() error = nil, wantErr true")
+		}
+	})
+}
+
+func TestGenerateKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, `private.pem`)
+	publicPath := filepath.Join(dir, `public.pem`)
+	if err := GenerateKeyFiles(privatePath, publicPath, 2048); err != nil {
+		t.Fatalf("GenerateKeyFiles() error = %v", err)
+	}
+
+	privateKey, err := LoadPrivateKey(privatePath)
+	if err != nil {
+		t.Fatalf("LoadPrivateKey() error = %v", err)
+	}
+	publicKey, err := LoadPublicKey(publicPath)
+	if err != nil {
+		t.Fatalf("LoadPublicKey() error = %v", err)
+	}
+	if !publicKey.Equal(&privateKey.PublicKey) {
+		t.Fatalf("loaded public key doesn't match private key")
+	}
+
+	data := []byte(`round trip through key files`)
+	encrypted, err := Encrypt(publicKey, data)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	got, err := Decrypt(privateKey, encrypted)
+	if err != nil {
+		t.Fatalf("Decrypt() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Decrypt() = %s, want %s", got, data)
+	}
+}
+
+func TestParseKeysPEM(t *testing.T) {
+	key, err := GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() error = %v", err)
+	}
+
+	privateTests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: `PKCS #1 private key`, data: EncodePrivateKeyPEM(key), wantErr: false},
+		{name: `PKCS #8 private key`, data: pem.EncodeToMemory(&pem.Block{Type: `PRIVATE KEY`, Bytes: pkcs8}), wantErr: false},
+		{name: `Not PEM`, data: []byte(`not a key`), wantErr: true},
+		{name: `Unknown block type`, data: pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: []byte{1}}), wantErr: true},
+	}
+	for _, tt := range privateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePrivateKeyPEM(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePrivateKeyPEM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	publicTests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: `PKCS #1 public key`, data: pem.EncodeToMemory(&pem.Block{Type: `RSA PUBLIC KEY`, Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)}), wantErr: false},
+		{name: `Not PEM`, data: []byte(`not a key`), wantErr: true},
+	}
+	for _, tt := range publicTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePublicKeyPEM(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePublicKeyPEM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
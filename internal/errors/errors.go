@@ -17,6 +17,19 @@ var (
 	ErrEmptyMetricaRawValue    = errors.New("empty metrica raw value in query")
 	ErrGettingAnswerFromServer = errors.New("cannot read server answer")
 	ErrMemStorageNotInitilized = errors.New("memstorage not initialized")
+	ErrInvalidSnapshot         = errors.New("invalid metrics snapshot")
+	ErrParseHistogram          = errors.New("histogram observation parsing error")
+	ErrUpdateHistogram         = errors.New("histogram updating error")
+	ErrInvalidHistogram        = errors.New("invalid histogram")
+	ErrHistogramBounds         = errors.New("histogram bounds mismatch")
+	ErrBadLabels               = errors.New("bad metric labels")
+	ErrBadMetricaName          = errors.New("bad metric name")
+	ErrBadAggregation          = errors.New("unknown aggregation function")
+	ErrHistoryNotSupported     = errors.New("history is not available for the metric")
+	ErrBadRetention            = errors.New("bad retention policy")
+	ErrBadRule                 = errors.New("bad alerting rule")
+	ErrBadSilence              = errors.New("bad silence")
+	ErrBadSubnet               = errors.New("bad trusted subnet")
 
 	// Agent errors
 	ErrRequestCreating        = errors.New("creating request error")
@@ -27,4 +40,14 @@ var (
 	ErrAddPollCount           = errors.New("error adding pollCount into an instance of the models.Metrics")
 	ErrAddData                = errors.New("error adding data into an instance of the models.Metrics")
 	ErrNoMetrics              = errors.New("GetData() didn't return any metrics")
+	ErrReadProc               = errors.New("cannot read system state from proc filesystem")
+	ErrUnknownReportMode      = errors.New("unknown combination of report mode and compression")
+	ErrSpool                  = errors.New("spool on disk error")
+	ErrServerStatus           = errors.New("server answered with an error status")
+
+	// Encryption errors
+	ErrBadPEM         = errors.New("cannot decode PEM block")
+	ErrNotRSAKey      = errors.New("key isn't RSA key")
+	ErrUnknownKeyType = errors.New("unknown PEM block type")
+	ErrBadCiphertext  = errors.New("ciphertext is too short or damaged")
 )
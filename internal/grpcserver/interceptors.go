@@ -0,0 +1,293 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/itaraxa/effectivepancake/internal/proto"
+	"github.com/itaraxa/effectivepancake/internal/services"
+)
+
+/*
+LoggingUnaryInterceptor logs every unary call with its duration and status code
+
+Args:
+
+	l logger: a logger used for printing messages
+
+Returns:
+
+	grpc.UnaryServerInterceptor
+*/
+func LoggingUnaryInterceptor(l logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		l.Info("gRPC call",
+			"method", info.FullMethod,
+			"peer", peerAddr(ctx),
+			"code", status.Code(err).String(),
+			"duration", time.Since(start),
+		)
+		return resp, err
+	}
+}
+
+/*
+LoggingStreamInterceptor logs every streaming call with its duration and status code
+
+Args:
+
+	l logger: a logger used for printing messages
+
+Returns:
+
+	grpc.StreamServerInterceptor
+*/
+func LoggingStreamInterceptor(l logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		l.Info("gRPC stream",
+			"method", info.FullMethod,
+			"peer", peerAddr(ss.Context()),
+			"code", status.Code(err).String(),
+			"duration", time.Since(start),
+		)
+		return err
+	}
+}
+
+/*
+checkSign checks the HMAC-SHA256 signature of the batch. Unsigned batches are rejected as in the HTTP API
+
+Args:
+
+	l logger: a logger used for printing messages
+	key string: a secret key for signing
+	msg any: received message, messages of other types are not checked
+
+Returns:
+
+	error: nil or status error with Unauthenticated code
+*/
+func checkSign(l logger, key string, msg any) error {
+	req, ok := msg.(*pb.UpdateMetricsRequest)
+	if !ok {
+		return nil
+	}
+	if req.GetHash() == "" {
+		l.Error("request isn't signed", "snapshot", req.GetSnapshotId())
+		return status.Error(codes.Unauthenticated, "request isn't signed")
+	}
+	data, err := req.SignedBytes()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !services.CheckSignSHA256(data, key, req.GetHash()) {
+		l.Error("signature mismatch", "snapshot", req.GetSnapshotId())
+		return status.Error(codes.Unauthenticated, "signature mismatch")
+	}
+	return nil
+}
+
+/*
+SignUnaryInterceptor rejects unary calls with unsigned or badly signed batches
+
+Args:
+
+	l logger: a logger used for printing messages
+	keys keyGetter: source of the secret key for signing, empty key - calls pass unchecked
+
+Returns:
+
+	grpc.UnaryServerInterceptor
+*/
+func SignUnaryInterceptor(l logger, keys keyGetter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if key := keys.Key(); key != "" {
+			if err := checkSign(l, key, req); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+/*
+signedStream checks the signature of every message received from the stream
+*/
+type signedStream struct {
+	grpc.ServerStream
+	l   logger
+	key string
+}
+
+func (s *signedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return checkSign(s.l, s.key, m)
+}
+
+/*
+SignStreamInterceptor aborts streams on the first unsigned or badly signed batch
+
+Args:
+
+	l logger: a logger used for printing messages
+	keys keyGetter: source of the secret key for signing, empty key - streams pass unchecked
+
+Returns:
+
+	grpc.StreamServerInterceptor
+*/
+func SignStreamInterceptor(l logger, keys keyGetter) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		// the key is taken once, so all messages of the stream are checked with the same key
+		key := keys.Key()
+		if key == "" {
+			return handler(srv, ss)
+		}
+		return handler(srv, &signedStream{ServerStream: ss, l: l, key: key})
+	}
+}
+
+// RealIPMetadata is the metadata key carrying the address of the agent, the same as the HTTP header
+var RealIPMetadata = strings.ToLower(services.RealIPHeader)
+
+/*
+checkSubnet checks, that the caller belongs to the trusted subnet
+
+Args:
+
+	ctx context.Context: context of the call
+	l logger: a logger used for printing messages
+	subnet *net.IPNet: trusted subnet
+
+Returns:
+
+	error: nil or status error with PermissionDenied code
+*/
+func checkSubnet(ctx context.Context, l logger, subnet *net.IPNet) error {
+	var realIP string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ips := md.Get(RealIPMetadata); len(ips) > 0 {
+			realIP = ips[0]
+		}
+	}
+	if !services.InTrustedSubnet(subnet, realIP, peerAddr(ctx)) {
+		l.Error("call from untrusted address", "real_ip", realIP, "peer", peerAddr(ctx))
+		return status.Error(codes.PermissionDenied, "address is outside the trusted subnet")
+	}
+	return nil
+}
+
+/*
+TrustedSubnetUnaryInterceptor rejects unary calls of agents outside the trusted subnet
+
+Args:
+
+	l logger: a logger used for printing messages
+	subnets subnetGetter: source of the trusted subnet, nil subnet - any address is trusted
+
+Returns:
+
+	grpc.UnaryServerInterceptor
+*/
+func TrustedSubnetUnaryInterceptor(l logger, subnets subnetGetter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkSubnet(ctx, l, subnets.TrustedSubnet()); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+/*
+TrustedSubnetStreamInterceptor rejects streams of agents outside the trusted subnet
+
+Args:
+
+	l logger: a logger used for printing messages
+	subnets subnetGetter: source of the trusted subnet, nil subnet - any address is trusted
+
+Returns:
+
+	grpc.StreamServerInterceptor
+*/
+func TrustedSubnetStreamInterceptor(l logger, subnets subnetGetter) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSubnet(ss.Context(), l, subnets.TrustedSubnet()); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// snapshotSaver saves all metrics, example: services.SnapshotFile
+type snapshotSaver interface {
+	Save(ctx context.Context, mg services.MetricGetter) error
+}
+
+/*
+SaveUnaryInterceptor saves all metrics to the snapshot file after each successful call.
+This is used for synchronous saving of metric data, the same as the middlewares.SaveStorageToFile
+
+Args:
+
+	l logger: a logger used for printing messages
+	mg services.MetricGetter: a storage that allows getting metric data
+	dst snapshotSaver: a file, which atomically replaces the snapshot
+
+Returns:
+
+	grpc.UnaryServerInterceptor
+*/
+func SaveUnaryInterceptor(l logger, mg services.MetricGetter, dst snapshotSaver) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err == nil {
+			saveSnapshot(ctx, l, mg, dst)
+		}
+		return resp, err
+	}
+}
+
+/*
+SaveStreamInterceptor saves all metrics to the snapshot file after each stream. The snapshot is saved
+even if the stream failed, because batches received before the failure stay in the storage
+
+Args:
+
+	l logger: a logger used for printing messages
+	mg services.MetricGetter: a storage that allows getting metric data
+	dst snapshotSaver: a file, which atomically replaces the snapshot
+
+Returns:
+
+	grpc.StreamServerInterceptor
+*/
+func SaveStreamInterceptor(l logger, mg services.MetricGetter, dst snapshotSaver) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		saveSnapshot(ss.Context(), l, mg, dst)
+		return err
+	}
+}
+
+// saveSnapshot saves metrics, the snapshot is written even if the client has gone
+func saveSnapshot(ctx context.Context, l logger, mg services.MetricGetter, dst snapshotSaver) {
+	if err := dst.Save(context.WithoutCancel(ctx), mg); err != nil {
+		l.Error("error writing to file", "error", err.Error())
+		return
+	}
+	l.Debug("data writed")
+}
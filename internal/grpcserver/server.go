@@ -0,0 +1,256 @@
+// Package grpcserver implements the gRPC transport of metrics, that works next to the HTTP API
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // agents may compress requests with gzip
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	pb "github.com/itaraxa/effectivepancake/internal/proto"
+	"github.com/itaraxa/effectivepancake/internal/services"
+)
+
+type logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+type agentTracker interface {
+	SeenAgent(id, addr string, now time.Time)
+}
+
+type keyGetter interface {
+	Key() string
+}
+
+type subnetGetter interface {
+	TrustedSubnet() *net.IPNet
+}
+
+// settings are the signing key and the trusted subnet, which may be changed while the server is running
+type settings interface {
+	keyGetter
+	subnetGetter
+}
+
+// AgentIDMetadata is the metadata key carrying the identifier of the reporting agent, the same as the HTTP header
+var AgentIDMetadata = strings.ToLower(services.AgentIDHeader)
+
+/*
+MetricsServer implements the Metrics gRPC service over the storage. Batches are applied with
+services.JSONUpdateBatchMetricaOnce, so the gRPC transport behaves as POST /updates/
+*/
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	l logger
+	s services.MetricBatchUpdateKeeper
+	t agentTracker
+}
+
+/*
+NewMetricsServer creates the implementation of the Metrics gRPC service
+
+Args:
+
+	l logger: a logger used for printing messages
+	s services.MetricBatchUpdateKeeper: storage for updating metrics
+	t agentTracker: tracker of reporting agents, may be nil
+
+Returns:
+
+	*MetricsServer
+*/
+func NewMetricsServer(l logger, s services.MetricBatchUpdateKeeper, t agentTracker) *MetricsServer {
+	return &MetricsServer{l: l, s: s, t: t}
+}
+
+/*
+NewServer creates the gRPC server with logging interceptors. The trusted subnet and the signature of requests
+are checked with the current settings on every call
+
+Args:
+
+	l logger: a logger used for printing messages
+	st settings: source of the key for checking HMAC-SHA256 signatures, empty - check disabled,
+		and of the trusted subnet of agents, nil - check disabled
+	srv pb.MetricsServer: implementation of the Metrics service
+	opts ...grpc.ServerOption: extra options, interceptors are chained after the built-in ones, example: SaveUnaryInterceptor
+
+Returns:
+
+	*grpc.Server
+*/
+func NewServer(l logger, st settings, srv pb.MetricsServer, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(LoggingUnaryInterceptor(l), TrustedSubnetUnaryInterceptor(l, st), SignUnaryInterceptor(l, st)),
+		grpc.ChainStreamInterceptor(LoggingStreamInterceptor(l), TrustedSubnetStreamInterceptor(l, st), SignStreamInterceptor(l, st)),
+	}, opts...)
+	s := grpc.NewServer(opts...)
+	pb.RegisterMetricsServer(s, srv)
+	return s
+}
+
+/*
+Stop stops the server gracefully: new calls are rejected and running calls are finished.
+Calls, which don't finish in the timeout, are cancelled
+
+Args:
+
+	l logger: a logger used for printing messages
+	s *grpc.Server: stopped server
+	timeout time.Duration: deadline for running calls
+
+Returns:
+
+	None
+*/
+func Stop(l logger, s *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		l.Info("gRPC server stopped gracefully")
+	case <-time.After(timeout):
+		s.Stop()
+		l.Info("gRPC server stopped, running calls are cancelled", "timeout", timeout)
+	}
+}
+
+/*
+UpdateMetrics applies one batch of metrics
+
+Args:
+
+	ctx context.Context
+	req *pb.UpdateMetricsRequest: batch of metrics
+
+Returns:
+
+	*pb.UpdateMetricsResponse
+	error: nil or status error with InvalidArgument or Internal code
+*/
+func (ms *MetricsServer) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	ms.seenAgent(ctx)
+	applied, err := ms.apply(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricsResponse{Accepted: int32(len(req.GetMetrics())), Replayed: !applied}, nil
+}
+
+/*
+StreamMetrics applies every received batch as soon as it arrives. The stream is aborted on the first failed batch,
+batches applied before stay in the storage
+
+Args:
+
+	stream pb.Metrics_StreamMetricsServer
+
+Returns:
+
+	error: nil or status error with InvalidArgument or Internal code
+*/
+func (ms *MetricsServer) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	ctx := stream.Context()
+	ms.seenAgent(ctx)
+	resp := &pb.UpdateMetricsResponse{}
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+		applied, err := ms.apply(ctx, req)
+		if err != nil {
+			return err
+		}
+		resp.Accepted += int32(len(req.GetMetrics()))
+		resp.Replayed = resp.Replayed || !applied
+	}
+}
+
+/*
+apply converts the batch into JSON metrics and updates the storage
+
+Args:
+
+	ctx context.Context
+	req *pb.UpdateMetricsRequest: batch of metrics
+
+Returns:
+
+	bool: false if the batch with the same snapshot id was applied before
+	error: nil or status error
+*/
+func (ms *MetricsServer) apply(ctx context.Context, req *pb.UpdateMetricsRequest) (bool, error) {
+	jmqs := make([]services.JSONMetricaQuerier, 0, len(req.GetMetrics()))
+	for _, m := range req.GetMetrics() {
+		jmqs = append(jmqs, m.JSONMetric())
+	}
+	applied, err := services.JSONUpdateBatchMetricaOnce(ctx, ms.l, req.GetSnapshotId(), jmqs, ms.s)
+	switch {
+	case err == nil:
+		return applied, nil
+	case errors.Is(err, myErrors.ErrInvalidHistogram), errors.Is(err, myErrors.ErrHistogramBounds), errors.Is(err, myErrors.ErrBadLabels),
+		errors.Is(err, myErrors.ErrBadMetricaName):
+		ms.l.Error("bad batch of metrics", "error", err.Error())
+		return false, status.Error(codes.InvalidArgument, err.Error())
+	default:
+		ms.l.Error("metrica update error", "error", err.Error())
+		return false, status.Error(codes.Internal, err.Error())
+	}
+}
+
+/*
+seenAgent records the heartbeat of the agent from the metadata of the call
+
+Args:
+
+	ctx context.Context: context of the call
+
+Returns:
+
+	None
+*/
+func (ms *MetricsServer) seenAgent(ctx context.Context) {
+	if ms.t == nil {
+		return
+	}
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(AgentIDMetadata); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	ms.t.SeenAgent(id, peerAddr(ctx), time.Now())
+}
+
+// peerAddr returns the host of the remote side of the call
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return addr
+}
@@ -0,0 +1,307 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/itaraxa/effectivepancake/internal/proto"
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
+	"github.com/itaraxa/effectivepancake/internal/services"
+)
+
+type testLogger struct{}
+
+func (testLogger) Debug(msg string, fields ...interface{}) {}
+func (testLogger) Info(msg string, fields ...interface{})  {}
+func (testLogger) Error(msg string, fields ...interface{}) {}
+
+type testTracker struct {
+	ids []string
+}
+
+func (tt *testTracker) SeenAgent(id, addr string, now time.Time) {
+	tt.ids = append(tt.ids, id)
+}
+
+type testSettings struct {
+	key    string
+	subnet *net.IPNet
+}
+
+func (ts testSettings) Key() string               { return ts.key }
+func (ts testSettings) TrustedSubnet() *net.IPNet { return ts.subnet }
+
+// startServer runs the gRPC server over the in-memory listener and returns the client
+func startServer(t *testing.T, key string, subnet *net.IPNet, opts ...grpc.ServerOption) (pb.MetricsClient, *memstorage.MemStorage, *testTracker) {
+	t.Helper()
+	ms := memstorage.NewMemStorage()
+	tracker := &testTracker{}
+	listener := bufconn.Listen(1 << 20)
+	s := NewServer(testLogger{}, testSettings{key: key, subnet: subnet}, NewMetricsServer(testLogger{}, ms, tracker), opts...)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient(`passthrough:///bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn), ms, tracker
+}
+
+func testRequest(snapshot string, delta int64, key string) *pb.UpdateMetricsRequest {
+	value := 1.5
+	req := &pb.UpdateMetricsRequest{
+		SnapshotId: snapshot,
+		Metrics: []*pb.Metric{
+			{Id: `Alloc`, Type: pb.Metric_GAUGE, Value: &value},
+			{Id: `PollCount`, Type: pb.Metric_COUNTER, Delta: &delta},
+		},
+	}
+	if key != "" {
+		data, _ := req.SignedBytes()
+		req.Hash = services.SignSHA256(data, key)
+	}
+	return req
+}
+
+func TestMetricsServer_UpdateMetrics(t *testing.T) {
+	client, ms, tracker := startServer(t, "", nil)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), AgentIDMetadata, `agent-1`)
+
+	resp, err := client.UpdateMetrics(ctx, testRequest(`snap-1`, 2, ""))
+	if err != nil {
+		t.Fatalf("UpdateMetrics() error = %v", err)
+	}
+	if resp.GetAccepted() != 2 || resp.GetReplayed() {
+		t.Errorf("UpdateMetrics() = %v, want 2 accepted and not replayed", resp)
+	}
+	// the same snapshot is applied only once
+	resp, err = client.UpdateMetrics(ctx, testRequest(`snap-1`, 2, ""))
+	if err != nil || !resp.GetReplayed() {
+		t.Errorf("UpdateMetrics() replay = %v, %v, want replayed", resp, err)
+	}
+
+	if v, _ := ms.GetMetrica(context.TODO(), `counter`, `PollCount`); v != int64(2) {
+		t.Errorf("PollCount = %v, want 2", v)
+	}
+	if v, _ := ms.GetMetrica(context.TODO(), `gauge`, `Alloc`); v != 1.5 {
+		t.Errorf("Alloc = %v, want 1.5", v)
+	}
+	if len(tracker.ids) != 2 || tracker.ids[0] != `agent-1` {
+		t.Errorf("seen agents = %v, want [agent-1 agent-1]", tracker.ids)
+	}
+}
+
+func TestMetricsServer_StreamMetrics(t *testing.T) {
+	client, ms, _ := startServer(t, "", nil)
+	stream, err := client.StreamMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("StreamMetrics() error = %v", err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err = stream.Send(testRequest("", i, "")); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv() error = %v", err)
+	}
+	if resp.GetAccepted() != 6 {
+		t.Errorf("accepted = %d, want 6", resp.GetAccepted())
+	}
+	if v, _ := ms.GetMetrica(context.TODO(), `counter`, `PollCount`); v != int64(6) {
+		t.Errorf("PollCount = %v, want 6", v)
+	}
+}
+
+func TestMetricsServer_StreamMetricsReplay(t *testing.T) {
+	client, ms, _ := startServer(t, "", nil)
+	// the second attempt repeats the first two messages of the snapshot and adds the third one
+	for _, n := range []int{2, 3} {
+		stream, err := client.StreamMetrics(context.Background())
+		if err != nil {
+			t.Fatalf("StreamMetrics() error = %v", err)
+		}
+		for i := 0; i < n; i++ {
+			if err = stream.Send(testRequest(fmt.Sprintf("snap-1/%d", i), 1, "")); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+		}
+		if _, err = stream.CloseAndRecv(); err != nil {
+			t.Fatalf("CloseAndRecv() error = %v", err)
+		}
+	}
+	if v, _ := ms.GetMetrica(context.TODO(), `counter`, `PollCount`); v != int64(3) {
+		t.Errorf("PollCount = %v, want 3", v)
+	}
+}
+
+func TestSignInterceptors(t *testing.T) {
+	const key = `secret`
+	client, ms, _ := startServer(t, key, nil)
+
+	tests := []struct {
+		name string
+		req  *pb.UpdateMetricsRequest
+		want codes.Code
+	}{
+		{name: `signed`, req: testRequest("", 1, key), want: codes.OK},
+		{name: `unsigned`, req: testRequest("", 1, ""), want: codes.Unauthenticated},
+		{name: `wrong key`, req: testRequest("", 1, `other`), want: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.UpdateMetrics(context.Background(), tt.req)
+			if status.Code(err) != tt.want {
+				t.Errorf("UpdateMetrics() code = %v, want %v", status.Code(err), tt.want)
+			}
+		})
+	}
+
+	t.Run(`stream`, func(t *testing.T) {
+		stream, err := client.StreamMetrics(context.Background())
+		if err != nil {
+			t.Fatalf("StreamMetrics() error = %v", err)
+		}
+		_ = stream.Send(testRequest("", 10, key))
+		_ = stream.Send(testRequest("", 100, ""))
+		if _, err = stream.CloseAndRecv(); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("CloseAndRecv() code = %v, want Unauthenticated", status.Code(err))
+		}
+	})
+	// only the signed batches are applied
+	if v, _ := ms.GetMetrica(context.TODO(), `counter`, `PollCount`); v != int64(11) {
+		t.Errorf("PollCount = %v, want 11", v)
+	}
+}
+
+// countingSaver counts saved snapshots
+type countingSaver struct {
+	mu    sync.Mutex
+	saves int
+}
+
+func (cs *countingSaver) Save(ctx context.Context, mg services.MetricGetter) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.saves++
+	return nil
+}
+
+func (cs *countingSaver) count() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.saves
+}
+
+func TestSaveInterceptors(t *testing.T) {
+	const key = `secret`
+	saver := &countingSaver{}
+	client, _, _ := startServer(t, key, nil,
+		grpc.ChainUnaryInterceptor(SaveUnaryInterceptor(testLogger{}, memstorage.NewMemStorage(), saver)),
+		grpc.ChainStreamInterceptor(SaveStreamInterceptor(testLogger{}, memstorage.NewMemStorage(), saver)),
+	)
+
+	if _, err := client.UpdateMetrics(context.Background(), testRequest("", 1, key)); err != nil {
+		t.Fatalf("UpdateMetrics() error = %v", err)
+	}
+	// rejected calls don't reach the storage and aren't saved
+	if _, err := client.UpdateMetrics(context.Background(), testRequest("", 1, "")); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("UpdateMetrics() code = %v, want Unauthenticated", status.Code(err))
+	}
+	if got := saver.count(); got != 1 {
+		t.Errorf("saves after unary calls = %d, want 1", got)
+	}
+
+	stream, err := client.StreamMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("StreamMetrics() error = %v", err)
+	}
+	_ = stream.Send(testRequest("", 1, key))
+	if _, err = stream.CloseAndRecv(); err != nil {
+		t.Fatalf("CloseAndRecv() error = %v", err)
+	}
+	if got := saver.count(); got != 2 {
+		t.Errorf("saves after the stream = %d, want 2", got)
+	}
+}
+
+func TestStop(t *testing.T) {
+	listener := bufconn.Listen(1 << 20)
+	s := NewServer(testLogger{}, testSettings{}, NewMetricsServer(testLogger{}, memstorage.NewMemStorage(), nil))
+	go s.Serve(listener)
+
+	conn, err := grpc.NewClient(`passthrough:///bufnet`,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient() error = %v", err)
+	}
+	defer conn.Close()
+	// the open stream never finishes by itself
+	stream, err := pb.NewMetricsClient(conn).StreamMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("StreamMetrics() error = %v", err)
+	}
+	if err = stream.Send(testRequest("", 1, "")); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	start := time.Now()
+	Stop(testLogger{}, s, 100*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stop() returned after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestTrustedSubnetInterceptors(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR(`10.0.0.0/8`)
+	client, _, _ := startServer(t, "", subnet)
+
+	tests := []struct {
+		name   string
+		realIP string
+		want   codes.Code
+	}{
+		{name: `trusted`, realIP: `10.1.2.3`, want: codes.OK},
+		{name: `untrusted`, realIP: `192.168.1.1`, want: codes.PermissionDenied},
+		// bufconn has no peer address, so the call without the metadata is rejected
+		{name: `without address`, want: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.realIP != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, RealIPMetadata, tt.realIP)
+			}
+			_, err := client.UpdateMetrics(ctx, testRequest("", 1, ""))
+			if status.Code(err) != tt.want {
+				t.Errorf("UpdateMetrics() code = %v, want %v", status.Code(err), tt.want)
+			}
+			stream, err := client.StreamMetrics(ctx)
+			if err == nil {
+				_, err = stream.CloseAndRecv()
+			}
+			if status.Code(err) != tt.want {
+				t.Errorf("StreamMetrics() code = %v, want %v", status.Code(err), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+type agentLister interface {
+	Agents(now time.Time) []models.AgentStatus
+}
+
+/*
+GetAgents creates a handler that returns reporting agents with their status and staleness in JSON
+
+Args:
+
+	al agentLister: tracker of agents
+	l logger: a logger for printing messages
+
+Returns:
+
+	http.HandlerFunc
+*/
+func GetAgents(al agentLister, l logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		jsonData, err := json.Marshal(al.Agents(time.Now()))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			l.Error("cannot marshal agents", "error", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(jsonData); err != nil {
+			l.Error("cannot write data to body", "error", err.Error())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+type alertLister interface {
+	Alerts() []models.Alert
+}
+
+/*
+GetAlerts creates a handler that returns pending, firing and recently resolved alerts in JSON
+
+Args:
+
+	al alertLister: alerting engine
+	l logger: a logger for printing messages
+
+Returns:
+
+	http.HandlerFunc
+*/
+func GetAlerts(al alertLister, l logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		jsonData, err := json.Marshal(al.Alerts())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			l.Error("cannot marshal alerts", "error", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(jsonData); err != nil {
+			l.Error("cannot write data to body", "error", err.Error())
+		}
+	}
+}
+
+type silencer interface {
+	Add(s models.Silence, now time.Time) (models.Silence, error)
+	List(now time.Time) []models.Silence
+}
+
+/*
+PostSilence creates a handler that adds the silence from JSON body and returns the stored silence with its identifier
+
+Args:
+
+	ss silencer: store of silences
+	l logger: a logger for printing messages
+
+Returns:
+
+	http.HandlerFunc
+*/
+func PostSilence(ss silencer, l logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var s models.Silence
+		if err := json.NewDecoder(req.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("cannot unmarshal silence", "error", err.Error())
+			return
+		}
+		s, err := ss.Add(s, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("cannot add silence", "error", err.Error())
+			return
+		}
+		l.Info("silence added", "id", s.ID, "matchers", models.FormatLabels(s.Matchers), "ends", s.EndsAt, "by", s.CreatedBy)
+		jsonData, err := json.Marshal(s)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			l.Error("cannot marshal silence", "error", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(jsonData); err != nil {
+			l.Error("cannot write data to body", "error", err.Error())
+		}
+	}
+}
+
+/*
+GetSilences creates a handler that returns silences, which are not expired, in JSON
+
+Args:
+
+	ss silencer: store of silences
+	l logger: a logger for printing messages
+
+Returns:
+
+	http.HandlerFunc
+*/
+func GetSilences(ss silencer, l logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		jsonData, err := json.Marshal(ss.List(time.Now()))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			l.Error("cannot marshal silences", "error", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(jsonData); err != nil {
+			l.Error("cannot write data to body", "error", err.Error())
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -18,6 +19,7 @@ import (
 const (
 	gauge                = `gauge`
 	counter              = `counter`
+	histogram            = `histogram`
 	maxQueryStringLength = 256
 )
 
@@ -36,11 +38,13 @@ type metricStorager interface {
 
 type metricGetter interface {
 	GetMetrica(context.Context, string, string) (interface{}, error)
+	GetAllMetrics(context.Context) (*models.MetricsSnapshot, error)
 }
 
 type metricUpdater interface {
 	UpdateGauge(ctx context.Context, metricName string, value float64) error
 	AddCounter(ctx context.Context, metricName string, value int64) error
+	AddHistogram(ctx context.Context, metricName string, h models.Histogram) error
 }
 
 type metricBatchUpdater interface {
@@ -52,10 +56,53 @@ type metricBatchUpdater interface {
 		MetricName  string
 		MetricDelta *int64
 	}) error
+	AddBatchHistogram(context.Context, []struct {
+		MetricName      string
+		MetricHistogram *models.Histogram
+	}) error
+}
+
+type idempotencyKeeper interface {
+	UpdateBatchOnce(ctx context.Context, key string, batch *models.MetricsBatch) (bool, error)
+}
+
+type metricBatchStorager interface {
+	metricBatchUpdater
+	idempotencyKeeper
 }
 
 type metricPrinter interface {
-	HTML(ctx context.Context) string
+	HTML(ctx context.Context, stale map[string]bool) string
+}
+
+type staleChecker interface {
+	MetricStaleness(mType, key string, now time.Time) (time.Time, bool, bool)
+}
+
+/*
+setStaleHeaders sets the time of the last update and the stale flag of the series on the response
+
+Args:
+
+	w http.ResponseWriter
+	st staleChecker: tracker of updates, nil - headers are not set
+	mType string: type of metrica
+	key string: series key
+
+Returns:
+
+	None
+*/
+func setStaleHeaders(w http.ResponseWriter, st staleChecker, mType, key string) {
+	if st == nil {
+		return
+	}
+	seen, stale, ok := st.MetricStaleness(mType, key, time.Now())
+	if !ok {
+		return
+	}
+	w.Header().Set(services.LastSeenHeader, seen.UTC().Format(time.RFC3339))
+	w.Header().Set(services.StaleHeader, strconv.FormatBool(stale))
 }
 
 /*
@@ -77,7 +124,7 @@ func GetAllCurrentMetrics(ctx context.Context, s metricPrinter, l logger) http.H
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusOK)
 
-		_, err := w.Write([]byte(s.HTML(ctx)))
+		_, err := w.Write([]byte(s.HTML(ctx, nil)))
 		if err != nil {
 			http.Error(w, "cannot write HTML to response body", http.StatusNoContent)
 			l.Error("cannot write HTML to response body", "error", err.Error())
@@ -85,6 +132,64 @@ func GetAllCurrentMetrics(ctx context.Context, s metricPrinter, l logger) http.H
 	}
 }
 
+/*
+GetPrometheusMetrics creates handler that returns all metrics in Prometheus text exposition format
+
+Args:
+
+	ctx context.Context
+	s metricGetter: a storage that allows getting metrics
+	l logger: a logger for printing messages
+
+Returns:
+
+	http.HandlerFunc
+*/
+func GetPrometheusMetrics(ctx context.Context, s metricGetter, l logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		l.Info("received a request to export metrics in Prometheus format")
+		ctxWithTimeout, cancelWithTimeout := context.WithTimeout(ctx, 5*time.Second)
+		defer cancelWithTimeout()
+
+		var buf bytes.Buffer
+		if err := services.WritePrometheusMetrics(ctxWithTimeout, s, &buf); err != nil {
+			http.Error(w, "cannot get metrics from storage", http.StatusInternalServerError)
+			l.Error("cannot export metrics", "error", err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", services.PrometheusContentType)
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			l.Error("cannot write to response body", "error", err.Error())
+		}
+	}
+}
+
+/*
+labelsFromQuery returns metric labels passed as URL query parameters, example: /value/gauge/Alloc?host=42.
+Only the first value of every parameter is used
+
+Args:
+
+	req *http.Request
+
+Returns:
+
+	map[string]string: labels, nil if there are no query parameters
+*/
+func labelsFromQuery(req *http.Request) map[string]string {
+	query := req.URL.Query()
+	if len(query) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(query))
+	for name, values := range query {
+		labels[name] = values[0]
+	}
+	return labels
+}
+
 /*
 GetMetrica creates a handler that returns the metric value
 
@@ -92,24 +197,32 @@ Args:
 
 	ctx context.Context
 	s metricGetter: An object implementing the service.Storager interface
+	st staleChecker: tracker of updates for marking stale metrics, may be nil
 	l logger: a logger for printing messages
 
 Returns:
 
 	http.HandlerFunc
 */
-func GetMetrica(ctx context.Context, s metricGetter, l logger) http.HandlerFunc {
+func GetMetrica(ctx context.Context, s metricGetter, st staleChecker, l logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		mType := chi.URLParam(req, "type")
 		mName := chi.URLParam(req, "name")
-		l.Info("received a request to get metrica", "type", mType, "name", mName)
-		v, err := s.GetMetrica(ctx, mType, mName)
+		labels := labelsFromQuery(req)
+		if err := models.ValidateLabels(labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica labels", "type", mType, "name", mName, "error", err.Error())
+			return
+		}
+		l.Info("received a request to get metrica", "type", mType, "name", mName, "labels", models.FormatLabels(labels))
+		v, err := s.GetMetrica(ctx, mType, models.SeriesKey(mName, labels))
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			l.Error("cannot get metrica", "type", mType, "name", mName, "error", err.Error())
 			return
 		}
+		setStaleHeaders(w, st, mType, models.SeriesKey(mName, labels))
 		w.WriteHeader(http.StatusOK)
 
 		res := ""
@@ -126,6 +239,12 @@ func GetMetrica(ctx context.Context, s metricGetter, l logger) http.HandlerFunc
 			} else {
 				l.Error("type assertions -> int64", "value", v)
 			}
+		case histogram:
+			if h, ok := v.(models.Histogram); ok {
+				res = h.String()
+			} else {
+				l.Error("type assertions -> models.Histogram", "value", v)
+			}
 		}
 		_, err = w.Write([]byte(res))
 		if err != nil {
@@ -143,13 +262,14 @@ Args:
 
 	ctx context.Context
 	s metricGetter: a storage that allows getting metric
+	st staleChecker: tracker of updates for marking stale metrics, may be nil
 	l logger: a logger for printing messages
 
 Returns:
 
 	http.HandlerFunc
 */
-func JSONGetMetrica(ctx context.Context, s metricGetter, l logger) http.HandlerFunc {
+func JSONGetMetrica(ctx context.Context, s metricGetter, st staleChecker, l logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		ctxWithTimeout, cancelWithTimeout := context.WithTimeout(ctx, 5*time.Second)
 		defer cancelWithTimeout()
@@ -168,8 +288,14 @@ func JSONGetMetrica(ctx context.Context, s metricGetter, l logger) http.HandlerF
 			l.Error("cannot unmarshal data", "data", buf.Bytes(), "error", err.Error())
 			return
 		}
-		l.Info("received a request to get metrica in JSON", "type", jm.GetMetricaType(), "name", jm.GetMetricaName())
-		valueFromStorage, err := s.GetMetrica(ctxWithTimeout, jm.GetMetricaType(), jm.GetMetricaName())
+		key, err := services.JSONMetricaKey(jm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica labels", "type", jm.GetMetricaType(), "name", jm.GetMetricaName(), "error", err.Error())
+			return
+		}
+		l.Info("received a request to get metrica in JSON", "type", jm.GetMetricaType(), "name", key)
+		valueFromStorage, err := s.GetMetrica(ctxWithTimeout, jm.GetMetricaType(), key)
 		if err != nil && errors.Is(err, myErrors.ErrMetricaNotFaund) {
 			w.WriteHeader(http.StatusNotFound)
 			l.Error("cannot get metrica", "type", jm.GetMetricaType(), "name", jm.GetMetricaName(), "error", err.Error())
@@ -195,6 +321,12 @@ func JSONGetMetrica(ctx context.Context, s metricGetter, l logger) http.HandlerF
 			} else {
 				l.Error("type assertion -> int64", "value", valueFromStorage)
 			}
+		case histogram:
+			if t, ok := valueFromStorage.(models.Histogram); ok {
+				jm.Histogram = &t
+			} else {
+				l.Error("type assertion -> models.Histogram", "value", valueFromStorage)
+			}
 		}
 
 		// Write response
@@ -205,6 +337,7 @@ func JSONGetMetrica(ctx context.Context, s metricGetter, l logger) http.HandlerF
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
+		setStaleHeaders(w, st, jm.GetMetricaType(), key)
 		w.WriteHeader(http.StatusOK)
 		_, err = w.Write(jsonData)
 		if err != nil {
@@ -222,13 +355,14 @@ Args:
 
 	ctx context.Context
 	l logger: a logger for printing messages
-	s metricUpdater: a storage that allows update metric data
+	s metricStorager: a storage that allows update metric data
+	bounds []float64: bucket bounds for new histograms
 
 Returns:
 
 	http.HandlerFunc
 */
-func PostUpdateHandler(ctx context.Context, l logger, s metricUpdater) http.HandlerFunc {
+func PostUpdateHandler(ctx context.Context, l logger, s metricStorager, bounds []float64) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		ctx1s, cancel1s := context.WithTimeout(ctx, 1*time.Second)
 		defer cancel1s()
@@ -249,6 +383,11 @@ func PostUpdateHandler(ctx context.Context, l logger, s metricUpdater) http.Hand
 			l.Error("query string does not match the format", "query string", queryString, "error", err.Error())
 			return
 		}
+		if err != nil && errors.Is(err, myErrors.ErrBadMetricaName) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica name", "query string", queryString, "error", err.Error())
+			return
+		}
 		if err != nil && (errors.Is(err, myErrors.ErrBadType) || errors.Is(err, myErrors.ErrBadValue)) {
 			http.Error(w, "invalid type or value", http.StatusBadRequest)
 			l.Error("invalid type or value", "query string", queryString, "error", err.Error())
@@ -259,9 +398,14 @@ func PostUpdateHandler(ctx context.Context, l logger, s metricUpdater) http.Hand
 			l.Error("unknown parse query error", "query string", queryString, "error", err.Error())
 			return
 		}
+		if err = q.SetMetricaLabels(labelsFromQuery(req)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica labels", "query string", queryString, "error", err.Error())
+			return
+		}
 
-		err = services.UpdateMetrica(ctx1s, q, s)
-		if err != nil && (errors.Is(err, myErrors.ErrParseGauge) || errors.Is(err, myErrors.ErrParseCounter)) {
+		err = services.UpdateMetrica(ctx1s, q, s, bounds)
+		if err != nil && (errors.Is(err, myErrors.ErrParseGauge) || errors.Is(err, myErrors.ErrParseCounter) || errors.Is(err, myErrors.ErrParseHistogram)) {
 			http.Error(w, "the value is not of the specified type", http.StatusBadRequest)
 			l.Error("the value is not of the specified type", "query", q.String(), "error", err.Error())
 			return
@@ -314,7 +458,7 @@ func PostJSONUpdateHandler(ctx context.Context, l logger, s metricStorager) http
 			l.Error("cannot update metrica", "data", buf.String(), "error", "metric name not found")
 			return
 		}
-		if jm.Delta == nil && jm.Value == nil {
+		if jm.Delta == nil && jm.Value == nil && jm.Histogram == nil {
 			http.Error(w, "any metric value is not set", http.StatusBadRequest)
 			l.Error("cannot update metrica", "data", buf.String(), "error", "any metric value is not set")
 			return
@@ -329,6 +473,11 @@ func PostJSONUpdateHandler(ctx context.Context, l logger, s metricStorager) http
 			l.Error("cannot update metrica", "data", buf.String(), "error", "the gauge value is not set")
 			return
 		}
+		if jm.Histogram == nil && jm.MType == histogram {
+			http.Error(w, "the histogram value is not set", http.StatusBadRequest)
+			l.Error("cannot update metrica", "data", buf.String(), "error", "the histogram value is not set")
+			return
+		}
 
 		// updating metrica in storage
 		err = services.JSONUpdateMetrica(ctx, jm, s)
@@ -342,6 +491,16 @@ func PostJSONUpdateHandler(ctx context.Context, l logger, s metricStorager) http
 			l.Error("unknown metrica type update error", "json query", jm.String(), "error", err.Error())
 			return
 		}
+		if err != nil && (errors.Is(err, myErrors.ErrBadLabels) || errors.Is(err, myErrors.ErrBadMetricaName)) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica name or labels", "json query", jm.String(), "error", err.Error())
+			return
+		}
+		if err != nil && (errors.Is(err, myErrors.ErrInvalidHistogram) || errors.Is(err, myErrors.ErrHistogramBounds)) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("invalid histogram", "json query", jm.String(), "error", err.Error())
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			l.Error("metrica update error", "json query", jm.String(), "error", err.Error())
@@ -349,7 +508,8 @@ func PostJSONUpdateHandler(ctx context.Context, l logger, s metricStorager) http
 		}
 
 		// Response
-		value, err := s.GetMetrica(ctx, jm.GetMetricaType(), jm.GetMetricaName())
+		key, _ := services.JSONMetricaKey(jm)
+		value, err := s.GetMetrica(ctx, jm.GetMetricaType(), key)
 		if err != nil {
 			http.Error(w, "get metrica from storage error", http.StatusInternalServerError)
 			l.Error("get metrica from storage error", "json query", jm.String(), "error", err.Error())
@@ -373,6 +533,14 @@ func PostJSONUpdateHandler(ctx context.Context, l logger, s metricStorager) http
 				l.Error("type assertion -> int64", "value", value)
 				return
 			}
+		case histogram:
+			if h, ok := value.(models.Histogram); ok {
+				resp.Histogram = &h
+			} else {
+				http.Error(w, "metrica type error", http.StatusInternalServerError)
+				l.Error("type assertion -> models.Histogram", "value", value)
+				return
+			}
 		}
 
 		body, err := json.Marshal(resp)
@@ -394,19 +562,20 @@ func PostJSONUpdateHandler(ctx context.Context, l logger, s metricStorager) http
 }
 
 /*
-PostJSONUpdateBatchHandler cretes a handler returning a function for writing a list of metrics
+PostJSONUpdateBatchHandler cretes a handler returning a function for writing a list of metrics.
+A batch with the idempotency key, that was already applied, is acknowledged without applying
 
 Args:
 
 	ctx context.Context
 	l logger: a logger for printing messages
-	s metricUpdater: a storage that allows update metric data
+	s metricBatchStorager: a storage that allows update metric data and remembers idempotency keys
 
 Returns:
 
 	http.HandlerFunc
 */
-func PostJSONUpdateBatchHandler(ctx context.Context, l logger, s metricStorager) http.HandlerFunc {
+func PostJSONUpdateBatchHandler(ctx context.Context, l logger, s metricBatchStorager) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// Processing
 		var buf bytes.Buffer
@@ -436,14 +605,28 @@ func PostJSONUpdateBatchHandler(ctx context.Context, l logger, s metricStorager)
 		}
 
 		// updating metrica in storage
-		err = services.JSONUpdateBatchMetrica(ctx, l, jmqs, s)
-		l.Info("request batch update", "body", fmt.Sprint(jmqs))
+		key := req.Header.Get(services.IdempotencyHeader)
+		applied, err := services.JSONUpdateBatchMetricaOnce(ctx, l, key, jmqs, s)
+		l.Info("request batch update", "body", fmt.Sprint(jmqs), "idempotency key", key)
+		if err != nil && (errors.Is(err, myErrors.ErrInvalidHistogram) || errors.Is(err, myErrors.ErrHistogramBounds)) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("invalid histogram in batch", "json query", buf.String(), "error", err.Error())
+			return
+		}
+		if err != nil && (errors.Is(err, myErrors.ErrBadLabels) || errors.Is(err, myErrors.ErrBadMetricaName)) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica name or labels in batch", "json query", buf.String(), "error", err.Error())
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			l.Error("metrica update error", "json query", buf.String(), "error", err.Error())
 			return
 		}
 
+		if !applied {
+			w.Header().Set(services.ReplayedHeader, "true")
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		_, err = w.Write([]byte(""))
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+	"github.com/itaraxa/effectivepancake/internal/services"
+)
+
+// defaultHistoryRange is the length of the interval, if the from parameter is missing
+const defaultHistoryRange = time.Hour
+
+type metricHistoryGetter interface {
+	GetHistory(ctx context.Context, metricaType string, metricaName string, from, to time.Time) ([]models.HistoryPoint, error)
+}
+
+/*
+parseHistoryTime parses the time parameter of the history request
+
+Args:
+
+	raw string: RFC3339 time or unix time in seconds
+	def time.Time: value for the empty parameter
+
+Returns:
+
+	time.Time
+	error: nil or error, if the parameter has unknown format
+*/
+func parseHistoryTime(raw string, def time.Time) (time.Time, error) {
+	if raw == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q: use RFC3339 or unix seconds", raw)
+	}
+	return t, nil
+}
+
+/*
+GetMetricHistory creates a handler that returns the history of the metric in JSON,
+example: /history/gauge/Alloc?from=2024-01-01T00:00:00Z&to=2024-01-01T01:00:00Z&step=1m&agg=max&host=42.
+Parameters from, to, step and agg are reserved, other parameters are labels of the series.
+By default the last hour is returned without downsampling, agg is avg
+
+Args:
+
+	ctx context.Context
+	s metricHistoryGetter: a storage that keeps the history of metrics
+	l logger: a logger for printing messages
+
+Returns:
+
+	http.HandlerFunc
+*/
+func GetMetricHistory(ctx context.Context, s metricHistoryGetter, l logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctxWithTimeout, cancelWithTimeout := context.WithTimeout(ctx, 5*time.Second)
+		defer cancelWithTimeout()
+
+		mType := chi.URLParam(req, "type")
+		mName := chi.URLParam(req, "name")
+		query := req.URL.Query()
+		to, err := parseHistoryTime(query.Get(`to`), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad history request", "type", mType, "name", mName, "error", err.Error())
+			return
+		}
+		from, err := parseHistoryTime(query.Get(`from`), to.Add(-defaultHistoryRange))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad history request", "type", mType, "name", mName, "error", err.Error())
+			return
+		}
+		if !from.Before(to) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			l.Error("bad history request", "type", mType, "name", mName, "from", from, "to", to)
+			return
+		}
+		var step time.Duration
+		if raw := query.Get(`step`); raw != "" {
+			step, err = time.ParseDuration(raw)
+			if err != nil || step <= 0 {
+				http.Error(w, fmt.Sprintf("bad step %q", raw), http.StatusBadRequest)
+				l.Error("bad history request", "type", mType, "name", mName, "step", raw)
+				return
+			}
+		}
+		agg := query.Get(`agg`)
+		if agg == "" {
+			agg = models.AggAvg
+		}
+		for _, p := range []string{`from`, `to`, `step`, `agg`} {
+			query.Del(p)
+		}
+		var labels map[string]string
+		if len(query) > 0 {
+			labels = make(map[string]string, len(query))
+			for name, values := range query {
+				labels[name] = values[0]
+			}
+		}
+		if err = models.ValidateLabels(labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad metrica labels", "type", mType, "name", mName, "error", err.Error())
+			return
+		}
+
+		l.Info("received a request to get metrica history", "type", mType, "name", mName, "labels", models.FormatLabels(labels),
+			"from", from, "to", to, "step", step, "agg", agg)
+		history, err := services.GetMetricHistory(ctxWithTimeout, s, mType, mName, labels, from, to, step, agg)
+		switch {
+		case errors.Is(err, myErrors.ErrBadAggregation):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			l.Error("bad history request", "type", mType, "name", mName, "error", err.Error())
+			return
+		case errors.Is(err, myErrors.ErrHistoryNotSupported):
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			l.Error("history is not supported", "type", mType, "name", mName, "error", err.Error())
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			l.Error("cannot get metrica history", "type", mType, "name", mName, "error", err.Error())
+			return
+		}
+
+		jsonData, err := json.Marshal(history)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			l.Error("cannot marshal data", "error", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(jsonData); err != nil {
+			l.Error("cannot write data to body", "error", err.Error())
+		}
+	}
+}
@@ -5,4 +5,5 @@ type Logger interface {
 	Info(msg string, fields ...interface{})
 	Debug(msg string, fields ...interface{})
 	Fatal(msg string, fields ...interface{})
+	SetLevel(levelString string)
 }
@@ -10,27 +10,32 @@ import (
 // Адаптер для zap
 type ZapLogger struct {
 	logger *zap.Logger
+	level  zap.AtomicLevel // уровень можно менять без пересоздания логгера
 }
 
-func NewZapLogger(levelString string) (logger *ZapLogger, err error) {
-	var level zapcore.Level
+// parseLevel converts the name of the level into the zap level, unknown names are INFO
+func parseLevel(levelString string) zapcore.Level {
 	switch levelString {
 	case "DEBUG":
-		level = zap.DebugLevel
+		return zap.DebugLevel
 	case "INFO":
-		level = zap.InfoLevel
+		return zap.InfoLevel
 	case "WARN":
-		level = zap.WarnLevel
+		return zap.WarnLevel
 	case "ERROR":
-		level = zap.ErrorLevel
+		return zap.ErrorLevel
 	default:
-		level = zap.InfoLevel
+		return zap.InfoLevel
 	}
+}
+
+func NewZapLogger(levelString string) (logger *ZapLogger, err error) {
+	level := zap.NewAtomicLevelAt(parseLevel(levelString))
 
 	config := zap.Config{
-		Level:       zap.NewAtomicLevelAt(level), // Уровень логирования
-		Development: false,                       // Режим разработки (влияет на формат)
-		Encoding:    "console",                   // Формат вывода "console" или "json"
+		Level:       level,     // Уровень логирования
+		Development: false,     // Режим разработки (влияет на формат)
+		Encoding:    "console", // Формат вывода "console" или "json"
 		EncoderConfig: zapcore.EncoderConfig{
 			TimeKey:        "time",                        // Ключ для вывода времени
 			LevelKey:       "level",                       // Ключ для вывода уровня
@@ -53,7 +58,22 @@ func NewZapLogger(levelString string) (logger *ZapLogger, err error) {
 		return
 	}
 
-	return &ZapLogger{logger: l}, nil
+	return &ZapLogger{logger: l, level: level}, nil
+}
+
+/*
+SetLevel changes the level of the working logger
+
+Args:
+
+	levelString string: DEBUG, INFO, WARN or ERROR, unknown names are INFO
+
+Returns:
+
+	None
+*/
+func (zl *ZapLogger) SetLevel(levelString string) {
+	zl.level.SetLevel(parseLevel(levelString))
 }
 
 // Преобразуем интерфейсные поля в zap.Field и вызываем соответствующий метод ZapLogger.logger
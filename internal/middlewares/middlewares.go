@@ -1,15 +1,20 @@
 package middlewares
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/itaraxa/effectivepancake/internal/encryption"
+	"github.com/itaraxa/effectivepancake/internal/models"
 	"github.com/itaraxa/effectivepancake/internal/services"
 )
 
@@ -19,9 +24,17 @@ type logger interface {
 	Error(msg string, fields ...interface{})
 }
 
+type keyGetter interface {
+	Key() string
+}
+
+type subnetGetter interface {
+	TrustedSubnet() *net.IPNet
+}
+
 type metricGetter interface {
 	GetMetrica(ctx context.Context, metricaType string, metricaName string) (interface{}, error)
-	GetAllMetrics(ctx context.Context) (interface{}, error)
+	GetAllMetrics(ctx context.Context) (*models.MetricsSnapshot, error)
 }
 
 /*
@@ -233,26 +246,164 @@ func DecompressRequestMiddleware(l logger) func(next http.Handler) http.Handler
 }
 
 /*
-SaveStorageToFile middleware saves all metric data to the io.WriterCloser after each successfully rocessed request.
+DecryptRequestMiddleware decrypts the request body encrypted by the agent with the server public key.
+Batches of metrics for POST /updates/ must be encrypted, unencrypted ones are rejected with 400 status code.
+Other requests without the encryption header are passed unchanged, because agents encrypt only batches.
+Must be used before DecompressRequestMiddleware
+
+Args:
+
+	l logger: a logger used for printing messages
+	key *rsa.PrivateKey: the server private key
+
+Returns:
+
+	func(next http.Handler) http.Handler
+*/
+func DecryptRequestMiddleware(l logger, key *rsa.PrivateKey) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(encryption.EncryptionHeader) != encryption.EncryptionScheme || r.Body == nil {
+				if r.Method == http.MethodPost && r.URL.Path == `/updates/` {
+					http.Error(w, "batch of metrics isn't encrypted", http.StatusBadRequest)
+					l.Error("batch of metrics isn't encrypted", "remote_addr", r.RemoteAddr)
+					return
+				}
+				l.Debug("Request isn't encrypted")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			encrypted, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "cannot read request body", http.StatusBadRequest)
+				l.Error("cannot read request body", "error", err.Error())
+				return
+			}
+			data, err := encryption.Decrypt(key, encrypted)
+			if err != nil {
+				http.Error(w, "cannot decrypt request body", http.StatusBadRequest)
+				l.Error("cannot decrypt request", "error", err.Error(), "remote_addr", r.RemoteAddr)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+			r.Header.Del(encryption.EncryptionHeader)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+/*
+Helper structure for the sign middleware function. Buffers the response for signing it before sending
+*/
+type signWriter struct {
+	http.ResponseWriter
+	buf        bytes.Buffer
+	statusCode int
+}
+
+/*
+Delaying the writing of the status code until the response body is signed
+*/
+func (sw *signWriter) WriteHeader(statusCode int) {
+	sw.statusCode = statusCode
+}
+
+/*
+Substituting the built-in writer method with the buffering implementation
+*/
+func (sw *signWriter) Write(b []byte) (int, error) {
+	return sw.buf.Write(b)
+}
+
+/*
+SignMiddleware checks the HMAC-SHA256 signature of the request body and signs the response body with the same key.
+Requests with a mismatched signature and non-GET requests without signature are rejected with 400 status code.
+Must be used after DecompressRequestMiddleware, because the signature is calculated over the uncompressed data.
+The key is read on every request, so it can be changed while the server is running
+
+Args:
+
+	l logger: a logger used for printing messages
+	keys keyGetter: source of the secret key for signing, empty key - requests pass unchecked
+
+Returns:
+
+	func(next http.Handler) http.Handler
+*/
+func SignMiddleware(l logger, keys keyGetter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := keys.Key()
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sign := r.Header.Get(services.HashHeader)
+			if sign == "" && r.Method != http.MethodGet {
+				http.Error(w, "request isn't signed", http.StatusBadRequest)
+				l.Error("request isn't signed", "method", r.Method, "path", r.URL.Path)
+				return
+			}
+			if sign != "" {
+				var body []byte
+				if r.Body != nil {
+					var err error
+					body, err = io.ReadAll(r.Body)
+					if err != nil {
+						http.Error(w, "cannot read request body", http.StatusBadRequest)
+						l.Error("cannot read request body", "error", err.Error())
+						return
+					}
+					r.Body = io.NopCloser(bytes.NewReader(body))
+				}
+				if !services.CheckSignSHA256(body, key, sign) {
+					http.Error(w, "signature mismatch", http.StatusBadRequest)
+					l.Error("signature mismatch", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+					return
+				}
+			}
+
+			sw := &signWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			w.Header().Set(services.HashHeader, services.SignSHA256(sw.buf.Bytes(), key))
+			w.WriteHeader(sw.statusCode)
+			if _, err := w.Write(sw.buf.Bytes()); err != nil {
+				l.Error("cannot write signed response", "error", err.Error())
+			}
+		})
+	}
+}
+
+type snapshotSaver interface {
+	Save(ctx context.Context, mg services.MetricGetter) error
+}
+
+/*
+SaveStorageToFile middleware saves all metric data to the snapshot file after each successfully processed request.
 This is used for synchronous saving of metric data
 
 Args:
 
+	ctx context.Context
 	l logger: a logger used for printing messages
-	s storager: a storager that allows getting metric data
-	dst io.WriteCloser: a WriteCloser object for writing metric data
+	s metricGetter: a storage that allows getting metric data
+	dst snapshotSaver: a file, which atomically replaces the snapshot, example: services.SnapshotFile
 
 Returns:
 
 	func(next http.Handler) http.Handler
 */
-func SaveStorageToFile(ctx context.Context, l logger, s metricGetter, dst io.WriteCloser) func(next http.Handler) http.Handler {
+func SaveStorageToFile(ctx context.Context, l logger, s metricGetter, dst snapshotSaver) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			wrappedWriter := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
 			next.ServeHTTP(wrappedWriter, r)
 			if wrappedWriter.statusCode == http.StatusOK {
-				err := services.WriteMetricsWithTimestamp(ctx, s, dst)
+				err := dst.Save(ctx, s)
 				if err != nil {
 					l.Error("error writing to file", "error", err.Error())
 					return
@@ -262,3 +413,66 @@ func SaveStorageToFile(ctx context.Context, l logger, s metricGetter, dst io.Wri
 		})
 	}
 }
+
+type agentTracker interface {
+	SeenAgent(id, addr string, now time.Time)
+}
+
+/*
+HeartbeatMiddleware records the request for updating metrics as a heartbeat of the agent, if it was applied
+with 2xx status code. The agent is identified by the X-Agent-ID header or by its remote address.
+It must be mounted on the updating routes behind the subnet and signature checks, so rejected requests aren't recorded
+
+Args:
+
+	l logger: a logger used for printing messages
+	t agentTracker: tracker of agents
+
+Returns:
+
+	func(next http.Handler) http.Handler
+*/
+func HeartbeatMiddleware(l logger, t agentTracker) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wrappedWriter := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(wrappedWriter, r)
+			if wrappedWriter.statusCode < 200 || wrappedWriter.statusCode > 299 {
+				return
+			}
+			addr, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				addr = r.RemoteAddr
+			}
+			t.SeenAgent(r.Header.Get(services.AgentIDHeader), addr, time.Now())
+			l.Debug("agent heartbeat", "agent", r.Header.Get(services.AgentIDHeader), "remote_addr", addr)
+		})
+	}
+}
+
+/*
+TrustedSubnetMiddleware rejects requests of agents outside the trusted subnet with 403 status code.
+The agent is identified by the X-Real-IP header or by its remote address
+
+Args:
+
+	l logger: a logger used for printing messages
+	subnets subnetGetter: source of the trusted subnet, nil subnet - any address is trusted
+
+Returns:
+
+	func(next http.Handler) http.Handler
+*/
+func TrustedSubnetMiddleware(l logger, subnets subnetGetter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			realIP := r.Header.Get(services.RealIPHeader)
+			if !services.InTrustedSubnet(subnets.TrustedSubnet(), realIP, r.RemoteAddr) {
+				http.Error(w, "address is outside the trusted subnet", http.StatusForbidden)
+				l.Error("request from untrusted address", "real_ip", realIP, "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
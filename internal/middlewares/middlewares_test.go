@@ -0,0 +1,205 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/encryption"
+	"github.com/itaraxa/effectivepancake/internal/services"
+)
+
+type testLogger struct{}
+
+func (testLogger) Debug(msg string, fields ...interface{}) {}
+func (testLogger) Info(msg string, fields ...interface{})  {}
+func (testLogger) Error(msg string, fields ...interface{}) {}
+
+// testTracker stores identifiers of seen agents
+type testTracker struct {
+	ids []string
+}
+
+func (tt *testTracker) SeenAgent(id, addr string, now time.Time) {
+	tt.ids = append(tt.ids, id)
+}
+
+func TestHeartbeatMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantIDs int
+	}{
+		{name: `applied update`, status: http.StatusOK, wantIDs: 1},
+		{name: `bad update`, status: http.StatusBadRequest, wantIDs: 0},
+		{name: `rejected update`, status: http.StatusForbidden, wantIDs: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := &testTracker{}
+			h := HeartbeatMiddleware(testLogger{}, tracker)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			req := httptest.NewRequest(http.MethodPost, `/updates/`, nil)
+			req.Header.Set(services.AgentIDHeader, `agent-1`)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if len(tracker.ids) != tt.wantIDs {
+				t.Errorf("heartbeats = %v, want %d", tracker.ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+// testKeys is the key, which can be changed between requests, like the reloaded config
+type testKeys struct {
+	mu  sync.Mutex
+	key string
+}
+
+func (tk *testKeys) Key() string {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	return tk.key
+}
+
+func (tk *testKeys) set(key string) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.key = key
+}
+
+func TestSignMiddleware(t *testing.T) {
+	const body = `[{"id":"PollCount","type":"counter","delta":1}]`
+	const answer = `{"status":"ok"}`
+	tests := []struct {
+		name       string
+		key        string
+		method     string
+		sign       string
+		wantStatus int
+		wantCalled bool
+		wantSigned bool
+	}{
+		{name: `valid signature`, key: `secret`, method: http.MethodPost, sign: services.SignSHA256([]byte(body), `secret`),
+			wantStatus: http.StatusCreated, wantCalled: true, wantSigned: true},
+		{name: `bad signature`, key: `secret`, method: http.MethodPost, sign: services.SignSHA256([]byte(body), `other`),
+			wantStatus: http.StatusBadRequest},
+		{name: `missing signature`, key: `secret`, method: http.MethodPost, wantStatus: http.StatusBadRequest},
+		{name: `unsigned GET`, key: `secret`, method: http.MethodGet, wantStatus: http.StatusCreated, wantCalled: true, wantSigned: true},
+		{name: `signing disabled`, method: http.MethodPost, wantStatus: http.StatusCreated, wantCalled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := SignMiddleware(testLogger{}, &testKeys{key: tt.key})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				// the handler gets the whole body, which was read for checking
+				got, _ := io.ReadAll(r.Body)
+				if r.Method == http.MethodPost && string(got) != body {
+					t.Errorf("handler body = %s, want %s", got, body)
+				}
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(answer))
+			}))
+			req := httptest.NewRequest(tt.method, `/updates/`, strings.NewReader(body))
+			if tt.sign != "" {
+				req.Header.Set(services.HashHeader, tt.sign)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("handler called = %v, want %v", called, tt.wantCalled)
+			}
+			gotSign := rec.Header().Get(services.HashHeader)
+			if tt.wantSigned && gotSign != services.SignSHA256([]byte(answer), tt.key) {
+				t.Errorf("response %s = %q, want signature of %s", services.HashHeader, gotSign, answer)
+			}
+			if !tt.wantSigned && gotSign != "" {
+				t.Errorf("response %s = %q, want none", services.HashHeader, gotSign)
+			}
+			if tt.wantCalled && rec.Body.String() != answer {
+				t.Errorf("response body = %s, want %s", rec.Body.String(), answer)
+			}
+		})
+	}
+}
+
+func TestSignMiddlewareReloadedKey(t *testing.T) {
+	const body = `{"id":"Alloc","type":"gauge","value":1}`
+	keys := &testKeys{key: `old`}
+	h := SignMiddleware(testLogger{}, keys)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	send := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, `/update/`, strings.NewReader(body))
+		req.Header.Set(services.HashHeader, services.SignSHA256([]byte(body), key))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send(`old`); rec.Code != http.StatusOK {
+		t.Fatalf("status with the old key = %d, want %d", rec.Code, http.StatusOK)
+	}
+	keys.set(`new`)
+	if rec := send(`old`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status with the replaced key = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := send(`new`)
+	if rec.Code != http.StatusOK || rec.Header().Get(services.HashHeader) != services.SignSHA256([]byte(body), `new`) {
+		t.Errorf("status = %d, %s = %q, want 200 signed with the new key", rec.Code, services.HashHeader, rec.Header().Get(services.HashHeader))
+	}
+}
+
+func TestDecryptRequestMiddleware(t *testing.T) {
+	key, err := encryption.GenerateKeyPair(2048)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair() error = %v", err)
+	}
+	const body = `[{"id":"Alloc","type":"gauge","value":1}]`
+	encrypted, err := encryption.Encrypt(&key.PublicKey, []byte(body))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		encrypted  bool
+		wantStatus int
+	}{
+		{name: `encrypted batch`, path: `/updates/`, body: string(encrypted), encrypted: true, wantStatus: http.StatusOK},
+		{name: `plaintext batch`, path: `/updates/`, body: body, wantStatus: http.StatusBadRequest},
+		{name: `damaged batch`, path: `/updates/`, body: body, encrypted: true, wantStatus: http.StatusBadRequest},
+		{name: `single metric`, path: `/update/`, body: `{"id":"Alloc","type":"gauge","value":1}`, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := DecryptRequestMiddleware(testLogger{}, key)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				got = string(data)
+			}))
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			if tt.encrypted {
+				req.Header.Set(encryption.EncryptionHeader, encryption.EncryptionScheme)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && tt.encrypted && got != body {
+				t.Errorf("handler body = %s, want %s", got, body)
+			}
+		})
+	}
+}
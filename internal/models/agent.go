@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// States of the reporting agent
+const (
+	AgentUp    = `up`
+	AgentStale = `stale`
+)
+
+// AgentStatus describes the last activity of one reporting agent
+type AgentStatus struct {
+	ID        string    `json:"id"`        // значение заголовка X-Agent-ID или адрес агента
+	Address   string    `json:"address"`   // адрес последнего запроса
+	FirstSeen time.Time `json:"firstSeen"` // время первого запроса
+	LastSeen  time.Time `json:"lastSeen"`  // время последнего запроса
+	Requests  int64     `json:"requests"`  // число запросов на обновление метрик
+	Status    string    `json:"status"`    // up или stale
+	Staleness float64   `json:"staleness"` // секунд с последнего запроса
+}
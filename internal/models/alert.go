@@ -0,0 +1,177 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+// States of the alert
+const (
+	AlertInactive = `inactive`
+	AlertPending  = `pending`
+	AlertFiring   = `firing`
+	AlertResolved = `resolved`
+)
+
+// Alert is the state of one alerting rule
+type Alert struct {
+	Name        string            `json:"name"`                  // имя правила
+	State       string            `json:"state"`                 // pending, firing или resolved
+	Expr        string            `json:"expr"`                  // выражение правила
+	Labels      map[string]string `json:"labels,omitempty"`      // метки правила для группировки и маршрутизации
+	Annotations map[string]string `json:"annotations,omitempty"` // описание для человека
+	Value       float64           `json:"value"`                 // последнее вычисленное значение выражения
+	ActiveAt    time.Time         `json:"activeAt"`              // момент, когда условие впервые выполнилось
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`     // момент перехода в firing
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`  // момент перехода в resolved
+}
+
+// RuleExpr is the parsed expression of the alerting rule, example: rate(counter PollCount{host="42"}) == 0 for 1m
+type RuleExpr struct {
+	Rate      bool              // per-second rate of the counter instead of its value
+	MType     string            // gauge or counter
+	Name      string            // metric name
+	Labels    map[string]string // metric labels
+	Op        string            // comparison operator: >, >=, <, <=, == or !=
+	Threshold float64           // compared value
+	For       time.Duration     // the condition must hold for this time before the alert fires
+}
+
+/*
+ParseRuleExpr parses the expression of the alerting rule.
+Format: [rate(]<type> <name>[{labels}][)] <op> <threshold> [for <duration>]
+
+Args:
+
+	raw string: expression, example: "gauge HeapAlloc > 500e6 for 2m"
+
+Returns:
+
+	RuleExpr
+	error: nil or errors.ErrBadRule
+*/
+func ParseRuleExpr(raw string) (RuleExpr, error) {
+	var e RuleExpr
+	bad := func(reason string) (RuleExpr, error) {
+		return RuleExpr{}, fmt.Errorf("%w: %s: %q", errors.ErrBadRule, reason, raw)
+	}
+
+	s := strings.TrimSpace(raw)
+	if rest, ok := strings.CutPrefix(s, `rate(`); ok {
+		e.Rate = true
+		s = strings.TrimSpace(rest)
+	}
+	e.MType, s, _ = strings.Cut(s, ` `)
+	switch e.MType {
+	case `gauge`, `counter`:
+	default:
+		return bad(`metric type must be gauge or counter`)
+	}
+	if e.Rate && e.MType != `counter` {
+		return bad(`rate is defined only for counters`)
+	}
+
+	key, s := cutSelector(strings.TrimSpace(s))
+	name, labels, err := ParseSeriesKey(key)
+	if err != nil || name == "" || strings.ContainsAny(name, `{}`) {
+		return bad(`bad metric selector`)
+	}
+	e.Name, e.Labels = name, labels
+	if e.Rate {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(s), `)`)
+		if !ok {
+			return bad(`rate( is not closed`)
+		}
+		s = rest
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 2 && len(fields) != 4 {
+		return bad(`expected <op> <threshold> [for <duration>]`)
+	}
+	switch fields[0] {
+	case `>`, `>=`, `<`, `<=`, `==`, `!=`:
+		e.Op = fields[0]
+	default:
+		return bad(`unknown operator ` + fields[0])
+	}
+	if e.Threshold, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return bad(`bad threshold`)
+	}
+	if len(fields) == 4 {
+		if fields[2] != `for` {
+			return bad(`expected for <duration>`)
+		}
+		if e.For, err = time.ParseDuration(fields[3]); err != nil || e.For < 0 {
+			return bad(`bad duration`)
+		}
+	}
+	return e, nil
+}
+
+// cutSelector splits the string after the series key: name with optional labels in braces, quoted values may contain any symbols
+func cutSelector(s string) (string, string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '}':
+			return s[:i+1], s[i+1:]
+		case (c == ' ' || c == ')') && !strings.Contains(s[:i], `{`):
+			return s[:i], s[i:]
+		}
+	}
+	return s, ""
+}
+
+/*
+Holds checks the condition of the expression for the value
+
+Args:
+
+	v float64: value of the metric or its rate
+
+Returns:
+
+	bool: true if the condition holds
+*/
+func (e RuleExpr) Holds(v float64) bool {
+	switch e.Op {
+	case `>`:
+		return v > e.Threshold
+	case `>=`:
+		return v >= e.Threshold
+	case `<`:
+		return v < e.Threshold
+	case `<=`:
+		return v <= e.Threshold
+	case `==`:
+		return v == e.Threshold
+	case `!=`:
+		return v != e.Threshold
+	}
+	return false
+}
+
+/*
+SeriesKey returns the storage key of the metric used by the expression
+
+Args:
+
+	None
+
+Returns:
+
+	string: series key, see SeriesKey
+*/
+func (e RuleExpr) SeriesKey() string {
+	return SeriesKey(e.Name, e.Labels)
+}
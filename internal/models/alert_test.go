@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+func TestParseRuleExpr(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    RuleExpr
+		wantErr bool
+	}{
+		{
+			name: `Gauge with for`,
+			raw:  `gauge HeapAlloc > 500e6 for 2m`,
+			want: RuleExpr{MType: `gauge`, Name: `HeapAlloc`, Op: `>`, Threshold: 500e6, For: 2 * time.Minute},
+		},
+		{
+			name: `Rate of counter`,
+			raw:  `rate(counter PollCount) == 0 for 1m`,
+			want: RuleExpr{Rate: true, MType: `counter`, Name: `PollCount`, Op: `==`, Threshold: 0, For: time.Minute},
+		},
+		{
+			name: `Labels with spaces and braces`,
+			raw:  `rate(counter PollCount{host="a b)}"}) <= 1`,
+			want: RuleExpr{Rate: true, MType: `counter`, Name: `PollCount`, Labels: map[string]string{`host`: `a b)}`}, Op: `<=`, Threshold: 1},
+		},
+		{name: `Histogram`, raw: `histogram Latency > 1`, wantErr: true},
+		{name: `Rate of gauge`, raw: `rate(gauge Alloc) > 1`, wantErr: true},
+		{name: `Unclosed rate`, raw: `rate(counter PollCount == 0`, wantErr: true},
+		{name: `Unknown operator`, raw: `gauge Alloc => 1`, wantErr: true},
+		{name: `Bad threshold`, raw: `gauge Alloc > many`, wantErr: true},
+		{name: `Bad duration`, raw: `gauge Alloc > 1 for ever`, wantErr: true},
+		{name: `No threshold`, raw: `gauge Alloc >`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRuleExpr(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRuleExpr() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, myErrors.ErrBadRule) {
+				t.Errorf("ParseRuleExpr() error = %v, want ErrBadRule", err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRuleExpr() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleExpr_Holds(t *testing.T) {
+	tests := []struct {
+		op   string
+		v    float64
+		want bool
+	}{
+		{`>`, 2, true}, {`>`, 1, false},
+		{`>=`, 1, true}, {`<`, 1, false},
+		{`<=`, 1, true}, {`==`, 1, true},
+		{`!=`, 1, false}, {`!=`, 0, true},
+	}
+	for _, tt := range tests {
+		e := RuleExpr{Op: tt.op, Threshold: 1}
+		if got := e.Holds(tt.v); got != tt.want {
+			t.Errorf("RuleExpr{%s 1}.Holds(%g) = %v, want %v", tt.op, tt.v, got, tt.want)
+		}
+	}
+}
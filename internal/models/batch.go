@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// IdempotencyKeyTTL is the time, during which storages remember the key of an applied batch.
+// It matches the default age limit of the agent spool, so replayed snapshots are still recognized
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// MetricsBatch is the batch of metrics, which is applied to the storage as a whole
+type MetricsBatch struct {
+	Gauges []struct {
+		MetricName  string
+		MetricValue *float64
+	}
+	Counters []struct {
+		MetricName  string
+		MetricDelta *int64
+	}
+	Histograms []struct {
+		MetricName      string
+		MetricHistogram *Histogram
+	}
+}
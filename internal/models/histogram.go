@@ -0,0 +1,148 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+// DefaultHistogramBounds are upper bounds of histogram buckets used when a histogram is created by a single observation
+var DefaultHistogramBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Distribution of observations. Buckets are not cumulative, the last bucket counts observations greater than the last bound
+type Histogram struct {
+	Bounds []float64 `json:"bounds"` // верхние границы корзин по возрастанию, корзина +Inf подразумевается
+	Counts []int64   `json:"counts"` // количество наблюдений в каждой корзине, len(Bounds)+1
+	Sum    float64   `json:"sum"`    // сумма наблюдений
+	Count  int64     `json:"count"`  // количество наблюдений
+}
+
+/*
+NewHistogram creates an empty histogram with the given bucket bounds
+
+Args:
+
+	bounds []float64: upper bounds of buckets in ascending order
+
+Returns:
+
+	Histogram
+*/
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{
+		Bounds: slices.Clone(bounds),
+		Counts: make([]int64, len(bounds)+1),
+	}
+}
+
+/*
+Observe adds the single observation into the histogram
+
+Args:
+
+	v float64: observed value
+*/
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+/*
+Merge adds observations from other histogram. Both histograms must have the same bounds
+
+Args:
+
+	other Histogram: merged histogram
+
+Returns:
+
+	error: nil or errors.ErrHistogramBounds
+*/
+func (h *Histogram) Merge(other Histogram) error {
+	if !slices.Equal(h.Bounds, other.Bounds) || len(h.Counts) != len(other.Counts) {
+		return errors.ErrHistogramBounds
+	}
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+	return nil
+}
+
+/*
+Clone returns a deep copy of the histogram
+
+Returns:
+
+	Histogram
+*/
+func (h Histogram) Clone() Histogram {
+	return Histogram{
+		Bounds: slices.Clone(h.Bounds),
+		Counts: slices.Clone(h.Counts),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+/*
+Validate checks the consistency of the histogram: bounds are finite and strictly ascending,
+there is a count for every bucket, counts are not negative and add up to Count
+
+Returns:
+
+	error: nil or errors.ErrInvalidHistogram with description of the problem
+*/
+func (h Histogram) Validate() error {
+	for i, b := range h.Bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("%w: bound %d is not finite", errors.ErrInvalidHistogram, i)
+		}
+		if i > 0 && b <= h.Bounds[i-1] {
+			return fmt.Errorf("%w: bounds are not strictly ascending", errors.ErrInvalidHistogram)
+		}
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: expected %d counts, got %d", errors.ErrInvalidHistogram, len(h.Bounds)+1, len(h.Counts))
+	}
+	var total int64
+	for _, c := range h.Counts {
+		if c < 0 {
+			return fmt.Errorf("%w: negative count", errors.ErrInvalidHistogram)
+		}
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("%w: counts add up to %d, but count is %d", errors.ErrInvalidHistogram, total, h.Count)
+	}
+	if math.IsNaN(h.Sum) || math.IsInf(h.Sum, 0) {
+		return fmt.Errorf("%w: sum is not finite", errors.ErrInvalidHistogram)
+	}
+	return nil
+}
+
+/*
+Get string representation of the histogram
+
+Output example:
+
+	count=3 sum=1.75 buckets=0.5:1,1:1,+Inf:1
+*/
+func (h Histogram) String() string {
+	buckets := make([]string, 0, len(h.Counts))
+	for i, c := range h.Counts {
+		bound := `+Inf`
+		if i < len(h.Bounds) {
+			bound = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+		}
+		buckets = append(buckets, fmt.Sprintf("%s:%d", bound, c))
+	}
+	return fmt.Sprintf("count=%d sum=%g buckets=%s", h.Count, h.Sum, strings.Join(buckets, `,`))
+}
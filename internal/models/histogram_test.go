@@ -0,0 +1,106 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds []float64
+		values []float64
+		want   Histogram
+	}{
+		{
+			name:   `Values in every bucket`,
+			bounds: []float64{1, 5},
+			values: []float64{0.5, 1, 3, 10},
+			want:   Histogram{Bounds: []float64{1, 5}, Counts: []int64{2, 1, 1}, Sum: 14.5, Count: 4},
+		},
+		{
+			name:   `Without bounds`,
+			bounds: []float64{},
+			values: []float64{2, 3},
+			want:   Histogram{Bounds: []float64{}, Counts: []int64{2}, Sum: 5, Count: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistogram(tt.bounds)
+			for _, v := range tt.values {
+				h.Observe(v)
+			}
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Errorf("Histogram.Observe() = %v, want %v", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogram_Merge(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       Histogram
+		other   Histogram
+		want    Histogram
+		wantErr error
+	}{
+		{
+			name:  `Same bounds`,
+			h:     Histogram{Bounds: []float64{1}, Counts: []int64{1, 2}, Sum: 5, Count: 3},
+			other: Histogram{Bounds: []float64{1}, Counts: []int64{3, 0}, Sum: 1.5, Count: 3},
+			want:  Histogram{Bounds: []float64{1}, Counts: []int64{4, 2}, Sum: 6.5, Count: 6},
+		},
+		{
+			name:    `Different bounds`,
+			h:       Histogram{Bounds: []float64{1}, Counts: []int64{1, 2}, Sum: 5, Count: 3},
+			other:   Histogram{Bounds: []float64{2}, Counts: []int64{1, 0}, Sum: 1, Count: 1},
+			want:    Histogram{Bounds: []float64{1}, Counts: []int64{1, 2}, Sum: 5, Count: 3},
+			wantErr: myErrors.ErrHistogramBounds,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.h.Merge(tt.other)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Histogram.Merge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(tt.h, tt.want) {
+				t.Errorf("Histogram.Merge() = %v, want %v", tt.h, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		h       Histogram
+		wantErr bool
+	}{
+		{name: `Valid`, h: Histogram{Bounds: []float64{1, 2}, Counts: []int64{1, 0, 1}, Sum: 4, Count: 2}, wantErr: false},
+		{name: `Not ascending bounds`, h: Histogram{Bounds: []float64{2, 1}, Counts: []int64{0, 0, 0}}, wantErr: true},
+		{name: `Wrong number of counts`, h: Histogram{Bounds: []float64{1}, Counts: []int64{1}, Count: 1}, wantErr: true},
+		{name: `Negative count`, h: Histogram{Bounds: []float64{1}, Counts: []int64{-1, 1}, Count: 0}, wantErr: true},
+		{name: `Count mismatch`, h: Histogram{Bounds: []float64{1}, Counts: []int64{1, 1}, Count: 3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.h.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Histogram.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHistogram_String(t *testing.T) {
+	h := Histogram{Bounds: []float64{0.5, 1}, Counts: []int64{1, 1, 1}, Sum: 1.75, Count: 3}
+	want := `count=3 sum=1.75 buckets=0.5:1,1:1,+Inf:1`
+	if got := h.String(); got != want {
+		t.Errorf("Histogram.String() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+// Aggregation functions for downsampling of the metric history
+const (
+	AggAvg  = `avg`
+	AggMin  = `min`
+	AggMax  = `max`
+	AggLast = `last`
+)
+
+// One value of the metric at the moment of time
+type HistoryPoint struct {
+	Timestamp time.Time `json:"ts"`    // момент записи значения или начало интервала усреднения
+	Value     float64   `json:"value"` // значение gauge или накопленное значение counter
+}
+
+// Time series of the metric returned by the history API
+type History struct {
+	ID          string            `json:"id"`               // имя метрики
+	MType       string            `json:"type"`             // gauge или counter
+	Labels      map[string]string `json:"labels,omitempty"` // метки серии
+	From        time.Time         `json:"from"`             // начало запрошенного интервала
+	To          time.Time         `json:"to"`               // конец запрошенного интервала, не включая
+	Step        string            `json:"step,omitempty"`   // шаг прореживания, пусто - исходные значения
+	Aggregation string            `json:"agg,omitempty"`    // функция прореживания
+	Points      []HistoryPoint    `json:"points"`           // значения в порядке времени
+}
+
+/*
+Downsample groups points into intervals of the step, starting from the from moment, and aggregates every interval
+into one point with the timestamp of the interval start. Empty intervals are skipped
+
+Args:
+
+	points []HistoryPoint: points sorted by time
+	from time.Time: start of the first interval
+	step time.Duration: length of the interval, 0 - points are returned as is
+	agg string: aggregation function: avg, min, max or last
+
+Returns:
+
+	[]HistoryPoint: aggregated points
+	error: nil or errors.ErrBadAggregation
+*/
+func Downsample(points []HistoryPoint, from time.Time, step time.Duration, agg string) ([]HistoryPoint, error) {
+	switch agg {
+	case AggAvg, AggMin, AggMax, AggLast:
+	default:
+		return nil, fmt.Errorf("%w: %q", errors.ErrBadAggregation, agg)
+	}
+	if step <= 0 {
+		return points, nil
+	}
+
+	out := []HistoryPoint{}
+	var bucket int64 = -1
+	var count int
+	for _, p := range points {
+		b := int64(p.Timestamp.Sub(from) / step)
+		if b != bucket || count == 0 {
+			if count > 0 && agg == AggAvg {
+				out[len(out)-1].Value /= float64(count)
+			}
+			bucket = b
+			count = 0
+			out = append(out, HistoryPoint{Timestamp: from.Add(time.Duration(b) * step), Value: p.Value})
+		} else {
+			last := &out[len(out)-1]
+			switch agg {
+			case AggAvg:
+				last.Value += p.Value
+			case AggMin:
+				last.Value = min(last.Value, p.Value)
+			case AggMax:
+				last.Value = max(last.Value, p.Value)
+			case AggLast:
+				last.Value = p.Value
+			}
+		}
+		count++
+	}
+	if count > 0 && agg == AggAvg {
+		out[len(out)-1].Value /= float64(count)
+	}
+	return out, nil
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(sec int, v float64) HistoryPoint {
+		return HistoryPoint{Timestamp: from.Add(time.Duration(sec) * time.Second), Value: v}
+	}
+	points := []HistoryPoint{at(0, 1), at(20, 3), at(50, 2), at(130, 10), at(170, 4)}
+	tests := []struct {
+		name    string
+		step    time.Duration
+		agg     string
+		want    []HistoryPoint
+		wantErr bool
+	}{
+		{name: `Raw`, step: 0, agg: AggAvg, want: points},
+		{name: `Avg`, step: time.Minute, agg: AggAvg, want: []HistoryPoint{at(0, 2), at(120, 7)}},
+		{name: `Min`, step: time.Minute, agg: AggMin, want: []HistoryPoint{at(0, 1), at(120, 4)}},
+		{name: `Max`, step: time.Minute, agg: AggMax, want: []HistoryPoint{at(0, 3), at(120, 10)}},
+		{name: `Last`, step: time.Minute, agg: AggLast, want: []HistoryPoint{at(0, 2), at(120, 4)}},
+		{name: `Unknown aggregation`, step: time.Minute, agg: `sum`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Downsample(points, from, tt.step, tt.agg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Downsample() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Downsample() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"fmt"
+	"html"
+)
+
+/*
+HTMLRow formats the row of the HTML view of metrics. The key and the value are escaped,
+because label values are chosen by agents
+
+Args:
+
+	key string: series key
+	value string: formatted value of the series
+	stale bool: the series isn't updated longer than the stale timeout, the row is greyed out and the name gets the "(stale)" suffix
+
+Returns:
+
+	string: row of the table
+*/
+func HTMLRow(key, value string, stale bool) string {
+	key, value = html.EscapeString(key), html.EscapeString(value)
+	if stale {
+		return fmt.Sprintf(`<tr style="color:#999"><td>%s (stale)</td><td>%s</td></tr>`, key, value)
+	}
+	return fmt.Sprintf("<tr><td>%s</td><td>%s</td></tr>", key, value)
+}
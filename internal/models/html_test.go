@@ -0,0 +1,29 @@
+package models
+
+import "testing"
+
+func TestHTMLRow(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		stale bool
+		want  string
+	}{
+		{name: `Plain`, key: `Alloc`, value: `1.5`, want: `<tr><td>Alloc</td><td>1.5</td></tr>`},
+		{name: `Stale`, key: `Alloc`, value: `1.5`, stale: true, want: `<tr style="color:#999"><td>Alloc (stale)</td><td>1.5</td></tr>`},
+		{
+			name:  `Script in label value`,
+			key:   SeriesKey(`Alloc`, map[string]string{`host`: `<script>alert(1)</script>`}),
+			value: `<b>1</b>`,
+			want:  `<tr><td>Alloc{host=&#34;&lt;script&gt;alert(1)&lt;/script&gt;&#34;}</td><td>&lt;b&gt;1&lt;/b&gt;</td></tr>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTMLRow(tt.key, tt.value, tt.stale); got != tt.want {
+				t.Errorf("HTMLRow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
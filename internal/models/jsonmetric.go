@@ -8,10 +8,12 @@ import (
 
 // unit of metrica
 type JSONMetric struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID        string            `json:"id"`                  // имя метрики
+	MType     string            `json:"type"`                // параметр, принимающий значение gauge, counter или histogram
+	Delta     *int64            `json:"delta,omitempty"`     // значение метрики в случае передачи counter
+	Value     *float64          `json:"value,omitempty"`     // значение метрики в случае передачи gauge
+	Histogram *Histogram        `json:"histogram,omitempty"` // значение метрики в случае передачи histogram
+	Labels    map[string]string `json:"labels,omitempty"`    // метки метрики, вместе с именем определяют серию
 }
 
 func (jm JSONMetric) String() string {
@@ -38,17 +40,70 @@ func (jm JSONMetric) GetMetricaCounter() *int64 {
 	return jm.Delta
 }
 
+func (jm JSONMetric) GetMetricaHistogram() *Histogram {
+	return jm.Histogram
+}
+
+func (jm JSONMetric) GetMetricaLabels() map[string]string {
+	return jm.Labels
+}
+
 // slice of metrics with mutex
 type JSONMetrics struct {
-	Data []JSONMetric
-	mu   sync.Mutex
+	Data       []JSONMetric
+	Labels     map[string]string // метки экземпляра агента, добавляемые ко всем метрикам
+	SnapshotID string            // идентификатор снимка, используется сервером для отбрасывания повторов
+	mu         sync.Mutex
+}
+
+/*
+NewJSONMetrics creates an empty slice of metrics. The labels are attached to every added metric
+
+Args:
+
+	labels map[string]string: identity of the agent instance, may be nil
+
+Returns:
+
+	*JSONMetrics
+*/
+func NewJSONMetrics(labels map[string]string) *JSONMetrics {
+	return &JSONMetrics{Labels: labels}
+}
+
+/*
+withLabels returns the metric with instance labels added. Own labels of the metric take precedence
+
+Args:
+
+	jm JSONMetric
+
+Returns:
+
+	JSONMetric: copy of the metric with a new labels map
+*/
+func (jms *JSONMetrics) withLabels(jm JSONMetric) JSONMetric {
+	if len(jms.Labels) == 0 {
+		return jm
+	}
+	labels := make(map[string]string, len(jms.Labels)+len(jm.Labels))
+	for k, v := range jms.Labels {
+		labels[k] = v
+	}
+	for k, v := range jm.Labels {
+		labels[k] = v
+	}
+	jm.Labels = labels
+	return jm
 }
 
 func (jms *JSONMetrics) AddData(data []JSONMetric) error {
 	jms.mu.Lock()
 	defer jms.mu.Unlock()
 
-	jms.Data = append(jms.Data, data...)
+	for _, jm := range data {
+		jms.Data = append(jms.Data, jms.withLabels(jm))
+	}
 	return nil
 }
 
@@ -56,11 +111,11 @@ func (jms *JSONMetrics) AddPollCount(pollCount int64) error {
 	jms.mu.Lock()
 	defer jms.mu.Unlock()
 
-	jms.Data = append(jms.Data, JSONMetric{
+	jms.Data = append(jms.Data, jms.withLabels(JSONMetric{
 		ID:    "PollCount",
 		MType: "counter",
 		Delta: &pollCount,
-	})
+	}))
 
 	return nil
 }
@@ -72,6 +127,13 @@ func (jms *JSONMetrics) GetData() []JSONMetric {
 	return jms.Data[:]
 }
 
+func (jms *JSONMetrics) GetSnapshotID() string {
+	jms.mu.Lock()
+	defer jms.mu.Unlock()
+
+	return jms.SnapshotID
+}
+
 func (jms *JSONMetrics) String() string {
 	jms.mu.Lock()
 	defer jms.mu.Unlock()
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONMetrics_Labels(t *testing.T) {
+	value := 1.5
+	tests := []struct {
+		name   string
+		labels map[string]string
+		data   []JSONMetric
+		want   []map[string]string
+	}{
+		{
+			name:   `Without instance labels`,
+			labels: nil,
+			data:   []JSONMetric{{ID: `Alloc`, MType: `gauge`, Value: &value}},
+			want:   []map[string]string{nil, nil},
+		},
+		{
+			name:   `Instance labels are attached`,
+			labels: map[string]string{`host`: `h1`, `instance`: `a1`},
+			data:   []JSONMetric{{ID: `Alloc`, MType: `gauge`, Value: &value}},
+			want: []map[string]string{
+				{`host`: `h1`, `instance`: `a1`},
+				{`host`: `h1`, `instance`: `a1`},
+			},
+		},
+		{
+			name:   `Own labels take precedence`,
+			labels: map[string]string{`host`: `h1`},
+			data:   []JSONMetric{{ID: `Alloc`, MType: `gauge`, Value: &value, Labels: map[string]string{`host`: `h2`, `core`: `0`}}},
+			want: []map[string]string{
+				{`host`: `h2`, `core`: `0`},
+				{`host`: `h1`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jms := NewJSONMetrics(tt.labels)
+			_ = jms.AddData(tt.data)
+			_ = jms.AddPollCount(1)
+			got := make([]map[string]string, 0, len(jms.GetData()))
+			for _, jm := range jms.GetData() {
+				got = append(got, jm.Labels)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+/*
+ValidateLabels checks that all label names match [a-zA-Z_][a-zA-Z0-9_]*
+
+Args:
+
+	labels map[string]string: checked labels
+
+Returns:
+
+	error: nil or errors.ErrBadLabels
+*/
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !validLabelName(name) {
+			return fmt.Errorf("%w: bad label name %q", errors.ErrBadLabels, name)
+		}
+	}
+	return nil
+}
+
+/*
+ValidateMetricName checks that the name of the metric can be a part of the series key: braces are reserved for the label set,
+so the name `a{x="1"}` would collide with the series of the metric a with the label x
+
+Args:
+
+	name string: checked name
+
+Returns:
+
+	error: nil or errors.ErrBadMetricaName
+*/
+func ValidateMetricName(name string) error {
+	if strings.ContainsAny(name, `{}`) {
+		return fmt.Errorf("%w: %q contains { or }", errors.ErrBadMetricaName, name)
+	}
+	return nil
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+/*
+FormatLabels returns canonical representation of the label set: labels sorted by name, values quoted and escaped
+
+Args:
+
+	labels map[string]string
+
+Returns:
+
+	string: canonical label set, example: `dc="eu",host="42"`. Empty string for empty label set
+
+Output example:
+
+	dc="eu",host="42"
+*/
+func FormatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[name]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+/*
+ParseLabels parses label set in canonical representation, created by FormatLabels
+
+Args:
+
+	raw string: label set, example: `dc="eu",host="42"`
+
+Returns:
+
+	map[string]string: labels, nil for empty string
+	error: nil or errors.ErrBadLabels
+*/
+func ParseLabels(raw string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for len(raw) > 0 {
+		eq := strings.IndexByte(raw, '=')
+		if eq <= 0 || eq+1 >= len(raw) || raw[eq+1] != '"' {
+			return nil, fmt.Errorf("%w: cannot parse %q", errors.ErrBadLabels, raw)
+		}
+		name := raw[:eq]
+		if !validLabelName(name) {
+			return nil, fmt.Errorf("%w: bad label name %q", errors.ErrBadLabels, name)
+		}
+		var value strings.Builder
+		i := eq + 2
+		closed := false
+		for ; i < len(raw); i++ {
+			c := raw[i]
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c == '\\' && i+1 < len(raw) {
+				i++
+				switch raw[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(raw[i])
+				}
+				continue
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return nil, fmt.Errorf("%w: unterminated value of label %q", errors.ErrBadLabels, name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate label %q", errors.ErrBadLabels, name)
+		}
+		labels[name] = value.String()
+		raw = raw[i+1:]
+		if len(raw) > 0 {
+			if raw[0] != ',' {
+				return nil, fmt.Errorf("%w: expected ',' after label %q", errors.ErrBadLabels, name)
+			}
+			raw = raw[1:]
+		}
+	}
+	return labels, nil
+}
+
+/*
+SeriesKey returns the storage identity of a metric: the name plus the canonical label set.
+A metric without labels is identified by its name only
+
+Args:
+
+	name string: metric name
+	labels map[string]string: metric labels
+
+Returns:
+
+	string: series key, example: `Alloc{host="42"}`
+*/
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + `{` + FormatLabels(labels) + `}`
+}
+
+/*
+ParseSeriesKey splits series key, created by SeriesKey, into the metric name and labels
+
+Args:
+
+	key string: series key
+
+Returns:
+
+	string: metric name
+	map[string]string: labels, nil if the key has no labels
+	error: nil or errors.ErrBadLabels
+*/
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	i := strings.IndexByte(key, '{')
+	if i < 0 || !strings.HasSuffix(key, `}`) {
+		return key, nil, nil
+	}
+	labels, err := ParseLabels(key[i+1 : len(key)-1])
+	if err != nil {
+		return key, nil, err
+	}
+	return key[:i], labels, nil
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels map[string]string
+		want   string
+	}{
+		{name: `Without labels`, metric: `Alloc`, labels: nil, want: `Alloc`},
+		{name: `Empty labels`, metric: `Alloc`, labels: map[string]string{}, want: `Alloc`},
+		{name: `Labels are sorted`, metric: `Alloc`, labels: map[string]string{`host`: `42`, `dc`: `eu`}, want: `Alloc{dc="eu",host="42"}`},
+		{name: `Escaped value`, metric: `Alloc`, labels: map[string]string{`path`: "C:\\\"x\"\n"}, want: `Alloc{path="C:\\\"x\"\n"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SeriesKey(tt.metric, tt.labels); got != tt.want {
+				t.Errorf("SeriesKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSeriesKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		wantName   string
+		wantLabels map[string]string
+		wantErr    error
+	}{
+		{name: `Without labels`, key: `Alloc`, wantName: `Alloc`},
+		{name: `With labels`, key: `Alloc{dc="eu",host="42"}`, wantName: `Alloc`, wantLabels: map[string]string{`dc`: `eu`, `host`: `42`}},
+		{name: `Escaped value`, key: `Alloc{path="C:\\\"x\"\n"}`, wantName: `Alloc`, wantLabels: map[string]string{`path`: "C:\\\"x\"\n"}},
+		{name: `Value with comma and brace`, key: `Alloc{v="a,b}"}`, wantName: `Alloc`, wantLabels: map[string]string{`v`: `a,b}`}},
+		{name: `Unterminated value`, key: `Alloc{host="42}`, wantErr: myErrors.ErrBadLabels},
+		{name: `Bad label name`, key: `Alloc{1host="42"}`, wantErr: myErrors.ErrBadLabels},
+		{name: `Duplicate label`, key: `Alloc{a="1",a="2"}`, wantErr: myErrors.ErrBadLabels},
+		{name: `Missing separator`, key: `Alloc{a="1"b="2"}`, wantErr: myErrors.ErrBadLabels},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotName, gotLabels, err := ParseSeriesKey(tt.key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseSeriesKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if gotName != tt.wantName {
+				t.Errorf("ParseSeriesKey() name = %v, want %v", gotName, tt.wantName)
+			}
+			if !reflect.DeepEqual(gotLabels, tt.wantLabels) {
+				t.Errorf("ParseSeriesKey() labels = %v, want %v", gotLabels, tt.wantLabels)
+			}
+			if key := SeriesKey(gotName, gotLabels); key != tt.key {
+				t.Errorf("SeriesKey() after parsing = %v, want %v", key, tt.key)
+			}
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{name: `Nil labels`, labels: nil, wantErr: false},
+		{name: `Valid labels`, labels: map[string]string{`host`: `42`, `_dc1`: ``}, wantErr: false},
+		{name: `Empty name`, labels: map[string]string{``: `42`}, wantErr: true},
+		{name: `Name with dash`, labels: map[string]string{`host-id`: `42`}, wantErr: true},
+		{name: `Name starting with digit`, labels: map[string]string{`1host`: `42`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateLabels(tt.labels); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateMetricName(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  string
+		wantErr bool
+	}{
+		{name: `Plain name`, metric: `Alloc`, wantErr: false},
+		{name: `Name with dots`, metric: `cpu.usage_1`, wantErr: false},
+		{name: `Series key as name`, metric: `Alloc{host="a"}`, wantErr: true},
+		{name: `Closing brace`, metric: `Alloc}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateMetricName(tt.metric); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMetricName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
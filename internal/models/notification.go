@@ -0,0 +1,72 @@
+package models
+
+import (
+	"time"
+)
+
+// AlertNameLabel is the label with the name of the rule, that is used for grouping and silencing of alerts
+const AlertNameLabel = `alertname`
+
+// Notification is the message about the group of alerts sent to notifiers
+type Notification struct {
+	Group  string            `json:"group"`  // ключ группы, например alertname="HighHeap"
+	Labels map[string]string `json:"labels"` // значения меток группировки
+	Status string            `json:"status"` // firing, если в группе есть сработавшие алерты, иначе resolved
+	Alerts []Alert           `json:"alerts"` // сработавшие и разрешенные с прошлого уведомления алерты
+	SentAt time.Time         `json:"sentAt"` // момент формирования уведомления
+}
+
+// Silence mutes notifications about alerts, whose labels match all matchers, in the interval [StartsAt, EndsAt)
+type Silence struct {
+	ID        string            `json:"id"`
+	Matchers  map[string]string `json:"matchers"`  // метки алерта и их значения, alertname - имя правила
+	StartsAt  time.Time         `json:"startsAt"`  // по умолчанию - момент создания
+	EndsAt    time.Time         `json:"endsAt"`    // окончание тишины
+	CreatedBy string            `json:"createdBy"` // автор
+	Comment   string            `json:"comment"`   // причина
+}
+
+/*
+AlertLabels returns labels of the alert with the name of the rule in the alertname label
+
+Args:
+
+	a Alert
+
+Returns:
+
+	map[string]string: new map with labels
+*/
+func AlertLabels(a Alert) map[string]string {
+	labels := make(map[string]string, len(a.Labels)+1)
+	for name, value := range a.Labels {
+		labels[name] = value
+	}
+	labels[AlertNameLabel] = a.Name
+	return labels
+}
+
+/*
+Matches checks, that the silence is active at the moment and all its matchers are equal to labels of the alert
+
+Args:
+
+	a Alert: checked alert
+	now time.Time: current time
+
+Returns:
+
+	bool: true if notifications about the alert are muted
+*/
+func (s Silence) Matches(a Alert, now time.Time) bool {
+	if now.Before(s.StartsAt) || !now.Before(s.EndsAt) {
+		return false
+	}
+	labels := AlertLabels(a)
+	for name, value := range s.Matchers {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
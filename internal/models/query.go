@@ -13,6 +13,7 @@ type Query struct {
 	MetricType     string
 	MetricName     string
 	MetricRawValue string
+	MetricLabels   map[string]string
 }
 
 func NewQuery() *Query {
@@ -57,7 +58,7 @@ func (q Query) GetMetricaType() string {
 
 func (q *Query) SetMetricaType(queryString string) error {
 	q.MetricType = strings.Split(queryString, `/`)[1]
-	if q.MetricType != "gauge" && q.MetricType != "counter" {
+	if q.MetricType != "gauge" && q.MetricType != "counter" && q.MetricType != "histogram" {
 		return errors.ErrBadType
 	}
 	return nil
@@ -75,11 +76,14 @@ func (q Query) GetMetricName() string {
 }
 
 func (q *Query) SetMetricaName(queryString string) error {
-	if name := strings.Split(queryString, `/`)[2]; name != `` {
-		q.MetricName = name
-	} else {
+	name := strings.Split(queryString, `/`)[2]
+	if name == `` {
 		return errors.ErrEmptyMetricaName
 	}
+	if err := ValidateMetricName(name); err != nil {
+		return err
+	}
+	q.MetricName = name
 	return nil
 }
 
@@ -102,3 +106,37 @@ func (q *Query) SetMetricaRawValue(queryString string) error {
 	}
 	return nil
 }
+
+/*
+Get metrica labels
+
+Returns:
+
+	map[string]string: labels of metrica, nil if not set
+*/
+func (q Query) GetMetricaLabels() map[string]string {
+	return q.MetricLabels
+}
+
+/*
+Set metrica labels, usually from URL query parameters
+
+Args:
+
+	labels map[string]string: labels of metrica
+
+Returns:
+
+	error: nil or errors.ErrBadLabels if label names are invalid
+*/
+func (q *Query) SetMetricaLabels(labels map[string]string) error {
+	if err := ValidateLabels(labels); err != nil {
+		return err
+	}
+	if len(labels) == 0 {
+		q.MetricLabels = nil
+		return nil
+	}
+	q.MetricLabels = labels
+	return nil
+}
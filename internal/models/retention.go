@@ -0,0 +1,54 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+// RetentionPolicy describes how long the history of metrics is kept in every resolution
+type RetentionPolicy struct {
+	Raw       time.Duration // время хранения исходных значений, после него значения сворачиваются в минутные агрегаты
+	Minute    time.Duration // время хранения минутных агрегатов, после него они сворачиваются в часовые
+	Hour      time.Duration // время хранения часовых агрегатов, после него они удаляются
+	Interval  time.Duration // период запуска задачи обслуживания
+	BatchSize int           // максимальное число строк, обрабатываемых одним запросом
+}
+
+// Default retention policy: raw values for a day, 1-minute rollups for 30 days, 1-hour rollups for a year
+var DefaultRetentionPolicy = RetentionPolicy{
+	Raw:       24 * time.Hour,
+	Minute:    30 * 24 * time.Hour,
+	Hour:      365 * 24 * time.Hour,
+	Interval:  5 * time.Minute,
+	BatchSize: 10000,
+}
+
+/*
+Validate checks, that every resolution is kept longer than the previous one
+
+Args:
+
+	None
+
+Returns:
+
+	error: nil or errors.ErrBadRetention
+*/
+func (rp RetentionPolicy) Validate() error {
+	if rp.Raw <= 0 || rp.Minute < rp.Raw || rp.Hour < rp.Minute {
+		return fmt.Errorf("%w: raw %s, 1m %s, 1h %s", errors.ErrBadRetention, rp.Raw, rp.Minute, rp.Hour)
+	}
+	if rp.Interval <= 0 || rp.BatchSize <= 0 {
+		return fmt.Errorf("%w: interval %s, batch %d", errors.ErrBadRetention, rp.Interval, rp.BatchSize)
+	}
+	return nil
+}
+
+// RetentionStats is the result of one run of the retention job
+type RetentionStats struct {
+	RolledUpMinute int64 // исходные значения, свернутые в минутные агрегаты
+	RolledUpHour   int64 // минутные агрегаты, свернутые в часовые
+	Expired        int64 // удаленные устаревшие строки
+}
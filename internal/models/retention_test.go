@@ -0,0 +1,29 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*RetentionPolicy)
+		wantErr bool
+	}{
+		{name: `Default`, change: func(*RetentionPolicy) {}},
+		{name: `No raw`, change: func(rp *RetentionPolicy) { rp.Raw = 0 }, wantErr: true},
+		{name: `Minute shorter than raw`, change: func(rp *RetentionPolicy) { rp.Minute = time.Hour }, wantErr: true},
+		{name: `Hour shorter than minute`, change: func(rp *RetentionPolicy) { rp.Hour = 48 * time.Hour }, wantErr: true},
+		{name: `No batch`, change: func(rp *RetentionPolicy) { rp.BatchSize = 0 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := DefaultRetentionPolicy
+			tt.change(&rp)
+			if err := rp.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("RetentionPolicy.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
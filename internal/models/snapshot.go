@@ -0,0 +1,91 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+// Current values of all metrics in the storage
+type MetricValues struct {
+	Gauges     map[string]float64   `json:"gauges"`               // значения gauge по имени метрики
+	Counters   map[string]int64     `json:"counters"`             // значения counter по имени метрики
+	Histograms map[string]Histogram `json:"histograms,omitempty"` // значения histogram по имени метрики
+}
+
+// Snapshot of the metric storage. Used for reading all metrics and for saving them into the file
+type MetricsSnapshot struct {
+	Timestamp time.Time         `json:"timestamp"`      // момент получения снимка
+	Metrics   MetricValues      `json:"metrics"`        // значения метрик
+	Meta      map[string]string `json:"meta,omitempty"` // дополнительные сведения о снимке
+}
+
+/*
+NewMetricsSnapshot creates an empty snapshot with the current timestamp
+
+Returns:
+
+	*MetricsSnapshot: pointer to the new snapshot with initialized maps
+*/
+func NewMetricsSnapshot() *MetricsSnapshot {
+	return &MetricsSnapshot{
+		Timestamp: time.Now(),
+		Metrics: MetricValues{
+			Gauges:     make(map[string]float64),
+			Counters:   make(map[string]int64),
+			Histograms: make(map[string]Histogram),
+		},
+	}
+}
+
+/*
+Validate checks that the snapshot is complete and contains only correct metric data
+
+Returns:
+
+	error: nil or errors.ErrInvalidSnapshot with description of the problem
+*/
+func (ms *MetricsSnapshot) Validate() error {
+	if ms.Timestamp.IsZero() {
+		return fmt.Errorf("%w: timestamp is not set", errors.ErrInvalidSnapshot)
+	}
+	if ms.Metrics.Gauges == nil {
+		return fmt.Errorf("%w: gauges are not set", errors.ErrInvalidSnapshot)
+	}
+	if ms.Metrics.Counters == nil {
+		return fmt.Errorf("%w: counters are not set", errors.ErrInvalidSnapshot)
+	}
+	for name, value := range ms.Metrics.Gauges {
+		if name == "" {
+			return fmt.Errorf("%w: gauge with empty name", errors.ErrInvalidSnapshot)
+		}
+		if _, _, err := ParseSeriesKey(name); err != nil {
+			return fmt.Errorf("%w: gauge %s: %v", errors.ErrInvalidSnapshot, name, err)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%w: gauge %s has not finite value", errors.ErrInvalidSnapshot, name)
+		}
+	}
+	for name := range ms.Metrics.Counters {
+		if name == "" {
+			return fmt.Errorf("%w: counter with empty name", errors.ErrInvalidSnapshot)
+		}
+		if _, _, err := ParseSeriesKey(name); err != nil {
+			return fmt.Errorf("%w: counter %s: %v", errors.ErrInvalidSnapshot, name, err)
+		}
+	}
+	for name, h := range ms.Metrics.Histograms {
+		if name == "" {
+			return fmt.Errorf("%w: histogram with empty name", errors.ErrInvalidSnapshot)
+		}
+		if _, _, err := ParseSeriesKey(name); err != nil {
+			return fmt.Errorf("%w: histogram %s: %v", errors.ErrInvalidSnapshot, name, err)
+		}
+		if err := h.Validate(); err != nil {
+			return fmt.Errorf("%w: histogram %s: %v", errors.ErrInvalidSnapshot, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMetricsSnapshot_Validate(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot MetricsSnapshot
+		wantErr  bool
+	}{
+		{
+			name: `Valid snapshot`,
+			snapshot: MetricsSnapshot{
+				Timestamp: time.Now(),
+				Metrics: MetricValues{
+					Gauges:   map[string]float64{`Alloc`: 3.14},
+					Counters: map[string]int64{`PollCount`: 1},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:     `Zero timestamp`,
+			snapshot: MetricsSnapshot{Metrics: MetricValues{Gauges: map[string]float64{}, Counters: map[string]int64{}}},
+			wantErr:  true,
+		},
+		{
+			name:     `Nil gauges`,
+			snapshot: MetricsSnapshot{Timestamp: time.Now(), Metrics: MetricValues{Counters: map[string]int64{}}},
+			wantErr:  true,
+		},
+		{
+			name: `Empty gauge name`,
+			snapshot: MetricsSnapshot{
+				Timestamp: time.Now(),
+				Metrics:   MetricValues{Gauges: map[string]float64{``: 1}, Counters: map[string]int64{}},
+			},
+			wantErr: true,
+		},
+		{
+			name: `NaN gauge`,
+			snapshot: MetricsSnapshot{
+				Timestamp: time.Now(),
+				Metrics:   MetricValues{Gauges: map[string]float64{`Alloc`: math.NaN()}, Counters: map[string]int64{}},
+			},
+			wantErr: true,
+		},
+		{
+			name: `Empty counter name`,
+			snapshot: MetricsSnapshot{
+				Timestamp: time.Now(),
+				Metrics:   MetricValues{Gauges: map[string]float64{}, Counters: map[string]int64{``: 1}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.snapshot.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("MetricsSnapshot.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package proto
+
+import (
+	"fmt"
+
+	gproto "google.golang.org/protobuf/proto"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// types of metrics in the HTTP API
+var metricTypes = map[Metric_MType]string{
+	Metric_GAUGE:     `gauge`,
+	Metric_COUNTER:   `counter`,
+	Metric_HISTOGRAM: `histogram`,
+}
+
+/*
+FromJSONMetric converts the metric of the HTTP API into the protobuf message
+
+Args:
+
+	jm models.JSONMetric: metric for converting
+
+Returns:
+
+	*Metric: protobuf message
+	error: nil or ErrBadType, if the type of the metric is unknown
+*/
+func FromJSONMetric(jm models.JSONMetric) (*Metric, error) {
+	m := &Metric{Id: jm.ID, Delta: jm.Delta, Value: jm.Value, Labels: jm.Labels}
+	for t, name := range metricTypes {
+		if name == jm.MType {
+			m.Type = t
+		}
+	}
+	if m.Type == Metric_UNSPECIFIED {
+		return nil, fmt.Errorf("%w: %s", myErrors.ErrBadType, jm.MType)
+	}
+	if jm.Histogram != nil {
+		m.Histogram = &Histogram{Bounds: jm.Histogram.Bounds, Counts: jm.Histogram.Counts, Sum: jm.Histogram.Sum, Count: jm.Histogram.Count}
+	}
+	return m, nil
+}
+
+/*
+JSONMetric converts the protobuf message into the metric of the HTTP API. Metric with unspecified type gets empty MType,
+which is ignored by the batch update as in the HTTP API
+
+Args:
+
+	None
+
+Returns:
+
+	models.JSONMetric
+*/
+func (m *Metric) JSONMetric() models.JSONMetric {
+	jm := models.JSONMetric{
+		ID:     m.GetId(),
+		MType:  metricTypes[m.GetType()],
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.GetLabels(),
+	}
+	if h := m.GetHistogram(); h != nil {
+		jm.Histogram = &models.Histogram{Bounds: h.GetBounds(), Counts: h.GetCounts(), Sum: h.GetSum(), Count: h.GetCount()}
+	}
+	return jm
+}
+
+/*
+SignedBytes returns the data, that is signed with HMAC-SHA256: the deterministic encoding of the request with empty hash
+
+Args:
+
+	None
+
+Returns:
+
+	[]byte: encoded request
+	error: nil or error of encoding
+*/
+func (r *UpdateMetricsRequest) SignedBytes() ([]byte, error) {
+	unsigned := &UpdateMetricsRequest{Metrics: r.GetMetrics(), SnapshotId: r.GetSnapshotId()}
+	return gproto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
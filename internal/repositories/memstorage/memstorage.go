@@ -4,16 +4,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"sync"
+	"time"
 
 	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
 )
 
 // Структура для хранения метрик в памяти
 type MemStorage struct {
-	Gauge   map[string]float64
-	Counter map[string]int64
-	mu      sync.Mutex
+	Gauge     map[string]float64
+	Counter   map[string]int64
+	Histogram map[string]models.Histogram
+	keys      map[string]time.Time // ключи идемпотентности примененных пакетов и время их применения
+	keysPrune time.Time
+	history   map[string]*historyRing // последние значения gauge и counter по ключу "<тип>/<серия>"
+	mu        sync.Mutex
 }
 
 /*
@@ -33,6 +40,7 @@ func (m *MemStorage) UpdateGauge(ctx context.Context, metricName string, value f
 	defer m.mu.Unlock()
 
 	m.Gauge[metricName] = value
+	m.record("gauge", metricName, value)
 
 	return nil
 }
@@ -52,6 +60,7 @@ func (m *MemStorage) UpdateBatchGauge(ctx context.Context, metrics []struct {
 			continue
 		}
 		m.Gauge[metric.MetricName] = *metric.MetricValue
+		m.record("gauge", metric.MetricName, *metric.MetricValue)
 	}
 	return updateErr
 }
@@ -73,6 +82,7 @@ func (m *MemStorage) AddCounter(ctx context.Context, metricName string, delta in
 	defer m.mu.Unlock()
 
 	m.Counter[metricName] += delta
+	m.record("counter", metricName, float64(m.Counter[metricName]))
 
 	return nil
 }
@@ -96,21 +106,76 @@ func (m *MemStorage) AddBatchCounter(ctx context.Context, metrics []struct {
 		} else {
 			m.Counter[metric.MetricName] = *metric.MetricDelta
 		}
+		m.record("counter", metric.MetricName, float64(m.Counter[metric.MetricName]))
 	}
 	return addError
 }
 
+/*
+Add observations of histogram to MemStorage. If exists - observations will be merged, bounds of buckets must be the same
+
+Args:
+
+	metricName string: metrica name
+	h models.Histogram: observations
+
+Returns:
+
+	error: nil or error of merging histograms
+*/
+func (m *MemStorage) AddHistogram(ctx context.Context, metricName string, h models.Histogram) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addHistogram(metricName, h)
+}
+
+func (m *MemStorage) AddBatchHistogram(ctx context.Context, metrics []struct {
+	MetricName      string
+	MetricHistogram *models.Histogram
+}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var addError error
+
+	for _, metric := range metrics {
+		if metric.MetricHistogram == nil {
+			addError = errors.Join(addError, fmt.Errorf("nil histogram in metrics[%s]", metric.MetricName))
+			continue
+		}
+		if err := m.addHistogram(metric.MetricName, *metric.MetricHistogram); err != nil {
+			addError = errors.Join(addError, fmt.Errorf("metrics[%s]: %w", metric.MetricName, err))
+		}
+	}
+	return addError
+}
+
+// addHistogram merges histogram into storage, the caller must hold the lock
+func (m *MemStorage) addHistogram(metricName string, h models.Histogram) error {
+	current, ok := m.Histogram[metricName]
+	if !ok {
+		m.Histogram[metricName] = h.Clone()
+		return nil
+	}
+	if err := current.Merge(h); err != nil {
+		return err
+	}
+	m.Histogram[metricName] = current
+	return nil
+}
+
 /*
 GetMetrica Get metrica value grom MemStorage by metrica name
 
 Args:
 
-	metricaType string: type of requested metrica. Should be "gauge" or "counter"
+	metricaType string: type of requested metrica. Should be "gauge", "counter" or "histogram"
 	metricaName string: name of requested metrica
 
 Returns:
 
-	string: value of metrica in the string representation
+	interface{}: float64 for gauge, int64 for counter or copy of models.Histogram for histogram
 	error: nil or error if metrica was not found in the MemStorage
 */
 func (m *MemStorage) GetMetrica(ctx context.Context, metricaType string, metricaName string) (interface{}, error) {
@@ -130,6 +195,13 @@ func (m *MemStorage) GetMetrica(ctx context.Context, metricaType string, metrica
 		}
 		return m.Counter[metricaName], nil
 
+	case "histogram":
+		h, ok := m.Histogram[metricaName]
+		if !ok {
+			return nil, myErrors.ErrMetricaNotFaund
+		}
+		return h.Clone(), nil
+
 	default:
 		// case with uncorrect type of metrica
 		return nil, myErrors.ErrMetricaNotFaund
@@ -138,15 +210,23 @@ func (m *MemStorage) GetMetrica(ctx context.Context, metricaType string, metrica
 
 /*
 GetAllMetrica return copy of data in memory storage
+
+Returns:
+
+	*models.MetricsSnapshot: snapshot with copies of gauges and counters
+	error: nil
 */
-func (m *MemStorage) GetAllMetrics(ctx context.Context) (interface{}, error) {
+func (m *MemStorage) GetAllMetrics(ctx context.Context) (*models.MetricsSnapshot, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	return struct {
-		Gauges   map[string]float64 `json:"gauges"`
-		Counters map[string]int64   `json:"counters"`
-	}{m.Gauge, m.Counter}, nil
+	snapshot := models.NewMetricsSnapshot()
+	maps.Copy(snapshot.Metrics.Gauges, m.Gauge)
+	maps.Copy(snapshot.Metrics.Counters, m.Counter)
+	for name, h := range m.Histogram {
+		snapshot.Metrics.Histograms[name] = h.Clone()
+	}
+	return snapshot, nil
 }
 
 /*
@@ -180,17 +260,26 @@ func (m *MemStorage) String(ctx context.Context) string {
 	for metric, values := range m.Counter {
 		s += fmt.Sprintf("%s: %d\n\r", metric, values)
 	}
+	s += "     Histogram:\n\r"
+	for metric, h := range m.Histogram {
+		s += fmt.Sprintf("%s: %s\n\r", metric, h)
+	}
 	return s
 }
 
 /*
 Get html representation of the current state the MemStorage
 
+Args:
+
+	ctx context.Context
+	stale map[string]bool: series keys, which rows are marked as stale, may be nil
+
 Returns:
 
 	string: html representation of the current state the MemStorage
 */
-func (m *MemStorage) HTML(ctx context.Context) string {
+func (m *MemStorage) HTML(ctx context.Context, stale map[string]bool) string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -240,10 +329,13 @@ func (m *MemStorage) HTML(ctx context.Context) string {
         <tbody>`
 
 	for metrica, value := range m.Gauge {
-		h += fmt.Sprintf("<tr><td>%s</td><td>%g</td></tr>", metrica, value)
+		h += models.HTMLRow(metrica, fmt.Sprintf("%g", value), stale[metrica])
 	}
 	for metrica, value := range m.Counter {
-		h += fmt.Sprintf("<tr><td>%s</td><td>%d</td></tr>", metrica, value)
+		h += models.HTMLRow(metrica, fmt.Sprintf("%d", value), stale[metrica])
+	}
+	for metrica, value := range m.Histogram {
+		h += models.HTMLRow(metrica, value.String(), stale[metrica])
 	}
 
 	h += `        </tbody>
@@ -264,13 +356,97 @@ Returns:
 */
 func NewMemStorage() *MemStorage {
 	return &MemStorage{
-		Gauge:   make(map[string]float64),
-		Counter: make(map[string]int64),
+		Gauge:     make(map[string]float64),
+		Counter:   make(map[string]int64),
+		Histogram: make(map[string]models.Histogram),
+		keys:      make(map[string]time.Time),
+		history:   make(map[string]*historyRing),
+	}
+}
+
+/*
+UpdateBatchOnce applies the batch and remembers its idempotency key under one lock. The batch is checked completely
+before applying, so a failed batch changes nothing and its key isn't remembered. Keys older than models.IdempotencyKeyTTL are forgotten
+
+Args:
+
+	ctx context.Context
+	key string: idempotency key of the batch
+	batch *models.MetricsBatch: metrics of the batch
+
+Returns:
+
+	bool: true if the batch was applied, false for a duplicate
+	error: nil or error of nil values or of incompatible histograms, nothing is applied in that case
+*/
+func (m *MemStorage) UpdateBatchOnce(ctx context.Context, key string, batch *models.MetricsBatch) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.keys == nil {
+		m.keys = make(map[string]time.Time)
+	}
+	now := time.Now()
+	// pruning of the whole map no more than once a minute
+	if now.Sub(m.keysPrune) > time.Minute {
+		for k, t := range m.keys {
+			if now.Sub(t) > models.IdempotencyKeyTTL {
+				delete(m.keys, k)
+			}
+		}
+		m.keysPrune = now
+	}
+	if t, ok := m.keys[key]; ok && now.Sub(t) <= models.IdempotencyKeyTTL {
+		return false, nil
+	}
+
+	// checking the whole batch before changing the storage
+	for _, metric := range batch.Gauges {
+		if metric.MetricValue == nil {
+			return false, fmt.Errorf("nil value in metrics[%s]", metric.MetricName)
+		}
+	}
+	for _, metric := range batch.Counters {
+		if metric.MetricDelta == nil {
+			return false, fmt.Errorf("nil delta in metrics[%s]", metric.MetricName)
+		}
+	}
+	merged := make(map[string]models.Histogram, len(batch.Histograms))
+	for _, metric := range batch.Histograms {
+		if metric.MetricHistogram == nil {
+			return false, fmt.Errorf("nil histogram in metrics[%s]", metric.MetricName)
+		}
+		current, ok := merged[metric.MetricName]
+		if !ok {
+			stored, exists := m.Histogram[metric.MetricName]
+			if !exists {
+				merged[metric.MetricName] = metric.MetricHistogram.Clone()
+				continue
+			}
+			// the stored histogram is merged in a copy, because the batch may still fail
+			current = stored.Clone()
+		}
+		if err := current.Merge(*metric.MetricHistogram); err != nil {
+			return false, fmt.Errorf("metrics[%s]: %w", metric.MetricName, err)
+		}
+		merged[metric.MetricName] = current
+	}
+
+	for _, metric := range batch.Gauges {
+		m.Gauge[metric.MetricName] = *metric.MetricValue
+		m.record("gauge", metric.MetricName, *metric.MetricValue)
 	}
+	for _, metric := range batch.Counters {
+		m.Counter[metric.MetricName] += *metric.MetricDelta
+		m.record("counter", metric.MetricName, float64(m.Counter[metric.MetricName]))
+	}
+	maps.Copy(m.Histogram, merged)
+	m.keys[key] = now
+	return true, nil
 }
 
 func (m *MemStorage) PingContext(ctx context.Context) error {
-	if m.Counter == nil || m.Gauge == nil {
+	if m.Counter == nil || m.Gauge == nil || m.Histogram == nil {
 		return myErrors.ErrMemStorageNotInitilized
 	}
 	return nil
@@ -285,5 +461,56 @@ func (m *MemStorage) Clear(ctx context.Context) error {
 	defer m.mu.Unlock()
 	clear(m.Gauge)
 	clear(m.Counter)
+	clear(m.Histogram)
+	clear(m.history)
 	return nil
 }
+
+// record appends the current value of the series to its history, the caller must hold the lock
+func (m *MemStorage) record(metricType string, metricName string, value float64) {
+	if m.history == nil {
+		m.history = make(map[string]*historyRing)
+	}
+	key := metricType + "/" + metricName
+	r, ok := m.history[key]
+	if !ok {
+		r = newHistoryRing(historyCapacity)
+		m.history[key] = r
+	}
+	r.push(time.Now(), value)
+}
+
+/*
+GetHistory returns the latest values of the series in the interval. Only the last historyCapacity values
+of every series are kept in memory
+
+Args:
+
+	ctx context.Context
+	metricaType string: type of requested metrica. Should be "gauge" or "counter"
+	metricaName string: series key of requested metrica
+	from time.Time: start of the interval
+	to time.Time: end of the interval, not included
+
+Returns:
+
+	[]models.HistoryPoint: values in the order of time, counters are returned as accumulated values
+	error: nil, myErrors.ErrHistoryNotSupported for histograms or myErrors.ErrMetricaNotFaund
+*/
+func (m *MemStorage) GetHistory(ctx context.Context, metricaType string, metricaName string, from, to time.Time) ([]models.HistoryPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch metricaType {
+	case "gauge", "counter":
+	case "histogram":
+		return nil, myErrors.ErrHistoryNotSupported
+	default:
+		return nil, myErrors.ErrMetricaNotFaund
+	}
+	r, ok := m.history[metricaType+"/"+metricaName]
+	if !ok {
+		return nil, myErrors.ErrMetricaNotFaund
+	}
+	return r.rangeOf(from, to), nil
+}
@@ -2,7 +2,11 @@ package memstorage
 
 import (
 	"context"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
 )
 
 func TestMemStorage_UpdateGauge(t *testing.T) {
@@ -224,3 +228,170 @@ func TestMemStorage_GetMetrica(t *testing.T) {
 		})
 	}
 }
+
+func TestMemStorage_AddHistogram(t *testing.T) {
+	tests := []struct {
+		name    string
+		current map[string]models.Histogram
+		add     models.Histogram
+		want    models.Histogram
+		wantErr bool
+	}{
+		{
+			name:    "Add new histogram",
+			current: map[string]models.Histogram{},
+			add:     models.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1},
+			want:    models.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1},
+			wantErr: false,
+		},
+		{
+			name:    "Merge into existing histogram",
+			current: map[string]models.Histogram{`latency`: {Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1}},
+			add:     models.Histogram{Bounds: []float64{1}, Counts: []int64{0, 2}, Sum: 5, Count: 2},
+			want:    models.Histogram{Bounds: []float64{1}, Counts: []int64{1, 2}, Sum: 5.5, Count: 3},
+			wantErr: false,
+		},
+		{
+			name:    "Merge histogram with other bounds",
+			current: map[string]models.Histogram{`latency`: {Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1}},
+			add:     models.Histogram{Bounds: []float64{2}, Counts: []int64{0, 2}, Sum: 5, Count: 2},
+			want:    models.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MemStorage{
+				Gauge:     map[string]float64{},
+				Counter:   map[string]int64{},
+				Histogram: tt.current,
+			}
+			if err := m.AddHistogram(context.TODO(), `latency`, tt.add); (err != nil) != tt.wantErr {
+				t.Errorf("MemStorage.AddHistogram() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := m.Histogram[`latency`]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MemStorage.AddHistogram() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemStorage_UpdateBatchOnce(t *testing.T) {
+	m := NewMemStorage()
+	_ = m.AddHistogram(context.TODO(), `latency`, models.Histogram{Bounds: []float64{1}, Counts: []int64{1, 0}, Sum: 0.5, Count: 1})
+	delta, value := int64(2), 1.5
+	batch := func(bounds []float64) *models.MetricsBatch {
+		b := &models.MetricsBatch{}
+		b.Gauges = append(b.Gauges, struct {
+			MetricName  string
+			MetricValue *float64
+		}{`Alloc`, &value})
+		b.Counters = append(b.Counters, struct {
+			MetricName  string
+			MetricDelta *int64
+		}{`PollCount`, &delta})
+		b.Histograms = append(b.Histograms, struct {
+			MetricName      string
+			MetricHistogram *models.Histogram
+		}{`latency`, &models.Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}})
+		return b
+	}
+
+	// the histogram with other bounds fails the whole batch, the key isn't remembered
+	if ok, err := m.UpdateBatchOnce(context.TODO(), `k1`, batch([]float64{2})); ok || err == nil {
+		t.Fatalf("MemStorage.UpdateBatchOnce() bad batch = %v, %v, want false, error", ok, err)
+	}
+	if _, err := m.GetMetrica(context.TODO(), `counter`, `PollCount`); err == nil {
+		t.Errorf("counter of the failed batch is applied")
+	}
+	if _, err := m.GetMetrica(context.TODO(), `gauge`, `Alloc`); err == nil {
+		t.Errorf("gauge of the failed batch is applied")
+	}
+
+	for i := 0; i < 2; i++ {
+		ok, err := m.UpdateBatchOnce(context.TODO(), `k1`, batch([]float64{1}))
+		if err != nil || ok != (i == 0) {
+			t.Errorf("MemStorage.UpdateBatchOnce() attempt %d = %v, %v, want %v, nil", i+1, ok, err, i == 0)
+		}
+	}
+	if got, _ := m.GetMetrica(context.TODO(), `counter`, `PollCount`); got != int64(2) {
+		t.Errorf("PollCount = %v, want 2", got)
+	}
+
+	m.keys[`k1`] = time.Now().Add(-models.IdempotencyKeyTTL - time.Second)
+	if ok, _ := m.UpdateBatchOnce(context.TODO(), `k1`, batch([]float64{1})); !ok {
+		t.Errorf("MemStorage.UpdateBatchOnce() expired key = false, want true")
+	}
+}
+
+func TestMemStorage_GetHistory(t *testing.T) {
+	m := NewMemStorage()
+	from := time.Now().Add(-time.Second)
+	for _, d := range []int64{1, 2, 3} {
+		_ = m.AddCounter(context.TODO(), `PollCount`, d)
+	}
+	_ = m.UpdateGauge(context.TODO(), `Alloc`, 3.14)
+	to := time.Now().Add(time.Second)
+
+	points, err := m.GetHistory(context.TODO(), `counter`, `PollCount`, from, to)
+	if err != nil {
+		t.Fatalf("MemStorage.GetHistory() error = %v", err)
+	}
+	// counters are stored as accumulated values
+	got := []float64{}
+	for _, p := range points {
+		got = append(got, p.Value)
+	}
+	if want := []float64{1, 3, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MemStorage.GetHistory() = %v, want %v", got, want)
+	}
+	if points, _ = m.GetHistory(context.TODO(), `gauge`, `Alloc`, to, to.Add(time.Hour)); len(points) != 0 {
+		t.Errorf("MemStorage.GetHistory() out of range = %v, want empty", points)
+	}
+	if _, err = m.GetHistory(context.TODO(), `gauge`, `Unknown`, from, to); err == nil {
+		t.Errorf("MemStorage.GetHistory() unknown metrica error = nil")
+	}
+	if _, err = m.GetHistory(context.TODO(), `histogram`, `Alloc`, from, to); err == nil {
+		t.Errorf("MemStorage.GetHistory() histogram error = nil")
+	}
+}
+
+func Test_historyRing(t *testing.T) {
+	r := newHistoryRing(3)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		r.push(start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	// the oldest values are overwritten
+	got := []float64{}
+	for _, p := range r.rangeOf(start, start.Add(time.Minute)) {
+		got = append(got, p.Value)
+	}
+	if want := []float64{2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("historyRing.rangeOf() = %v, want %v", got, want)
+	}
+	if got := r.rangeOf(start.Add(3*time.Second), start.Add(4*time.Second)); len(got) != 1 || got[0].Value != 3 {
+		t.Errorf("historyRing.rangeOf() = %v, want one value 3", got)
+	}
+}
+
+func Test_historyRingGrowth(t *testing.T) {
+	r := newHistoryRing(20)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// a new series holds only the initial size
+	r.push(start, 0)
+	if got := cap(r.points); got != historyInitialSize {
+		t.Errorf("capacity of a new ring = %d, want %d", got, historyInitialSize)
+	}
+	for i := 1; i < 25; i++ {
+		r.push(start.Add(time.Duration(i)*time.Second), float64(i))
+	}
+	// the buffer doesn't grow over the capacity and keeps the latest values
+	if got := cap(r.points); got != 20 {
+		t.Errorf("capacity of the full ring = %d, want 20", got)
+	}
+	points := r.rangeOf(start, start.Add(time.Minute))
+	if len(points) != 20 || points[0].Value != 5 || points[19].Value != 24 {
+		t.Errorf("historyRing.rangeOf() = %v, want values 5..24", points)
+	}
+}
@@ -0,0 +1,74 @@
+package memstorage
+
+import (
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+const (
+	// historyCapacity is the number of the latest values kept for every series
+	historyCapacity = 1024
+	// historyInitialSize is the number of values allocated for a new series, the buffer grows up to historyCapacity
+	historyInitialSize = 8
+)
+
+/*
+historyRing is a ring buffer of the latest values of one series. The buffer is allocated lazily and grows
+by doubling, so rarely updated series don't hold the whole capacity. Not safe for concurrent use
+*/
+type historyRing struct {
+	points   []models.HistoryPoint
+	capacity int  // maximum number of kept values
+	next     int  // index for the next value, when the buffer is full
+	full     bool // buffer reached the capacity and was wrapped, the oldest value is at next
+}
+
+// newHistoryRing creates an empty ring buffer of the given capacity
+func newHistoryRing(capacity int) *historyRing {
+	return &historyRing{capacity: max(capacity, 1)}
+}
+
+// push stores the value, overwriting the oldest one when the buffer is full
+func (r *historyRing) push(ts time.Time, value float64) {
+	p := models.HistoryPoint{Timestamp: ts, Value: value}
+	if r.full {
+		r.points[r.next] = p
+		r.next = (r.next + 1) % r.capacity
+		return
+	}
+	if len(r.points) == cap(r.points) {
+		grown := make([]models.HistoryPoint, len(r.points), min(max(2*cap(r.points), historyInitialSize), r.capacity))
+		copy(grown, r.points)
+		r.points = grown
+	}
+	r.points = append(r.points, p)
+	r.full = len(r.points) == r.capacity
+}
+
+/*
+rangeOf returns stored values in the interval [from, to) in the order of time
+
+Args:
+
+	from time.Time: start of the interval
+	to time.Time: end of the interval, not included
+
+Returns:
+
+	[]models.HistoryPoint: copies of the stored values
+*/
+func (r *historyRing) rangeOf(from, to time.Time) []models.HistoryPoint {
+	out := []models.HistoryPoint{}
+	start := 0
+	if r.full {
+		start = r.next
+	}
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !p.Timestamp.Before(from) && p.Timestamp.Before(to) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
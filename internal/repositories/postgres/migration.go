@@ -5,42 +5,430 @@ import (
 	"database/sql"
 	"embed"
 	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-//go:embed migrations/*.up.sql
+//go:embed migrations/*.sql
 var migrationFiles embed.FS
 
+// migrationLockID is the key of the postgres advisory lock, that serializes migrations of concurrent servers
+const migrationLockID int64 = 7_342_115_001
+
+/*
+Migration is one version of the database schema. Files with the same version prefix,
+e.g. 001_create_gauges_table.up.sql and 001_create_counters_table.up.sql, are joined in the order of their names
+*/
 type Migration struct {
 	Version int
+	Name    string
 	UpSQL   string
 	DownSQL string
 }
 
 /*
-prepareTablesContext create tables for metrice storage if not exist
+MigrationStatus describes the state of one migration in the database
+*/
+type MigrationStatus struct {
+	Version int
+	Name    string
+	Applied bool
+}
+
+/*
+loadMigrations reads migrations from the directory. Files must be named <version>_<name>.up.sql and <version>_<name>.down.sql
 
 Args:
 
-	ctx context.Context
-	db *sql.DB: pointer to sql.DB instance
+	fsys fs.FS: file system with migrations
+	dir string: directory with migration files
 
 Returns:
 
-	error: nil or an error that occurred while processing the request
+	[]Migration: migrations sorted by version
+	error: nil or error of reading files or parsing version
 */
-func prepareTablesContext(ctx context.Context, db *sql.DB) error {
-	files, err := migrationFiles.ReadDir("migrations")
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, dir)
 	if err != nil {
-		return fmt.Errorf("reading migration files error: %w", err)
+		return nil, fmt.Errorf("reading migration files error: %w", err)
 	}
+	// ReadDir returns files sorted by name, so parts of one version are joined in a stable order
+	byVersion := make(map[int]*Migration)
 	for _, file := range files {
-		content, err := migrationFiles.ReadFile("migrations/" + file.Name())
+		name := file.Name()
+		var up bool
+		switch {
+		case strings.HasSuffix(name, `.up.sql`):
+			up = true
+		case strings.HasSuffix(name, `.down.sql`):
+		default:
+			continue
+		}
+		prefix, title, ok := strings.Cut(name, `_`)
+		if !ok {
+			return nil, fmt.Errorf("migration file %s has no version prefix", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s has bad version: %w", name, err)
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("reading migration file %s error: %w", name, err)
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		sqlText := strings.TrimSpace(string(content))
+		if up {
+			m.Name = joinMigrationPart(m.Name, strings.TrimSuffix(title, `.up.sql`), `, `)
+			m.UpSQL = joinMigrationPart(m.UpSQL, sqlText, "\n")
+		} else {
+			m.DownSQL = joinMigrationPart(m.DownSQL, sqlText, "\n")
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.UpSQL == "" {
+			return nil, fmt.Errorf("migration %d has no up file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// joinMigrationPart appends the part to the text of the migration
+func joinMigrationPart(text, part, sep string) string {
+	if text == "" {
+		return part
+	}
+	if part == "" {
+		return text
+	}
+	return text + sep + part
+}
+
+/*
+pendingMigrations returns migrations, that are not applied yet
+
+Args:
+
+	migrations []Migration: all known migrations sorted by version
+	applied map[int]bool: applied versions
+
+Returns:
+
+	[]Migration: pending migrations sorted by version
+*/
+func pendingMigrations(migrations []Migration, applied map[int]bool) []Migration {
+	pending := []Migration{}
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+/*
+Migrator applies and rolls back embedded migrations. Applied versions are recorded in the schema_migrations table
+*/
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+/*
+NewMigrator creates a migrator for the embedded migrations
+
+Args:
+
+	db *sql.DB: pointer to sql.DB instance
+
+Returns:
+
+	*Migrator
+	error: nil or error of reading embedded migrations
+*/
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, `migrations`)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+/*
+withLock runs the function on a dedicated connection holding the advisory lock, so only one server migrates the database at a time
+
+Args:
+
+	ctx context.Context
+	f func(conn *sql.Conn) error: function to run under the lock
+
+Returns:
+
+	error
+*/
+func (m *Migrator) withLock(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get connection for migrations: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLockID); err != nil {
+		return fmt.Errorf("cannot take migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1);", migrationLockID)
+
+	if _, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP);`); err != nil {
+		return fmt.Errorf("cannot create schema_migrations table: %w", err)
+	}
+	return f(conn)
+}
+
+/*
+appliedVersions reads versions from the schema_migrations table
+
+Args:
+
+	ctx context.Context
+	conn *sql.Conn: connection holding the migration lock
+
+Returns:
+
+	map[int]bool: applied versions
+	error
+*/
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations;")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err = rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("cannot read applied migrations: %w", err)
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+/*
+runMigrationTx executes the SQL of the migration and updates schema_migrations in one transaction
+
+Args:
+
+	ctx context.Context
+	conn *sql.Conn: connection holding the migration lock
+	query string: SQL of the migration
+	record string: statement updating schema_migrations
+	version int: version of the migration
+
+Returns:
+
+	error
+*/
+func runMigrationTx(ctx context.Context, conn *sql.Conn, query, record string, version int) (err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, record, version)
+	return err
+}
+
+/*
+Up applies all pending migrations in the order of versions, each one in its own transaction
+
+Args:
+
+	ctx context.Context
+
+Returns:
+
+	[]int: applied versions
+	error: nil or error of the first failed migration, the following migrations are not applied
+*/
+func (m *Migrator) Up(ctx context.Context) ([]int, error) {
+	done := []int{}
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range pendingMigrations(m.migrations, applied) {
+			err = runMigrationTx(ctx, conn, mig.UpSQL, "INSERT INTO schema_migrations (version) VALUES ($1);", mig.Version)
+			if err != nil {
+				return fmt.Errorf("applying migration %d (%s): %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+/*
+Down rolls back the last n applied migrations in the reverse order of versions, each one in its own transaction
+
+Args:
+
+	ctx context.Context
+	n int: number of migrations to roll back
+
+Returns:
+
+	[]int: rolled back versions
+	error: nil or error of the first failed rollback
+*/
+func (m *Migrator) Down(ctx context.Context, n int) ([]int, error) {
+	done := []int{}
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < n; i-- {
+			mig := m.migrations[i]
+			if !applied[mig.Version] {
+				continue
+			}
+			if mig.DownSQL == "" {
+				return fmt.Errorf("migration %d (%s) has no down file", mig.Version, mig.Name)
+			}
+			err = runMigrationTx(ctx, conn, mig.DownSQL, "DELETE FROM schema_migrations WHERE version = $1;", mig.Version)
+			if err != nil {
+				return fmt.Errorf("rolling back migration %d (%s): %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+/*
+Status returns the state of all known migrations
+
+Args:
+
+	ctx context.Context
+
+Returns:
+
+	[]MigrationStatus: states sorted by version
+	error
+*/
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	statuses := []MigrationStatus{}
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
 		if err != nil {
-			return fmt.Errorf("reading migration file %s error: %w", file.Name(), err)
+			return err
 		}
-		if _, err := db.ExecContext(ctx, string(content)); err != nil {
-			return fmt.Errorf("preapring database error: %w", err)
+		for _, mig := range m.migrations {
+			statuses = append(statuses, MigrationStatus{Version: mig.Version, Name: mig.Name, Applied: applied[mig.Version]})
 		}
+		return nil
+	})
+	return statuses, err
+}
+
+/*
+Force records the database as migrated exactly to the version without executing any SQL: versions up to
+the given one are marked as applied, later versions are marked as pending. Used to repair schema_migrations by hand
+
+Args:
+
+	ctx context.Context
+	version int: version of the current schema, 0 - no migrations applied
+
+Returns:
+
+	error: nil or error, if the version is unknown or schema_migrations cannot be updated
+*/
+func (m *Migrator) Force(ctx context.Context, version int) error {
+	known := version == 0
+	for _, mig := range m.migrations {
+		known = known || mig.Version == version
+	}
+	if !known {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+	return m.withLock(ctx, func(conn *sql.Conn) (err error) {
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction: %w", err)
+		}
+		defer func() {
+			if err != nil {
+				_ = tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+		}()
+
+		if _, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations;"); err != nil {
+			return fmt.Errorf("cannot clear schema_migrations: %w", err)
+		}
+		for _, mig := range m.migrations {
+			if mig.Version > version {
+				break
+			}
+			if _, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1);", mig.Version); err != nil {
+				return fmt.Errorf("cannot record migration %d: %w", mig.Version, err)
+			}
+		}
+		return nil
+	})
+}
+
+/*
+prepareTablesContext applies pending migrations of the database schema
+
+Args:
+
+	ctx context.Context
+	db *sql.DB: pointer to sql.DB instance
+
+Returns:
+
+	error: nil or an error that occurred while processing the request
+*/
+func prepareTablesContext(ctx context.Context, db *sql.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	if _, err = migrator.Up(ctx); err != nil {
+		return fmt.Errorf("preapring database error: %w", err)
 	}
 	return nil
 }
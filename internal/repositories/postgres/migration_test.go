@@ -0,0 +1,66 @@
+package postgres
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func Test_loadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		`m/002_create_b.up.sql`:   {Data: []byte("CREATE TABLE b ();\n")},
+		`m/002_create_b.down.sql`: {Data: []byte("DROP TABLE b;")},
+		`m/001_create_a.up.sql`:   {Data: []byte("CREATE TABLE a ();")},
+		`m/001_create_c.up.sql`:   {Data: []byte("CREATE TABLE c ();")},
+		`m/001_create_a.down.sql`: {Data: []byte("DROP TABLE a;")},
+		`m/README.md`:             {Data: []byte("not a migration")},
+	}
+	got, err := loadMigrations(fsys, `m`)
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+	want := []Migration{
+		{Version: 1, Name: `create_a, create_c`, UpSQL: "CREATE TABLE a ();\nCREATE TABLE c ();", DownSQL: "DROP TABLE a;"},
+		{Version: 2, Name: `create_b`, UpSQL: "CREATE TABLE b ();", DownSQL: "DROP TABLE b;"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadMigrations() = %+v, want %+v", got, want)
+	}
+
+	bad := []fstest.MapFS{
+		{`m/x_create_a.up.sql`: {Data: []byte("SELECT 1;")}},
+		{`m/createa.up.sql`: {Data: []byte("SELECT 1;")}},
+		{`m/003_only_down.down.sql`: {Data: []byte("SELECT 1;")}},
+	}
+	for _, fsys := range bad {
+		if _, err = loadMigrations(fsys, `m`); err == nil {
+			t.Errorf("loadMigrations(%v) error = nil, wantErr true", fsys)
+		}
+	}
+}
+
+func Test_pendingMigrations(t *testing.T) {
+	migrations := []Migration{{Version: 1}, {Version: 2}, {Version: 3}}
+	got := pendingMigrations(migrations, map[int]bool{1: true, 3: true})
+	if len(got) != 1 || got[0].Version != 2 {
+		t.Errorf("pendingMigrations() = %+v, want version 2", got)
+	}
+	if got = pendingMigrations(migrations, map[int]bool{1: true, 2: true, 3: true}); len(got) != 0 {
+		t.Errorf("pendingMigrations() = %+v, want none", got)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, `migrations`)
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("no embedded migrations")
+	}
+	for _, m := range migrations {
+		if m.DownSQL == "" {
+			t.Errorf("migration %d (%s) has no down file", m.Version, m.Name)
+		}
+	}
+}
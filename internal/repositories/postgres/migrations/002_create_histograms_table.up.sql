@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS histograms (
+    metric_id TEXT NOT NULL,
+    metric_bounds JSONB NOT NULL,
+    metric_counts JSONB NOT NULL,
+    metric_sum double precision NOT NULL,
+    metric_count bigint NOT NULL,
+    metric_timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP);
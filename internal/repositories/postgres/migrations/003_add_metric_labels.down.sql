@@ -0,0 +1,3 @@
+ALTER TABLE gauges DROP COLUMN IF EXISTS metric_labels;
+ALTER TABLE counters DROP COLUMN IF EXISTS metric_labels;
+ALTER TABLE histograms DROP COLUMN IF EXISTS metric_labels;
@@ -0,0 +1,3 @@
+ALTER TABLE gauges ADD COLUMN IF NOT EXISTS metric_labels TEXT NOT NULL DEFAULT '';
+ALTER TABLE counters ADD COLUMN IF NOT EXISTS metric_labels TEXT NOT NULL DEFAULT '';
+ALTER TABLE histograms ADD COLUMN IF NOT EXISTS metric_labels TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS histogram_values;
+DROP TABLE IF EXISTS counter_values;
+DROP TABLE IF EXISTS gauge_values;
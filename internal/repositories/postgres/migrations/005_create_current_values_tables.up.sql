@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS gauge_values (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    metric_value double precision NOT NULL,
+    metric_timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (metric_id, metric_labels));
+CREATE TABLE IF NOT EXISTS counter_values (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    metric_delta bigint NOT NULL,
+    metric_timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (metric_id, metric_labels));
+CREATE TABLE IF NOT EXISTS histogram_values (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    metric_bounds JSONB NOT NULL,
+    metric_counts JSONB NOT NULL,
+    metric_sum double precision NOT NULL,
+    metric_count bigint NOT NULL,
+    metric_timestamp TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (metric_id, metric_labels));
+INSERT INTO gauge_values (metric_id, metric_labels, metric_value, metric_timestamp)
+    SELECT DISTINCT ON (metric_id, metric_labels) metric_id, metric_labels, metric_value, metric_timestamp
+    FROM gauges ORDER BY metric_id, metric_labels, metric_timestamp DESC
+    ON CONFLICT (metric_id, metric_labels) DO NOTHING;
+INSERT INTO counter_values (metric_id, metric_labels, metric_delta, metric_timestamp)
+    SELECT DISTINCT ON (metric_id, metric_labels) metric_id, metric_labels, metric_delta, metric_timestamp
+    FROM counters ORDER BY metric_id, metric_labels, metric_timestamp DESC
+    ON CONFLICT (metric_id, metric_labels) DO NOTHING;
+INSERT INTO histogram_values (metric_id, metric_labels, metric_bounds, metric_counts, metric_sum, metric_count, metric_timestamp)
+    SELECT DISTINCT ON (metric_id, metric_labels) metric_id, metric_labels, metric_bounds, metric_counts, metric_sum, metric_count, metric_timestamp
+    FROM histograms ORDER BY metric_id, metric_labels, metric_timestamp DESC
+    ON CONFLICT (metric_id, metric_labels) DO NOTHING;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS gauges_series_time_idx;
+DROP INDEX IF EXISTS counters_series_time_idx;
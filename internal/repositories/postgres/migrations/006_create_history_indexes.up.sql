@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS gauges_series_time_idx ON gauges (metric_id, metric_labels, metric_timestamp);
+CREATE INDEX IF NOT EXISTS counters_series_time_idx ON counters (metric_id, metric_labels, metric_timestamp);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS gauges_time_idx;
+DROP INDEX IF EXISTS counters_time_idx;
+DROP INDEX IF EXISTS histograms_time_idx;
+DROP TABLE IF EXISTS gauges_1m;
+DROP TABLE IF EXISTS gauges_1h;
+DROP TABLE IF EXISTS counters_1m;
+DROP TABLE IF EXISTS counters_1h;
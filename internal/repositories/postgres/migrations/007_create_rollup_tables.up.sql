@@ -0,0 +1,51 @@
+CREATE TABLE IF NOT EXISTS gauges_1m (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value double precision NOT NULL,
+    max_value double precision NOT NULL,
+    sum_value double precision NOT NULL,
+    value_count bigint NOT NULL,
+    last_value double precision NOT NULL,
+    last_timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (metric_id, metric_labels, bucket));
+CREATE INDEX IF NOT EXISTS gauges_1m_bucket_idx ON gauges_1m (bucket);
+CREATE TABLE IF NOT EXISTS gauges_1h (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value double precision NOT NULL,
+    max_value double precision NOT NULL,
+    sum_value double precision NOT NULL,
+    value_count bigint NOT NULL,
+    last_value double precision NOT NULL,
+    last_timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (metric_id, metric_labels, bucket));
+CREATE INDEX IF NOT EXISTS gauges_1h_bucket_idx ON gauges_1h (bucket);
+CREATE TABLE IF NOT EXISTS counters_1m (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value double precision NOT NULL,
+    max_value double precision NOT NULL,
+    sum_value double precision NOT NULL,
+    value_count bigint NOT NULL,
+    last_value double precision NOT NULL,
+    last_timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (metric_id, metric_labels, bucket));
+CREATE INDEX IF NOT EXISTS counters_1m_bucket_idx ON counters_1m (bucket);
+CREATE TABLE IF NOT EXISTS counters_1h (
+    metric_id TEXT NOT NULL,
+    metric_labels TEXT NOT NULL DEFAULT '',
+    bucket TIMESTAMPTZ NOT NULL,
+    min_value double precision NOT NULL,
+    max_value double precision NOT NULL,
+    sum_value double precision NOT NULL,
+    value_count bigint NOT NULL,
+    last_value double precision NOT NULL,
+    last_timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (metric_id, metric_labels, bucket));
+CREATE INDEX IF NOT EXISTS counters_1h_bucket_idx ON counters_1h (bucket);
+CREATE INDEX IF NOT EXISTS gauges_time_idx ON gauges (metric_timestamp);
+CREATE INDEX IF NOT EXISTS counters_time_idx ON counters (metric_timestamp);
+CREATE INDEX IF NOT EXISTS histograms_time_idx ON histograms (metric_timestamp);
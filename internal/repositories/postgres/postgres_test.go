@@ -0,0 +1,75 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestPostgresRepository_AddCounter(t *testing.T) {
+	upsertCounter := regexp.QuoteMeta(`INSERT INTO counter_values (metric_id, metric_labels, metric_delta, metric_timestamp) VALUES ($1, $2, $3, $4)`) +
+		`.*` + regexp.QuoteMeta(`metric_delta = counter_values.metric_delta + EXCLUDED.metric_delta`)
+	insertHistory := regexp.QuoteMeta(`INSERT INTO counters (metric_id, metric_labels, metric_delta, metric_timestamp) VALUES ($1, $2, $3, $4);`)
+
+	tests := []struct {
+		name       string
+		history    bool
+		metricName string
+		delta      int64
+		wantID     string
+		wantLabels string
+		total      int64 // value of the counter after the upsert
+		historyErr error
+		wantErr    bool
+	}{
+		{name: `increment without history`, metricName: `PollCount`, delta: 5, wantID: `PollCount`, total: 15},
+		{name: `increment with history`, history: true, metricName: `PollCount`, delta: 5, wantID: `PollCount`, total: 15},
+		{name: `labeled series with history`, history: true, metricName: `requests{code="200",method="GET"}`, delta: 1,
+			wantID: `requests`, wantLabels: `code="200",method="GET"`, total: 1},
+		{name: `history insert failed`, history: true, metricName: `PollCount`, delta: 5, wantID: `PollCount`, total: 15,
+			historyErr: errors.New("relation \"counters\" does not exist"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+			if err != nil {
+				t.Fatalf("sqlmock.New() error = %v", err)
+			}
+			defer db.Close()
+			pr := &PostgresRepository{db: db, history: tt.history}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(upsertCounter).
+				WithArgs(tt.wantID, tt.wantLabels, tt.delta, sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{`metric_delta`}).AddRow(tt.total))
+			if tt.history {
+				// the history gets the new value of the counter, not the delta
+				exec := mock.ExpectExec(insertHistory).WithArgs(tt.wantID, tt.wantLabels, tt.total, sqlmock.AnyArg())
+				if tt.historyErr != nil {
+					exec.WillReturnError(tt.historyErr)
+				} else {
+					exec.WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			if tt.wantErr {
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectCommit()
+			}
+
+			err = pr.AddCounter(context.Background(), tt.metricName, tt.delta)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AddCounter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.historyErr != nil && !errors.Is(err, tt.historyErr) {
+				t.Errorf("AddCounter() error = %v, want %v", err, tt.historyErr)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
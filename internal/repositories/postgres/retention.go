@@ -0,0 +1,207 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// historyTable describes the raw history table of one metric type and its rollup tables
+type historyTable struct {
+	mType  string // type of metrics
+	raw    string // table with raw values
+	value  string // column with the value
+	minute string // table with 1-minute rollups
+	hour   string // table with 1-hour rollups
+	rollup string // value of the rollup returned by the history API: average for gauges, last accumulated value for counters
+}
+
+var historyTables = []historyTable{
+	{mType: gauge, raw: `gauges`, value: `metric_value`, minute: `gauges_1m`, hour: `gauges_1h`, rollup: `sum_value / value_count`},
+	{mType: counter, raw: `counters`, value: `metric_delta`, minute: `counters_1m`, hour: `counters_1h`, rollup: `last_value`},
+}
+
+/*
+historyQuery builds the query, which reads raw values and rollups of one series in the interval.
+Raw values and rollups never overlap, because rows are moved between tables
+
+Args:
+
+	t historyTable: tables of the metric type
+
+Returns:
+
+	string: query with parameters $1 - metric id, $2 - labels, $3 - from, $4 - to
+*/
+func historyQuery(t historyTable) string {
+	return fmt.Sprintf(`SELECT ts, v FROM (
+	SELECT metric_timestamp AS ts, %[2]s::double precision AS v FROM %[1]s
+		WHERE metric_id = $1 AND metric_labels = $2 AND metric_timestamp >= $3 AND metric_timestamp < $4
+	UNION ALL
+	SELECT bucket, %[5]s FROM %[3]s WHERE metric_id = $1 AND metric_labels = $2 AND bucket >= $3 AND bucket < $4
+	UNION ALL
+	SELECT bucket, %[5]s FROM %[4]s WHERE metric_id = $1 AND metric_labels = $2 AND bucket >= $3 AND bucket < $4
+) h ORDER BY ts;`, t.raw, t.value, t.minute, t.hour, t.rollup)
+}
+
+// rollupConflict merges the new rollup row into the existing row of the same bucket
+const rollupConflict = `ON CONFLICT (metric_id, metric_labels, bucket) DO UPDATE SET
+	min_value = LEAST(%[1]s.min_value, EXCLUDED.min_value),
+	max_value = GREATEST(%[1]s.max_value, EXCLUDED.max_value),
+	sum_value = %[1]s.sum_value + EXCLUDED.sum_value,
+	value_count = %[1]s.value_count + EXCLUDED.value_count,
+	last_value = CASE WHEN EXCLUDED.last_timestamp >= %[1]s.last_timestamp THEN EXCLUDED.last_value ELSE %[1]s.last_value END,
+	last_timestamp = GREATEST(%[1]s.last_timestamp, EXCLUDED.last_timestamp)`
+
+/*
+rawRollupQuery builds the query, which moves a batch of raw values older than $1 into 1-minute rollups.
+Deleting and inserting are done by one statement, so values are never lost or counted twice
+
+Args:
+
+	t historyTable: tables of the metric type
+
+Returns:
+
+	string: query with parameters $1 - cutoff time, $2 - batch size, returning the number of moved rows
+*/
+func rawRollupQuery(t historyTable) string {
+	return fmt.Sprintf(`WITH moved AS (
+	DELETE FROM %[1]s WHERE ctid IN (SELECT ctid FROM %[1]s WHERE metric_timestamp < $1 ORDER BY metric_timestamp LIMIT $2)
+	RETURNING metric_id, metric_labels, %[2]s::double precision AS v, metric_timestamp AS ts
+), inserted AS (
+	INSERT INTO %[3]s (metric_id, metric_labels, bucket, min_value, max_value, sum_value, value_count, last_value, last_timestamp)
+	SELECT metric_id, metric_labels, date_trunc('minute', ts), min(v), max(v), sum(v), count(*),
+		(array_agg(v ORDER BY ts DESC))[1], max(ts)
+	FROM moved GROUP BY metric_id, metric_labels, date_trunc('minute', ts)
+	%[4]s
+)
+SELECT count(*) FROM moved;`, t.raw, t.value, t.minute, fmt.Sprintf(rollupConflict, t.minute))
+}
+
+/*
+minuteRollupQuery builds the query, which moves a batch of 1-minute rollups older than $1 into 1-hour rollups
+
+Args:
+
+	t historyTable: tables of the metric type
+
+Returns:
+
+	string: query with parameters $1 - cutoff time, $2 - batch size, returning the number of moved rows
+*/
+func minuteRollupQuery(t historyTable) string {
+	return fmt.Sprintf(`WITH moved AS (
+	DELETE FROM %[1]s WHERE ctid IN (SELECT ctid FROM %[1]s WHERE bucket < $1 ORDER BY bucket LIMIT $2)
+	RETURNING *
+), inserted AS (
+	INSERT INTO %[2]s (metric_id, metric_labels, bucket, min_value, max_value, sum_value, value_count, last_value, last_timestamp)
+	SELECT metric_id, metric_labels, date_trunc('hour', bucket), min(min_value), max(max_value), sum(sum_value), sum(value_count),
+		(array_agg(last_value ORDER BY last_timestamp DESC))[1], max(last_timestamp)
+	FROM moved GROUP BY metric_id, metric_labels, date_trunc('hour', bucket)
+	%[3]s
+)
+SELECT count(*) FROM moved;`, t.minute, t.hour, fmt.Sprintf(rollupConflict, t.hour))
+}
+
+/*
+expireQuery builds the query, which deletes a batch of rows older than $1
+
+Args:
+
+	table string: name of the table
+	column string: column with the time of the row
+
+Returns:
+
+	string: query with parameters $1 - cutoff time, $2 - batch size
+*/
+func expireQuery(table, column string) string {
+	return fmt.Sprintf(`DELETE FROM %[1]s WHERE ctid IN (SELECT ctid FROM %[1]s WHERE %[2]s < $1 ORDER BY %[2]s LIMIT $2);`, table, column)
+}
+
+/*
+runBatches executes the batch query until it processes less rows than the batch size
+
+Args:
+
+	ctx context.Context: batches stop, when the context is cancelled
+	query string: query with parameters $1 - cutoff time, $2 - batch size
+	counted bool: the query returns the number of rows, otherwise rows affected are used
+	cutoff time.Time: rows older than cutoff are processed
+	batch int: batch size
+
+Returns:
+
+	int64: number of processed rows
+	error
+*/
+func (pr *PostgresRepository) runBatches(ctx context.Context, query string, counted bool, cutoff time.Time, batch int) (int64, error) {
+	var total int64
+	for ctx.Err() == nil {
+		var n int64
+		if counted {
+			if err := pr.db.QueryRowContext(ctx, query, cutoff, batch).Scan(&n); err != nil {
+				return total, err
+			}
+		} else {
+			res, err := pr.db.ExecContext(ctx, query, cutoff, batch)
+			if err != nil {
+				return total, err
+			}
+			if n, err = res.RowsAffected(); err != nil {
+				return total, err
+			}
+		}
+		total += n
+		if n < int64(batch) {
+			return total, nil
+		}
+	}
+	return total, ctx.Err()
+}
+
+/*
+ApplyRetention compacts old raw values of gauges and counters into 1-minute rollups, old 1-minute rollups into
+1-hour rollups and deletes expired 1-hour rollups and raw histograms. Rows are processed in bounded batches,
+every batch is a separate statement, so the job can be interrupted at any moment
+
+Args:
+
+	ctx context.Context
+	policy models.RetentionPolicy: retention periods and batch size
+	now time.Time: current time
+
+Returns:
+
+	models.RetentionStats: number of processed rows
+	error: nil or error of the first failed batch
+*/
+func (pr *PostgresRepository) ApplyRetention(ctx context.Context, policy models.RetentionPolicy, now time.Time) (models.RetentionStats, error) {
+	var stats models.RetentionStats
+	for _, t := range historyTables {
+		n, err := pr.runBatches(ctx, rawRollupQuery(t), true, now.Add(-policy.Raw), policy.BatchSize)
+		stats.RolledUpMinute += n
+		if err != nil {
+			return stats, fmt.Errorf("cannot roll up %s: %w", t.raw, err)
+		}
+		n, err = pr.runBatches(ctx, minuteRollupQuery(t), true, now.Add(-policy.Minute), policy.BatchSize)
+		stats.RolledUpHour += n
+		if err != nil {
+			return stats, fmt.Errorf("cannot roll up %s: %w", t.minute, err)
+		}
+		n, err = pr.runBatches(ctx, expireQuery(t.hour, `bucket`), false, now.Add(-policy.Hour), policy.BatchSize)
+		stats.Expired += n
+		if err != nil {
+			return stats, fmt.Errorf("cannot expire %s: %w", t.hour, err)
+		}
+	}
+	n, err := pr.runBatches(ctx, expireQuery(`histograms`, `metric_timestamp`), false, now.Add(-policy.Raw), policy.BatchSize)
+	stats.Expired += n
+	if err != nil {
+		return stats, fmt.Errorf("cannot expire histograms: %w", err)
+	}
+	return stats, nil
+}
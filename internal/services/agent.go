@@ -2,21 +2,46 @@ package services
 
 import (
 	"bytes"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"os"
 	"runtime"
 	"sync"
 	"time"
 
 	"github.com/itaraxa/effectivepancake/internal/config"
+	"github.com/itaraxa/effectivepancake/internal/encryption"
 	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
 	"github.com/itaraxa/effectivepancake/internal/models"
+	pb "github.com/itaraxa/effectivepancake/internal/proto"
 )
 
+/*
+checkResponseStatus reports the answer of the server with a non-2xx status as an error,
+so the snapshot isn't counted as delivered
+
+Args:
+
+	resp *http.Response: answer of the server
+
+Returns:
+
+	error: nil or myErrors.ErrServerStatus
+*/
+func checkResponseStatus(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %s", myErrors.ErrServerStatus, resp.Status)
+	}
+	return nil
+}
+
 /*
 sendMetricsToServerQueryStr send metrica data to server via http. Data included into request string
 
@@ -25,12 +50,13 @@ Args:
 	ms MetricsGetter: pointer to object implemented MetricsGetter interface
 	serverURL string: endpoint of server
 	client *http.Client: pointer to httpClient object, which uses for connection to server
+	key string: key for signing request body, if empty - request isn't signed
 
 Returns:
 
 	error: nil or error, encountered during sending data
 */
-func sendMetricsToServerQueryStr(l logger, ms MetricsGetter, serverURL string, client *http.Client) error {
+func sendMetricsToServerQueryStr(l logger, ms MetricsGetter, serverURL string, client *http.Client, key string) error {
 	mData := ms.GetData()
 	if len(mData) == 0 {
 		return myErrors.ErrNoMetrics
@@ -39,18 +65,28 @@ func sendMetricsToServerQueryStr(l logger, ms MetricsGetter, serverURL string, c
 		queryString := ""
 		if m.MType == "gauge" {
 			// queryString = fmt.Sprintf("http://%s/update/%s/%s/%f", serverURL, m.MType, m.ID, *m.Value)
-			queryString = createURL(serverURL, m.MType, m.ID, fmt.Sprint(*m.Value))
+			queryString = createURL(serverURL, `update`, m.MType, m.ID, fmt.Sprint(*m.Value))
 		} else if m.MType == "counter" {
 			// queryString = fmt.Sprintf("http://%s/update/%s/%s/%d", serverURL, m.MType, m.ID, *m.Delta)
-			queryString = createURL(serverURL, m.MType, m.ID, fmt.Sprint(*m.Delta))
+			queryString = createURL(serverURL, `update`, m.MType, m.ID, fmt.Sprint(*m.Delta))
+		}
+		if len(m.Labels) > 0 {
+			labels := url.Values{}
+			for k, v := range m.Labels {
+				labels.Set(k, v)
+			}
+			queryString += `?` + labels.Encode()
 		}
 		l.Debug("query string", "string", queryString)
 		req, err := http.NewRequest(`POST`, queryString, nil)
-		req.Header.Set("Content-Type", "text/plain")
 		if err != nil {
 			l.Error("cannot create request", "error", err.Error())
 			return err
 		}
+		req.Header.Set("Content-Type", "text/plain")
+		if key != "" {
+			req.Header.Set(HashHeader, SignSHA256(nil, key))
+		}
 		resp, err := retryRequest(func() (*http.Response, error) { return client.Do(req) })
 		if err != nil {
 			return errors.Join(myErrors.ErrSendingMetricsToServer, err)
@@ -61,6 +97,9 @@ func sendMetricsToServerQueryStr(l logger, ms MetricsGetter, serverURL string, c
 		if err != nil {
 			return err
 		}
+		if err = checkResponseStatus(resp); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -75,12 +114,13 @@ Args:
 	ms MetricsGetter: pointer to object implemented MetricsGetter interface
 	serverURL string: endpoint of server
 	client *http.Client: pointer to httpClient object, which uses for connection to server
+	key string: key for signing request body, if empty - request isn't signed
 
 Returns:
 
 	error: nil or error, encountered during sending data
 */
-func sendMetricaToServerJSON(l logger, ms MetricsGetter, serverURL string, client *http.Client) error {
+func sendMetricaToServerJSON(l logger, ms MetricsGetter, serverURL string, client *http.Client, key string) error {
 	mData := ms.GetData()
 	if len(mData) == 0 {
 		return myErrors.ErrNoMetrics
@@ -95,11 +135,14 @@ func sendMetricaToServerJSON(l logger, ms MetricsGetter, serverURL string, clien
 		// req, err := http.NewRequest(`POST`, fmt.Sprintf("http://%s/update/", serverURL), bytes.NewBuffer(jsonDataReq))
 		req, err := http.NewRequest(`POST`, createURL(serverURL, `update/`), bytes.NewBuffer(jsonDataReq))
 		l.Debug("query string", "string", createURL(serverURL, `update/`))
-		req.Header.Set("Content-Type", "application/json")
 		if err != nil {
 			l.Error("cannot create request", "error", err.Error())
 			return err
 		}
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(HashHeader, SignSHA256(jsonDataReq, key))
+		}
 		resp, err := retryRequest(func() (*http.Response, error) { return client.Do(req) })
 		if err != nil {
 			return errors.Join(myErrors.ErrSendingMetricsToServer, err)
@@ -112,11 +155,30 @@ func sendMetricaToServerJSON(l logger, ms MetricsGetter, serverURL string, clien
 		}
 		l.Info("json data from responce", "string representation", buf.String())
 		resp.Body.Close()
+		if err = checkResponseStatus(resp); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func sendMetricaToServerBatch(l logger, ms MetricsGetter, serverURL string, client *http.Client) error {
+/*
+sendMetricaToServerBatch send all metrics to server via http POST method in one request. Data included into request body in JSON
+
+Args:
+
+	l logger: implementation of logger-interface
+	ms MetricsGetter: pointer to object implemented MetricsGetter interface
+	serverURL string: endpoint of server
+	client *http.Client: pointer to httpClient object, which uses for connection to server
+	key string: key for signing request body, if empty - request isn't signed
+	publicKey *rsa.PublicKey: server public key for encrypting request body, if nil - request isn't encrypted
+
+Returns:
+
+	error: nil or error, encountered during sending data
+*/
+func sendMetricaToServerBatch(l logger, ms MetricsGetter, serverURL string, client *http.Client, key string, publicKey *rsa.PublicKey) error {
 	mData := ms.GetData()
 	if len(mData) == 0 {
 		return myErrors.ErrNoMetrics
@@ -126,14 +188,31 @@ func sendMetricaToServerBatch(l logger, ms MetricsGetter, serverURL string, clie
 		return err
 	}
 	l.Debug("json data for send", "string representation", string(jsonDataReq))
+	body := jsonDataReq
+	if publicKey != nil {
+		body, err = encryption.Encrypt(publicKey, jsonDataReq)
+		if err != nil {
+			l.Error("cannot encrypt data", "error", err.Error())
+			return err
+		}
+	}
 	// req, err := http.NewRequest(`POST`, fmt.Sprintf("http://%s/updates/", serverURL), bytes.NewBuffer(jsonDataReq))
-	req, err := http.NewRequest(`POST`, createURL(serverURL, `updates/`), bytes.NewBuffer(jsonDataReq))
+	req, err := http.NewRequest(`POST`, createURL(serverURL, `updates/`), bytes.NewBuffer(body))
 	l.Debug("query string", "string", createURL(serverURL, `updates/`))
-	req.Header.Set("Content-Type", "application/json")
 	if err != nil {
 		l.Error("cannot create request", "error", err.Error())
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(HashHeader, SignSHA256(jsonDataReq, key))
+	}
+	if id := ms.GetSnapshotID(); id != "" {
+		req.Header.Set(IdempotencyHeader, id)
+	}
+	if publicKey != nil {
+		req.Header.Set(encryption.EncryptionHeader, encryption.EncryptionScheme)
+	}
 	resp, err := retryRequest(func() (*http.Response, error) { return client.Do(req) })
 	if err != nil {
 		return errors.Join(myErrors.ErrSendingMetricsToServer, err)
@@ -147,7 +226,7 @@ func sendMetricaToServerBatch(l logger, ms MetricsGetter, serverURL string, clie
 	l.Info("json data from responce", "string representation", buf.String())
 	resp.Body.Close()
 
-	return nil
+	return checkResponseStatus(resp)
 }
 
 /*
@@ -160,12 +239,13 @@ Args:
 	ms MetricsGetter: pointer to object implemented MetricsGetter interface
 	serverURL string: endpoint of server
 	client *http.Client: pointer to httpClient object, which uses for connection to server
+	key string: key for signing request body, if empty - request isn't signed
 
 Returns:
 
 	error: nil or error, encountered during sending data
 */
-func sendMetricaToServerJSONgzip(l logger, ms MetricsGetter, serverURL string, client *http.Client) error {
+func sendMetricaToServerJSONgzip(l logger, ms MetricsGetter, serverURL string, client *http.Client, key string) error {
 	mData := ms.GetData()
 	if len(mData) == 0 {
 		return myErrors.ErrNoMetrics
@@ -184,13 +264,16 @@ func sendMetricaToServerJSONgzip(l logger, ms MetricsGetter, serverURL string, c
 		// req, err := http.NewRequest(`POST`, fmt.Sprintf("http://%s/update/", serverURL), bytes.NewBuffer(jsonGzipDataReq))
 		req, err := http.NewRequest(`POST`, createURL(serverURL, `update/`), bytes.NewBuffer(jsonGzipDataReq))
 		l.Debug("query string", "string", createURL(serverURL, `update/`))
-		req.Header.Set("Accept-Encoding", "gzip")
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Content-Encoding", "gzip")
 		if err != nil {
 			l.Error("cannot create request", "error", err.Error())
 			return err
 		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		if key != "" {
+			req.Header.Set(HashHeader, SignSHA256(jsonDataReq, key))
+		}
 
 		start := time.Now()
 		resp, err := retryRequest(func() (*http.Response, error) { return client.Do(req) })
@@ -224,13 +307,31 @@ func sendMetricaToServerJSONgzip(l logger, ms MetricsGetter, serverURL string, c
 			}
 			l.Info("json data from responce", "string representation", buf.String(), "duration", time.Since(start))
 		default:
-			l.Info("received a response with an error code", "status code", resp.StatusCode, "duration", time.Since(start))
+			l.Error("received a response with an error code", "status code", resp.StatusCode, "duration", time.Since(start))
+			return checkResponseStatus(resp)
 		}
 	}
 	return nil
 }
 
-func sendMetricaToServerBatchgzip(l logger, ms MetricsGetter, serverURL string, client *http.Client) error {
+/*
+sendMetricaToServerBatchgzip send all metrics to server via http POST method in one request. Data included into request body in compressed JSON.
+If the server public key is set, the compressed data is encrypted with it
+
+Args:
+
+	l logger: implementation of logger-interface
+	ms MetricsGetter: pointer to object implemented MetricsGetter interface
+	serverURL string: endpoint of server
+	client *http.Client: pointer to httpClient object, which uses for connection to server
+	key string: key for signing request body, if empty - request isn't signed
+	publicKey *rsa.PublicKey: server public key for encrypting request body, if nil - request isn't encrypted
+
+Returns:
+
+	error: nil or error, encountered during sending data
+*/
+func sendMetricaToServerBatchgzip(l logger, ms MetricsGetter, serverURL string, client *http.Client, key string, publicKey *rsa.PublicKey) error {
 	mData := ms.GetData()
 	if len(mData) == 0 {
 		l.Error("no metrics for sending")
@@ -247,17 +348,33 @@ func sendMetricaToServerBatchgzip(l logger, ms MetricsGetter, serverURL string,
 		return err
 	}
 	l.Debug("json data for send compressd", "string representation", string(jsonDataReq), "compress ratio", float64(len(jsonDataReq))/float64(len(jsonGzipDataReq)))
+	if publicKey != nil {
+		jsonGzipDataReq, err = encryption.Encrypt(publicKey, jsonGzipDataReq)
+		if err != nil {
+			l.Error("cannot encrypt data", "error", err.Error())
+			return err
+		}
+	}
 
 	// req, err := http.NewRequest(`POST`, fmt.Sprintf("http://%s/updates/", serverURL), bytes.NewBuffer(jsonGzipDataReq))
 	req, err := http.NewRequest(`POST`, createURL(serverURL, `updates/`), bytes.NewBuffer(jsonGzipDataReq))
 	l.Debug("query string", "string", createURL(serverURL, `updates/`))
-	req.Header.Set("Accept-Encoding", "gzip")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Encoding", "gzip")
 	if err != nil {
 		l.Error("cannot create request", "error", err.Error())
 		return err
 	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if key != "" {
+		req.Header.Set(HashHeader, SignSHA256(jsonDataReq, key))
+	}
+	if id := ms.GetSnapshotID(); id != "" {
+		req.Header.Set(IdempotencyHeader, id)
+	}
+	if publicKey != nil {
+		req.Header.Set(encryption.EncryptionHeader, encryption.EncryptionScheme)
+	}
 
 	start := time.Now()
 	resp, err := retryRequest(func() (*http.Response, error) { return client.Do(req) })
@@ -291,26 +408,79 @@ func sendMetricaToServerBatchgzip(l logger, ms MetricsGetter, serverURL string,
 		}
 		l.Info("json data from responce", "string representation", buf.String(), "duration", time.Since(start))
 	default:
-		l.Info("received a response with an error code", "status code", resp.StatusCode, "duration", time.Since(start))
+		l.Error("received a response with an error code", "status code", resp.StatusCode, "duration", time.Since(start))
+		return checkResponseStatus(resp)
 	}
 
 	return nil
 }
 
+/*
+AgentID returns the identifier, which the agent sends in the X-Agent-ID header:
+the configured agent id or the hostname
+
+Args:
+
+	conf *config.AgentConfig: pointer to config instance
+
+Returns:
+
+	string: identifier of the agent, empty if the hostname is unknown
+*/
+func AgentID(conf *config.AgentConfig) string {
+	if conf.InstanceID != "" {
+		return conf.InstanceID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+/*
+InstanceLabels returns the identity of the agent instance, that is attached to every reported metric:
+the "host" label with the hostname, the "instance" label with the configured agent id and extra tags from config.
+Tags take precedence over the host and instance labels
+
+Args:
+
+	l logger: a logger used for printing messages
+	conf *config.AgentConfig: pointer to config instance
+
+Returns:
+
+	map[string]string: labels of the agent instance
+*/
+func InstanceLabels(l logger, conf *config.AgentConfig) map[string]string {
+	labels := make(map[string]string, len(conf.Tags)+2)
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		labels[`host`] = hostname
+	} else if err != nil {
+		l.Error("cannot get hostname", "error", err.Error())
+	}
+	if conf.InstanceID != "" {
+		labels[`instance`] = conf.InstanceID
+	}
+	for k, v := range conf.Tags {
+		labels[k] = v
+	}
+	return labels
+}
+
 /*
 Collecting metrics. This function agregates and executes all ways for collecting metrica
 
 Args:
 
 	pollCount uint64: count for writing to PollCount metrica
+	labels map[string]string: identity of the agent instance, attached to every metric
 
 Returns:
 
 	*models.Metrica: pointer to models.Metrics structure, which store metrica data on Agent
 	error: nil
 */
-func collectMetrics(pollCount int64) (MetricsAddGetter, error) {
-	jms := &models.JSONMetrics{}
+func collectMetrics(pollCount int64, labels map[string]string) (MetricsAddGetter, error) {
+	jms := models.NewJSONMetrics(labels)
+	jms.SnapshotID = newSnapshotID()
 
 	err := jms.AddPollCount(pollCount)
 	if err != nil {
@@ -458,117 +628,251 @@ func collectOtherMetrics() []models.JSONMetric {
 }
 
 /*
-Function for periodically collecting all metrics
+putSnapshot passes collected metrics into the channel for the reporter. If the channel is full, the metrics
+are written to the spool, without the spool it blocks until the context is cancelled
+
+Args:
+
+	ctx context.Context: context of the agent
+	l logger: a logger used for printing messages
+	dataChan chan MetricsAddGetter: channel for exchanging metric data
+	spool *Spool: pointer to the spool, nil - spool disabled
+	ms MetricsAddGetter: collected metrics
+
+Returns:
+
+	bool: false if the context was cancelled before the metrics were passed
+*/
+func putSnapshot(ctx context.Context, l logger, dataChan chan MetricsAddGetter, spool *Spool, ms MetricsAddGetter) bool {
+	if len(dataChan) == cap(dataChan) {
+		l.Error("Error internal commnication", "error", myErrors.ErrChannelFull.Error())
+		if spool != nil {
+			err := spool.Put(l, ms)
+			if err == nil {
+				return true
+			}
+			l.Error("cannot spool snapshot", "error", err.Error())
+		}
+	}
+	select {
+	case dataChan <- ms:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/*
+Function for periodically collecting all metrics. Stops when the context is cancelled
 
 Args:
 
+	ctx context.Context: context of the agent, cancelling stops polling
 	wg *sync.WaitGroup: pointer to sync.WaitGroup for for controlling the completion of a function in a goroutine
-	controlChan chan bool: channel for receiving a stop signal
-	dataChan chan Metricer: channel for exchanging metric data
+	dataChan chan MetricsAddGetter: channel for exchanging metric data
+	spool *Spool: pointer to the spool for metrics, that don't fit into dataChan, nil - spool disabled
 	l logger.Logger: pointer to logger instance
-	pollInterval time.Duration
+	config *config.AgentConfig: pointer to config instance
 
 Returns:
 
 	None
 */
-func PollMetrics(wg *sync.WaitGroup, controlChan chan bool, dataChan chan MetricsAddGetter, l logger, config *config.AgentConfig) {
+func PollMetrics(ctx context.Context, wg *sync.WaitGroup, dataChan chan MetricsAddGetter, spool *Spool, l logger, config *config.AgentConfig) {
 	defer wg.Done()
+	defer l.Info("Polling metrica stopped")
 	var pollCounter int64 = 0
-POLLING:
+	labels := InstanceLabels(l, config)
+	l.Info("Agent instance labels", "labels", models.FormatLabels(labels))
+	ticker := time.NewTicker(config.PollInterval)
+	defer ticker.Stop()
 	for {
-		controlChan <- false
-
 		l.Info("Poll counter", "Value", pollCounter)
-		ms, err := collectMetrics(pollCounter)
+		ms, err := collectMetrics(pollCounter, labels)
 		if err != nil {
 			l.Error("Error collect metrics")
 		}
-		if len(dataChan) == cap(dataChan) {
-			l.Error("Error internal commnication", "error", myErrors.ErrChannelFull.Error())
+		if !putSnapshot(ctx, l, dataChan, spool, ms) {
+			return
 		}
-		dataChan <- ms
 		pollCounter += 1
-		time.Sleep(config.PollInterval)
 
-		if <-controlChan {
-			l.Info("Polling metrica stopped")
-			break POLLING
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
 /*
-Function for periodically sending metrics
+ReplaysSafely reports, whether every snapshot is sent with the idempotency key, so the spool can replay it
+without adding counters twice. Batches and the grpc transport carry the key, single metrics of raw and json modes don't
+
+Args:
+
+	conf *config.AgentConfig: pointer to config instance
+
+Returns:
+
+	bool: true if snapshots can be spooled and replayed
+*/
+func ReplaysSafely(conf *config.AgentConfig) bool {
+	return conf.Batch || conf.Transport == `grpc`
+}
+
+/*
+newSender chooses the function for sending metrics to the server according to the agent config
 
 Args:
 
+	conf *config.AgentConfig: pointer to config instance
+	client *http.Client: pointer to http client instance
+	publicKey *rsa.PublicKey: server public key for encrypting data, nil - encryption disabled
+
+Returns:
+
+	sender: function for sending one snapshot of metrics, nil if the config has unknown combination of report mode and compression
+*/
+func newSender(conf *config.AgentConfig, client *http.Client, publicKey *rsa.PublicKey) sender {
+	switch {
+	case conf.ReportMode == `json` && conf.Compress == `gzip` && !conf.Batch:
+		return func(l logger, ms MetricsGetter) error {
+			if err := sendMetricaToServerJSONgzip(l, ms, conf.AddressServer, client, conf.Key); err != nil {
+				return fmt.Errorf("sending gzipped json metrica: %w", err)
+			}
+			return nil
+		}
+	case conf.ReportMode == `json` && conf.Compress == `none` && !conf.Batch:
+		return func(l logger, ms MetricsGetter) error {
+			if err := sendMetricaToServerJSON(l, ms, conf.AddressServer, client, conf.Key); err != nil {
+				return fmt.Errorf("sending nongzipped json metrica: %w", err)
+			}
+			return nil
+		}
+	case conf.ReportMode == `raw` && !conf.Batch:
+		return func(l logger, ms MetricsGetter) error {
+			if err := sendMetricsToServerQueryStr(l, ms, conf.AddressServer, client, conf.Key); err != nil {
+				return fmt.Errorf("sending query string metrica: %w", err)
+			}
+			return nil
+		}
+	case conf.Batch && conf.Compress == `none`:
+		return func(l logger, ms MetricsGetter) error {
+			if err := sendMetricaToServerBatch(l, ms, conf.AddressServer, client, conf.Key, publicKey); err != nil {
+				return fmt.Errorf("sending nongzipped batch of metrics: %w", err)
+			}
+			return nil
+		}
+	case conf.Batch && conf.Compress == `gzip`:
+		return func(l logger, ms MetricsGetter) error {
+			if err := sendMetricaToServerBatchgzip(l, ms, conf.AddressServer, client, conf.Key, publicKey); err != nil {
+				return fmt.Errorf("sending gzipped batch of metrics: %w", err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+/*
+Function for periodically sending metrics. Snapshots of metrics are passed to the fixed pool of
+config.RateLimit workers, so no more than RateLimit requests are sent to the server at the same time.
+When the context is cancelled, the snapshots left in dataChan are sent within config.ShutdownTimeout.
+With the grpc transport metrics are sent to the gRPC server at config.AddressServer instead of the HTTP API.
+If the spool is set, snapshots, that failed to send, are written to it and replayed in order in the background
+
+Args:
+
+	ctx context.Context: context of the agent, cancelling stops reporting
 	wg *sync.WaitGroup: pointer to sync.WaitGroup for for controlling the completion of a function in a goroutine
-	controlChan chan bool: channel for receiving a stop signal
-	dataChan chan Metricer: channel for exchanging metric data
+	dataChan chan MetricsAddGetter: channel for exchanging metric data
+	spool *Spool: pointer to the spool, nil - spool disabled
 	l logger.Logger: pointer to logger instance
 	config *config.AgentConfig: pointer to config instance
 	client *http.Client: pointer to http client instance
+	publicKey *rsa.PublicKey: server public key for encrypting data, nil - encryption disabled
 
 Returns:
 
 	None
 */
-func ReportMetrics(wg *sync.WaitGroup, controlChan chan bool, dataChan chan MetricsAddGetter, l logger, conf *config.AgentConfig, client *http.Client) {
+func ReportMetrics(ctx context.Context, wg *sync.WaitGroup, dataChan chan MetricsAddGetter, spool *Spool, l logger, conf *config.AgentConfig, client *http.Client, publicKey *rsa.PublicKey) {
 	defer wg.Done()
+
+	send := newSender(conf, client, publicKey)
+	if conf.Transport == `grpc` {
+		conn, err := NewGRPCConn(conf)
+		if err != nil {
+			l.Error("cannot create gRPC connection", "server", conf.AddressServer, "error", err.Error())
+			return
+		}
+		defer conn.Close()
+		send = newGRPCSender(conf, pb.NewMetricsClient(conn))
+	}
+	if send == nil {
+		l.Error("unknown report mode", "report mode", conf.ReportMode, "compress", conf.Compress, "batch", conf.Batch)
+		send = func(l logger, ms MetricsGetter) error { return myErrors.ErrUnknownReportMode }
+	}
+	if spool != nil {
+		var drainerWG sync.WaitGroup
+		drainerWG.Add(1)
+		go DrainSpool(ctx, &drainerWG, spool, l, send, conf.ReportInterval)
+		defer drainerWG.Wait()
+		send = spooledSender(spool, send)
+	}
+	workers := max(conf.RateLimit, 1)
+	jobs := make(chan MetricsGetter, workers)
+	var workersWG sync.WaitGroup
+	StartReportWorkers(&workersWG, workers, jobs, l, send)
+
+	ticker := time.NewTicker(conf.ReportInterval)
+	defer ticker.Stop()
 	var reportCounter uint64 = 0
-REPORTING:
 	for {
-		controlChan <- false
-
-		time.Sleep(conf.ReportInterval)
-		for len(dataChan) > 0 {
+		select {
+		case <-ctx.Done():
+			l.Info("Reporting metrica stopped")
+			flushReports(l, dataChan, jobs, &workersWG, conf.ShutdownTimeout)
+			return
+		case <-ticker.C:
 			l.Info("Report counter", "Value", reportCounter)
-			switch {
-			case conf.ReportMode == `json` && conf.Compress == `gzip` && !conf.Batch:
-				go func(l logger, dataChan chan MetricsAddGetter, config *config.AgentConfig, client *http.Client) {
-					err := sendMetricaToServerJSONgzip(l, <-dataChan, config.AddressServer, client)
-					if err != nil {
-						l.Error("sending gzipped json metrica", "error", err.Error())
-					}
-				}(l, dataChan, conf, client)
-			case conf.ReportMode == `json` && conf.Compress == `none` && !conf.Batch:
-				go func(l logger, dataChan chan MetricsAddGetter, config *config.AgentConfig, client *http.Client) {
-					err := sendMetricaToServerJSON(l, <-dataChan, config.AddressServer, client)
-					if err != nil {
-						l.Error("sending nongzipped json metrica", "error", err.Error())
-					}
-				}(l, dataChan, conf, client)
-			case conf.ReportMode == `raw` && !conf.Batch:
-				go func(l logger, dataChan chan MetricsAddGetter, config *config.AgentConfig, client *http.Client) {
-					err := sendMetricsToServerQueryStr(l, <-dataChan, config.AddressServer, client)
-					if err != nil {
-						l.Error("sending query string metrica", "error", err.Error())
-					}
-				}(l, dataChan, conf, client)
-
-			case conf.Batch && conf.Compress == `none`:
-				go func(l logger, dataChan chan MetricsAddGetter, config *config.AgentConfig, client *http.Client) {
-					err := sendMetricaToServerBatch(l, <-dataChan, config.AddressServer, client)
-					if err != nil {
-						l.Error("sending nongzipped batch of metrics", "error", err.Error())
-					}
-				}(l, dataChan, conf, client)
-
-			case conf.Batch && conf.Compress == `gzip`:
-				go func(l logger, dataChan chan MetricsAddGetter, config *config.AgentConfig, client *http.Client) {
-					err := sendMetricaToServerBatchgzip(l, <-dataChan, config.AddressServer, client)
-					if err != nil {
-						l.Error("sending gzipped batch of metrics", "error", err.Error())
-					}
-				}(l, dataChan, conf, client)
+			if !passReports(ctx, dataChan, jobs) {
+				l.Info("Reporting metrica stopped")
+				flushReports(l, dataChan, jobs, &workersWG, conf.ShutdownTimeout)
+				return
 			}
+			reportCounter++
 		}
-		reportCounter++
+	}
+}
 
-		if <-controlChan {
-			l.Info("Reporting metrica stopped")
-			break REPORTING
+/*
+passReports passes the snapshots buffered in dataChan to the workers. Stops waiting for a free worker
+when the context is cancelled, the current snapshot is returned to dataChan for flushing
+
+Args:
+
+	ctx context.Context: context of the agent
+	dataChan chan MetricsAddGetter: channel with buffered snapshots
+	jobs chan<- MetricsGetter: channel of the workers pool
+
+Returns:
+
+	bool: false if the context was cancelled
+*/
+func passReports(ctx context.Context, dataChan chan MetricsAddGetter, jobs chan<- MetricsGetter) bool {
+	for len(dataChan) > 0 {
+		ms := <-dataChan
+		select {
+		case jobs <- ms:
+		case <-ctx.Done():
+			select {
+			case dataChan <- ms:
+			default: // the poller filled the channel, the snapshot is lost
+			}
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	pb "github.com/itaraxa/effectivepancake/internal/proto"
+)
+
+// grpcTimeout is the deadline of one gRPC call of the agent
+const grpcTimeout = 5 * time.Second
+
+/*
+NewGRPCConn creates the connection to the gRPC server of metrics. The connection is established lazily on the first call
+
+Args:
+
+	conf *config.AgentConfig: pointer to config instance, AddressServer is used as the gRPC endpoint
+
+Returns:
+
+	*grpc.ClientConn
+	error: nil or error of parsing the address
+*/
+func NewGRPCConn(conf *config.AgentConfig) (*grpc.ClientConn, error) {
+	return grpc.NewClient(conf.AddressServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+/*
+newGRPCRequest converts the metrics into the signed gRPC request
+
+Args:
+
+	ms MetricsGetter: pointer to object implemented MetricsGetter interface
+	key string: key for signing the request, if empty - request isn't signed
+
+Returns:
+
+	*pb.UpdateMetricsRequest
+	error: nil or error of converting or signing
+*/
+func newGRPCRequest(ms MetricsGetter, key string) (*pb.UpdateMetricsRequest, error) {
+	mData := ms.GetData()
+	if len(mData) == 0 {
+		return nil, myErrors.ErrNoMetrics
+	}
+	req := &pb.UpdateMetricsRequest{SnapshotId: ms.GetSnapshotID()}
+	for _, jm := range mData {
+		m, err := pb.FromJSONMetric(jm)
+		if err != nil {
+			return nil, err
+		}
+		req.Metrics = append(req.Metrics, m)
+	}
+	if key != "" {
+		if err := signGRPCRequest(req, key); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// signGRPCRequest sets the HMAC-SHA256 signature of the request
+func signGRPCRequest(req *pb.UpdateMetricsRequest, key string) error {
+	data, err := req.SignedBytes()
+	if err != nil {
+		return err
+	}
+	req.Hash = SignSHA256(data, key)
+	return nil
+}
+
+/*
+sendMetricsToServerGRPC sends all metrics in one unary call
+
+Args:
+
+	l logger: implementation of logger-interface
+	ms MetricsGetter: pointer to object implemented MetricsGetter interface
+	client pb.MetricsClient: gRPC client of the metrics service
+	key string: key for signing the request, if empty - request isn't signed
+	opts []grpc.CallOption: options of the call, example: compression
+
+Returns:
+
+	error: nil or error, encountered during sending data
+*/
+func sendMetricsToServerGRPC(l logger, ms MetricsGetter, client pb.MetricsClient, key string, opts ...grpc.CallOption) error {
+	req, err := newGRPCRequest(ms, key)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	resp, err := client.UpdateMetrics(ctx, req, opts...)
+	if err != nil {
+		return fmt.Errorf("%w: %v", myErrors.ErrSendingMetricsToServer, err)
+	}
+	l.Info("metrics sent via gRPC", "accepted", resp.GetAccepted(), "replayed", resp.GetReplayed())
+	return nil
+}
+
+/*
+streamMessageID derives the idempotency key of one message of the stream from the snapshot identifier
+
+Args:
+
+	snapshotID string: identifier of the snapshot, empty - check disabled
+	i int: index of the message in the stream
+
+Returns:
+
+	string: "<snapshot>/<index>" or empty string
+*/
+func streamMessageID(snapshotID string, i int) string {
+	if snapshotID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", snapshotID, i)
+}
+
+/*
+sendMetricsToServerGRPCStream sends every metric as a separate message of the client stream. Every message has
+its own idempotency key, derived from the snapshot identifier and the index of the metric, so the server skips
+messages, which were applied before, when the snapshot is retried or replayed from the spool
+
+Args:
+
+	l logger: implementation of logger-interface
+	ms MetricsGetter: pointer to object implemented MetricsGetter interface
+	client pb.MetricsClient: gRPC client of the metrics service
+	key string: key for signing messages, if empty - messages aren't signed
+	opts []grpc.CallOption: options of the call, example: compression
+
+Returns:
+
+	error: nil or error, encountered during sending data
+*/
+func sendMetricsToServerGRPCStream(l logger, ms MetricsGetter, client pb.MetricsClient, key string, opts ...grpc.CallOption) error {
+	batch, err := newGRPCRequest(ms, "")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+	defer cancel()
+	stream, err := client.StreamMetrics(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("%w: %v", myErrors.ErrSendingMetricsToServer, err)
+	}
+	for i, m := range batch.GetMetrics() {
+		req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{m}, SnapshotId: streamMessageID(batch.GetSnapshotId(), i)}
+		if key != "" {
+			if err = signGRPCRequest(req, key); err != nil {
+				return err
+			}
+		}
+		if err = stream.Send(req); err != nil {
+			break
+		}
+	}
+	// the error of Send is io.EOF, if the server aborted the stream, the status is returned by CloseAndRecv
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return fmt.Errorf("%w: %v", myErrors.ErrSendingMetricsToServer, err)
+	}
+	l.Info("metrics streamed via gRPC", "accepted", resp.GetAccepted())
+	return nil
+}
+
+/*
+newGRPCSender chooses the function for sending metrics via gRPC: batch mode uses the unary call,
+otherwise metrics are sent one by one in the client stream
+
+Args:
+
+	conf *config.AgentConfig: pointer to config instance
+	client pb.MetricsClient: gRPC client of the metrics service
+
+Returns:
+
+	sender: function for sending one snapshot of metrics
+*/
+func newGRPCSender(conf *config.AgentConfig, client pb.MetricsClient) sender {
+	var opts []grpc.CallOption
+	if conf.Compress == `gzip` {
+		opts = append(opts, grpc.UseCompressor(gzip.Name))
+	}
+	send := sendMetricsToServerGRPCStream
+	if conf.Batch {
+		send = sendMetricsToServerGRPC
+	}
+	md := []string{strings.ToLower(AgentIDHeader), AgentID(conf)}
+	if ip, err := OutboundIP(conf.AddressServer); err == nil {
+		md = append(md, strings.ToLower(RealIPHeader), ip)
+	}
+	return func(l logger, ms MetricsGetter) error {
+		return send(l, ms, &agentMetadataClient{MetricsClient: client, md: md}, conf.Key, opts...)
+	}
+}
+
+/*
+agentMetadataClient adds the identifier and the address of the agent to the metadata of every call,
+the same as the X-Agent-ID and X-Real-IP headers
+*/
+type agentMetadataClient struct {
+	pb.MetricsClient
+	md []string // key-value pairs
+}
+
+func (c *agentMetadataClient) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest, opts ...grpc.CallOption) (*pb.UpdateMetricsResponse, error) {
+	return c.MetricsClient.UpdateMetrics(metadata.AppendToOutgoingContext(ctx, c.md...), in, opts...)
+}
+
+func (c *agentMetadataClient) StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (pb.Metrics_StreamMetricsClient, error) {
+	return c.MetricsClient.StreamMetrics(metadata.AppendToOutgoingContext(ctx, c.md...), opts...)
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+	"github.com/itaraxa/effectivepancake/internal/models"
+	pb "github.com/itaraxa/effectivepancake/internal/proto"
+)
+
+// recordingMetricsClient stores received requests instead of sending them
+type recordingMetricsClient struct {
+	pb.MetricsClient
+	reqs []*pb.UpdateMetricsRequest
+	ids  []string
+	ips  []string
+}
+
+func (c *recordingMetricsClient) seen(ctx context.Context) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	c.ids = append(c.ids, md.Get(AgentIDHeader)...)
+	c.ips = append(c.ips, md.Get(RealIPHeader)...)
+}
+
+func (c *recordingMetricsClient) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest, opts ...grpc.CallOption) (*pb.UpdateMetricsResponse, error) {
+	c.seen(ctx)
+	c.reqs = append(c.reqs, in)
+	return &pb.UpdateMetricsResponse{Accepted: int32(len(in.GetMetrics()))}, nil
+}
+
+func (c *recordingMetricsClient) StreamMetrics(ctx context.Context, opts ...grpc.CallOption) (pb.Metrics_StreamMetricsClient, error) {
+	c.seen(ctx)
+	return &recordingStream{c: c}, nil
+}
+
+type recordingStream struct {
+	grpc.ClientStream
+	c *recordingMetricsClient
+}
+
+func (s *recordingStream) Send(req *pb.UpdateMetricsRequest) error {
+	s.c.reqs = append(s.c.reqs, req)
+	return nil
+}
+
+func (s *recordingStream) CloseAndRecv() (*pb.UpdateMetricsResponse, error) {
+	return &pb.UpdateMetricsResponse{}, nil
+}
+
+func Test_newGRPCSender(t *testing.T) {
+	tests := []struct {
+		name     string
+		batch    bool
+		wantReqs int
+		wantIDs  []string
+	}{
+		{name: `unary batch`, batch: true, wantReqs: 1, wantIDs: []string{`snap-1`}},
+		{name: `stream`, batch: false, wantReqs: 2, wantIDs: []string{`snap-1/0`, `snap-1/1`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.NewAgentConfig()
+			conf.Batch = tt.batch
+			conf.Key = `secret`
+			conf.InstanceID = `agent-1`
+			client := &recordingMetricsClient{}
+
+			value := 1.5
+			ms := models.NewJSONMetrics(nil)
+			ms.SnapshotID = `snap-1`
+			_ = ms.AddPollCount(5)
+			_ = ms.AddData([]models.JSONMetric{{ID: `Alloc`, MType: `gauge`, Value: &value}})
+			if err := newGRPCSender(conf, client)(testLogger{}, ms); err != nil {
+				t.Fatalf("send() error = %v", err)
+			}
+			if len(client.reqs) != tt.wantReqs {
+				t.Fatalf("sent %d requests, want %d", len(client.reqs), tt.wantReqs)
+			}
+			for i, req := range client.reqs {
+				if req.GetSnapshotId() != tt.wantIDs[i] {
+					t.Errorf("request %d snapshot id = %s, want %s", i, req.GetSnapshotId(), tt.wantIDs[i])
+				}
+				data, _ := req.SignedBytes()
+				if !CheckSignSHA256(data, conf.Key, req.GetHash()) {
+					t.Errorf("request %v has bad signature", req)
+				}
+			}
+			if len(client.ids) != 1 || client.ids[0] != `agent-1` {
+				t.Errorf("agent ids = %v, want [agent-1]", client.ids)
+			}
+			if len(client.ips) != 1 || client.ips[0] != `127.0.0.1` {
+				t.Errorf("agent addresses = %v, want [127.0.0.1]", client.ips)
+			}
+		})
+	}
+}
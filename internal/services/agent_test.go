@@ -1,10 +1,15 @@
 package services
 
 import (
+	"context"
+	"crypto/rsa"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/itaraxa/effectivepancake/internal/config"
 	"github.com/itaraxa/effectivepancake/internal/models"
@@ -16,6 +21,7 @@ func Test_sendMetricsToServerQueryStr(t *testing.T) {
 		ms        MetricsGetter
 		serverURL string
 		client    *http.Client
+		key       string
 	}
 	tests := []struct {
 		name    string
@@ -26,7 +32,7 @@ func Test_sendMetricsToServerQueryStr(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := sendMetricsToServerQueryStr(tt.args.l, tt.args.ms, tt.args.serverURL, tt.args.client); (err != nil) != tt.wantErr {
+			if err := sendMetricsToServerQueryStr(tt.args.l, tt.args.ms, tt.args.serverURL, tt.args.client, tt.args.key); (err != nil) != tt.wantErr {
 				t.Errorf("sendMetricsToServerQueryStr() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -39,6 +45,7 @@ func Test_sendMetricaToServerJSON(t *testing.T) {
 		ms        MetricsGetter
 		serverURL string
 		client    *http.Client
+		key       string
 	}
 	tests := []struct {
 		name    string
@@ -49,7 +56,7 @@ func Test_sendMetricaToServerJSON(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := sendMetricaToServerJSON(tt.args.l, tt.args.ms, tt.args.serverURL, tt.args.client); (err != nil) != tt.wantErr {
+			if err := sendMetricaToServerJSON(tt.args.l, tt.args.ms, tt.args.serverURL, tt.args.client, tt.args.key); (err != nil) != tt.wantErr {
 				t.Errorf("sendMetricaToServerJSON() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -62,6 +69,7 @@ func Test_sendMetricaToServerJSONgzip(t *testing.T) {
 		ms        MetricsGetter
 		serverURL string
 		client    *http.Client
+		key       string
 	}
 	tests := []struct {
 		name    string
@@ -72,7 +80,7 @@ func Test_sendMetricaToServerJSONgzip(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := sendMetricaToServerJSONgzip(tt.args.l, tt.args.ms, tt.args.serverURL, tt.args.client); (err != nil) != tt.wantErr {
+			if err := sendMetricaToServerJSONgzip(tt.args.l, tt.args.ms, tt.args.serverURL, tt.args.client, tt.args.key); (err != nil) != tt.wantErr {
 				t.Errorf("sendMetricaToServerJSONgzip() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -82,6 +90,7 @@ func Test_sendMetricaToServerJSONgzip(t *testing.T) {
 func Test_collectMetrics(t *testing.T) {
 	type args struct {
 		pollCount int64
+		labels    map[string]string
 	}
 	tests := []struct {
 		name    string
@@ -93,7 +102,7 @@ func Test_collectMetrics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := collectMetrics(tt.args.pollCount)
+			got, err := collectMetrics(tt.args.pollCount, tt.args.labels)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("collectMetrics() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -138,12 +147,48 @@ func Test_collectOtherMetrics(t *testing.T) {
 }
 
 func TestPollMetrics(t *testing.T) {
+	conf := config.NewAgentConfig()
+	conf.PollInterval = time.Hour
+	dataChan := make(chan MetricsAddGetter, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go PollMetrics(ctx, &wg, dataChan, nil, testLogger{}, conf)
+
+	// the first snapshot is collected without waiting for the ticker
+	select {
+	case ms := <-dataChan:
+		if len(ms.GetData()) == 0 {
+			t.Errorf("PollMetrics() sent an empty snapshot")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("PollMetrics() didn't send a snapshot")
+	}
+
+	// cancelling must stop polling without waiting for the poll interval
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("PollMetrics() didn't stop after the context was cancelled")
+	}
+}
+
+func TestReportMetrics(t *testing.T) {
 	type args struct {
-		wg          *sync.WaitGroup
-		controlChan chan bool
-		dataChan    chan MetricsAddGetter
-		l           logger
-		config      *config.AgentConfig
+		ctx       context.Context
+		wg        *sync.WaitGroup
+		dataChan  chan MetricsAddGetter
+		spool     *Spool
+		l         logger
+		config    *config.AgentConfig
+		client    *http.Client
+		publicKey *rsa.PublicKey
 	}
 	tests := []struct {
 		name string
@@ -153,29 +198,80 @@ func TestPollMetrics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			PollMetrics(tt.args.wg, tt.args.controlChan, tt.args.dataChan, tt.args.l, tt.args.config)
+			ReportMetrics(tt.args.ctx, tt.args.wg, tt.args.dataChan, tt.args.spool, tt.args.l, tt.args.config, tt.args.client, tt.args.publicKey)
 		})
 	}
 }
 
-func TestReportMetrics(t *testing.T) {
-	type args struct {
-		wg          *sync.WaitGroup
-		controlChan chan bool
-		dataChan    chan MetricsAddGetter
-		l           logger
-		config      *config.AgentConfig
-		client      *http.Client
+func TestInstanceLabels(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name string
+		conf *config.AgentConfig
+		want map[string]string
+	}{
+		{
+			name: `Hostname only`,
+			conf: &config.AgentConfig{},
+			want: map[string]string{`host`: hostname},
+		},
+		{
+			name: `Instance id and tags`,
+			conf: &config.AgentConfig{InstanceID: `agent-1`, Tags: map[string]string{`dc`: `eu`}},
+			want: map[string]string{`host`: hostname, `instance`: `agent-1`, `dc`: `eu`},
+		},
+		{
+			name: `Tag overrides host`,
+			conf: &config.AgentConfig{Tags: map[string]string{`host`: `web`}},
+			want: map[string]string{`host`: `web`},
+		},
 	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := InstanceLabels(testLogger{}, tt.conf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("InstanceLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sendMetricaToServerBatchIdempotencyKey(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(IdempotencyHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	jms := models.NewJSONMetrics(nil)
+	jms.SnapshotID = `snapshot-1`
+	_ = jms.AddPollCount(1)
+	for i := 0; i < 2; i++ {
+		if err := sendMetricaToServerBatch(testLogger{}, jms, server.URL, server.Client(), ``, nil); err != nil {
+			t.Fatalf("sendMetricaToServerBatch() error = %v", err)
+		}
+	}
+	if len(got) != 2 || got[0] != `snapshot-1` || got[1] != `snapshot-1` {
+		t.Errorf("idempotency keys = %v, want the snapshot id in every request", got)
+	}
+}
+
+func TestReplaysSafely(t *testing.T) {
 	tests := []struct {
 		name string
-		args args
+		conf *config.AgentConfig
+		want bool
 	}{
-		// TODO: Add test cases.
+		{name: `http batch`, conf: &config.AgentConfig{Transport: `http`, Batch: true}, want: true},
+		{name: `http single json`, conf: &config.AgentConfig{Transport: `http`, ReportMode: `json`}, want: false},
+		{name: `http single raw`, conf: &config.AgentConfig{Transport: `http`, ReportMode: `raw`}, want: false},
+		{name: `grpc stream`, conf: &config.AgentConfig{Transport: `grpc`}, want: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ReportMetrics(tt.args.wg, tt.args.controlChan, tt.args.dataChan, tt.args.l, tt.args.config, tt.args.client)
+			if got := ReplaysSafely(tt.conf); got != tt.want {
+				t.Errorf("ReplaysSafely() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
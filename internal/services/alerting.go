@@ -0,0 +1,405 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// resolvedAlertTTL is the time, during which resolved alerts are shown
+const resolvedAlertTTL = 15 * time.Minute
+
+// AlertRule is one rule of the rules file
+type AlertRule struct {
+	Name        string            `json:"name" yaml:"name"`
+	Expr        string            `json:"expr" yaml:"expr"`
+	For         string            `json:"for,omitempty" yaml:"for,omitempty"` // alternative to "for <duration>" in the expression
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	parsed      models.RuleExpr
+}
+
+// alertRulesFile is the content of the rules file
+type alertRulesFile struct {
+	Rules []AlertRule `json:"rules" yaml:"rules"`
+}
+
+/*
+ParseAlertRules parses and checks rules. Names of rules must be unique
+
+Args:
+
+	data []byte: content of the rules file in JSON, example: {"rules": [{"name": "HighHeap", "expr": "gauge HeapAlloc > 500e6 for 2m"}]}
+
+Returns:
+
+	[]AlertRule: parsed rules
+	error: nil or error wrapping myErrors.ErrBadRule
+*/
+func ParseAlertRules(data []byte) ([]AlertRule, error) {
+	var f alertRulesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%w: %v", myErrors.ErrBadRule, err)
+	}
+	return checkAlertRules(f.Rules)
+}
+
+/*
+ParseAlertRulesYAML parses and checks rules written in YAML. Names of rules must be unique
+
+Args:
+
+	data []byte: content of the rules file in YAML, example:
+		rules:
+		  - name: HighHeap
+		    expr: gauge HeapAlloc > 500e6 for 2m
+
+Returns:
+
+	[]AlertRule: parsed rules
+	error: nil or error wrapping myErrors.ErrBadRule
+*/
+func ParseAlertRulesYAML(data []byte) ([]AlertRule, error) {
+	var f alertRulesFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %v", myErrors.ErrBadRule, err)
+	}
+	return checkAlertRules(f.Rules)
+}
+
+/*
+checkAlertRules checks names of rules and parses their expressions
+
+Args:
+
+	rules []AlertRule: decoded rules
+
+Returns:
+
+	[]AlertRule: rules with parsed expressions
+	error: nil or error wrapping myErrors.ErrBadRule
+*/
+func checkAlertRules(rules []AlertRule) ([]AlertRule, error) {
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		r := &rules[i]
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("%w: empty or duplicate name %q", myErrors.ErrBadRule, r.Name)
+		}
+		names[r.Name] = true
+		expr, err := models.ParseRuleExpr(r.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		if r.For != "" {
+			if expr.For != 0 {
+				return nil, fmt.Errorf("%w: rule %s has duration in the expression and in the for field", myErrors.ErrBadRule, r.Name)
+			}
+			if expr.For, err = time.ParseDuration(r.For); err != nil || expr.For < 0 {
+				return nil, fmt.Errorf("%w: rule %s has bad for %q", myErrors.ErrBadRule, r.Name, r.For)
+			}
+		}
+		r.parsed = expr
+	}
+	return rules, nil
+}
+
+/*
+LoadAlertRules reads rules from the file. Files with .yaml or .yml extension are parsed as YAML, others as JSON
+
+Args:
+
+	fileName string: path to the rules file
+
+Returns:
+
+	[]AlertRule: parsed rules
+	error: nil or error of reading or parsing the file
+*/
+func LoadAlertRules(fileName string) ([]AlertRule, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read rules file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case `.yaml`, `.yml`:
+		return ParseAlertRulesYAML(data)
+	}
+	return ParseAlertRules(data)
+}
+
+// counterSample is the previous value of the counter for calculating its rate
+type counterSample struct {
+	value int64
+	at    time.Time
+}
+
+/*
+AlertEngine evaluates alerting rules against stored metrics and keeps states of alerts.
+An alert is pending while its condition holds shorter than the for duration, then it is firing.
+A firing alert becomes resolved, when the condition stops holding or its metric disappears, a pending alert is just dropped
+*/
+type AlertEngine struct {
+	mu      sync.Mutex
+	rules   []AlertRule
+	alerts  map[string]*models.Alert
+	samples map[string]counterSample
+}
+
+/*
+NewAlertEngine creates the engine for the rules
+
+Args:
+
+	rules []AlertRule: rules parsed by ParseAlertRules or LoadAlertRules
+
+Returns:
+
+	*AlertEngine
+*/
+func NewAlertEngine(rules []AlertRule) *AlertEngine {
+	return &AlertEngine{
+		rules:   rules,
+		alerts:  make(map[string]*models.Alert),
+		samples: make(map[string]counterSample),
+	}
+}
+
+/*
+SetRules replaces the rules of the engine. Alerts and counter samples of rules, which are kept with the same
+definition, keep their state. Firing alerts of removed or changed rules become resolved, so the dispatcher
+notifies about them, other states of these rules are dropped
+
+Args:
+
+	rules []AlertRule: new rules
+	now time.Time: time of the replacement
+
+Returns:
+
+	None
+*/
+func (e *AlertEngine) SetRules(rules []AlertRule, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	old := make(map[string]AlertRule, len(e.rules))
+	for _, r := range e.rules {
+		old[r.Name] = r
+	}
+	kept := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		prev, ok := old[r.Name]
+		kept[r.Name] = ok && prev.sameDefinition(r)
+	}
+	for name, a := range e.alerts {
+		switch {
+		case kept[name] || a.State == models.AlertResolved:
+		case a.State == models.AlertFiring:
+			resolvedAt := now
+			a.State = models.AlertResolved
+			a.ResolvedAt = &resolvedAt
+		default:
+			delete(e.alerts, name)
+		}
+	}
+	maps.DeleteFunc(e.samples, func(name string, _ counterSample) bool { return !kept[name] })
+	e.rules = rules
+}
+
+// sameDefinition checks, whether the rule evaluates the same condition and labels its alert the same way
+func (r AlertRule) sameDefinition(other AlertRule) bool {
+	return r.Expr == other.Expr && r.parsed.For == other.parsed.For && maps.Equal(r.Labels, other.Labels)
+}
+
+/*
+ruleValue gets the value of the rule expression from the storage
+
+Args:
+
+	ctx context.Context
+	mg MetricGetter: storage with metrics
+	r AlertRule: evaluated rule
+	now time.Time: time of the evaluation
+
+Returns:
+
+	float64: value of the metric or rate of the counter
+	bool: false if the value is unknown: no metric or the first sample of the counter
+*/
+func (e *AlertEngine) ruleValue(ctx context.Context, mg MetricGetter, r AlertRule, now time.Time) (float64, bool) {
+	key := r.parsed.SeriesKey()
+	v, err := mg.GetMetrica(ctx, r.parsed.MType, key)
+	if err != nil {
+		return 0, false
+	}
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int64:
+		if !r.parsed.Rate {
+			return float64(value), true
+		}
+		prev, ok := e.samples[r.Name]
+		e.samples[r.Name] = counterSample{value: value, at: now}
+		if !ok || !now.After(prev.at) {
+			return 0, false
+		}
+		delta := value - prev.value
+		if delta < 0 {
+			// the counter was reset, it has grown from zero since the previous sample
+			delta = value
+		}
+		return float64(delta) / now.Sub(prev.at).Seconds(), true
+	}
+	return 0, false
+}
+
+/*
+Evaluate evaluates all rules once and updates states of alerts
+
+Args:
+
+	ctx context.Context
+	mg MetricGetter: storage with metrics
+	now time.Time: time of the evaluation
+
+Returns:
+
+	[]models.Alert: copies of alerts, which changed their state to firing or resolved
+*/
+func (e *AlertEngine) Evaluate(ctx context.Context, mg MetricGetter, now time.Time) []models.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	changed := []models.Alert{}
+	names := make(map[string]bool, len(e.rules))
+	for _, r := range e.rules {
+		names[r.Name] = true
+	}
+	// resolved alerts of removed rules are shown for resolvedAlertTTL too
+	maps.DeleteFunc(e.alerts, func(name string, a *models.Alert) bool {
+		return !names[name] && a.State == models.AlertResolved && now.Sub(*a.ResolvedAt) > resolvedAlertTTL
+	})
+	for _, r := range e.rules {
+		value, known := e.ruleValue(ctx, mg, r, now)
+		holds := known && r.parsed.Holds(value)
+		a, ok := e.alerts[r.Name]
+		if ok && a.State == models.AlertResolved && (holds || now.Sub(*a.ResolvedAt) > resolvedAlertTTL) {
+			delete(e.alerts, r.Name)
+			a, ok = nil, false
+		}
+
+		switch {
+		case holds && !ok:
+			a = &models.Alert{Name: r.Name, State: models.AlertPending, Expr: r.Expr, Labels: r.Labels, Annotations: r.Annotations, ActiveAt: now}
+			e.alerts[r.Name] = a
+		case !holds && ok && a.State == models.AlertPending:
+			delete(e.alerts, r.Name)
+			continue
+		case !holds && ok && a.State == models.AlertFiring:
+			resolvedAt := now
+			a.State = models.AlertResolved
+			a.ResolvedAt = &resolvedAt
+			changed = append(changed, copyAlert(a))
+		}
+		if !ok && !holds {
+			continue
+		}
+		if known {
+			a.Value = value
+		}
+		if a.State == models.AlertPending && now.Sub(a.ActiveAt) >= r.parsed.For {
+			firedAt := now
+			a.State = models.AlertFiring
+			a.FiredAt = &firedAt
+			changed = append(changed, copyAlert(a))
+		}
+	}
+	return changed
+}
+
+// copyAlert returns the copy of the alert, that can be used without the lock
+func copyAlert(a *models.Alert) models.Alert {
+	c := *a
+	c.Labels = maps.Clone(a.Labels)
+	c.Annotations = maps.Clone(a.Annotations)
+	return c
+}
+
+/*
+Alerts returns pending, firing and recently resolved alerts
+
+Args:
+
+	None
+
+Returns:
+
+	[]models.Alert: copies of alerts sorted by name
+*/
+func (e *AlertEngine) Alerts() []models.Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make([]models.Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		out = append(out, copyAlert(a))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+/*
+RunAlerting periodically evaluates the rules until the context is cancelled
+
+Args:
+
+	ctx context.Context
+	wg *sync.WaitGroup: pointer to sync.WaitGroup, which is done when the evaluation loop exits
+	l logger: a logger used for printing messages
+	e *AlertEngine: engine with the rules
+	mg MetricGetter: storage with metrics
+	d *AlertDispatcher: dispatcher of notifications, nil - alerts are only logged
+	interval time.Duration: interval between evaluations
+
+Returns:
+
+	None
+*/
+func RunAlerting(ctx context.Context, wg *sync.WaitGroup, l logger, e *AlertEngine, mg MetricGetter, d *AlertDispatcher, interval time.Duration) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Info("alerting stopped")
+			return
+		case now := <-ticker.C:
+			for _, a := range e.Evaluate(ctx, mg, now) {
+				l.Info("alert state changed", "name", a.Name, "state", a.State, "value", a.Value, "expr", a.Expr)
+			}
+			if d != nil {
+				d.Dispatch(l, e.Alerts(), now)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
+)
+
+func TestParseAlertRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{name: `Valid`, data: `{"rules": [{"name": "HighHeap", "expr": "gauge HeapAlloc > 500e6", "for": "2m"}, {"name": "Stalled", "expr": "rate(counter PollCount) == 0 for 1m"}]}`},
+		{name: `Duplicate name`, data: `{"rules": [{"name": "A", "expr": "gauge X > 1"}, {"name": "A", "expr": "gauge Y > 1"}]}`, wantErr: true},
+		{name: `Two durations`, data: `{"rules": [{"name": "A", "expr": "gauge X > 1 for 1m", "for": "2m"}]}`, wantErr: true},
+		{name: `Bad expression`, data: `{"rules": [{"name": "A", "expr": "gauge X"}]}`, wantErr: true},
+		{name: `Bad JSON`, data: `{"rules": [`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseAlertRules([]byte(tt.data)); (err != nil) != tt.wantErr {
+				t.Errorf("ParseAlertRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAlertRulesYAML(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantRules int
+		wantErr   bool
+	}{
+		{name: `Valid`, data: "rules:\n  - name: HighHeap\n    expr: gauge HeapAlloc > 500e6\n    for: 2m\n    labels:\n      severity: page\n", wantRules: 1},
+		{name: `Empty`, data: ``, wantRules: 0},
+		{name: `Unknown field`, data: "rules:\n  - name: A\n    expression: gauge X > 1\n", wantErr: true},
+		{name: `Bad expression`, data: "rules:\n  - name: A\n    expr: gauge X\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseAlertRulesYAML([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAlertRulesYAML() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(rules) != tt.wantRules {
+				t.Errorf("ParseAlertRulesYAML() = %d rules, want %d", len(rules), tt.wantRules)
+			}
+		})
+	}
+}
+
+func TestAlertEngine_Evaluate(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(`{"rules": [
+		{"name": "HighHeap", "expr": "gauge HeapAlloc > 100 for 2m"},
+		{"name": "Stalled", "expr": "rate(counter PollCount) == 0"}]}`))
+	if err != nil {
+		t.Fatalf("ParseAlertRules() error = %v", err)
+	}
+	m := memstorage.NewMemStorage()
+	e := NewAlertEngine(rules)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	state := func(name string) string {
+		for _, a := range e.Alerts() {
+			if a.Name == name {
+				return a.State
+			}
+		}
+		return models.AlertInactive
+	}
+	step := func(minutes int, heap float64, polls int64) []models.Alert {
+		_ = m.UpdateGauge(context.TODO(), `HeapAlloc`, heap)
+		_ = m.AddCounter(context.TODO(), `PollCount`, polls)
+		return e.Evaluate(context.TODO(), m, start.Add(time.Duration(minutes)*time.Minute))
+	}
+
+	step(0, 200, 1)
+	if got := state(`HighHeap`); got != models.AlertPending {
+		t.Errorf("HighHeap = %s, want pending", got)
+	}
+	// the first sample of the counter doesn't have a rate
+	if got := state(`Stalled`); got != models.AlertInactive {
+		t.Errorf("Stalled = %s, want inactive", got)
+	}
+
+	if changed := step(1, 50, 0); len(changed) != 1 || changed[0].Name != `Stalled` || changed[0].State != models.AlertFiring {
+		t.Errorf("changed = %+v, want Stalled firing", changed)
+	}
+	// the condition was interrupted, pending alert is dropped
+	if got := state(`HighHeap`); got != models.AlertInactive {
+		t.Errorf("HighHeap = %s, want inactive", got)
+	}
+
+	step(2, 200, 1)
+	step(3, 200, 1)
+	if got := state(`HighHeap`); got != models.AlertPending {
+		t.Errorf("HighHeap = %s, want pending", got)
+	}
+	if got := state(`Stalled`); got != models.AlertResolved {
+		t.Errorf("Stalled = %s, want resolved", got)
+	}
+	changed := step(4, 300, 1)
+	if len(changed) != 1 || changed[0].State != models.AlertFiring || changed[0].Value != 300 {
+		t.Errorf("changed = %+v, want HighHeap firing with value 300", changed)
+	}
+
+	// resolved alerts are shown for resolvedAlertTTL
+	step(20, 300, 1)
+	if got := state(`Stalled`); got != models.AlertInactive {
+		t.Errorf("Stalled = %s, want dropped after resolvedAlertTTL", got)
+	}
+}
+
+func TestAlertEngine_EvaluateMissingMetricAndCounterReset(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(`{"rules": [
+		{"name": "HighHeap", "expr": "gauge HeapAlloc > 100"},
+		{"name": "Polling", "expr": "rate(counter PollCount) >= 0"}]}`))
+	if err != nil {
+		t.Fatalf("ParseAlertRules() error = %v", err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := NewAlertEngine(rules)
+
+	before := memstorage.NewMemStorage()
+	_ = before.UpdateGauge(context.TODO(), `HeapAlloc`, 200)
+	_ = before.AddCounter(context.TODO(), `PollCount`, 100)
+	if changed := e.Evaluate(context.TODO(), before, start); len(changed) != 1 || changed[0].Name != `HighHeap` {
+		t.Fatalf("changed = %+v, want HighHeap firing", changed)
+	}
+
+	// the gauge disappeared and the counter was reset, for example after a restart of the server without restoring
+	after := memstorage.NewMemStorage()
+	_ = after.AddCounter(context.TODO(), `PollCount`, 6)
+	changed := e.Evaluate(context.TODO(), after, start.Add(time.Minute))
+	if len(changed) != 2 {
+		t.Fatalf("changed = %+v, want HighHeap resolved and Polling firing", changed)
+	}
+	for _, a := range changed {
+		switch a.Name {
+		case `HighHeap`:
+			if a.State != models.AlertResolved {
+				t.Errorf("HighHeap = %s, want resolved", a.State)
+			}
+		case `Polling`:
+			if a.State != models.AlertFiring || a.Value != 0.1 {
+				t.Errorf("Polling = %s with rate %g, want firing with rate 0.1", a.State, a.Value)
+			}
+		}
+	}
+}
+
+func TestAlertEngine_SetRules(t *testing.T) {
+	rules, err := ParseAlertRules([]byte(`{"rules": [
+		{"name": "HighHeap", "expr": "gauge HeapAlloc > 100"},
+		{"name": "LowHeap", "expr": "gauge HeapAlloc > 10"}]}`))
+	if err != nil {
+		t.Fatalf("ParseAlertRules() error = %v", err)
+	}
+	changedRules, err := ParseAlertRules([]byte(`{"rules": [{"name": "HighHeap", "expr": "gauge HeapAlloc > 150"}]}`))
+	if err != nil {
+		t.Fatalf("ParseAlertRules() error = %v", err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	state := func(e *AlertEngine, name string) string {
+		for _, a := range e.Alerts() {
+			if a.Name == name {
+				return a.State
+			}
+		}
+		return models.AlertInactive
+	}
+	m := memstorage.NewMemStorage()
+	_ = m.UpdateGauge(context.TODO(), `HeapAlloc`, 200)
+	e := NewAlertEngine(rules)
+	d := NewAlertDispatcher(nil, nil, []string{models.AlertNameLabel}, time.Hour)
+	e.Evaluate(context.TODO(), m, at(0))
+	if sent := d.Dispatch(testLogger{}, e.Alerts(), at(0)); len(sent) != 2 {
+		t.Fatalf("sent = %+v, want 2 firing notifications", sent)
+	}
+
+	// the kept rule keeps its alert, the alert of the removed rule is resolved and notified
+	e.SetRules(rules[:1], at(1))
+	if got := state(e, `HighHeap`); got != models.AlertFiring {
+		t.Errorf("HighHeap = %s, want firing", got)
+	}
+	if got := state(e, `LowHeap`); got != models.AlertResolved {
+		t.Errorf("LowHeap = %s, want resolved", got)
+	}
+	sent := d.Dispatch(testLogger{}, e.Alerts(), at(1))
+	if len(sent) != 1 || sent[0].Status != models.AlertResolved || sent[0].Alerts[0].Name != `LowHeap` {
+		t.Errorf("sent = %+v, want resolved LowHeap", sent)
+	}
+
+	// the changed rule starts from the beginning
+	e.SetRules(changedRules, at(2))
+	if got := state(e, `HighHeap`); got != models.AlertResolved {
+		t.Errorf("HighHeap = %s, want resolved after the change of the rule", got)
+	}
+	if changed := e.Evaluate(context.TODO(), m, at(3)); len(changed) != 1 || changed[0].State != models.AlertFiring || !changed[0].ActiveAt.Equal(at(3)) {
+		t.Errorf("changed = %+v, want HighHeap firing again since the evaluation", changed)
+	}
+
+	// resolved alerts of removed rules are dropped after resolvedAlertTTL
+	e.SetRules(nil, at(4))
+	e.Evaluate(context.TODO(), m, at(5))
+	if got := state(e, `HighHeap`); got != models.AlertResolved {
+		t.Errorf("HighHeap = %s, want resolved", got)
+	}
+	if changed := e.Evaluate(context.TODO(), m, at(20)); len(changed) != 0 || len(e.Alerts()) != 0 {
+		t.Errorf("alerts = %+v, want none without rules", e.Alerts())
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"time"
 
 	"github.com/itaraxa/effectivepancake/internal/models"
 )
@@ -12,14 +13,22 @@ type MetricStorager interface {
 	MetricUpdater
 	MetricBatchUpdater
 	MetricPrinter
+	MetricHistoryGetter
+	IdempotencyKeeper
 	PingContext(context.Context) error
 	Clear(context.Context) error
 	Close() error
 }
 
+type MetricGetUpdater interface {
+	MetricGetter
+	MetricUpdater
+}
+
 type MetricUpdater interface {
 	UpdateGauge(context.Context, string, float64) error
 	AddCounter(context.Context, string, int64) error
+	AddHistogram(context.Context, string, models.Histogram) error
 }
 
 type MetricBatchUpdater interface {
@@ -31,16 +40,46 @@ type MetricBatchUpdater interface {
 		MetricName  string
 		MetricDelta *int64
 	}) error
+	AddBatchHistogram(context.Context, []struct {
+		MetricName      string
+		MetricHistogram *models.Histogram
+	}) error
+}
+
+type MetricBatchUpdateKeeper interface {
+	MetricBatchUpdater
+	IdempotencyKeeper
+}
+
+// IdempotencyKeeper applies the batch together with its idempotency key as a whole, so retried batches aren't applied twice.
+// UpdateBatchOnce returns false without applying, if the batch with the key was applied before
+type IdempotencyKeeper interface {
+	UpdateBatchOnce(ctx context.Context, key string, batch *models.MetricsBatch) (bool, error)
 }
 
 type MetricGetter interface {
 	GetMetrica(context.Context, string, string) (interface{}, error)
-	GetAllMetrics(context.Context) (interface{}, error)
+	GetAllMetrics(context.Context) (*models.MetricsSnapshot, error)
+}
+
+// MetricHistoryGetter returns values of the series, which were stored in the interval [from, to)
+type MetricHistoryGetter interface {
+	GetHistory(ctx context.Context, metricaType string, metricaName string, from, to time.Time) ([]models.HistoryPoint, error)
+}
+
+// HistoryCompactor compacts and deletes old history according to the retention policy
+type HistoryCompactor interface {
+	ApplyRetention(ctx context.Context, policy models.RetentionPolicy, now time.Time) (models.RetentionStats, error)
+}
+
+// AlertNotifier delivers notifications about alerts: webhook, file, e-mail
+type AlertNotifier interface {
+	Notify(ctx context.Context, n models.Notification) error
 }
 
 type MetricPrinter interface {
 	String(ctx context.Context) string
-	HTML(ctx context.Context) string
+	HTML(ctx context.Context, stale map[string]bool) string
 }
 
 // Интерфейс для описания взаимодействия с запросом на обновление метрики
@@ -51,6 +90,8 @@ type Querier interface {
 	SetMetricaName(string) error
 	GetMetricaRawValue() string
 	SetMetricaRawValue(string) error
+	GetMetricaLabels() map[string]string
+	SetMetricaLabels(map[string]string) error
 	String() string
 }
 
@@ -59,6 +100,8 @@ type JSONMetricaQuerier interface {
 	GetMetricaName() string
 	GetMetricaValue() *float64
 	GetMetricaCounter() *int64
+	GetMetricaHistogram() *models.Histogram
+	GetMetricaLabels() map[string]string
 }
 
 // Agent-side interfaces
@@ -74,6 +117,7 @@ type MetricsAdderr interface {
 
 type MetricsGetter interface {
 	GetData() []models.JSONMetric
+	GetSnapshotID() string
 }
 
 // Common interfaces
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// SilenceStore keeps silences in memory
+type SilenceStore struct {
+	mu       sync.Mutex
+	silences map[string]models.Silence
+}
+
+/*
+NewSilenceStore creates an empty store of silences
+
+Args:
+
+	None
+
+Returns:
+
+	*SilenceStore
+*/
+func NewSilenceStore() *SilenceStore {
+	return &SilenceStore{silences: make(map[string]models.Silence)}
+}
+
+/*
+Add checks the silence and stores it with a new identifier
+
+Args:
+
+	s models.Silence: silence, StartsAt defaults to now
+	now time.Time: current time
+
+Returns:
+
+	models.Silence: stored silence
+	error: nil or error wrapping myErrors.ErrBadSilence
+*/
+func (ss *SilenceStore) Add(s models.Silence, now time.Time) (models.Silence, error) {
+	if len(s.Matchers) == 0 {
+		return s, fmt.Errorf("%w: matchers are required", myErrors.ErrBadSilence)
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = now
+	}
+	if !s.EndsAt.After(s.StartsAt) || !s.EndsAt.After(now) {
+		return s, fmt.Errorf("%w: endsAt must be after startsAt and now", myErrors.ErrBadSilence)
+	}
+	s.ID = newSnapshotID()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.silences[s.ID] = s
+	return s, nil
+}
+
+/*
+List returns silences, which are not expired. Expired silences are deleted
+
+Args:
+
+	now time.Time: current time
+
+Returns:
+
+	[]models.Silence: silences sorted by end time
+*/
+func (ss *SilenceStore) List(now time.Time) []models.Silence {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	out := make([]models.Silence, 0, len(ss.silences))
+	for id, s := range ss.silences {
+		if !now.Before(s.EndsAt) {
+			delete(ss.silences, id)
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].EndsAt.Before(out[j].EndsAt) })
+	return out
+}
+
+/*
+Silenced checks, whether notifications about the alert are muted
+
+Args:
+
+	a models.Alert: checked alert
+	now time.Time: current time
+
+Returns:
+
+	bool: true if any active silence matches the alert
+*/
+func (ss *SilenceStore) Silenced(a models.Alert, now time.Time) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, s := range ss.silences {
+		if s.Matches(a, now) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// notifyQueueSize is the number of notifications waiting for sending, new notifications are dropped when the queue is full
+	notifyQueueSize = 64
+	// notifyTimeout limits sending of one notification to all notifiers
+	notifyTimeout = time.Minute
+)
+
+// alertGroup is the state of notifications about one group of alerts
+type alertGroup struct {
+	notified []string // names of firing alerts in the last notification, sorted
+	lastSent time.Time
+}
+
+/*
+AlertDispatcher groups alerts by labels and sends notifications to all notifiers. A notification is sent,
+when the set of firing alerts of the group changes, and repeated every repeat interval while the group is firing.
+Silenced alerts are excluded from notifications. Notifications are sent by Run through a bounded queue,
+so slow notifiers don't delay the evaluation of rules
+*/
+type AlertDispatcher struct {
+	notifiers []AlertNotifier
+	silences  *SilenceStore
+	groupBy   []string
+	repeat    time.Duration
+	groups    map[string]*alertGroup
+	queue     chan models.Notification
+}
+
+/*
+NewAlertDispatcher creates the dispatcher
+
+Args:
+
+	notifiers []AlertNotifier: destinations of notifications
+	silences *SilenceStore: store of silences
+	groupBy []string: labels for grouping alerts, alertname is the name of the rule. Empty - all alerts are in one group
+	repeat time.Duration: interval of repeated notifications about firing groups
+
+Returns:
+
+	*AlertDispatcher
+*/
+func NewAlertDispatcher(notifiers []AlertNotifier, silences *SilenceStore, groupBy []string, repeat time.Duration) *AlertDispatcher {
+	return &AlertDispatcher{
+		notifiers: notifiers,
+		silences:  silences,
+		groupBy:   groupBy,
+		repeat:    repeat,
+		groups:    make(map[string]*alertGroup),
+		queue:     make(chan models.Notification, notifyQueueSize),
+	}
+}
+
+/*
+groupOf returns the key and labels of the group of the alert
+
+Args:
+
+	a models.Alert
+
+Returns:
+
+	string: key of the group, example: alertname="HighHeap"
+	map[string]string: values of grouping labels
+*/
+func (d *AlertDispatcher) groupOf(a models.Alert) (string, map[string]string) {
+	all := models.AlertLabels(a)
+	labels := make(map[string]string, len(d.groupBy))
+	for _, name := range d.groupBy {
+		labels[name] = all[name]
+	}
+	return models.FormatLabels(labels), labels
+}
+
+/*
+Dispatch queues notifications about groups, which changed or must be repeated. Must be called after every evaluation of rules
+
+Args:
+
+	l logger: a logger used for printing messages
+	alerts []models.Alert: current alerts of the engine
+	now time.Time: time of the evaluation
+
+Returns:
+
+	[]models.Notification: queued notifications
+*/
+func (d *AlertDispatcher) Dispatch(l logger, alerts []models.Alert, now time.Time) []models.Notification {
+	type pending struct {
+		labels   map[string]string
+		firing   []models.Alert
+		resolved []models.Alert
+	}
+	byGroup := make(map[string]*pending)
+	for key := range d.groups {
+		byGroup[key] = &pending{}
+	}
+	for _, a := range alerts {
+		if a.State != models.AlertFiring && a.State != models.AlertResolved {
+			continue
+		}
+		if d.silences != nil && d.silences.Silenced(a, now) {
+			continue
+		}
+		key, labels := d.groupOf(a)
+		p, ok := byGroup[key]
+		if !ok {
+			p = &pending{}
+			byGroup[key] = p
+		}
+		p.labels = labels
+		if a.State == models.AlertFiring {
+			p.firing = append(p.firing, a)
+		} else {
+			p.resolved = append(p.resolved, a)
+		}
+	}
+
+	sent := []models.Notification{}
+	keys := make([]string, 0, len(byGroup))
+	for key := range byGroup {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		p := byGroup[key]
+		g, ok := d.groups[key]
+		if !ok {
+			g = &alertGroup{}
+		}
+		names := make([]string, 0, len(p.firing))
+		for _, a := range p.firing {
+			names = append(names, a.Name)
+		}
+		sort.Strings(names)
+		changed := !slices.Equal(names, g.notified)
+		due := len(names) > 0 && now.Sub(g.lastSent) >= d.repeat
+		if !changed && !due {
+			continue
+		}
+
+		// resolved alerts are reported only once, if they were notified as firing
+		n := models.Notification{Group: key, Labels: p.labels, Status: models.AlertFiring, Alerts: p.firing, SentAt: now}
+		for _, a := range p.resolved {
+			if slices.Contains(g.notified, a.Name) && !slices.Contains(names, a.Name) {
+				n.Alerts = append(n.Alerts, a)
+			}
+		}
+		if len(names) == 0 {
+			n.Status = models.AlertResolved
+		}
+		if len(n.Alerts) > 0 && d.enqueue(l, n) {
+			sent = append(sent, n)
+		}
+		if len(names) == 0 {
+			delete(d.groups, key)
+			continue
+		}
+		g.notified, g.lastSent = names, now
+		d.groups[key] = g
+	}
+	return sent
+}
+
+/*
+enqueue puts the notification into the queue without waiting
+
+Args:
+
+	l logger: a logger used for printing messages
+	n models.Notification: notification
+
+Returns:
+
+	bool: false if the queue is full and the notification is dropped
+*/
+func (d *AlertDispatcher) enqueue(l logger, n models.Notification) bool {
+	select {
+	case d.queue <- n:
+		return true
+	default:
+		l.Error("alert notification dropped, queue is full", "group", n.Group, "status", n.Status, "queue", cap(d.queue))
+		return false
+	}
+}
+
+/*
+Run sends queued notifications until the context is cancelled. Sending of one notification is limited by notifyTimeout
+
+Args:
+
+	ctx context.Context
+	wg *sync.WaitGroup: wait group, Done is called on return
+	l logger: a logger used for printing messages
+
+Returns:
+
+	None
+*/
+func (d *AlertDispatcher) Run(ctx context.Context, wg *sync.WaitGroup, l logger) {
+	defer wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Info("alert notifications stopped", "unsent", len(d.queue))
+			return
+		case n := <-d.queue:
+			sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			d.send(sendCtx, l, n)
+			cancel()
+		}
+	}
+}
+
+/*
+send delivers the notification to every notifier, errors are logged
+
+Args:
+
+	ctx context.Context
+	l logger: a logger used for printing messages
+	n models.Notification: notification
+
+Returns:
+
+	None
+*/
+func (d *AlertDispatcher) send(ctx context.Context, l logger, n models.Notification) {
+	for _, notifier := range d.notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			l.Error("cannot send alert notification", "group", n.Group, "status", n.Status, "notifier", fmt.Sprintf("%T", notifier), "error", err.Error())
+		}
+	}
+	l.Info("alert notification sent", "group", n.Group, "status", n.Status, "alerts", len(n.Alerts))
+}
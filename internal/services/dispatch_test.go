@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// recordingNotifier passes all notifications to the channel
+type recordingNotifier struct {
+	sent chan models.Notification
+}
+
+func (rn *recordingNotifier) Notify(ctx context.Context, n models.Notification) error {
+	rn.sent <- n
+	return nil
+}
+
+func TestAlertDispatcher_Dispatch(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	alert := func(name, state, host string) models.Alert {
+		return models.Alert{Name: name, State: state, Labels: map[string]string{`host`: host}}
+	}
+	rn := &recordingNotifier{sent: make(chan models.Notification, notifyQueueSize)}
+	silences := NewSilenceStore()
+	d := NewAlertDispatcher([]AlertNotifier{rn}, silences, []string{`host`}, 10*time.Minute)
+
+	// two alerts of one host are grouped, pending alerts are not notified
+	sent := d.Dispatch(testLogger{}, []models.Alert{
+		alert(`HighHeap`, models.AlertFiring, `a`),
+		alert(`HighCPU`, models.AlertFiring, `a`),
+		alert(`Stalled`, models.AlertPending, `b`),
+	}, at(0))
+	if len(sent) != 1 || sent[0].Group != `host="a"` || len(sent[0].Alerts) != 2 {
+		t.Fatalf("sent = %+v, want one group of host a with 2 alerts", sent)
+	}
+
+	// nothing changed, repeat interval didn't pass
+	firing := []models.Alert{alert(`HighHeap`, models.AlertFiring, `a`), alert(`HighCPU`, models.AlertFiring, `a`)}
+	if sent = d.Dispatch(testLogger{}, firing, at(5)); len(sent) != 0 {
+		t.Errorf("sent = %+v, want nothing before repeat interval", sent)
+	}
+	if sent = d.Dispatch(testLogger{}, firing, at(10)); len(sent) != 1 {
+		t.Errorf("sent = %+v, want repeated notification", sent)
+	}
+
+	// resolved alert is reported once with the rest of the group
+	partly := []models.Alert{alert(`HighHeap`, models.AlertFiring, `a`), alert(`HighCPU`, models.AlertResolved, `a`)}
+	sent = d.Dispatch(testLogger{}, partly, at(11))
+	if len(sent) != 1 || sent[0].Status != models.AlertFiring || len(sent[0].Alerts) != 2 {
+		t.Errorf("sent = %+v, want firing group with the resolved alert", sent)
+	}
+	if sent = d.Dispatch(testLogger{}, partly, at(12)); len(sent) != 0 {
+		t.Errorf("sent = %+v, want nothing", sent)
+	}
+
+	// silenced alerts are not notified
+	if _, err := silences.Add(models.Silence{Matchers: map[string]string{`alertname`: `Stalled`}, EndsAt: at(60)}, at(12)); err != nil {
+		t.Fatalf("SilenceStore.Add() error = %v", err)
+	}
+	withSilenced := append(partly, alert(`Stalled`, models.AlertFiring, `b`))
+	if sent = d.Dispatch(testLogger{}, withSilenced, at(13)); len(sent) != 0 {
+		t.Errorf("sent = %+v, want silenced alert skipped", sent)
+	}
+
+	// the last alert of the group is resolved
+	sent = d.Dispatch(testLogger{}, []models.Alert{alert(`HighHeap`, models.AlertResolved, `a`)}, at(14))
+	if len(sent) != 1 || sent[0].Status != models.AlertResolved {
+		t.Errorf("sent = %+v, want resolved group", sent)
+	}
+
+	// queued notifications are sent by Run
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go d.Run(ctx, &wg, testLogger{})
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-rn.sent:
+		case <-time.After(time.Second):
+			t.Fatalf("notifier received %d notifications, want 4", i)
+		}
+	}
+}
+
+func TestAlertDispatcher_DispatchQueueFull(t *testing.T) {
+	d := NewAlertDispatcher(nil, nil, []string{`host`}, time.Minute)
+	alerts := make([]models.Alert, 0, notifyQueueSize+1)
+	for i := 0; i <= notifyQueueSize; i++ {
+		alerts = append(alerts, models.Alert{Name: `Down`, State: models.AlertFiring, Labels: map[string]string{`host`: strconv.Itoa(i)}})
+	}
+	if sent := d.Dispatch(testLogger{}, alerts, time.Now()); len(sent) != notifyQueueSize {
+		t.Errorf("queued %d notifications, want %d", len(sent), notifyQueueSize)
+	}
+}
+
+func TestSilenceStore_Add(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		s       models.Silence
+		wantErr bool
+	}{
+		{name: `Valid`, s: models.Silence{Matchers: map[string]string{`alertname`: `A`}, EndsAt: now.Add(time.Hour)}},
+		{name: `No matchers`, s: models.Silence{EndsAt: now.Add(time.Hour)}, wantErr: true},
+		{name: `Already ended`, s: models.Silence{Matchers: map[string]string{`alertname`: `A`}, EndsAt: now.Add(-time.Hour)}, wantErr: true},
+	}
+	ss := NewSilenceStore()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ss.Add(tt.s, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SilenceStore.Add() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.ID == "" || !got.StartsAt.Equal(now)) {
+				t.Errorf("SilenceStore.Add() = %+v, want ID and StartsAt set", got)
+			}
+		})
+	}
+	if got := ss.List(now.Add(2 * time.Hour)); len(got) != 0 {
+		t.Errorf("SilenceStore.List() = %+v, want expired silences removed", got)
+	}
+}
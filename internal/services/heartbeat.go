@@ -0,0 +1,370 @@
+package services
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// agentEvictFactor is the number of stale timeouts, after which an agent without requests or a series without updates is forgotten
+const agentEvictFactor = 10
+
+/*
+Heartbeats records, when every agent and every metric series was updated last time,
+so frozen values of agents, that stopped reporting, can be detected. Agents and series, which aren't updated for
+agentEvictFactor stale timeouts, are forgotten, so churn of agent ids and labels doesn't grow the tracker
+*/
+type Heartbeats struct {
+	mu         sync.Mutex
+	agents     map[string]*models.AgentStatus
+	series     map[string]time.Time // время последнего обновления по ключу "<тип>/<серия>"
+	staleAfter time.Duration
+	markStale  bool
+}
+
+/*
+NewHeartbeats creates the tracker
+
+Args:
+
+	staleAfter time.Duration: agents and metrics without updates for this time are stale
+	markStale bool: mark stale metrics in the HTML view and /value/ responses
+
+Returns:
+
+	*Heartbeats
+*/
+func NewHeartbeats(staleAfter time.Duration, markStale bool) *Heartbeats {
+	return &Heartbeats{
+		agents:     make(map[string]*models.AgentStatus),
+		series:     make(map[string]time.Time),
+		staleAfter: staleAfter,
+		markStale:  markStale,
+	}
+}
+
+/*
+SeenAgent records the request of the agent
+
+Args:
+
+	id string: identifier of the agent, the address is used if it's empty
+	addr string: remote address of the request
+	now time.Time: time of the request
+
+Returns:
+
+	None
+*/
+func (h *Heartbeats) SeenAgent(id, addr string, now time.Time) {
+	if id == "" {
+		id = addr
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	a, ok := h.agents[id]
+	if !ok {
+		h.evictAgents(now)
+		a = &models.AgentStatus{ID: id, FirstSeen: now}
+		h.agents[id] = a
+	}
+	a.Address = addr
+	a.LastSeen = now
+	a.Requests++
+}
+
+/*
+evictAgents deletes agents, which didn't report for agentEvictFactor stale timeouts. Must be called with the lock held
+
+Args:
+
+	now time.Time: current time
+
+Returns:
+
+	None
+*/
+func (h *Heartbeats) evictAgents(now time.Time) {
+	maps.DeleteFunc(h.agents, func(_ string, a *models.AgentStatus) bool {
+		return now.Sub(a.LastSeen) > agentEvictFactor*h.staleAfter
+	})
+}
+
+/*
+SeenMetric records the update of the series
+
+Args:
+
+	mType string: type of metrica
+	key string: series key
+	now time.Time: time of the update
+
+Returns:
+
+	None
+*/
+func (h *Heartbeats) SeenMetric(mType, key string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	typed := mType + "/" + key
+	if _, ok := h.series[typed]; !ok {
+		h.evictSeries(now)
+	}
+	h.series[typed] = now
+}
+
+/*
+evictSeries deletes series, which weren't updated for agentEvictFactor stale timeouts. Must be called with the lock held
+
+Args:
+
+	now time.Time: current time
+
+Returns:
+
+	None
+*/
+func (h *Heartbeats) evictSeries(now time.Time) {
+	maps.DeleteFunc(h.series, func(_ string, seen time.Time) bool {
+		return now.Sub(seen) > agentEvictFactor*h.staleAfter
+	})
+}
+
+/*
+Agents returns states of all agents
+
+Args:
+
+	now time.Time: current time
+
+Returns:
+
+	[]models.AgentStatus: agents sorted by identifier
+*/
+func (h *Heartbeats) Agents(now time.Time) []models.AgentStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.evictAgents(now)
+	out := make([]models.AgentStatus, 0, len(h.agents))
+	for _, a := range h.agents {
+		s := *a
+		s.Staleness = now.Sub(s.LastSeen).Seconds()
+		s.Status = models.AgentUp
+		if now.Sub(s.LastSeen) > h.staleAfter {
+			s.Status = models.AgentStale
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+/*
+MetricStaleness returns the time of the last update of the series, if marking of stale metrics is enabled
+
+Args:
+
+	mType string: type of metrica
+	key string: series key
+	now time.Time: current time
+
+Returns:
+
+	time.Time: time of the last update
+	bool: true if the series wasn't updated longer than the stale timeout
+	bool: false if marking is disabled or the series was never updated since the start of the server
+*/
+func (h *Heartbeats) MetricStaleness(mType, key string, now time.Time) (time.Time, bool, bool) {
+	if !h.markStale {
+		return time.Time{}, false, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen, ok := h.series[mType+"/"+key]
+	if !ok {
+		return time.Time{}, false, false
+	}
+	return seen, now.Sub(seen) > h.staleAfter, true
+}
+
+/*
+staleSeries returns series keys, which weren't updated longer than the stale timeout and have no fresh series
+of another type with the same key. Forgotten series are evicted first
+
+Args:
+
+	now time.Time: current time
+
+Returns:
+
+	map[string]bool: stale series keys
+*/
+func (h *Heartbeats) staleSeries(now time.Time) map[string]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.evictSeries(now)
+	stale := make(map[string]bool)
+	for typed, seen := range h.series {
+		_, key, _ := strings.Cut(typed, "/")
+		isStale, known := stale[key]
+		if now.Sub(seen) > h.staleAfter {
+			stale[key] = !known || isStale
+		} else {
+			stale[key] = false
+		}
+	}
+	for key, isStale := range stale {
+		if !isStale {
+			delete(stale, key)
+		}
+	}
+	return stale
+}
+
+/*
+TrackedStorage wraps the storage and records updates of series in Heartbeats.
+If marking of stale metrics is enabled, stale rows of the HTML view are greyed out
+*/
+type TrackedStorage struct {
+	MetricStorager
+	hb *Heartbeats
+}
+
+/*
+NewTrackedStorage wraps the storage
+
+Args:
+
+	s MetricStorager: wrapped storage
+	hb *Heartbeats: tracker of updates
+
+Returns:
+
+	*TrackedStorage
+*/
+func NewTrackedStorage(s MetricStorager, hb *Heartbeats) *TrackedStorage {
+	return &TrackedStorage{MetricStorager: s, hb: hb}
+}
+
+func (ts *TrackedStorage) UpdateGauge(ctx context.Context, metricName string, value float64) error {
+	err := ts.MetricStorager.UpdateGauge(ctx, metricName, value)
+	if err == nil {
+		ts.hb.SeenMetric(gauge, metricName, time.Now())
+	}
+	return err
+}
+
+func (ts *TrackedStorage) AddCounter(ctx context.Context, metricName string, delta int64) error {
+	err := ts.MetricStorager.AddCounter(ctx, metricName, delta)
+	if err == nil {
+		ts.hb.SeenMetric(counter, metricName, time.Now())
+	}
+	return err
+}
+
+func (ts *TrackedStorage) AddHistogram(ctx context.Context, metricName string, h models.Histogram) error {
+	err := ts.MetricStorager.AddHistogram(ctx, metricName, h)
+	if err == nil {
+		ts.hb.SeenMetric(histogram, metricName, time.Now())
+	}
+	return err
+}
+
+func (ts *TrackedStorage) UpdateBatchGauge(ctx context.Context, metrics []struct {
+	MetricName  string
+	MetricValue *float64
+}) error {
+	err := ts.MetricStorager.UpdateBatchGauge(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, m := range metrics {
+		if m.MetricValue != nil {
+			ts.hb.SeenMetric(gauge, m.MetricName, now)
+		}
+	}
+	return nil
+}
+
+func (ts *TrackedStorage) AddBatchCounter(ctx context.Context, metrics []struct {
+	MetricName  string
+	MetricDelta *int64
+}) error {
+	err := ts.MetricStorager.AddBatchCounter(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, m := range metrics {
+		if m.MetricDelta != nil {
+			ts.hb.SeenMetric(counter, m.MetricName, now)
+		}
+	}
+	return nil
+}
+
+func (ts *TrackedStorage) AddBatchHistogram(ctx context.Context, metrics []struct {
+	MetricName      string
+	MetricHistogram *models.Histogram
+}) error {
+	err := ts.MetricStorager.AddBatchHistogram(ctx, metrics)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, m := range metrics {
+		if m.MetricHistogram != nil {
+			ts.hb.SeenMetric(histogram, m.MetricName, now)
+		}
+	}
+	return nil
+}
+
+func (ts *TrackedStorage) UpdateBatchOnce(ctx context.Context, key string, batch *models.MetricsBatch) (bool, error) {
+	applied, err := ts.MetricStorager.UpdateBatchOnce(ctx, key, batch)
+	if err != nil || !applied {
+		return applied, err
+	}
+	now := time.Now()
+	for _, m := range batch.Gauges {
+		ts.hb.SeenMetric(gauge, m.MetricName, now)
+	}
+	for _, m := range batch.Counters {
+		ts.hb.SeenMetric(counter, m.MetricName, now)
+	}
+	for _, m := range batch.Histograms {
+		ts.hb.SeenMetric(histogram, m.MetricName, now)
+	}
+	return true, nil
+}
+
+/*
+HTML returns the HTML view of the wrapped storage. If marking of stale metrics is enabled,
+rows of stale series are greyed out and their names get the "(stale)" suffix
+
+Args:
+
+	ctx context.Context
+	stale map[string]bool: series keys, which are marked as stale in addition to the tracked ones, may be nil
+
+Returns:
+
+	string: html representation of the storage
+*/
+func (ts *TrackedStorage) HTML(ctx context.Context, stale map[string]bool) string {
+	if !ts.hb.markStale {
+		return ts.MetricStorager.HTML(ctx, stale)
+	}
+	tracked := ts.hb.staleSeries(time.Now())
+	maps.Copy(tracked, stale)
+	return ts.MetricStorager.HTML(ctx, tracked)
+}
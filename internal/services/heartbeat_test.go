@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
+)
+
+func TestHeartbeats_Agents(t *testing.T) {
+	hb := NewHeartbeats(time.Minute, false)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hb.SeenAgent(`agent-1`, `10.0.0.1`, start)
+	hb.SeenAgent(`agent-1`, `10.0.0.1`, start.Add(30*time.Second))
+	hb.SeenAgent(``, `10.0.0.2`, start)
+
+	got := hb.Agents(start.Add(80 * time.Second))
+	if len(got) != 2 {
+		t.Fatalf("Agents() = %+v, want 2 agents", got)
+	}
+	// agent without id is identified by its address
+	want := []struct {
+		id       string
+		status   string
+		requests int64
+	}{{`10.0.0.2`, models.AgentStale, 1}, {`agent-1`, models.AgentUp, 2}}
+	for i, w := range want {
+		if got[i].ID != w.id || got[i].Status != w.status || got[i].Requests != w.requests {
+			t.Errorf("Agents()[%d] = %+v, want id %s, status %s, requests %d", i, got[i], w.id, w.status, w.requests)
+		}
+	}
+	if got[1].Staleness != 50 {
+		t.Errorf("Agents()[1].Staleness = %g, want 50", got[1].Staleness)
+	}
+}
+
+func TestHeartbeats_EvictAgents(t *testing.T) {
+	hb := NewHeartbeats(time.Minute, false)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hb.SeenAgent(`old`, `10.0.0.1`, start)
+	hb.SeenAgent(`alive`, `10.0.0.2`, start)
+	hb.SeenAgent(`alive`, `10.0.0.2`, start.Add(9*time.Minute))
+
+	// a new agent evicts agents, which didn't report for agentEvictFactor stale timeouts
+	hb.SeenAgent(`new`, `10.0.0.3`, start.Add(11*time.Minute))
+	if got := len(hb.agents); got != 2 {
+		t.Errorf("agents = %d, want 2 after eviction", got)
+	}
+	got := hb.Agents(start.Add(11 * time.Minute))
+	if len(got) != 2 || got[0].ID != `alive` || got[1].ID != `new` {
+		t.Errorf("Agents() = %+v, want alive and new", got)
+	}
+}
+
+func TestHeartbeats_EvictSeries(t *testing.T) {
+	hb := NewHeartbeats(time.Minute, true)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hb.SeenMetric(`gauge`, `Alloc{pod="a"}`, start)
+	hb.SeenMetric(`gauge`, `Alloc{pod="b"}`, start.Add(9*time.Minute))
+
+	// a new series evicts series, which weren't updated for agentEvictFactor stale timeouts
+	hb.SeenMetric(`gauge`, `Alloc{pod="c"}`, start.Add(11*time.Minute))
+	if got := len(hb.series); got != 2 {
+		t.Errorf("series = %d, want 2 after eviction", got)
+	}
+	if _, _, ok := hb.MetricStaleness(`gauge`, `Alloc{pod="a"}`, start.Add(11*time.Minute)); ok {
+		t.Errorf("MetricStaleness() of the evicted series is known")
+	}
+
+	// rendering evicts too
+	stale := hb.staleSeries(start.Add(20 * time.Minute))
+	if len(hb.series) != 1 || !stale[`Alloc{pod="c"}`] {
+		t.Errorf("series = %v, stale = %v, want only the stale pod c", hb.series, stale)
+	}
+}
+
+func TestTrackedStorage(t *testing.T) {
+	hb := NewHeartbeats(time.Minute, true)
+	ts := NewTrackedStorage(memstorage.NewMemStorage(), hb)
+	_ = ts.UpdateGauge(context.TODO(), `Alloc`, 1)
+	value := int64(1)
+	_ = ts.AddBatchCounter(context.TODO(), []struct {
+		MetricName  string
+		MetricDelta *int64
+	}{{MetricName: `PollCount`, MetricDelta: &value}})
+
+	now := time.Now()
+	if _, stale, ok := hb.MetricStaleness(`counter`, `PollCount`, now); !ok || stale {
+		t.Errorf("MetricStaleness(PollCount) = %v, %v, want fresh", stale, ok)
+	}
+	if _, _, ok := hb.MetricStaleness(`gauge`, `Unknown`, now); ok {
+		t.Errorf("MetricStaleness(Unknown) is known")
+	}
+
+	// PollCount is updated again, Alloc is frozen
+	hb.SeenMetric(`gauge`, `Alloc`, now.Add(-2*time.Minute))
+	if _, stale, _ := hb.MetricStaleness(`gauge`, `Alloc`, now); !stale {
+		t.Errorf("MetricStaleness(Alloc) isn't stale")
+	}
+	html := ts.HTML(context.TODO(), nil)
+	if !strings.Contains(html, `<td>Alloc (stale)</td>`) || strings.Contains(html, `PollCount (stale)`) {
+		t.Errorf("HTML() doesn't mark only Alloc as stale:\n%s", html)
+	}
+}
+
+func TestNewAgentIDTransport(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(AgentIDHeader)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewAgentIDTransport(`agent-1`, nil)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if got != `agent-1` {
+		t.Errorf("%s = %q, want agent-1", AgentIDHeader, got)
+	}
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+/*
+NewAlertNotifiers creates notifiers enabled in the configuration
+
+Args:
+
+	conf *config.ServerConfig: configuration of the server
+
+Returns:
+
+	[]AlertNotifier: webhook, file and SMTP notifiers, empty if nothing is configured
+*/
+func NewAlertNotifiers(conf *config.ServerConfig) []AlertNotifier {
+	notifiers := []AlertNotifier{}
+	if conf.NotifyWebhook != "" {
+		notifiers = append(notifiers, NewWebhookNotifier(conf.NotifyWebhook, &http.Client{Timeout: 10 * time.Second}, 3, time.Second))
+	}
+	if conf.NotifyFile != "" {
+		notifiers = append(notifiers, NewFileNotifier(conf.NotifyFile))
+	}
+	if conf.SMTPAddr != "" && len(conf.SMTPTo) > 0 {
+		notifiers = append(notifiers, NewSMTPNotifier(conf.SMTPAddr, conf.SMTPFrom, conf.SMTPTo, conf.SMTPUser, conf.SMTPPassword))
+	}
+	return notifiers
+}
+
+/*
+WebhookNotifier posts notifications in JSON to the URL. Failed requests and answers with 5xx or 429 status
+are retried with exponential backoff
+*/
+type WebhookNotifier struct {
+	url      string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+/*
+NewWebhookNotifier creates the webhook notifier
+
+Args:
+
+	url string: URL of the webhook
+	client *http.Client: client for sending requests
+	attempts int: maximum number of attempts
+	backoff time.Duration: delay before the second attempt, every next delay is doubled
+
+Returns:
+
+	*WebhookNotifier
+*/
+func NewWebhookNotifier(url string, client *http.Client, attempts int, backoff time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: client, attempts: max(attempts, 1), backoff: backoff}
+}
+
+/*
+Notify sends the notification to the webhook
+
+Args:
+
+	ctx context.Context: retries stop, when the context is cancelled
+	n models.Notification: notification
+
+Returns:
+
+	error: nil or error of the last attempt
+*/
+func (wn *WebhookNotifier) Notify(ctx context.Context, n models.Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	delay := wn.backoff
+	for i := 0; ; i++ {
+		retry, err := wn.post(ctx, body)
+		if !retry || i+1 >= wn.attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w, last error: %v", ctx.Err(), err)
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends one request to the webhook and reports, whether the request can be retried
+func (wn *WebhookNotifier) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	case resp.StatusCode >= http.StatusBadRequest:
+		// the same request will be rejected again
+		return false, fmt.Errorf("webhook rejected notification: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// FileNotifier appends notifications to the file, one JSON object per line
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+/*
+NewFileNotifier creates the file notifier
+
+Args:
+
+	path string: path to the JSONL file, the file is created if needed
+
+Returns:
+
+	*FileNotifier
+*/
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+/*
+Notify appends the notification to the file
+
+Args:
+
+	ctx context.Context
+	n models.Notification: notification
+
+Returns:
+
+	error: nil or error of writing the file
+*/
+func (fn *FileNotifier) Notify(ctx context.Context, n models.Notification) error {
+	line, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	file, err := os.OpenFile(fn.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// smtpTimeout limits the SMTP session, if the context has no deadline
+const smtpTimeout = 30 * time.Second
+
+// SMTPNotifier sends notifications by e-mail
+type SMTPNotifier struct {
+	addr string
+	from string
+	to   []string
+	auth smtp.Auth
+}
+
+/*
+NewSMTPNotifier creates the SMTP notifier. PLAIN authentication is used, if the user is set
+
+Args:
+
+	addr string: address of the SMTP server, example: localhost:25
+	from string: sender address
+	to []string: recipient addresses
+	user string: user for authentication, empty - no authentication
+	password string: password for authentication
+
+Returns:
+
+	*SMTPNotifier
+*/
+func NewSMTPNotifier(addr, from string, to []string, user, password string) *SMTPNotifier {
+	sn := &SMTPNotifier{addr: addr, from: from, to: to}
+	if user != "" {
+		host, _, _ := strings.Cut(addr, `:`)
+		sn.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return sn
+}
+
+/*
+Notify sends the notification as a plain text message. STARTTLS is used, if the server supports it
+
+Args:
+
+	ctx context.Context: deadline of the SMTP session, smtpTimeout is used if the context has no deadline.
+		Cancelling the context interrupts the session
+	n models.Notification: notification
+
+Returns:
+
+	error: nil or error of the SMTP session
+*/
+func (sn *SMTPNotifier) Notify(ctx context.Context, n models.Notification) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", sn.addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	host, _, _ := strings.Cut(sn.addr, `:`)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err = sn.send(c, host, formatMail(sn.from, sn.to, n)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+/*
+send passes the message to the SMTP server the same way as smtp.SendMail
+
+Args:
+
+	c *smtp.Client: client of the opened session
+	host string: name of the server for checking its certificate
+	msg []byte: message with headers
+
+Returns:
+
+	error: nil or error of the SMTP command
+*/
+func (sn *SMTPNotifier) send(c *smtp.Client, host string, msg []byte) error {
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if sn.auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(sn.auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err := c.Mail(sn.from); err != nil {
+		return err
+	}
+	for _, to := range sn.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+/*
+formatMail creates the e-mail message with the notification
+
+Args:
+
+	from string: sender address
+	to []string: recipient addresses
+	n models.Notification: notification
+
+Returns:
+
+	[]byte: message with headers and CRLF line endings
+*/
+func formatMail(from string, to []string, n models.Notification) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: [%s] %s (%d)\r\n", strings.ToUpper(n.Status), n.Group, len(n.Alerts))
+	fmt.Fprintf(&b, "Date: %s\r\n", n.SentAt.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, a := range n.Alerts {
+		fmt.Fprintf(&b, "%s %s: %s = %g\r\n", strings.ToUpper(a.State), a.Name, a.Expr, a.Value)
+		for name, value := range a.Annotations {
+			fmt.Fprintf(&b, "  %s: %s\r\n", name, value)
+		}
+	}
+	return []byte(b.String())
+}
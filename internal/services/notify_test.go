@@ -0,0 +1,184 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+func testNotification() models.Notification {
+	return models.Notification{
+		Group:  `alertname="HighHeap"`,
+		Status: models.AlertFiring,
+		Alerts: []models.Alert{{Name: `HighHeap`, State: models.AlertFiring, Expr: `gauge HeapAlloc > 100`, Value: 200}},
+		SentAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestWebhookNotifier_Notify(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: `Success`, statuses: []int{200}, wantCalls: 1},
+		{name: `Retry after 5xx`, statuses: []int{503, 429, 200}, wantCalls: 3},
+		{name: `Attempts exhausted`, statuses: []int{500, 500, 500, 500}, wantCalls: 3, wantErr: true},
+		{name: `No retry after 4xx`, statuses: []int{400, 200}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := calls.Add(1) - 1
+				var n models.Notification
+				if err := json.NewDecoder(r.Body).Decode(&n); err != nil || n.Group != testNotification().Group {
+					t.Errorf("bad notification %+v: %v", n, err)
+				}
+				w.WriteHeader(tt.statuses[i])
+			}))
+			defer srv.Close()
+
+			wn := NewWebhookNotifier(srv.URL, srv.Client(), 3, time.Millisecond)
+			if err := wn.Notify(context.Background(), testNotification()); (err != nil) != tt.wantErr {
+				t.Errorf("WebhookNotifier.Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("webhook called %d times, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFileNotifier_Notify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `alerts.jsonl`)
+	fn := NewFileNotifier(path)
+	for i := 0; i < 2; i++ {
+		if err := fn.Notify(context.Background(), testNotification()); err != nil {
+			t.Fatalf("FileNotifier.Notify() error = %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("cannot read file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("file has %d lines, want 2", len(lines))
+	}
+	var n models.Notification
+	if err = json.Unmarshal([]byte(lines[1]), &n); err != nil || n.Alerts[0].Name != `HighHeap` {
+		t.Errorf("line = %s, error = %v", lines[1], err)
+	}
+}
+
+// fakeSMTPServer accepts one message and sends its DATA to the channel
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 fake ESMTP")
+		var data strings.Builder
+		inData := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if inData {
+				if line == ".\r\n" {
+					inData = false
+					messages <- data.String()
+					reply("250 queued")
+					continue
+				}
+				data.WriteString(line)
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 fake")
+			case cmd == "DATA":
+				inData = true
+				reply("354 go ahead")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestSMTPNotifier_Notify(t *testing.T) {
+	addr, messages := fakeSMTPServer(t)
+	sn := NewSMTPNotifier(addr, `metrics@example.com`, []string{`ops@example.com`}, ``, ``)
+	if err := sn.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatalf("SMTPNotifier.Notify() error = %v", err)
+	}
+	select {
+	case msg := <-messages:
+		for _, want := range []string{`To: ops@example.com`, `Subject: [FIRING] alertname="HighHeap" (1)`, `FIRING HighHeap: gauge HeapAlloc > 100 = 200`} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("message doesn't contain %q:\n%s", want, msg)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message wasn't received")
+	}
+}
+
+func TestSMTPNotifier_NotifyTimeout(t *testing.T) {
+	// the server accepts the connection and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		conn.Close()
+	}()
+
+	sn := NewSMTPNotifier(ln.Addr().String(), `metrics@example.com`, []string{`ops@example.com`}, ``, ``)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := sn.Notify(ctx, testNotification()); err == nil {
+		t.Fatal("SMTPNotifier.Notify() error = nil, want timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SMTPNotifier.Notify() returned after %v, want about 100ms", elapsed)
+	}
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sender sends one snapshot of metrics to the server
+type sender func(l logger, ms MetricsGetter) error
+
+/*
+StartReportWorkers starts the fixed pool of workers, that send snapshots of metrics from the jobs channel.
+Every worker sends one snapshot at a time, so no more than n requests are in flight.
+Workers exit after the jobs channel is closed and drained
+
+Args:
+
+	wg *sync.WaitGroup: pointer to sync.WaitGroup, which is done when all workers exit
+	n int: number of workers, values less than 1 are treated as 1
+	jobs <-chan MetricsGetter: channel with snapshots for sending
+	l logger: a logger used for printing messages
+	send sender: function for sending one snapshot
+
+Returns:
+
+	None
+*/
+func StartReportWorkers(wg *sync.WaitGroup, n int, jobs <-chan MetricsGetter, l logger, send sender) {
+	if n < 1 {
+		n = 1
+	}
+	wg.Add(n)
+	for id := 1; id <= n; id++ {
+		go reportWorker(id, wg, jobs, l, send)
+	}
+}
+
+/*
+reportWorker sends snapshots from the jobs channel until it is closed
+
+Args:
+
+	id int: number of the worker for logging
+	wg *sync.WaitGroup: pointer to sync.WaitGroup of the pool
+	jobs <-chan MetricsGetter: channel with snapshots for sending
+	l logger: a logger used for printing messages
+	send sender: function for sending one snapshot
+
+Returns:
+
+	None
+*/
+func reportWorker(id int, wg *sync.WaitGroup, jobs <-chan MetricsGetter, l logger, send sender) {
+	defer wg.Done()
+	for ms := range jobs {
+		if err := send(l, ms); err != nil {
+			l.Error("sending metrics", "worker", id, "error", err.Error())
+		}
+	}
+	l.Debug("report worker stopped", "worker", id)
+}
+
+/*
+flushReports passes the snapshots left in dataChan to the workers, closes the jobs channel and waits
+until workers finish sending. Gives up when the timeout expires, the unsent snapshots are lost
+
+Args:
+
+	l logger: a logger used for printing messages
+	dataChan chan MetricsAddGetter: channel with buffered snapshots
+	jobs chan<- MetricsGetter: channel of the workers pool
+	wg *sync.WaitGroup: pointer to sync.WaitGroup of the pool
+	timeout time.Duration: deadline for sending all snapshots
+
+Returns:
+
+	bool: true if all snapshots were sent before the deadline
+*/
+func flushReports(l logger, dataChan chan MetricsAddGetter, jobs chan<- MetricsGetter, wg *sync.WaitGroup, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	l.Info("Flushing buffered metrics", "snapshots", len(dataChan), "timeout", timeout)
+FLUSH:
+	for len(dataChan) > 0 {
+		ms := <-dataChan
+		select {
+		case jobs <- ms:
+		case <-ctx.Done():
+			// the current snapshot is lost too
+			l.Error("flush deadline exceeded", "lost snapshots", len(dataChan)+1)
+			break FLUSH
+		}
+	}
+	close(jobs)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		l.Info("Report workers stopped")
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		l.Error("flush deadline exceeded, report workers are still sending")
+		return false
+	}
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+func TestStartReportWorkers(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		jobs    int
+		wantMax int32
+	}{
+		{name: `Single worker`, workers: 1, jobs: 10, wantMax: 1},
+		{name: `Three workers`, workers: 3, jobs: 20, wantMax: 3},
+		{name: `Zero workers means one`, workers: 0, jobs: 5, wantMax: 1},
+		{name: `More workers than jobs`, workers: 8, jobs: 4, wantMax: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inFlight, maxInFlight, done int32
+			send := func(l logger, ms MetricsGetter) error {
+				cur := atomic.AddInt32(&inFlight, 1)
+				for {
+					m := atomic.LoadInt32(&maxInFlight)
+					if cur <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, cur) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+				atomic.AddInt32(&done, 1)
+				return nil
+			}
+
+			jobs := make(chan MetricsGetter)
+			var wg sync.WaitGroup
+			StartReportWorkers(&wg, tt.workers, jobs, testLogger{}, send)
+			for i := 0; i < tt.jobs; i++ {
+				jobs <- &models.JSONMetrics{}
+			}
+			close(jobs)
+			wg.Wait()
+
+			if done != int32(tt.jobs) {
+				t.Errorf("sent %d snapshots, want %d", done, tt.jobs)
+			}
+			if maxInFlight > tt.wantMax {
+				t.Errorf("max concurrent sends = %d, want <= %d", maxInFlight, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestReportMetricsRateLimit(t *testing.T) {
+	const rateLimit = 2
+	var inFlight, maxInFlight, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if cur <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, cur) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	conf := config.NewAgentConfig()
+	conf.AddressServer = server.URL
+	// snapshots are sent by the flush on shutdown
+	conf.ReportInterval = time.Hour
+	conf.Compress = `none`
+	conf.RateLimit = rateLimit
+
+	const snapshots = 10
+	dataChan := make(chan MetricsAddGetter, snapshots)
+	for i := 0; i < snapshots; i++ {
+		jms := models.NewJSONMetrics(nil)
+		_ = jms.AddPollCount(int64(i))
+		dataChan <- jms
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	wg.Add(1)
+	ReportMetrics(ctx, &wg, dataChan, nil, testLogger{}, conf, server.Client(), nil)
+
+	if requests != snapshots {
+		t.Errorf("server received %d requests, want %d", requests, snapshots)
+	}
+	if maxInFlight > rateLimit {
+		t.Errorf("max concurrent requests = %d, want <= %d", maxInFlight, rateLimit)
+	}
+}
+
+func Test_flushReportsDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	send := func(l logger, ms MetricsGetter) error {
+		<-release
+		return nil
+	}
+
+	dataChan := make(chan MetricsAddGetter, 3)
+	for i := 0; i < 3; i++ {
+		dataChan <- models.NewJSONMetrics(nil)
+	}
+	jobs := make(chan MetricsGetter)
+	var wg sync.WaitGroup
+	StartReportWorkers(&wg, 1, jobs, testLogger{}, send)
+
+	start := time.Now()
+	if flushReports(testLogger{}, dataChan, jobs, &wg, 50*time.Millisecond) {
+		t.Errorf("flushReports() = true, want false for a stuck sender")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("flushReports() took %v, want it bounded by the timeout", d)
+	}
+}
+
+func TestReportMetricsShutdownBlockedSender(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	conf := config.NewAgentConfig()
+	conf.AddressServer = server.URL
+	conf.ReportInterval = 10 * time.Millisecond
+	conf.ShutdownTimeout = 50 * time.Millisecond
+	conf.Compress = `none`
+	conf.RateLimit = 1
+
+	// more snapshots than the worker and the jobs channel can take
+	dataChan := make(chan MetricsAddGetter, 5)
+	for i := 0; i < 5; i++ {
+		jms := models.NewJSONMetrics(nil)
+		_ = jms.AddPollCount(int64(i))
+		dataChan <- jms
+	}
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go ReportMetrics(ctx, &wg, dataChan, nil, testLogger{}, conf, server.Client(), nil)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("ReportMetrics() didn't stop with a blocked sender")
+	}
+}
@@ -0,0 +1,205 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// PrometheusContentType is the content type of the Prometheus text exposition format
+const PrometheusContentType = `text/plain; version=0.0.4; charset=utf-8`
+
+/*
+SanitizePrometheusName converts a metric name into a valid Prometheus metric name.
+Invalid characters are replaced with '_', a name starting with a digit is prefixed with '_'
+
+Args:
+
+	name string: original metric name
+
+Returns:
+
+	string: name matching [a-zA-Z_:][a-zA-Z0-9_:]*
+*/
+func SanitizePrometheusName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+/*
+formatPrometheusValue formats float value as Prometheus sample value
+
+Args:
+
+	v float64
+
+Returns:
+
+	string: shortest representation of the value, special values as +Inf, -Inf and NaN
+*/
+func formatPrometheusValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Single series of the metric family
+type promSeries struct {
+	key    string // ключ серии в хранилище
+	labels string // каноническое представление меток
+}
+
+/*
+promFamilies groups series keys by metric name. Keys which cannot be parsed are treated as names without labels
+
+Args:
+
+	series map[string]V: values of metrics by series keys
+
+Returns:
+
+	[]string: sorted metric names
+	map[string][]promSeries: series of every metric name sorted by labels
+*/
+func promFamilies[V any](series map[string]V) ([]string, map[string][]promSeries) {
+	families := make(map[string][]promSeries)
+	for key := range series {
+		name, labels, err := models.ParseSeriesKey(key)
+		if err != nil {
+			name, labels = key, nil
+		}
+		families[name] = append(families[name], promSeries{key: key, labels: models.FormatLabels(labels)})
+	}
+	names := make([]string, 0, len(families))
+	for name, series := range families {
+		names = append(names, name)
+		sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+	}
+	sort.Strings(names)
+	return names, families
+}
+
+/*
+promLabels joins canonical label sets into Prometheus label block
+
+Args:
+
+	sets ...string: canonical label sets, empty sets are skipped
+
+Returns:
+
+	string: label block with braces or empty string
+*/
+func promLabels(sets ...string) string {
+	parts := make([]string, 0, len(sets))
+	for _, s := range sets {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return `{` + strings.Join(parts, `,`) + `}`
+}
+
+/*
+WritePrometheusMetrics writes all metrics from storage to the writer in Prometheus text exposition format.
+Series with the same name and different labels are exposed as one metric family.
+Histograms are exposed with cumulative buckets, sum and count. Metric families are sorted by name. If a counter name collides with a gauge name after sanitization,
+the counter is exposed with the "_total" suffix; other collisions are skipped
+
+Args:
+
+	ctx context.Context
+	mg MetricGetter: a storage that allows getting metrics
+	dst io.Writer: an object that allows data to be written to it
+
+Returns:
+
+	error: nil or error, if occured
+*/
+func WritePrometheusMetrics(ctx context.Context, mg MetricGetter, dst io.Writer) error {
+	snapshot, err := mg.GetAllMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	all := snapshot.Metrics
+
+	w := bufio.NewWriter(dst)
+	used := make(map[string]bool, len(all.Gauges)+len(all.Counters))
+
+	gaugeNames, gaugeSeries := promFamilies(all.Gauges)
+	for _, name := range gaugeNames {
+		promName := SanitizePrometheusName(name)
+		if used[promName] {
+			continue
+		}
+		used[promName] = true
+		fmt.Fprintf(w, "# TYPE %s %s\n", promName, gauge)
+		for _, ps := range gaugeSeries[name] {
+			fmt.Fprintf(w, "%s%s %s\n", promName, promLabels(ps.labels), formatPrometheusValue(all.Gauges[ps.key]))
+		}
+	}
+
+	counterNames, counterSeries := promFamilies(all.Counters)
+	for _, name := range counterNames {
+		promName := SanitizePrometheusName(name)
+		if used[promName] {
+			promName += `_total`
+		}
+		if used[promName] {
+			continue
+		}
+		used[promName] = true
+		fmt.Fprintf(w, "# TYPE %s %s\n", promName, counter)
+		for _, ps := range counterSeries[name] {
+			fmt.Fprintf(w, "%s%s %d\n", promName, promLabels(ps.labels), all.Counters[ps.key])
+		}
+	}
+
+	histogramNames, histogramSeries := promFamilies(all.Histograms)
+	for _, name := range histogramNames {
+		promName := SanitizePrometheusName(name)
+		if used[promName] {
+			continue
+		}
+		used[promName] = true
+		fmt.Fprintf(w, "# TYPE %s %s\n", promName, histogram)
+		for _, ps := range histogramSeries[name] {
+			h := all.Histograms[ps.key]
+			var cumulative int64
+			for i, c := range h.Counts {
+				cumulative += c
+				le := `+Inf`
+				if i < len(h.Bounds) {
+					le = formatPrometheusValue(h.Bounds[i])
+				}
+				fmt.Fprintf(w, "%s_bucket%s %d\n", promName, promLabels(ps.labels, `le="`+le+`"`), cumulative)
+			}
+			fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", promName, promLabels(ps.labels), formatPrometheusValue(h.Sum), promName, promLabels(ps.labels), h.Count)
+		}
+	}
+
+	return w.Flush()
+}
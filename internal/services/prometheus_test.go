@@ -0,0 +1,100 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
+)
+
+func TestSanitizePrometheusName(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{name: `Valid name`, arg: `HeapAlloc`, want: `HeapAlloc`},
+		{name: `Name with colon and underscore`, arg: `job:heap_alloc`, want: `job:heap_alloc`},
+		{name: `Name with dots and dashes`, arg: `cpu.usage-total`, want: `cpu_usage_total`},
+		{name: `Name starting with digit`, arg: `1minute`, want: `_1minute`},
+		{name: `Name with unicode`, arg: `память`, want: `______`},
+		{name: `Empty name`, arg: ``, want: `_`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizePrometheusName(tt.arg); got != tt.want {
+				t.Errorf("SanitizePrometheusName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		gauges     map[string]float64
+		counters   map[string]int64
+		histograms map[string]models.Histogram
+		want       string
+	}{
+		{
+			name:     `Empty storage`,
+			gauges:   map[string]float64{},
+			counters: map[string]int64{},
+			want:     ``,
+		},
+		{
+			name:     `Gauges and counters`,
+			gauges:   map[string]float64{`b.gauge`: 3.14, `Alloc`: 1024, `Inf`: math.Inf(1)},
+			counters: map[string]int64{`PollCount`: 42},
+			want: "# TYPE Alloc gauge\nAlloc 1024\n" +
+				"# TYPE Inf gauge\nInf +Inf\n" +
+				"# TYPE b_gauge gauge\nb_gauge 3.14\n" +
+				"# TYPE PollCount counter\nPollCount 42\n",
+		},
+		{
+			name:     `Counter collides with gauge`,
+			gauges:   map[string]float64{`requests`: 1.5},
+			counters: map[string]int64{`requests`: 7},
+			want: "# TYPE requests gauge\nrequests 1.5\n" +
+				"# TYPE requests_total counter\nrequests_total 7\n",
+		},
+		{
+			name:     `Histogram`,
+			gauges:   map[string]float64{},
+			counters: map[string]int64{},
+			histograms: map[string]models.Histogram{
+				`latency`: {Bounds: []float64{0.1, 1}, Counts: []int64{2, 1, 1}, Sum: 3.5, Count: 4},
+			},
+			want: "# TYPE latency histogram\n" +
+				"latency_bucket{le=\"0.1\"} 2\n" +
+				"latency_bucket{le=\"1\"} 3\n" +
+				"latency_bucket{le=\"+Inf\"} 4\n" +
+				"latency_sum 3.5\nlatency_count 4\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := memstorage.NewMemStorage()
+			for name, value := range tt.gauges {
+				_ = ms.UpdateGauge(context.TODO(), name, value)
+			}
+			for name, delta := range tt.counters {
+				_ = ms.AddCounter(context.TODO(), name, delta)
+			}
+			for name, h := range tt.histograms {
+				_ = ms.AddHistogram(context.TODO(), name, h)
+			}
+			var buf bytes.Buffer
+			if err := WritePrometheusMetrics(context.TODO(), ms, &buf); err != nil {
+				t.Fatalf("WritePrometheusMetrics() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("WritePrometheusMetrics() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+)
+
+// levelSetter changes the level of the working logger
+type levelSetter interface {
+	SetLevel(levelString string)
+}
+
+/*
+LiveConfig keeps the settings of the server, that can be changed without restart: log level, store interval,
+trusted subnet, signing key and alerting rules. Middlewares and interceptors read the settings on every request
+*/
+type LiveConfig struct {
+	mu             sync.RWMutex
+	conf           config.ServerConfig
+	subnet         *net.IPNet
+	alerts         *AlertEngine
+	levels         levelSetter
+	storeIntervals chan time.Duration
+}
+
+/*
+NewLiveConfig creates the live settings from the config, which the server was started with
+
+Args:
+
+	conf *config.ServerConfig: pointer to the loaded config
+	alerts *AlertEngine: engine, which gets reloaded alerting rules
+	levels levelSetter: logger, which level is changed, may be nil
+
+Returns:
+
+	*LiveConfig
+	error: nil or error of parsing the trusted subnet
+*/
+func NewLiveConfig(conf *config.ServerConfig, alerts *AlertEngine, levels levelSetter) (*LiveConfig, error) {
+	subnet, err := ParseTrustedSubnet(conf.TrustedSubnet)
+	if err != nil {
+		return nil, err
+	}
+	return &LiveConfig{
+		conf:           *conf,
+		subnet:         subnet,
+		alerts:         alerts,
+		levels:         levels,
+		storeIntervals: make(chan time.Duration, 1),
+	}, nil
+}
+
+// Key returns the current key for signing, empty - signing is disabled
+func (lc *LiveConfig) Key() string {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.conf.Key
+}
+
+// TrustedSubnet returns the current trusted subnet, nil - any address is trusted
+func (lc *LiveConfig) TrustedSubnet() *net.IPNet {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.subnet
+}
+
+// StoreIntervals returns the channel with new intervals of periodic saving to the file
+func (lc *LiveConfig) StoreIntervals() <-chan time.Duration {
+	return lc.storeIntervals
+}
+
+/*
+Apply applies the safe changes of the reloaded config. All new values are checked first,
+so a broken config changes nothing
+
+Args:
+
+	next *config.ServerConfig: reloaded config
+
+Returns:
+
+	applied []string: names of the settings changed live
+	restart []string: names of the changed settings, which need a restart of the server
+	err error: nil or error of checking the trusted subnet or loading alerting rules
+*/
+func (lc *LiveConfig) Apply(next *config.ServerConfig) (applied []string, restart []string, err error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	subnet, err := ParseTrustedSubnet(next.TrustedSubnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the rules file is re-read even if its path isn't changed
+	var rules []AlertRule
+	if next.RulesFile != "" {
+		if rules, err = LoadAlertRules(next.RulesFile); err != nil {
+			return nil, nil, fmt.Errorf("rules file %s: %w", next.RulesFile, err)
+		}
+	}
+	// periodic saving can't be switched on or off live: synchronous saving is a middleware
+	periodic := lc.conf.DatabaseDSN == "" && lc.conf.StoreInterval > 0 && next.StoreInterval > 0
+
+	for _, name := range lc.conf.ChangedSettings(next) {
+		switch {
+		case name == `log_level`:
+			if lc.levels == nil {
+				restart = append(restart, name)
+				continue
+			}
+			lc.levels.SetLevel(next.LogLevel)
+			lc.conf.LogLevel = next.LogLevel
+		case name == `store_interval` && periodic:
+			select {
+			case <-lc.storeIntervals: // the previous interval isn't read yet
+			default:
+			}
+			lc.storeIntervals <- time.Duration(next.StoreInterval) * time.Second
+			lc.conf.StoreInterval = next.StoreInterval
+		case name == `trusted_subnet`:
+			lc.subnet = subnet
+			lc.conf.TrustedSubnet = next.TrustedSubnet
+		case name == `key`:
+			lc.conf.Key = next.Key
+		case name == `rules_file` && lc.alerts != nil:
+			lc.conf.RulesFile = next.RulesFile
+		default:
+			restart = append(restart, name)
+			continue
+		}
+		applied = append(applied, name)
+	}
+	if lc.alerts != nil {
+		lc.alerts.SetRules(rules, time.Now())
+		if next.RulesFile != "" && !slices.Contains(applied, `rules_file`) {
+			applied = append(applied, `rules`)
+		}
+	}
+	return applied, restart, nil
+}
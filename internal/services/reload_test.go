@@ -0,0 +1,130 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+)
+
+type recordingLevels struct {
+	level string
+}
+
+func (rl *recordingLevels) SetLevel(levelString string) {
+	rl.level = levelString
+}
+
+func TestLiveConfig_Apply(t *testing.T) {
+	rulesFile := filepath.Join(t.TempDir(), `rules.json`)
+	if err := os.WriteFile(rulesFile, []byte(`{"rules": [{"name": "HighHeap", "expr": "gauge HeapAlloc > 100"}]}`), 0o600); err != nil {
+		t.Fatalf("cannot write rules file: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		change      func(sc *config.ServerConfig)
+		wantApplied []string
+		wantRestart []string
+		wantErr     bool
+	}{
+		{
+			name: `live settings`,
+			change: func(sc *config.ServerConfig) {
+				sc.LogLevel, sc.Key, sc.TrustedSubnet, sc.StoreInterval = `DEBUG`, `secret`, `10.0.0.0/8`, 10
+			},
+			wantApplied: []string{`log_level`, `store_interval`, `key`, `trusted_subnet`},
+		},
+		{
+			name: `restart settings`,
+			change: func(sc *config.ServerConfig) {
+				sc.Endpoint, sc.DatabaseDSN, sc.StoreInterval = `:9090`, `postgres://db`, 0
+			},
+			wantRestart: []string{`address`, `store_interval`, `database_dsn`},
+		},
+		{
+			name:        `rules`,
+			change:      func(sc *config.ServerConfig) { sc.RulesFile = rulesFile },
+			wantApplied: []string{`rules_file`},
+		},
+		{
+			name:    `bad subnet`,
+			change:  func(sc *config.ServerConfig) { sc.Key, sc.TrustedSubnet = `secret`, `10.0.0.0` },
+			wantErr: true,
+		},
+		{
+			name: `missing rules`,
+			change: func(sc *config.ServerConfig) {
+				sc.Key, sc.RulesFile = `secret`, filepath.Join(t.TempDir(), `missing.json`)
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			levels := &recordingLevels{}
+			alerts := NewAlertEngine(nil)
+			lc, err := NewLiveConfig(config.NewServerConfig(), alerts, levels)
+			if err != nil {
+				t.Fatalf("NewLiveConfig() error = %v", err)
+			}
+			next := config.NewServerConfig()
+			tt.change(next)
+			applied, restart, err := lc.Apply(next)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// nothing is applied from the broken config
+				if lc.Key() != "" || lc.TrustedSubnet() != nil {
+					t.Errorf("Apply() changed settings of the broken config")
+				}
+				return
+			}
+			if !sameNames(applied, tt.wantApplied) || !sameNames(restart, tt.wantRestart) {
+				t.Errorf("Apply() = %v, %v, want %v, %v", applied, restart, tt.wantApplied, tt.wantRestart)
+			}
+		})
+	}
+}
+
+// sameNames compares lists of setting names ignoring their order
+func sameNames(got, want []string) bool {
+	got, want = slices.Clone(got), slices.Clone(want)
+	slices.Sort(got)
+	slices.Sort(want)
+	return slices.Equal(got, want)
+}
+
+func TestLiveConfig_values(t *testing.T) {
+	levels := &recordingLevels{}
+	lc, err := NewLiveConfig(config.NewServerConfig(), NewAlertEngine(nil), levels)
+	if err != nil {
+		t.Fatalf("NewLiveConfig() error = %v", err)
+	}
+	next := config.NewServerConfig()
+	next.LogLevel, next.Key, next.TrustedSubnet, next.StoreInterval = `DEBUG`, `secret`, `10.0.0.0/8`, 10
+	if _, _, err = lc.Apply(next); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if levels.level != `DEBUG` {
+		t.Errorf("level = %s, want DEBUG", levels.level)
+	}
+	if lc.Key() != `secret` {
+		t.Errorf("Key() = %s, want secret", lc.Key())
+	}
+	if subnet := lc.TrustedSubnet(); subnet == nil || subnet.String() != `10.0.0.0/8` {
+		t.Errorf("TrustedSubnet() = %v, want 10.0.0.0/8", subnet)
+	}
+	select {
+	case d := <-lc.StoreIntervals():
+		if d != 10*time.Second {
+			t.Errorf("store interval = %v, want 10s", d)
+		}
+	default:
+		t.Errorf("store interval isn't sent")
+	}
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// Names of the metrics, which describe the progress of the retention job
+const (
+	retentionRolledUpRows = `RetentionRolledUpRows`    // counter of rows moved into rollups, label tier: 1m or 1h
+	retentionExpiredRows  = `RetentionExpiredRows`     // counter of deleted expired rows
+	retentionErrors       = `RetentionErrors`          // counter of failed runs
+	retentionLastDuration = `RetentionLastDuration`    // gauge, duration of the last run in seconds
+	retentionLastSuccess  = `RetentionLastSuccessTime` // gauge, unix time of the last successful run
+)
+
+/*
+applyRetention runs the retention job once and stores its progress as metrics in the storage.
+Rows processed before an error are counted too
+
+Args:
+
+	ctx context.Context
+	l logger: a logger used for printing messages
+	c HistoryCompactor: storage with the history
+	mu MetricUpdater: storage for the progress metrics
+	policy models.RetentionPolicy: retention periods and batch size
+
+Returns:
+
+	error: nil or error of the retention job
+*/
+func applyRetention(ctx context.Context, l logger, c HistoryCompactor, mu MetricUpdater, policy models.RetentionPolicy) error {
+	start := time.Now()
+	stats, err := c.ApplyRetention(ctx, policy, start)
+	duration := time.Since(start)
+
+	_ = mu.AddCounter(ctx, models.SeriesKey(retentionRolledUpRows, map[string]string{"tier": "1m"}), stats.RolledUpMinute)
+	_ = mu.AddCounter(ctx, models.SeriesKey(retentionRolledUpRows, map[string]string{"tier": "1h"}), stats.RolledUpHour)
+	_ = mu.AddCounter(ctx, retentionExpiredRows, stats.Expired)
+	_ = mu.UpdateGauge(ctx, retentionLastDuration, duration.Seconds())
+	if err != nil {
+		_ = mu.AddCounter(ctx, retentionErrors, 1)
+		return err
+	}
+	_ = mu.UpdateGauge(ctx, retentionLastSuccess, float64(start.Unix()))
+	l.Info("retention job finished", "rolled up 1m", stats.RolledUpMinute, "rolled up 1h", stats.RolledUpHour,
+		"expired", stats.Expired, "duration", duration)
+	return nil
+}
+
+/*
+RunRetention periodically compacts and deletes old history until the context is cancelled
+
+Args:
+
+	ctx context.Context
+	wg *sync.WaitGroup: pointer to sync.WaitGroup, which is done when the job exits
+	l logger: a logger used for printing messages
+	c HistoryCompactor: storage with the history
+	mu MetricUpdater: storage for the progress metrics
+	policy models.RetentionPolicy: retention periods, interval of runs and batch size
+
+Returns:
+
+	None
+*/
+func RunRetention(ctx context.Context, wg *sync.WaitGroup, l logger, c HistoryCompactor, mu MetricUpdater, policy models.RetentionPolicy) {
+	defer wg.Done()
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+	for {
+		if err := applyRetention(ctx, l, c, mu, policy); err != nil && ctx.Err() == nil {
+			l.Error("retention job failed", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			l.Info("retention job stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
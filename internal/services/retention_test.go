@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
+)
+
+// fakeCompactor returns the same result for every run of the retention job
+type fakeCompactor struct {
+	stats models.RetentionStats
+	err   error
+}
+
+func (fc fakeCompactor) ApplyRetention(ctx context.Context, policy models.RetentionPolicy, now time.Time) (models.RetentionStats, error) {
+	return fc.stats, fc.err
+}
+
+func Test_applyRetention(t *testing.T) {
+	m := memstorage.NewMemStorage()
+	c := fakeCompactor{stats: models.RetentionStats{RolledUpMinute: 100, RolledUpHour: 60, Expired: 5}}
+	for i := 0; i < 2; i++ {
+		if err := applyRetention(context.TODO(), testLogger{}, c, m, models.DefaultRetentionPolicy); err != nil {
+			t.Fatalf("applyRetention() error = %v", err)
+		}
+	}
+	minuteKey := models.SeriesKey(retentionRolledUpRows, map[string]string{"tier": "1m"})
+	if got := m.Counter[minuteKey]; got != 200 {
+		t.Errorf("%s = %d, want 200", minuteKey, got)
+	}
+	if got := m.Counter[retentionExpiredRows]; got != 10 {
+		t.Errorf("%s = %d, want 10", retentionExpiredRows, got)
+	}
+	if _, ok := m.Gauge[retentionLastSuccess]; !ok {
+		t.Errorf("%s is not set", retentionLastSuccess)
+	}
+
+	// rows processed before the error are counted too
+	m = memstorage.NewMemStorage()
+	c.err = errors.New("connection lost")
+	if err := applyRetention(context.TODO(), testLogger{}, c, m, models.DefaultRetentionPolicy); err == nil {
+		t.Fatalf("applyRetention() error = nil, want error")
+	}
+	if m.Counter[retentionErrors] != 1 || m.Counter[retentionExpiredRows] != 5 {
+		t.Errorf("counters after failed run = %v", m.Counter)
+	}
+	if _, ok := m.Gauge[retentionLastSuccess]; ok {
+		t.Errorf("%s is set after failed run", retentionLastSuccess)
+	}
+}
@@ -3,8 +3,10 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -15,8 +17,9 @@ import (
 )
 
 const (
-	gauge   = `gauge`
-	counter = `counter`
+	gauge     = `gauge`
+	counter   = `counter`
+	histogram = `histogram`
 )
 
 /*
@@ -60,12 +63,14 @@ Args:
 	ctx context.Context
 	q Querier: object, implementing Querier interface
 	s Storager: object, implementing Storager interface
+	bounds []float64: bucket bounds for a histogram, that doesn't exist in the storage yet
 
 Returns:
 
 	error: nil or error, if occurred
 */
-func UpdateMetrica(ctx context.Context, q Querier, s MetricUpdater) error {
+func UpdateMetrica(ctx context.Context, q Querier, s MetricGetUpdater, bounds []float64) error {
+	key := models.SeriesKey(q.GetMetricName(), q.GetMetricaLabels())
 	switch q.GetMetricaType() {
 	case gauge:
 		g, err := strconv.ParseFloat(q.GetMetricaRawValue(), 64)
@@ -73,7 +78,7 @@ func UpdateMetrica(ctx context.Context, q Querier, s MetricUpdater) error {
 			return myErrors.ErrParseGauge
 		}
 
-		err = retryQueryToDB(func() error { return s.UpdateGauge(ctx, q.GetMetricName(), g) })
+		err = retryQueryToDB(func() error { return s.UpdateGauge(ctx, key, g) })
 
 		if err != nil {
 			return myErrors.ErrUpdateGauge
@@ -83,16 +88,55 @@ func UpdateMetrica(ctx context.Context, q Querier, s MetricUpdater) error {
 		if err != nil {
 			return myErrors.ErrParseCounter
 		}
-		err = retryQueryToDB(func() error { return s.AddCounter(ctx, q.GetMetricName(), int64(c)) })
+		err = retryQueryToDB(func() error { return s.AddCounter(ctx, key, int64(c)) })
 		if err != nil {
 			return myErrors.ErrAddCounter
 		}
+	case histogram:
+		v, err := strconv.ParseFloat(q.GetMetricaRawValue(), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return myErrors.ErrParseHistogram
+		}
+		// a single observation uses bounds of the existing histogram
+		h := models.NewHistogram(bounds)
+		if current, err := s.GetMetrica(ctx, histogram, key); err == nil {
+			if ch, ok := current.(models.Histogram); ok {
+				h = models.NewHistogram(ch.Bounds)
+			}
+		}
+		h.Observe(v)
+		err = retryQueryToDB(func() error { return s.AddHistogram(ctx, key, h) })
+		if err != nil {
+			return errors.Join(myErrors.ErrUpdateHistogram, err)
+		}
 	default:
 		return myErrors.ErrBadType
 	}
 	return nil
 }
 
+/*
+JSONMetricaKey returns the storage key of the metric from the request: the metric name plus its labels
+
+Args:
+
+	jmq JSONMetricaQuerier: a request that allows getting the metric name and labels
+
+Returns:
+
+	string: series key, see models.SeriesKey
+	error: nil, myErrors.ErrBadMetricaName or myErrors.ErrBadLabels
+*/
+func JSONMetricaKey(jmq JSONMetricaQuerier) (string, error) {
+	if err := models.ValidateMetricName(jmq.GetMetricaName()); err != nil {
+		return "", err
+	}
+	if err := models.ValidateLabels(jmq.GetMetricaLabels()); err != nil {
+		return "", err
+	}
+	return models.SeriesKey(jmq.GetMetricaName(), jmq.GetMetricaLabels()), nil
+}
+
 /*
 JSONUpdateMetrica updates the metric value received from the request in the storage
 
@@ -107,19 +151,34 @@ Returns:
 	error: nil or error, if occured
 */
 func JSONUpdateMetrica(ctx context.Context, jmq JSONMetricaQuerier, mu MetricUpdater) error {
+	key, err := JSONMetricaKey(jmq)
+	if err != nil {
+		return err
+	}
 	ctx1s, cancel1s := context.WithTimeout(ctx, 1*time.Second)
 	defer cancel1s()
 	switch jmq.GetMetricaType() {
 	case gauge:
-		err := retryQueryToDB(func() error { return mu.UpdateGauge(ctx1s, jmq.GetMetricaName(), *jmq.GetMetricaValue()) })
+		err := retryQueryToDB(func() error { return mu.UpdateGauge(ctx1s, key, *jmq.GetMetricaValue()) })
 		if err != nil {
 			return myErrors.ErrUpdateGauge
 		}
 	case counter:
-		err := retryQueryToDB(func() error { return mu.AddCounter(ctx1s, jmq.GetMetricaName(), *jmq.GetMetricaCounter()) })
+		err := retryQueryToDB(func() error { return mu.AddCounter(ctx1s, key, *jmq.GetMetricaCounter()) })
 		if err != nil {
 			return myErrors.ErrAddCounter
 		}
+	case histogram:
+		if jmq.GetMetricaHistogram() == nil {
+			return fmt.Errorf("%w: histogram is not set", myErrors.ErrInvalidHistogram)
+		}
+		if err := jmq.GetMetricaHistogram().Validate(); err != nil {
+			return err
+		}
+		err := retryQueryToDB(func() error { return mu.AddHistogram(ctx1s, key, *jmq.GetMetricaHistogram()) })
+		if err != nil {
+			return errors.Join(myErrors.ErrUpdateHistogram, err)
+		}
 	default:
 		return myErrors.ErrBadType
 	}
@@ -140,11 +199,11 @@ Returns:
 	error: nil or error, if occured
 */
 func WriteMetrics(ctx context.Context, mg MetricGetter, dst io.Writer) error {
-	metrics, err := mg.GetAllMetrics(ctx)
+	snapshot, err := mg.GetAllMetrics(ctx)
 	if err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(metrics, "\t", "\t")
+	data, err := json.MarshalIndent(snapshot.Metrics, "\t", "\t")
 	if err != nil {
 		return err
 	}
@@ -169,15 +228,12 @@ Returns:
 	error: nil or error, if occured
 */
 func WriteMetricsWithTimestamp(ctx context.Context, mg MetricGetter, dst io.Writer) error {
-	var err error
-	blob := make(map[string]interface{})
-	blob["timestamp"] = time.Now()
-	blob["metrics"], err = mg.GetAllMetrics(ctx)
+	snapshot, err := mg.GetAllMetrics(ctx)
 	if err != nil {
 		return err
 	}
 
-	data, err := json.MarshalIndent(blob, "\t", "\t")
+	data, err := json.MarshalIndent(snapshot, "\t", "\t")
 	if err != nil {
 		return err
 	}
@@ -189,8 +245,8 @@ func WriteMetricsWithTimestamp(ctx context.Context, mg MetricGetter, dst io.Writ
 }
 
 /*
-SaveMetricsToFile saves metrics from storage to the file.
-THis is warapper over WriteMetricsWithTimestamp(mg MetricGetter, dst io.Writer) function
+SaveMetricsToFile saves metrics from storage to the file atomically, previous snapshots aren't kept.
+This is wrapper over SnapshotFile.Save
 
 Args:
 
@@ -204,16 +260,9 @@ Returns:
 	error: nil or error, if occured
 */
 func SaveMetricsToFile(ctx context.Context, l logger, mg MetricGetter, fileName string) error {
-	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
-	if err != nil {
-		l.Debug("cannot open file for writing", "error", err.Error(), "filename", fileName)
-		return fmt.Errorf("cannot open %s for writing: %v", fileName, err)
-	}
-	defer file.Close()
-	err = WriteMetricsWithTimestamp(ctx, mg, file)
-	if err != nil {
-		l.Debug("cannot save data to file", "error", err.Error(), "filename")
-		return fmt.Errorf("cannot save date into %s: %v", fileName, err)
+	if err := NewSnapshotFile(fileName, 0).Save(ctx, mg); err != nil {
+		l.Debug("cannot save data to file", "error", err.Error(), "filename", fileName)
+		return err
 	}
 	l.Info("file saved", "filename", fileName)
 	return nil
@@ -233,44 +282,78 @@ Returns:
 	error: nil or error, if occured
 */
 func LoadMetrics(mu MetricUpdater, src io.Reader) (time.Time, error) {
-	data := make(map[string]interface{})
-	decoder := json.NewDecoder(src)
-	if err := decoder.Decode(&data); err != nil {
-		return time.UnixMilli(0), fmt.Errorf("cannot unmarshal data")
-	}
-	timeStampStr, ok := data["timestamp"].(string)
-	if !ok {
-		return time.UnixMilli(0), fmt.Errorf("data doesn't contain timestamp field")
-	}
-	timeStamp, err := time.Parse("2006-01-02T15:04:05.999999999Z07:00", timeStampStr)
+	snapshot, err := ReadSnapshot(src)
 	if err != nil {
-		return time.UnixMilli(0), fmt.Errorf("cann't parse timestamp: %v", err.Error())
+		return time.UnixMilli(0), err
 	}
-	metrics, ok := data["metrics"]
-	if !ok {
-		return time.UnixMilli(0), fmt.Errorf("data doesn't contain metrics")
+	if err = applySnapshot(mu, snapshot); err != nil {
+		return time.UnixMilli(0), err
 	}
 
-	if gauges, ok := metrics.(map[string]interface{})["gauges"]; ok {
-		for ID, value := range gauges.(map[string]interface{}) {
-			err = retryQueryToDB(func() error { return mu.UpdateGauge(context.TODO(), ID, value.(float64)) })
-			if err != nil {
-				return time.UnixMilli(0), fmt.Errorf("updating gauge %s error: %v", ID, err.Error())
-			}
+	return snapshot.Timestamp, nil
+}
+
+/*
+applySnapshot writes metrics of the validated snapshot into the storage
+
+Args:
+
+	mu MetricUpdater: a storage that allows updating metric data
+	snapshot *models.MetricsSnapshot: snapshot read by ReadSnapshot
+
+Returns:
+
+	error: nil or error of updating the storage
+*/
+func applySnapshot(mu MetricUpdater, snapshot *models.MetricsSnapshot) error {
+	for ID, value := range snapshot.Metrics.Gauges {
+		err := retryQueryToDB(func() error { return mu.UpdateGauge(context.TODO(), ID, value) })
+		if err != nil {
+			return fmt.Errorf("updating gauge %s error: %v", ID, err.Error())
 		}
 	}
-	if counter, ok := metrics.(map[string]interface{})["counters"]; ok {
-		for ID, delta := range counter.(map[string]interface{}) {
-			// Unmarshall from interface{} to float64 and convert to int64
-			// because json.Unmarshall numbers into float64
-			err = retryQueryToDB(func() error { return mu.AddCounter(context.TODO(), ID, int64(delta.(float64))) })
-			if err != nil {
-				return time.UnixMilli(0), fmt.Errorf("updating counter %s error: %v", ID, err.Error())
-			}
+	for ID, delta := range snapshot.Metrics.Counters {
+		err := retryQueryToDB(func() error { return mu.AddCounter(context.TODO(), ID, delta) })
+		if err != nil {
+			return fmt.Errorf("updating counter %s error: %v", ID, err.Error())
+		}
+	}
+	for ID, h := range snapshot.Metrics.Histograms {
+		err := retryQueryToDB(func() error { return mu.AddHistogram(context.TODO(), ID, h) })
+		if err != nil {
+			return fmt.Errorf("updating histogram %s error: %v", ID, err.Error())
 		}
 	}
+	return nil
+}
+
+/*
+ReadSnapshot reads and strictly validates metrics snapshot from any reader.
+Unknown fields, trailing data and invalid metric values are rejected
 
-	return timeStamp, nil
+Args:
+
+	src io.Reader: an object that allow reading data
+
+Returns:
+
+	*models.MetricsSnapshot: read snapshot
+	error: nil or error, if occured
+*/
+func ReadSnapshot(src io.Reader) (*models.MetricsSnapshot, error) {
+	snapshot := &models.MetricsSnapshot{}
+	decoder := json.NewDecoder(src)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(snapshot); err != nil {
+		return nil, fmt.Errorf("%w: cannot unmarshal data: %v", myErrors.ErrInvalidSnapshot, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: unexpected data after snapshot", myErrors.ErrInvalidSnapshot)
+	}
+	if err := snapshot.Validate(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
 }
 
 /*
@@ -306,65 +389,223 @@ func LoadMetricsFromFile(l logger, mu MetricUpdater, fileName string) error {
 }
 
 /*
-JSONUpdateBatchMetrica a function that performs batch updates of metrics in the storage
+RunPeriodicSaving saves metrics to the file periodically until the context is cancelled.
+The interval can be changed while saving is running
 
 Args:
 
 	ctx context.Context
 	l logger: a logger used for printing messages
-	jmqs []JSONMetricaQuerier: a slice of objcets, that implements the JSONMetricaQuerier interface
-	mbu MetricBatchUpdater: object, that implements the MetricBatchUpdater interface
+	mg MetricGetter: a storage that allows getting metrics
+	sf *SnapshotFile: the file for saving metric data
+	interval time.Duration: initial interval between savings
+	intervals <-chan time.Duration: new intervals between savings
 
 Returns:
 
-	error
+	None
 */
-func JSONUpdateBatchMetrica(ctx context.Context, l logger, jmqs []JSONMetricaQuerier, mbu MetricBatchUpdater) error {
-	gaugeBatch := []struct {
-		MetricName  string
-		MetricValue *float64
-	}{}
+func RunPeriodicSaving(ctx context.Context, l logger, mg MetricGetter, sf *SnapshotFile, interval time.Duration, intervals <-chan time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case interval = <-intervals:
+			ticker.Reset(interval)
+			l.Info("store interval changed", "interval", interval)
+		case <-ticker.C:
+			if err := sf.Save(ctx, mg); err != nil {
+				l.Error("cannot save data to file", "error", err.Error())
+				continue
+			}
+			l.Info("file saved", "filename", sf.path)
+		}
+	}
+}
 
-	counterBatch := []struct {
-		MetricName  string
-		MetricDelta *int64
-	}{}
+/*
+newMetricsBatch groups metrics of the request by type and validates them
 
+Args:
+
+	l logger: a logger used for printing messages
+	jmqs []JSONMetricaQuerier: a slice of objcets, that implements the JSONMetricaQuerier interface
+
+Returns:
+
+	*models.MetricsBatch
+	error: nil, error of bad labels or of invalid histogram
+*/
+func newMetricsBatch(l logger, jmqs []JSONMetricaQuerier) (*models.MetricsBatch, error) {
+	batch := &models.MetricsBatch{}
 	for _, jmq := range jmqs {
+		name, err := JSONMetricaKey(jmq)
+		if err != nil {
+			l.Error("bad name or labels in batch", "name", jmq.GetMetricaName(), "error", err.Error())
+			return nil, err
+		}
 		switch jmq.GetMetricaType() {
 		case gauge:
-			name := jmq.GetMetricaName()
 			value := jmq.GetMetricaValue()
-			gaugeBatch = append(gaugeBatch, struct {
+			batch.Gauges = append(batch.Gauges, struct {
 				MetricName  string
 				MetricValue *float64
 			}{MetricName: name, MetricValue: value})
 
 		case counter:
-			name := jmq.GetMetricaName()
 			delta := jmq.GetMetricaCounter()
-			counterBatch = append(counterBatch, struct {
+			batch.Counters = append(batch.Counters, struct {
 				MetricName  string
 				MetricDelta *int64
 			}{MetricName: name, MetricDelta: delta})
+
+		case histogram:
+			h := jmq.GetMetricaHistogram()
+			if h == nil {
+				l.Error("histogram without value in batch", "name", name)
+				return nil, fmt.Errorf("%w: histogram %s is not set", myErrors.ErrInvalidHistogram, name)
+			}
+			if err := h.Validate(); err != nil {
+				l.Error("invalid histogram in batch", "name", name, "error", err.Error())
+				return nil, err
+			}
+			batch.Histograms = append(batch.Histograms, struct {
+				MetricName      string
+				MetricHistogram *models.Histogram
+			}{MetricName: name, MetricHistogram: h})
 		}
 	}
-	l.Debug("get batch for load", "gauges", len(gaugeBatch), "counters", len(counterBatch))
+	l.Debug("get batch for load", "gauges", len(batch.Gauges), "counters", len(batch.Counters), "histograms", len(batch.Histograms))
+	return batch, nil
+}
+
+/*
+JSONUpdateBatchMetrica a function that performs batch updates of metrics in the storage
+
+Args:
+
+	ctx context.Context
+	l logger: a logger used for printing messages
+	jmqs []JSONMetricaQuerier: a slice of objcets, that implements the JSONMetricaQuerier interface
+	mbu MetricBatchUpdater: object, that implements the MetricBatchUpdater interface
+
+Returns:
+
+	error
+*/
+func JSONUpdateBatchMetrica(ctx context.Context, l logger, jmqs []JSONMetricaQuerier, mbu MetricBatchUpdater) error {
+	batch, err := newMetricsBatch(l, jmqs)
+	if err != nil {
+		return err
+	}
 
 	ctxWithTimeout, cancelWithTimeout := context.WithTimeout(ctx, 3*time.Second)
 	defer cancelWithTimeout()
 
-	err := retryQueryToDB(func() error { return mbu.UpdateBatchGauge(ctxWithTimeout, gaugeBatch) })
+	err = retryQueryToDB(func() error { return mbu.UpdateBatchGauge(ctxWithTimeout, batch.Gauges) })
 	if err != nil {
 		l.Error("updating gauge batch", "error", err.Error())
 		return err
 	}
 
-	err = retryQueryToDB(func() error { return mbu.AddBatchCounter(ctxWithTimeout, counterBatch) })
+	err = retryQueryToDB(func() error { return mbu.AddBatchCounter(ctxWithTimeout, batch.Counters) })
 	if err != nil {
 		l.Error("updating counter batch", "error", err.Error())
 		return err
 	}
 
+	if len(batch.Histograms) > 0 {
+		err = retryQueryToDB(func() error { return mbu.AddBatchHistogram(ctxWithTimeout, batch.Histograms) })
+		if err != nil {
+			l.Error("updating histogram batch", "error", err.Error())
+			return err
+		}
+	}
+
 	return nil
 }
+
+/*
+JSONUpdateBatchMetricaOnce applies the batch of metrics only once for the idempotency key. The key is stored
+by the storage together with metrics of the batch, so a failed batch leaves neither metrics nor the key,
+and the batch is reported as replayed only after it was applied completely. Empty key disables the check
+
+Args:
+
+	ctx context.Context
+	l logger: a logger used for printing messages
+	key string: idempotency key of the batch, may be empty
+	jmqs []JSONMetricaQuerier: a slice of objcets, that implements the JSONMetricaQuerier interface
+	s MetricBatchUpdateKeeper: object, that implements the MetricBatchUpdater and IdempotencyKeeper interfaces
+
+Returns:
+
+	bool: false if the batch with the same key was applied before
+	error
+*/
+func JSONUpdateBatchMetricaOnce(ctx context.Context, l logger, key string, jmqs []JSONMetricaQuerier, s MetricBatchUpdateKeeper) (bool, error) {
+	if key == "" {
+		return true, JSONUpdateBatchMetrica(ctx, l, jmqs, s)
+	}
+	batch, err := newMetricsBatch(l, jmqs)
+	if err != nil {
+		return false, err
+	}
+
+	ctxWithTimeout, cancelWithTimeout := context.WithTimeout(ctx, 3*time.Second)
+	defer cancelWithTimeout()
+
+	var applied bool
+	err = retryQueryToDB(func() (err error) {
+		applied, err = s.UpdateBatchOnce(ctxWithTimeout, key, batch)
+		return err
+	})
+	if err != nil {
+		l.Error("updating batch", "key", key, "error", err.Error())
+		return false, err
+	}
+	if !applied {
+		l.Info("duplicate batch skipped", "key", key)
+	}
+	return applied, nil
+}
+
+/*
+GetMetricHistory reads the history of the series from the storage and downsamples it
+
+Args:
+
+	ctx context.Context
+	hg MetricHistoryGetter: storage with the history of metrics
+	mType string: type of metrica, "gauge" or "counter"
+	mName string: name of metrica
+	labels map[string]string: labels of the series
+	from time.Time: start of the interval
+	to time.Time: end of the interval, not included
+	step time.Duration: length of the downsampling interval, 0 - values are returned as stored
+	agg string: aggregation function, see models.Downsample
+
+Returns:
+
+	*models.History: time series
+	error: nil, myErrors.ErrBadAggregation, myErrors.ErrHistoryNotSupported or error of the storage
+*/
+func GetMetricHistory(ctx context.Context, hg MetricHistoryGetter, mType, mName string, labels map[string]string,
+	from, to time.Time, step time.Duration, agg string) (*models.History, error) {
+	points, err := hg.GetHistory(ctx, mType, models.SeriesKey(mName, labels), from, to)
+	if err != nil {
+		return nil, err
+	}
+	points, err = models.Downsample(points, from, step, agg)
+	if err != nil {
+		return nil, err
+	}
+	h := &models.History{ID: mName, MType: mType, Labels: labels, From: from, To: to, Points: points}
+	if step > 0 {
+		h.Step = step.String()
+		h.Aggregation = agg
+	}
+	return h, nil
+}
@@ -1,13 +1,19 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
 	"github.com/itaraxa/effectivepancake/internal/models"
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
 )
 
 func TestParseQueryString(t *testing.T) {
@@ -43,6 +49,16 @@ func TestParseQueryString(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: `Update histogram`,
+			args: args{raw: `/update/histogram/latency/0.25`},
+			wantQ: &models.Query{
+				MetricType:     `histogram`,
+				MetricName:     `latency`,
+				MetricRawValue: `0.25`,
+			},
+			wantErr: false,
+		},
 		{
 			name:    `Gauge without value`,
 			args:    args{raw: `/update/gauge/test4/`},
@@ -61,6 +77,12 @@ func TestParseQueryString(t *testing.T) {
 			wantQ:   &models.Query{},
 			wantErr: true,
 		},
+		{
+			name:    `Name with braces`,
+			args:    args{raw: `/update/counter/a{x="1"}/14`},
+			wantQ:   &models.Query{},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -90,7 +112,87 @@ func TestLoadMetrics(t *testing.T) {
 		want    time.Time
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			name: `Correct snapshot`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{"Alloc":3.14},"counters":{"PollCount":5}}}`),
+			},
+			want:    time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC),
+			wantErr: false,
+		},
+		{
+			name: `Empty metrics`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{},"counters":{}}}`),
+			},
+			want:    time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC),
+			wantErr: false,
+		},
+		{
+			name: `Truncated file`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{"Alloc":3.1`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
+		{
+			name: `Without timestamp`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"metrics":{"gauges":{},"counters":{}}}`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
+		{
+			name: `Without counters`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{}}}`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
+		{
+			name: `Gauge with wrong type`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{"Alloc":"3.14"},"counters":{}}}`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
+		{
+			name: `Fractional counter`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{},"counters":{"PollCount":1.5}}}`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
+		{
+			name: `Unknown field`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{},"counters":{}},"extra":1}`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
+		{
+			name: `Trailing data`,
+			args: args{
+				mu:  memstorage.NewMemStorage(),
+				src: strings.NewReader(`{"timestamp":"2024-10-01T12:00:00Z","metrics":{"gauges":{},"counters":{}}}{}`),
+			},
+			want:    time.UnixMilli(0),
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -99,7 +201,7 @@ func TestLoadMetrics(t *testing.T) {
 				t.Errorf("LoadMetrics() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
+			if !got.Equal(tt.want) {
 				t.Errorf("LoadMetrics() = %v, want %v", got, tt.want)
 			}
 		})
@@ -127,3 +229,162 @@ func TestLoadMetricsFromFile(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteLoadMetricsRoundTrip(t *testing.T) {
+	src := memstorage.NewMemStorage()
+	_ = src.UpdateGauge(context.TODO(), `Alloc`, 3.14)
+	_ = src.AddCounter(context.TODO(), `PollCount`, 42)
+
+	var buf bytes.Buffer
+	if err := WriteMetricsWithTimestamp(context.TODO(), src, &buf); err != nil {
+		t.Fatalf("WriteMetricsWithTimestamp() error = %v", err)
+	}
+
+	dst := memstorage.NewMemStorage()
+	if _, err := LoadMetrics(dst, &buf); err != nil {
+		t.Fatalf("LoadMetrics() error = %v", err)
+	}
+	want, _ := src.GetAllMetrics(context.TODO())
+	got, _ := dst.GetAllMetrics(context.TODO())
+	if !reflect.DeepEqual(got.Metrics, want.Metrics) {
+		t.Errorf("loaded metrics = %v, want %v", got.Metrics, want.Metrics)
+	}
+}
+
+func TestUpdateMetricaHistogram(t *testing.T) {
+	ms := memstorage.NewMemStorage()
+	bounds := []float64{0.1, 1}
+	for _, raw := range []string{`/update/histogram/latency/0.05`, `/update/histogram/latency/0.5`, `/update/histogram/latency/7`} {
+		q, err := ParseQueryString(raw)
+		if err != nil {
+			t.Fatalf("ParseQueryString() error = %v", err)
+		}
+		if err = UpdateMetrica(context.TODO(), q, ms, bounds); err != nil {
+			t.Fatalf("UpdateMetrica() error = %v", err)
+		}
+	}
+	q, _ := ParseQueryString(`/update/histogram/latency/none`)
+	if err := UpdateMetrica(context.TODO(), q, ms, bounds); err == nil {
+		t.Errorf("UpdateMetrica() with bad value error = nil, wantErr true")
+	}
+
+	got, err := ms.GetMetrica(context.TODO(), `histogram`, `latency`)
+	if err != nil {
+		t.Fatalf("GetMetrica() error = %v", err)
+	}
+	want := models.Histogram{Bounds: []float64{0.1, 1}, Counts: []int64{1, 1, 1}, Sum: 7.55, Count: 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("histogram = %v, want %v", got, want)
+	}
+}
+
+func TestJSONUpdateBatchMetricaLabels(t *testing.T) {
+	ms := memstorage.NewMemStorage()
+	one, two := 1.0, 2.0
+	delta := int64(3)
+	jmqs := []JSONMetricaQuerier{
+		models.JSONMetric{ID: `Alloc`, MType: `gauge`, Value: &one, Labels: map[string]string{`host`: `a`}},
+		models.JSONMetric{ID: `Alloc`, MType: `gauge`, Value: &two, Labels: map[string]string{`host`: `b`}},
+		models.JSONMetric{ID: `PollCount`, MType: `counter`, Delta: &delta, Labels: map[string]string{`host`: `a`}},
+		models.JSONMetric{ID: `PollCount`, MType: `counter`, Delta: &delta, Labels: map[string]string{`host`: `a`}},
+	}
+	if err := JSONUpdateBatchMetrica(context.TODO(), testLogger{}, jmqs, ms); err != nil {
+		t.Fatalf("JSONUpdateBatchMetrica() error = %v", err)
+	}
+	got, _ := ms.GetAllMetrics(context.TODO())
+	wantGauges := map[string]float64{`Alloc{host="a"}`: 1, `Alloc{host="b"}`: 2}
+	wantCounters := map[string]int64{`PollCount{host="a"}`: 6}
+	if !reflect.DeepEqual(got.Metrics.Gauges, wantGauges) {
+		t.Errorf("gauges = %v, want %v", got.Metrics.Gauges, wantGauges)
+	}
+	if !reflect.DeepEqual(got.Metrics.Counters, wantCounters) {
+		t.Errorf("counters = %v, want %v", got.Metrics.Counters, wantCounters)
+	}
+
+	bad := []JSONMetricaQuerier{
+		models.JSONMetric{ID: `Alloc`, MType: `gauge`, Value: &one, Labels: map[string]string{`host-id`: `a`}},
+	}
+	if err := JSONUpdateBatchMetrica(context.TODO(), testLogger{}, bad, ms); err == nil {
+		t.Errorf("JSONUpdateBatchMetrica() with bad labels error = nil, wantErr true")
+	}
+
+	// the name with braces would collide with the series Alloc{host="a"}
+	bad = []JSONMetricaQuerier{
+		models.JSONMetric{ID: `Alloc{host="a"}`, MType: `gauge`, Value: &two},
+	}
+	if err := JSONUpdateBatchMetrica(context.TODO(), testLogger{}, bad, ms); !errors.Is(err, myErrors.ErrBadMetricaName) {
+		t.Errorf("JSONUpdateBatchMetrica() with braces in name error = %v, want ErrBadMetricaName", err)
+	}
+	if err := JSONUpdateMetrica(context.TODO(), bad[0], ms); !errors.Is(err, myErrors.ErrBadMetricaName) {
+		t.Errorf("JSONUpdateMetrica() with braces in name error = %v, want ErrBadMetricaName", err)
+	}
+}
+
+func TestUpdateMetricaLabels(t *testing.T) {
+	ms := memstorage.NewMemStorage()
+	q, err := ParseQueryString(`/update/counter/PollCount/2`)
+	if err != nil {
+		t.Fatalf("ParseQueryString() error = %v", err)
+	}
+	if err = q.SetMetricaLabels(map[string]string{`host`: `a`}); err != nil {
+		t.Fatalf("SetMetricaLabels() error = %v", err)
+	}
+	if err = UpdateMetrica(context.TODO(), q, ms, nil); err != nil {
+		t.Fatalf("UpdateMetrica() error = %v", err)
+	}
+	if _, err = ms.GetMetrica(context.TODO(), `counter`, `PollCount`); err == nil {
+		t.Errorf("GetMetrica() without labels error = nil, wantErr true")
+	}
+	got, err := ms.GetMetrica(context.TODO(), `counter`, `PollCount{host="a"}`)
+	if err != nil || got != int64(2) {
+		t.Errorf("GetMetrica() = %v, %v, want 2", got, err)
+	}
+}
+
+type testLogger struct{}
+
+func (testLogger) Error(msg string, fields ...interface{}) {}
+func (testLogger) Info(msg string, fields ...interface{})  {}
+func (testLogger) Debug(msg string, fields ...interface{}) {}
+
+func TestJSONUpdateBatchMetricaOnce(t *testing.T) {
+	ms := memstorage.NewMemStorage()
+	delta := int64(3)
+	jmqs := []JSONMetricaQuerier{
+		models.JSONMetric{ID: `PollCount`, MType: `counter`, Delta: &delta},
+	}
+	for i := 0; i < 2; i++ {
+		applied, err := JSONUpdateBatchMetricaOnce(context.TODO(), testLogger{}, `batch-1`, jmqs, ms)
+		if err != nil {
+			t.Fatalf("JSONUpdateBatchMetricaOnce() error = %v", err)
+		}
+		if applied != (i == 0) {
+			t.Errorf("JSONUpdateBatchMetricaOnce() attempt %d applied = %v", i+1, applied)
+		}
+	}
+	if got, _ := ms.GetMetrica(context.TODO(), `counter`, `PollCount`); got != int64(3) {
+		t.Errorf("counter after duplicate batch = %v, want 3", got)
+	}
+
+	// a failed batch leaves no key, so the corrected retry is applied
+	one := 1.0
+	bad := []JSONMetricaQuerier{
+		models.JSONMetric{ID: `Alloc`, MType: `gauge`, Value: &one, Labels: map[string]string{`host-id`: `a`}},
+	}
+	if _, err := JSONUpdateBatchMetricaOnce(context.TODO(), testLogger{}, `batch-2`, bad, ms); err == nil {
+		t.Fatalf("JSONUpdateBatchMetricaOnce() with bad labels error = nil, wantErr true")
+	}
+	if applied, err := JSONUpdateBatchMetricaOnce(context.TODO(), testLogger{}, `batch-2`, jmqs, ms); !applied || err != nil {
+		t.Errorf("JSONUpdateBatchMetricaOnce() after failure = %v, %v, want true, nil", applied, err)
+	}
+
+	// without the key every batch is applied
+	for i := 0; i < 2; i++ {
+		if _, err := JSONUpdateBatchMetricaOnce(context.TODO(), testLogger{}, ``, jmqs, ms); err != nil {
+			t.Fatalf("JSONUpdateBatchMetricaOnce() error = %v", err)
+		}
+	}
+	if got, _ := ms.GetMetrica(context.TODO(), `counter`, `PollCount`); got != int64(12) {
+		t.Errorf("counter = %v, want 12", got)
+	}
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+/*
+SnapshotFile saves snapshots of metrics to the file atomically: the snapshot is written to a temporary file
+in the same directory, synced to the disk and renamed over the target, so a crash never leaves a half-written file.
+Previous snapshots are kept as rotated generations: file.1 is the previous snapshot, file.2 is older and so on
+*/
+type SnapshotFile struct {
+	mu          sync.Mutex // savings are serialized, because they rotate the same files
+	path        string
+	generations int
+}
+
+/*
+NewSnapshotFile creates the snapshot file
+
+Args:
+
+	path string: path to the file with the newest snapshot
+	generations int: number of previous snapshots to keep, 0 - previous snapshots aren't kept
+
+Returns:
+
+	*SnapshotFile
+*/
+func NewSnapshotFile(path string, generations int) *SnapshotFile {
+	return &SnapshotFile{path: path, generations: max(generations, 0)}
+}
+
+// generationPath returns the path of the n-th generation, 0 is the newest snapshot
+func (sf *SnapshotFile) generationPath(n int) string {
+	if n == 0 {
+		return sf.path
+	}
+	return sf.path + `.` + strconv.Itoa(n)
+}
+
+/*
+Save writes the snapshot of metrics to the temporary file and replaces the newest snapshot with it.
+The replaced snapshot becomes the generation 1, the oldest generation is deleted
+
+Args:
+
+	ctx context.Context
+	mg MetricGetter: a storage that allows getting metrics
+
+Returns:
+
+	error: nil or error of writing the snapshot, the previous snapshot stays untouched in that case
+*/
+func (sf *SnapshotFile) Save(ctx context.Context, mg MetricGetter) error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	dir := filepath.Dir(sf.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(sf.path)+`.tmp-*`)
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %w", err)
+	}
+	// the temporary file is left only if saving failed
+	defer os.Remove(tmp.Name())
+
+	if err = WriteMetricsWithTimestamp(ctx, mg, tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot save data into %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot change mode of %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot sync %s: %w", tmp.Name(), err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("cannot close %s: %w", tmp.Name(), err)
+	}
+
+	if err = sf.rotate(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), sf.path); err != nil {
+		return fmt.Errorf("cannot replace %s: %w", sf.path, err)
+	}
+	return syncDir(dir)
+}
+
+/*
+rotate shifts generations of snapshots by one: file.2 becomes file.3, file.1 becomes file.2, the file becomes file.1.
+The oldest generation is overwritten
+
+Args:
+
+	None
+
+Returns:
+
+	error: nil or error of renaming files
+*/
+func (sf *SnapshotFile) rotate() error {
+	for n := sf.generations; n > 0; n-- {
+		err := os.Rename(sf.generationPath(n-1), sf.generationPath(n))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("cannot rotate snapshots: %w", err)
+		}
+	}
+	return nil
+}
+
+// syncDir flushes renames in the directory to the disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("cannot sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+/*
+Load loads metrics from the newest valid generation. Every generation is validated completely before applying,
+so metrics of a broken snapshot don't get into the storage
+
+Args:
+
+	l logger: a logger used for printing messages
+	mu MetricUpdater: a storage that allows updating metric data
+
+Returns:
+
+	string: path to the loaded generation
+	error: nil or error of the newest generation, if none of them is valid
+*/
+func (sf *SnapshotFile) Load(l logger, mu MetricUpdater) (string, error) {
+	var firstErr error
+	for n := 0; n <= sf.generations; n++ {
+		path := sf.generationPath(n)
+		snapshot, err := readSnapshotFile(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				l.Error("snapshot is skipped", "error", err.Error(), "filename", path)
+			}
+			continue
+		}
+		if err = applySnapshot(mu, snapshot); err != nil {
+			return path, err
+		}
+		l.Info("metrics have been loaded", "filename", path, "origin timestamp", snapshot.Timestamp)
+		return path, nil
+	}
+	return "", firstErr
+}
+
+/*
+readSnapshotFile reads and validates the snapshot from the file. Files of older versions, where synchronous saving
+appended every snapshot to the same file, are accepted too: the last complete snapshot of the file is used
+
+Args:
+
+	path string: path to the file
+
+Returns:
+
+	*models.MetricsSnapshot: read snapshot
+	error: nil or error of reading or validating the file
+*/
+func readSnapshotFile(path string) (*models.MetricsSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := ReadSnapshot(bytes.NewReader(data))
+	if err == nil {
+		return snapshot, nil
+	}
+	if last := lastAppendedSnapshot(data); last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+/*
+lastAppendedSnapshot finds the last valid snapshot in the data with several snapshots written one after another.
+Decoding stops at the first broken snapshot, for example half-written by a crash
+
+Args:
+
+	data []byte: content of the file
+
+Returns:
+
+	*models.MetricsSnapshot: the last valid snapshot, nil if the data has less than two snapshots
+*/
+func lastAppendedSnapshot(data []byte) *models.MetricsSnapshot {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var last *models.MetricsSnapshot
+	decoded := 0
+	for {
+		snapshot := &models.MetricsSnapshot{}
+		if err := decoder.Decode(snapshot); err != nil {
+			break
+		}
+		decoded++
+		if snapshot.Validate() == nil {
+			last = snapshot
+		}
+	}
+	if decoded < 2 {
+		return nil
+	}
+	return last
+}
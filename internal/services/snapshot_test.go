@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itaraxa/effectivepancake/internal/repositories/memstorage"
+)
+
+func TestSnapshotFile_Save(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, `metrics.dat`)
+	sf := NewSnapshotFile(path, 2)
+	ms := memstorage.NewMemStorage()
+
+	for i := 1; i <= 4; i++ {
+		_ = ms.AddCounter(context.TODO(), `PollCount`, 1)
+		if err := sf.Save(context.TODO(), ms); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+	}
+
+	// the newest snapshot and two previous generations are kept, temporary files are removed
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("files = %v, want 3 files", entries)
+	}
+	for n, want := range []int64{4, 3, 2} {
+		dst := memstorage.NewMemStorage()
+		file, err := os.Open(sf.generationPath(n))
+		if err != nil {
+			t.Fatalf("generation %d: %v", n, err)
+		}
+		_, err = LoadMetrics(dst, file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("LoadMetrics() generation %d error = %v", n, err)
+		}
+		if v, _ := dst.GetMetrica(context.TODO(), `counter`, `PollCount`); v != want {
+			t.Errorf("generation %d PollCount = %v, want %d", n, v, want)
+		}
+	}
+}
+
+func TestSnapshotFile_Load(t *testing.T) {
+	tests := []struct {
+		name     string
+		broken   []int // generations, which are corrupted after saving
+		missing  []int // generations, which are deleted after saving
+		wantGen  int
+		wantPoll int64
+		wantErr  bool
+	}{
+		{name: `newest`, wantGen: 0, wantPoll: 3},
+		{name: `broken newest`, broken: []int{0}, wantGen: 1, wantPoll: 2},
+		{name: `crash during rotation`, missing: []int{0}, wantGen: 1, wantPoll: 2},
+		{name: `only oldest is valid`, broken: []int{0}, missing: []int{1}, wantGen: 2, wantPoll: 1},
+		{name: `nothing is valid`, broken: []int{0, 1, 2}, wantErr: true},
+		{name: `no files`, missing: []int{0, 1, 2}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sf := NewSnapshotFile(filepath.Join(t.TempDir(), `metrics.dat`), 2)
+			src := memstorage.NewMemStorage()
+			for i := 0; i < 3; i++ {
+				_ = src.AddCounter(context.TODO(), `PollCount`, 1)
+				if err := sf.Save(context.TODO(), src); err != nil {
+					t.Fatalf("Save() error = %v", err)
+				}
+			}
+			for _, n := range tt.broken {
+				// half-written snapshot
+				data, _ := os.ReadFile(sf.generationPath(n))
+				_ = os.WriteFile(sf.generationPath(n), data[:len(data)/2], 0o644)
+			}
+			for _, n := range tt.missing {
+				_ = os.Remove(sf.generationPath(n))
+			}
+
+			dst := memstorage.NewMemStorage()
+			got, err := sf.Load(testLogger{}, dst)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != sf.generationPath(tt.wantGen) {
+				t.Errorf("Load() = %s, want %s", got, sf.generationPath(tt.wantGen))
+			}
+			if v, _ := dst.GetMetrica(context.TODO(), `counter`, `PollCount`); v != tt.wantPoll {
+				t.Errorf("PollCount = %v, want %d", v, tt.wantPoll)
+			}
+		})
+	}
+}
+
+func TestSnapshotFile_LoadAppended(t *testing.T) {
+	// older versions appended every synchronously saved snapshot to the same file
+	path := filepath.Join(t.TempDir(), `metrics.dat`)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("os.Create() error = %v", err)
+	}
+	src := memstorage.NewMemStorage()
+	for i := 0; i < 3; i++ {
+		_ = src.AddCounter(context.TODO(), `PollCount`, 1)
+		if err = WriteMetricsWithTimestamp(context.TODO(), src, file); err != nil {
+			t.Fatalf("WriteMetricsWithTimestamp() error = %v", err)
+		}
+	}
+	// the last snapshot was interrupted
+	_, _ = file.WriteString(`{"timestamp":`)
+	file.Close()
+
+	dst := memstorage.NewMemStorage()
+	if _, err = NewSnapshotFile(path, 0).Load(testLogger{}, dst); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if v, _ := dst.GetMetrica(context.TODO(), `counter`, `PollCount`); v != int64(3) {
+		t.Errorf("PollCount = %v, want 3 from the last complete snapshot", v)
+	}
+}
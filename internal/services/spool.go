@@ -0,0 +1,389 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// spoolExt is the extension of the spool entry files
+const spoolExt = `.json`
+
+// spoolRecord is the content of one spool entry file
+type spoolRecord struct {
+	ID      string              `json:"id"`      // identifier of the snapshot, sent to the server as the idempotency key
+	Created time.Time           `json:"created"` // time when the snapshot was spooled
+	Metrics []models.JSONMetric `json:"metrics"`
+}
+
+// spoolEntry describes the file of one spooled snapshot
+type spoolEntry struct {
+	seq     uint64
+	path    string
+	size    int64
+	created time.Time
+}
+
+/*
+Spool is a disk-backed write-ahead queue of snapshots, that couldn't be sent to the server.
+Every snapshot is stored in its own file, named by an increasing sequence number, and is removed
+only after it was successfully sent. Snapshots are never merged and keep their identifiers, so the server
+can drop a snapshot, which was applied before the agent got the answer
+*/
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	mu       sync.Mutex
+	sending  sync.Mutex   // serializes sending of new and spooled snapshots, so a new snapshot never overtakes a spooled one
+	entries  []spoolEntry // ordered by seq
+	size     int64
+	seq      uint64
+}
+
+/*
+NewSpool opens the spool directory, creating it if needed, and loads the entries left by the previous run
+
+Args:
+
+	dir string: path to the spool directory
+	maxBytes int64: maximum total size of spooled files, 0 - unlimited
+	maxAge time.Duration: maximum age of a spooled snapshot, 0 - unlimited
+
+Returns:
+
+	*Spool: pointer to the spool instance
+	error: nil or error, if the directory cannot be created or read
+*/
+func NewSpool(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("%w: %v", myErrors.ErrSpool, err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", myErrors.ErrSpool, err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		s.entries = append(s.entries, spoolEntry{seq: seq, path: filepath.Join(dir, name), size: info.Size(), created: info.ModTime()})
+		s.size += info.Size()
+		s.seq = max(s.seq, seq)
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].seq < s.entries[j].seq })
+	return s, nil
+}
+
+/*
+Len returns the number of spooled snapshots
+
+Args:
+
+	None
+
+Returns:
+
+	int: number of snapshots waiting for replay
+*/
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+/*
+Put appends the snapshot to the end of the queue. The file is written into a temporary file and renamed,
+so a crash never leaves a partial entry. The oldest entries are dropped when the limits are exceeded
+
+Args:
+
+	l logger: a logger used for printing messages
+	ms MetricsGetter: snapshot of metrics
+
+Returns:
+
+	error: nil or error, if the snapshot cannot be written
+*/
+func (s *Spool) Put(l logger, ms MetricsGetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	rec := spoolRecord{ID: ms.GetSnapshotID(), Created: time.Now(), Metrics: ms.GetData()}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolExt))
+	tmp := path + `.tmp`
+	if err = os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("%w: %v", myErrors.ErrSpool, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%w: %v", myErrors.ErrSpool, err)
+	}
+	s.entries = append(s.entries, spoolEntry{seq: s.seq, path: path, size: int64(len(data)), created: rec.Created})
+	s.size += int64(len(data))
+	s.enforceLimits(l)
+	return nil
+}
+
+/*
+enforceLimits removes the oldest entries, which exceed the size or age limits. Must be called under the lock
+
+Args:
+
+	l logger: a logger used for printing messages
+
+Returns:
+
+	None
+*/
+func (s *Spool) enforceLimits(l logger) {
+	dropped := 0
+	for len(s.entries) > 0 {
+		head := s.entries[0]
+		expired := s.maxAge > 0 && time.Since(head.created) > s.maxAge
+		oversized := s.maxBytes > 0 && s.size > s.maxBytes && len(s.entries) > 1
+		if !expired && !oversized {
+			break
+		}
+		s.removeHead()
+		dropped++
+	}
+	if dropped > 0 {
+		l.Error("spooled snapshots dropped by limits", "dropped", dropped, "size", s.size, "entries", len(s.entries))
+	}
+}
+
+/*
+removeHead deletes the file of the oldest entry. Must be called under the lock
+
+Args:
+
+	None
+
+Returns:
+
+	None
+*/
+func (s *Spool) removeHead() {
+	head := s.entries[0]
+	os.Remove(head.path)
+	s.size -= head.size
+	s.entries = s.entries[1:]
+}
+
+/*
+Replay sends spooled snapshots in order, starting from the oldest one. Every snapshot is removed right after
+it was sent, replay stops on the first failed sending, so the snapshot stays at the head of the queue.
+New snapshots of spooledSender wait, while a spooled snapshot is being sent
+
+Args:
+
+	ctx context.Context: replay stops between snapshots when the context is cancelled
+	l logger: a logger used for printing messages
+	send sender: function for sending one snapshot
+
+Returns:
+
+	int: number of sent snapshots
+	error: nil or error of the failed sending
+*/
+func (s *Spool) Replay(ctx context.Context, l logger, send sender) (int, error) {
+	sent := 0
+	for ctx.Err() == nil {
+		ok, err := s.replayHead(l, send)
+		if err != nil {
+			return sent, err
+		}
+		if !ok {
+			return sent, nil
+		}
+		sent++
+	}
+	return sent, ctx.Err()
+}
+
+/*
+replayHead sends the oldest spooled snapshot and removes it. Broken entries are dropped without sending
+
+Args:
+
+	l logger: a logger used for printing messages
+	send sender: function for sending one snapshot
+
+Returns:
+
+	bool: false if the spool is empty
+	error: nil or error of the failed sending
+*/
+func (s *Spool) replayHead(l logger, send sender) (bool, error) {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	for {
+		s.mu.Lock()
+		s.enforceLimits(l)
+		if len(s.entries) == 0 {
+			s.mu.Unlock()
+			return false, nil
+		}
+		head := s.entries[0]
+		s.mu.Unlock()
+
+		ms, err := readSpoolEntry(head.path)
+		if err != nil {
+			l.Error("cannot read spooled snapshot, dropped", "file", head.path, "error", err.Error())
+			s.dropHead(head.seq)
+			continue
+		}
+		if err = send(l, ms); err != nil {
+			return true, err
+		}
+		s.dropHead(head.seq)
+		return true, nil
+	}
+}
+
+/*
+dropHead removes the oldest entry, if it wasn't already removed by the limits
+
+Args:
+
+	seq uint64: sequence number of the expected head
+
+Returns:
+
+	None
+*/
+func (s *Spool) dropHead(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) > 0 && s.entries[0].seq == seq {
+		s.removeHead()
+	}
+}
+
+/*
+readSpoolEntry loads the snapshot from the spool file
+
+Args:
+
+	path string: path to the file
+
+Returns:
+
+	MetricsAddGetter: loaded snapshot
+	error: nil or error, if the file cannot be read or parsed
+*/
+func readSpoolEntry(path string) (MetricsAddGetter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec spoolRecord
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	jms := models.NewJSONMetrics(nil)
+	jms.SnapshotID = rec.ID
+	if err = jms.AddData(rec.Metrics); err != nil {
+		return nil, err
+	}
+	return jms, nil
+}
+
+/*
+spooledSender wraps the sender, so snapshots, that failed to send, are put into the spool.
+While the spool isn't empty, new snapshots are queued behind the spooled ones to keep the order.
+The check of the spool, sending and spooling are done under the same lock as Replay, so with the spool
+the workers send snapshots one at a time
+
+Args:
+
+	s *Spool: pointer to the spool
+	send sender: function for sending one snapshot
+
+Returns:
+
+	sender: wrapped function
+*/
+func spooledSender(s *Spool, send sender) sender {
+	return func(l logger, ms MetricsGetter) error {
+		s.sending.Lock()
+		defer s.sending.Unlock()
+		if s.Len() > 0 {
+			return s.Put(l, ms)
+		}
+		err := send(l, ms)
+		if err == nil {
+			return nil
+		}
+		if perr := s.Put(l, ms); perr != nil {
+			return fmt.Errorf("%w, cannot spool snapshot: %v", err, perr)
+		}
+		l.Info("snapshot spooled", "error", err.Error(), "spooled", s.Len())
+		return nil
+	}
+}
+
+/*
+DrainSpool periodically replays the spooled snapshots until the context is cancelled
+
+Args:
+
+	ctx context.Context: context of the reporter
+	wg *sync.WaitGroup: pointer to sync.WaitGroup, which is done when the drainer exits
+	s *Spool: pointer to the spool
+	l logger: a logger used for printing messages
+	send sender: function for sending one snapshot
+	interval time.Duration: interval between replay attempts
+
+Returns:
+
+	None
+*/
+func DrainSpool(ctx context.Context, wg *sync.WaitGroup, s *Spool, l logger, send sender, interval time.Duration) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Info("Spool drainer stopped", "spooled", s.Len())
+			return
+		case <-ticker.C:
+			if s.Len() == 0 {
+				continue
+			}
+			sent, err := s.Replay(ctx, l, send)
+			if err != nil {
+				l.Info("server is still unavailable", "replayed", sent, "spooled", s.Len(), "error", err.Error())
+				continue
+			}
+			l.Info("spool replayed", "replayed", sent)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// testSnapshot returns a snapshot with the only PollCount counter
+func testSnapshot(pollCount int64) MetricsGetter {
+	jms := models.NewJSONMetrics(nil)
+	_ = jms.AddPollCount(pollCount)
+	return jms
+}
+
+// recordingSender returns a sender, that stores PollCount of sent snapshots and fails while fail is true
+func recordingSender(sent *[]int64, fail *bool) sender {
+	return func(l logger, ms MetricsGetter) error {
+		if *fail {
+			return errors.New("server is down")
+		}
+		*sent = append(*sent, *ms.GetData()[0].Delta)
+		return nil
+	}
+}
+
+func TestSpoolReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err = s.Put(testLogger{}, testSnapshot(i)); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	// entries survive the restart of the agent
+	s, err = NewSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", s.Len())
+	}
+
+	var sent []int64
+	fail := true
+	if n, err := s.Replay(context.Background(), testLogger{}, recordingSender(&sent, &fail)); err == nil || n != 0 {
+		t.Errorf("Replay() = %d, %v, want 0 and error", n, err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("Len() after failed replay = %d, want 3", s.Len())
+	}
+
+	fail = false
+	if n, err := s.Replay(context.Background(), testLogger{}, recordingSender(&sent, &fail)); err != nil || n != 3 {
+		t.Errorf("Replay() = %d, %v, want 3 and nil", n, err)
+	}
+	// every counter delta is sent exactly once, in the spooled order
+	want := []int64{1, 2, 3}
+	if len(sent) != len(want) {
+		t.Fatalf("sent %v, want %v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("sent %v, want %v", sent, want)
+			break
+		}
+	}
+	if n, _ := s.Replay(context.Background(), testLogger{}, recordingSender(&sent, &fail)); n != 0 || len(sent) != 3 {
+		t.Errorf("second Replay() sent %d snapshots, want 0", n)
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+	t.Run(`Size`, func(t *testing.T) {
+		s, err := NewSpool(t.TempDir(), 1, 0)
+		if err != nil {
+			t.Fatalf("NewSpool() error = %v", err)
+		}
+		for i := int64(1); i <= 3; i++ {
+			_ = s.Put(testLogger{}, testSnapshot(i))
+		}
+		// the newest snapshot is kept even if it alone exceeds the limit
+		if s.Len() != 1 {
+			t.Fatalf("Len() = %d, want 1", s.Len())
+		}
+		var sent []int64
+		fail := false
+		_, _ = s.Replay(context.Background(), testLogger{}, recordingSender(&sent, &fail))
+		if len(sent) != 1 || sent[0] != 3 {
+			t.Errorf("sent %v, want [3]", sent)
+		}
+	})
+	t.Run(`Age`, func(t *testing.T) {
+		s, err := NewSpool(t.TempDir(), 0, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("NewSpool() error = %v", err)
+		}
+		_ = s.Put(testLogger{}, testSnapshot(1))
+		time.Sleep(20 * time.Millisecond)
+		var sent []int64
+		fail := false
+		if n, err := s.Replay(context.Background(), testLogger{}, recordingSender(&sent, &fail)); err != nil || n != 0 {
+			t.Errorf("Replay() = %d, %v, want 0 and nil", n, err)
+		}
+		if s.Len() != 0 {
+			t.Errorf("Len() = %d, want 0", s.Len())
+		}
+	})
+}
+
+func Test_spooledSender(t *testing.T) {
+	s, err := NewSpool(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	var sent []int64
+	fail := true
+	send := spooledSender(s, recordingSender(&sent, &fail))
+
+	if err = send(testLogger{}, testSnapshot(1)); err != nil {
+		t.Errorf("send() error = %v, want snapshot spooled", err)
+	}
+	fail = false
+	// the server is up again, but the new snapshot is queued behind the spooled one
+	if err = send(testLogger{}, testSnapshot(2)); err != nil {
+		t.Errorf("send() error = %v", err)
+	}
+	if len(sent) != 0 || s.Len() != 2 {
+		t.Fatalf("sent %v and spooled %d, want nothing sent and 2 spooled", sent, s.Len())
+	}
+	_, _ = s.Replay(context.Background(), testLogger{}, recordingSender(&sent, &fail))
+	if len(sent) != 2 || sent[0] != 1 || sent[1] != 2 {
+		t.Errorf("sent %v, want [1 2]", sent)
+	}
+}
+
+func TestSpoolKeepsSnapshotOnServerError(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	var accepted atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := int(status.Load())
+		if code == http.StatusOK {
+			accepted.Add(1)
+		}
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	s, err := NewSpool(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	for _, compress := range []string{`none`, `gzip`} {
+		conf := config.NewAgentConfig()
+		conf.AddressServer = server.URL
+		conf.Batch = true
+		conf.Compress = compress
+		send := newSender(conf, server.Client(), nil)
+
+		if err = send(testLogger{}, testSnapshot(1)); !errors.Is(err, myErrors.ErrServerStatus) {
+			t.Errorf("%s send() error = %v, want %v", compress, err, myErrors.ErrServerStatus)
+		}
+		if err = spooledSender(s, send)(testLogger{}, testSnapshot(1)); err != nil {
+			t.Errorf("%s spooled send() error = %v, want snapshot spooled", compress, err)
+		}
+		if n, err := s.Replay(context.Background(), testLogger{}, send); err == nil || n != 0 {
+			t.Errorf("%s Replay() = %d, %v, want 0 and error", compress, n, err)
+		}
+	}
+	// the server answered 500 every time, so both snapshots are still spooled
+	if s.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", s.Len())
+	}
+
+	status.Store(http.StatusOK)
+	conf := config.NewAgentConfig()
+	conf.AddressServer = server.URL
+	conf.Batch = true
+	conf.Compress = `none`
+	if n, err := s.Replay(context.Background(), testLogger{}, newSender(conf, server.Client(), nil)); err != nil || n != 2 {
+		t.Errorf("Replay() = %d, %v, want 2 and nil", n, err)
+	}
+	if s.Len() != 0 || accepted.Load() != 2 {
+		t.Errorf("Len() = %d and server accepted %d, want 0 and 2", s.Len(), accepted.Load())
+	}
+}
+
+func Test_spooledSenderConcurrentWorkers(t *testing.T) {
+	s, err := NewSpool(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatalf("NewSpool() error = %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var sent []int64
+	send := spooledSender(s, func(l logger, ms MetricsGetter) error {
+		delta := *ms.GetData()[0].Delta
+		if delta == 1 {
+			// the older snapshot fails slowly
+			close(started)
+			<-release
+			return errors.New("server is down")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, delta)
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = send(testLogger{}, testSnapshot(1))
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		_ = send(testLogger{}, testSnapshot(2))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// the newer snapshot is queued behind the failed one instead of overtaking it
+	if len(sent) != 0 || s.Len() != 2 {
+		t.Errorf("sent %v and spooled %d, want nothing sent and 2 spooled", sent, s.Len())
+	}
+}
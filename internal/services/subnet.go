@@ -0,0 +1,121 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+// RealIPHeader is the name of the HTTP header carrying the address of the agent, that is checked against the trusted subnet
+const RealIPHeader = `X-Real-IP`
+
+/*
+ParseTrustedSubnet parses the trusted subnet in CIDR notation
+
+Args:
+
+	cidr string: subnet, example: "192.168.1.0/24", empty - any address is trusted
+
+Returns:
+
+	*net.IPNet: parsed subnet, nil for the empty string
+	error: nil or ErrBadSubnet
+*/
+func ParseTrustedSubnet(cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", myErrors.ErrBadSubnet, err)
+	}
+	return subnet, nil
+}
+
+/*
+InTrustedSubnet checks, that the agent belongs to the trusted subnet. The address from the X-Real-IP header is used,
+if it is set, otherwise the remote address of the connection
+
+Args:
+
+	subnet *net.IPNet: trusted subnet, nil - any address is trusted
+	realIP string: value of the X-Real-IP header, may be empty
+	remoteAddr string: remote address of the connection, host or host:port
+
+Returns:
+
+	bool: true if the address is trusted
+*/
+func InTrustedSubnet(subnet *net.IPNet, realIP, remoteAddr string) bool {
+	if subnet == nil {
+		return true
+	}
+	addr := strings.TrimSpace(realIP)
+	if addr == "" {
+		addr = remoteAddr
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			addr = host
+		}
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && subnet.Contains(ip)
+}
+
+/*
+OutboundIP returns the address of the interface, that is used for connecting to the server.
+The UDP socket is only bound, no packets are sent
+
+Args:
+
+	serverAddr string: address of the server, host:port or URL with http:// prefix
+
+Returns:
+
+	string: address of the outbound interface
+	error: nil or error of resolving the server address
+*/
+func OutboundIP(serverAddr string) (string, error) {
+	conn, err := net.Dial(`udp`, strings.TrimPrefix(serverAddr, `http://`))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// realIPTransport sets the address of the agent on every request
+type realIPTransport struct {
+	ip   string
+	next http.RoundTripper
+}
+
+func (t realIPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(RealIPHeader, t.ip)
+	return t.next.RoundTrip(req)
+}
+
+/*
+NewRealIPTransport wraps the transport, so the server can check the agent against the trusted subnet
+
+Args:
+
+	ip string: address of the agent, empty - the header isn't set
+	next http.RoundTripper: wrapped transport, nil - http.DefaultTransport
+
+Returns:
+
+	http.RoundTripper
+*/
+func NewRealIPTransport(ip string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if ip == "" {
+		return next
+	}
+	return realIPTransport{ip: ip, next: next}
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+)
+
+func TestParseTrustedSubnet(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidr    string
+		wantNil bool
+		wantErr bool
+	}{
+		{name: `empty`, cidr: ``, wantNil: true},
+		{name: `ipv4`, cidr: `192.168.1.0/24`},
+		{name: `ipv6`, cidr: `fd00::/8`},
+		{name: `without mask`, cidr: `192.168.1.1`, wantNil: true, wantErr: true},
+		{name: `garbage`, cidr: `subnet`, wantNil: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedSubnet(tt.cidr)
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, myErrors.ErrBadSubnet)) {
+				t.Errorf("ParseTrustedSubnet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != tt.wantNil {
+				t.Errorf("ParseTrustedSubnet() = %v, wantNil %v", got, tt.wantNil)
+			}
+		})
+	}
+}
+
+func TestInTrustedSubnet(t *testing.T) {
+	subnet, _ := ParseTrustedSubnet(`10.0.0.0/8`)
+	tests := []struct {
+		name       string
+		realIP     string
+		remoteAddr string
+		want       bool
+	}{
+		{name: `header inside`, realIP: `10.1.2.3`, remoteAddr: `192.168.1.1:5000`, want: true},
+		{name: `header outside`, realIP: `192.168.1.1`, remoteAddr: `10.1.2.3:5000`, want: false},
+		{name: `peer inside`, remoteAddr: `10.1.2.3:5000`, want: true},
+		{name: `peer without port`, remoteAddr: `10.1.2.3`, want: true},
+		{name: `peer outside`, remoteAddr: `127.0.0.1:5000`, want: false},
+		{name: `bad header`, realIP: `agent`, remoteAddr: `10.1.2.3:5000`, want: false},
+		{name: `no address`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := InTrustedSubnet(subnet, tt.realIP, tt.remoteAddr); got != tt.want {
+				t.Errorf("InTrustedSubnet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !InTrustedSubnet(nil, ``, ``) {
+		t.Errorf("InTrustedSubnet() without subnet = false, want true")
+	}
+}
+
+func TestNewRealIPTransport(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(RealIPHeader)
+	}))
+	defer srv.Close()
+
+	ip, err := OutboundIP(srv.URL)
+	if err != nil || ip != `127.0.0.1` {
+		t.Fatalf("OutboundIP() = %q, %v, want 127.0.0.1", ip, err)
+	}
+	client := &http.Client{Transport: NewRealIPTransport(ip, nil)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if got != ip {
+		t.Errorf("%s = %q, want %q", RealIPHeader, got, ip)
+	}
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itaraxa/effectivepancake/internal/config"
+	myErrors "github.com/itaraxa/effectivepancake/internal/errors"
+	"github.com/itaraxa/effectivepancake/internal/models"
+)
+
+// Files of the proc filesystem used by the system collector
+var (
+	procMeminfo = `/proc/meminfo`
+	procStat    = `/proc/stat`
+)
+
+// Cumulative CPU times of a single core from /proc/stat, in USER_HZ
+type cpuTimes struct {
+	idle  uint64 // время простоя, включая ожидание ввода-вывода
+	total uint64 // суммарное время
+}
+
+/*
+readMemInfo reads the total and free memory from /proc/meminfo format
+
+Args:
+
+	src io.Reader: content of /proc/meminfo
+
+Returns:
+
+	float64: total memory, bytes
+	float64: free memory, bytes
+	error: nil or myErrors.ErrReadProc
+*/
+func readMemInfo(src io.Reader) (float64, float64, error) {
+	var total, free float64
+	var foundTotal, foundFree bool
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *float64
+		switch fields[0] {
+		case `MemTotal:`:
+			dst, foundTotal = &total, true
+		case `MemFree:`:
+			dst, foundFree = &free, true
+		default:
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: %s: %v", myErrors.ErrReadProc, fields[0], err)
+		}
+		// values are in kB
+		*dst = float64(v) * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, fmt.Errorf("%w: %v", myErrors.ErrReadProc, err)
+	}
+	if !foundTotal || !foundFree {
+		return 0, 0, fmt.Errorf("%w: MemTotal or MemFree not found", myErrors.ErrReadProc)
+	}
+	return total, free, nil
+}
+
+/*
+readCPUTimes reads cumulative times of every CPU core from /proc/stat format. The aggregated "cpu" line is skipped
+
+Args:
+
+	src io.Reader: content of /proc/stat
+
+Returns:
+
+	[]cpuTimes: times of cores in order cpu0, cpu1, ...
+	error: nil or myErrors.ErrReadProc
+*/
+func readCPUTimes(src io.Reader) ([]cpuTimes, error) {
+	var out []cpuTimes
+	scanner := bufio.NewScanner(src)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], `cpu`) || fields[0] == `cpu` {
+			continue
+		}
+		var t cpuTimes
+		for i, f := range fields[1:] {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", myErrors.ErrReadProc, fields[0], err)
+			}
+			// guest and guest_nice are already included into user and nice
+			if i >= 8 {
+				break
+			}
+			t.total += v
+			// idle and iowait
+			if i == 3 || i == 4 {
+				t.idle += v
+			}
+		}
+		out = append(out, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", myErrors.ErrReadProc, err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: no cpu lines", myErrors.ErrReadProc)
+	}
+	return out, nil
+}
+
+/*
+cpuUtilization calculates utilization of every core between two readings of /proc/stat
+
+Args:
+
+	prev []cpuTimes: previous reading, nil for the first reading
+	cur []cpuTimes: current reading
+
+Returns:
+
+	[]float64: utilization of cores, percents. Zero for a core without a previous reading or without elapsed time
+*/
+func cpuUtilization(prev, cur []cpuTimes) []float64 {
+	out := make([]float64, len(cur))
+	for i, c := range cur {
+		if i >= len(prev) || c.total <= prev[i].total {
+			continue
+		}
+		total := float64(c.total - prev[i].total)
+		idle := float64(c.idle - prev[i].idle)
+		out[i] = 100 * (total - idle) / total
+	}
+	return out
+}
+
+/*
+collectSystemMetrics reads memory and CPU state of the host from the proc filesystem.
+Collected metrics:
+  - TotalMemory
+  - FreeMemory
+  - CPUutilization1..N
+
+Args:
+
+	prev []cpuTimes: CPU times from the previous call, nil for the first call
+	labels map[string]string: identity of the agent instance, attached to every metric
+
+Returns:
+
+	MetricsAddGetter: collected metrics
+	[]cpuTimes: CPU times for the next call
+	error: nil or error, if occured
+*/
+func collectSystemMetrics(prev []cpuTimes, labels map[string]string) (MetricsAddGetter, []cpuTimes, error) {
+	jms := models.NewJSONMetrics(labels)
+	jms.SnapshotID = newSnapshotID()
+
+	meminfo, err := os.Open(procMeminfo)
+	if err != nil {
+		return jms, prev, fmt.Errorf("%w: %v", myErrors.ErrReadProc, err)
+	}
+	defer meminfo.Close()
+	total, free, err := readMemInfo(meminfo)
+	if err != nil {
+		return jms, prev, err
+	}
+
+	stat, err := os.Open(procStat)
+	if err != nil {
+		return jms, prev, fmt.Errorf("%w: %v", myErrors.ErrReadProc, err)
+	}
+	defer stat.Close()
+	cur, err := readCPUTimes(stat)
+	if err != nil {
+		return jms, prev, err
+	}
+
+	out := []models.JSONMetric{
+		{ID: "TotalMemory", MType: "gauge", Value: &total},
+		{ID: "FreeMemory", MType: "gauge", Value: &free},
+	}
+	for i, u := range cpuUtilization(prev, cur) {
+		out = append(out, models.JSONMetric{ID: fmt.Sprintf("CPUutilization%d", i+1), MType: "gauge", Value: &u})
+	}
+	if err = jms.AddData(out); err != nil {
+		return jms, cur, myErrors.ErrAddData
+	}
+	return jms, cur, nil
+}
+
+/*
+Function for periodically collecting system metrics of the host. Works on its own schedule
+and sends collected metrics into the same channel as PollMetrics. Stops when the context is cancelled
+
+Args:
+
+	ctx context.Context: context of the agent, cancelling stops polling
+	wg *sync.WaitGroup: pointer to sync.WaitGroup for for controlling the completion of a function in a goroutine
+	dataChan chan MetricsAddGetter: channel for exchanging metric data
+	spool *Spool: pointer to the spool for metrics, that don't fit into dataChan, nil - spool disabled
+	l logger: pointer to logger instance
+	config *config.AgentConfig: pointer to config instance
+
+Returns:
+
+	None
+*/
+func PollSystemMetrics(ctx context.Context, wg *sync.WaitGroup, dataChan chan MetricsAddGetter, spool *Spool, l logger, config *config.AgentConfig) {
+	defer wg.Done()
+	defer l.Info("Polling system metrica stopped")
+	labels := InstanceLabels(l, config)
+	var prev []cpuTimes
+	ticker := time.NewTicker(config.SystemPollInterval)
+	defer ticker.Stop()
+	for {
+		ms, cur, err := collectSystemMetrics(prev, labels)
+		if err != nil {
+			l.Error("Error collect system metrics", "error", err.Error())
+		} else {
+			// the first reading has no base for CPU utilization
+			if prev != nil && !putSnapshot(ctx, l, dataChan, spool, ms) {
+				return
+			}
+			prev = cur
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMeminfo = `MemTotal:       16318412 kB
+MemFree:         1204128 kB
+MemAvailable:    9876543 kB
+Buffers:          123456 kB
+`
+
+const testStat = `cpu  400 0 200 1200 200 0 0 0 0 0
+cpu0 100 0 100 700 100 0 0 0 0 0
+cpu1 300 0 100 500 100 0 0 0 0 0
+intr 12345
+ctxt 67890
+`
+
+func Test_readMemInfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		wantTotal float64
+		wantFree  float64
+		wantErr   bool
+	}{
+		{name: `Valid meminfo`, src: testMeminfo, wantTotal: 16318412 * 1024, wantFree: 1204128 * 1024},
+		{name: `Without MemFree`, src: "MemTotal: 100 kB\n", wantErr: true},
+		{name: `Bad value`, src: "MemTotal: x kB\nMemFree: 1 kB\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, free, err := readMemInfo(strings.NewReader(tt.src))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMemInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if total != tt.wantTotal || free != tt.wantFree {
+				t.Errorf("readMemInfo() = %v, %v, want %v, %v", total, free, tt.wantTotal, tt.wantFree)
+			}
+		})
+	}
+}
+
+func Test_readCPUTimes(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []cpuTimes
+		wantErr bool
+	}{
+		{name: `Two cores`, src: testStat, want: []cpuTimes{{idle: 800, total: 1000}, {idle: 600, total: 1000}}},
+		{name: `Without cores`, src: "cpu  1 2 3 4 5\n", wantErr: true},
+		{name: `Bad value`, src: "cpu0 1 x 3 4 5\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readCPUTimes(strings.NewReader(tt.src))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCPUTimes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readCPUTimes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cpuUtilization(t *testing.T) {
+	tests := []struct {
+		name string
+		prev []cpuTimes
+		cur  []cpuTimes
+		want []float64
+	}{
+		{name: `First reading`, prev: nil, cur: []cpuTimes{{idle: 10, total: 20}}, want: []float64{0}},
+		{
+			name: `Two cores`,
+			prev: []cpuTimes{{idle: 800, total: 1000}, {idle: 600, total: 1000}},
+			cur:  []cpuTimes{{idle: 850, total: 1100}, {idle: 600, total: 1200}},
+			want: []float64{50, 100},
+		},
+		{name: `No elapsed time`, prev: []cpuTimes{{idle: 5, total: 10}}, cur: []cpuTimes{{idle: 5, total: 10}}, want: []float64{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cpuUtilization(tt.prev, tt.cur); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cpuUtilization() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_collectSystemMetrics(t *testing.T) {
+	dir := t.TempDir()
+	oldMeminfo, oldStat := procMeminfo, procStat
+	defer func() { procMeminfo, procStat = oldMeminfo, oldStat }()
+	procMeminfo, procStat = filepath.Join(dir, `meminfo`), filepath.Join(dir, `stat`)
+	if err := os.WriteFile(procMeminfo, []byte(testMeminfo), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(procStat, []byte(testStat), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := []cpuTimes{{idle: 750, total: 900}, {idle: 600, total: 900}}
+	ms, cur, err := collectSystemMetrics(prev, map[string]string{`host`: `h1`})
+	if err != nil {
+		t.Fatalf("collectSystemMetrics() error = %v", err)
+	}
+	if len(cur) != 2 {
+		t.Errorf("collectSystemMetrics() returned %d cores, want 2", len(cur))
+	}
+	got := make(map[string]float64)
+	for _, m := range ms.GetData() {
+		if m.Labels[`host`] != `h1` {
+			t.Errorf("metric %s labels = %v, want host=h1", m.ID, m.Labels)
+		}
+		got[m.ID] = *m.Value
+	}
+	want := map[string]float64{
+		`TotalMemory`:     16318412 * 1024,
+		`FreeMemory`:      1204128 * 1024,
+		`CPUutilization1`: 50,
+		`CPUutilization2`: 100,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collectSystemMetrics() = %v, want %v", got, want)
+	}
+
+	procStat = filepath.Join(dir, `missing`)
+	if _, _, err = collectSystemMetrics(prev, nil); err == nil {
+		t.Errorf("collectSystemMetrics() without stat file error = nil, wantErr true")
+	}
+}
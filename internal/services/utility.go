@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +19,74 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
+// HashHeader is the name of the HTTP header carrying the HMAC-SHA256 signature of the body
+const HashHeader = `HashSHA256`
+
+// IdempotencyHeader is the name of the HTTP header carrying the identifier of the batch of metrics
+const IdempotencyHeader = `Idempotency-Key`
+
+// ReplayedHeader is set by the server, when the batch with the same identifier was already applied
+const ReplayedHeader = `Idempotent-Replayed`
+
+// AgentIDHeader is the name of the HTTP header carrying the identifier of the reporting agent
+const AgentIDHeader = `X-Agent-ID`
+
+// Headers, which are set on /value/ responses, if marking of stale metrics is enabled
+const (
+	LastSeenHeader = `X-Metric-Last-Seen`
+	StaleHeader    = `X-Metric-Stale`
+)
+
+// agentIDTransport sets the agent identifier header on every request
+type agentIDTransport struct {
+	id   string
+	next http.RoundTripper
+}
+
+func (t agentIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(AgentIDHeader, t.id)
+	return t.next.RoundTrip(req)
+}
+
+/*
+NewAgentIDTransport wraps the transport, so the server can track the agent by its identifier
+
+Args:
+
+	id string: identifier of the agent
+	next http.RoundTripper: wrapped transport, nil - http.DefaultTransport
+
+Returns:
+
+	http.RoundTripper
+*/
+func NewAgentIDTransport(id string, next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return agentIDTransport{id: id, next: next}
+}
+
+/*
+newSnapshotID generates a random identifier of the snapshot of metrics
+
+Args:
+
+	None
+
+Returns:
+
+	string: 32 hex digits
+*/
+func newSnapshotID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
 func ShowQuery(q Querier) string {
 	return q.String()
 }
@@ -83,6 +156,47 @@ func decompress(data []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+/*
+SignSHA256 calculates the HMAC-SHA256 signature of data with the key
+
+Args:
+
+	data []byte: signed data
+	key string: secret key
+
+Returns:
+
+	string: hex representation of the signature
+*/
+func SignSHA256(data []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+CheckSignSHA256 checks that sign is the valid HMAC-SHA256 signature of data with the key
+
+Args:
+
+	data []byte: signed data
+	key string: secret key
+	sign string: hex representation of the checked signature
+
+Returns:
+
+	bool: true - the signature is valid, false - otherwise
+*/
+func CheckSignSHA256(data []byte, key string, sign string) bool {
+	s, err := hex.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return hmac.Equal(h.Sum(nil), s)
+}
+
 /*
 retryablePgError checks the error type and decides whether to retry the request
 
@@ -56,3 +56,69 @@ func Test_decompress(t *testing.T) {
 		})
 	}
 }
+
+func TestSignSHA256(t *testing.T) {
+	type args struct {
+		data []byte
+		key  string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: `Sign json body`,
+			args: args{data: []byte(`{"id":"Alloc","type":"gauge","value":3.14}`), key: `secret`},
+			want: `3bea26e04115cf17fa1b1785a214817a8c32efd72f62bee39f01548f543339a1`,
+		},
+		{
+			name: `Sign empty body`,
+			args: args{data: nil, key: `secret`},
+			want: `f9e66e179b6747ae54108f82f8ade8b3c25d76fd30afde6c395822c530196169`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SignSHA256(tt.args.data, tt.args.key); got != tt.want {
+				t.Errorf("SignSHA256() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSignSHA256(t *testing.T) {
+	type args struct {
+		data []byte
+		key  string
+		sign string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: `Valid signature`,
+			args: args{data: []byte(`{"id":"Alloc","type":"gauge","value":3.14}`), key: `secret`, sign: `3bea26e04115cf17fa1b1785a214817a8c32efd72f62bee39f01548f543339a1`},
+			want: true,
+		},
+		{
+			name: `Wrong key`,
+			args: args{data: []byte(`{"id":"Alloc","type":"gauge","value":3.14}`), key: `other`, sign: `3bea26e04115cf17fa1b1785a214817a8c32efd72f62bee39f01548f543339a1`},
+			want: false,
+		},
+		{
+			name: `Not hex signature`,
+			args: args{data: []byte(`{}`), key: `secret`, sign: `not a hex`},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckSignSHA256(tt.args.data, tt.args.key, tt.args.sign); got != tt.want {
+				t.Errorf("CheckSignSHA256() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}